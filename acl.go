@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// trustedNetworkKey gin context 中标记请求来自免认证网络且没有带 key
+const trustedNetworkKey = "trusted_network"
+
+// ACLConfig 按客户端 IP 的访问控制
+type ACLConfig struct {
+	Allow      []*net.IPNet // 不为空时只允许这些网络访问
+	Deny       []*net.IPNet // 优先于 Allow
+	Trusted    []*net.IPNet // 来自这些网络且没有带 key 的请求使用 TrustedKey
+	TrustedKey string
+	Proxies    []string // 可信的反向代理，只有来自这些地址的 X-Forwarded-For / X-Real-IP 才会被采用
+}
+
+func loadACLConfig(defaultUpstreamKey string) (ACLConfig, error) {
+	var cfg ACLConfig
+	var err error
+	if cfg.Allow, err = parseCIDRs(os.Getenv("IP_ALLOWLIST")); err != nil {
+		return cfg, fmt.Errorf("IP_ALLOWLIST: %w", err)
+	}
+	if cfg.Deny, err = parseCIDRs(os.Getenv("IP_DENYLIST")); err != nil {
+		return cfg, fmt.Errorf("IP_DENYLIST: %w", err)
+	}
+	if cfg.Trusted, err = parseCIDRs(os.Getenv("TRUSTED_NETWORKS")); err != nil {
+		return cfg, fmt.Errorf("TRUSTED_NETWORKS: %w", err)
+	}
+	cfg.TrustedKey = os.Getenv("TRUSTED_NETWORK_API_KEY")
+	if cfg.TrustedKey == "" {
+		cfg.TrustedKey = defaultUpstreamKey
+	}
+	if len(cfg.Trusted) > 0 && cfg.TrustedKey == "" {
+		return cfg, fmt.Errorf("TRUSTED_NETWORKS requires TRUSTED_NETWORK_API_KEY, ANTHROPIC_API_KEY or ANTHROPIC_API_KEYS")
+	}
+	cfg.Proxies = parseModelList(os.Getenv("TRUSTED_PROXIES"))
+	return cfg, nil
+}
+
+func (cfg ACLConfig) enabled() bool {
+	return len(cfg.Allow) > 0 || len(cfg.Deny) > 0 || len(cfg.Trusted) > 0
+}
+
+// parseCIDRs 解析逗号分隔的 CIDR，单个 IP 视为 /32（IPv6 为 /128）
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range parseModelList(s) {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q", item)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", item)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// NetworkACL 拒绝不在 IP_ALLOWLIST 中或在 IP_DENYLIST 中的客户端（403），并标记来自 TRUSTED_NETWORKS 且没有带 key 的请求
+// /healthz 和 /readyz 不受限制，便于负载均衡和 Kubernetes 探测
+func NetworkACL(cfg ACLConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.URL.Path {
+		case "/healthz", "/readyz":
+			c.Next()
+			return
+		}
+		clientIP := c.ClientIP()
+		ip := net.ParseIP(clientIP)
+		if ip == nil || containsIP(cfg.Deny, ip) || (len(cfg.Allow) > 0 && !containsIP(cfg.Allow, ip)) {
+			reqLog(requestID(c)).Warn("client ip rejected", "client_ip", clientIP)
+			c.Set(auditDecisionKey, auditBlockedIP)
+			respondError(c, http.StatusForbidden, "Access from your IP address is not allowed")
+			c.Abort()
+			return
+		}
+		if containsIP(cfg.Trusted, ip) && !hasCredentials(c) {
+			c.Set(trustedNetworkKey, true)
+		}
+		c.Next()
+	}
+}
+
+// hasCredentials 请求是否带了任意一种 key 头
+func hasCredentials(c *gin.Context) bool {
+	for _, header := range []string{"Authorization", "x-api-key", "api-key"} {
+		if c.GetHeader(header) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// trustedNetworkAPIKey 来自免认证网络且没有带 key 的请求使用服务端配置的上游 key，用量按客户端 IP 统计
+func (h *ProxyHandler) trustedNetworkAPIKey(c *gin.Context, reqID string) (string, bool) {
+	if !c.GetBool(trustedNetworkKey) {
+		return "", false
+	}
+	name := "ip:" + c.ClientIP()
+	reqLog(reqID).Debug("trusted network request without api key", "client_ip", c.ClientIP())
+	c.Set(keyNameKey, name)
+	c.Set(usageKeyKey, name)
+	return h.trustedKey, true
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 与 main 相同的注册顺序：先添加 NetworkACL，再注册 /metrics
+func TestNetworkACLCoversMetrics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	deny, err := parseCIDRs("203.0.113.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := gin.New()
+	r.Use(NetworkACL(ACLConfig{Deny: deny}))
+	r.GET("/metrics", metrics.Handler)
+	r.GET("/healthz", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	tests := []struct {
+		path, remoteAddr string
+		want             int
+	}{
+		{"/metrics", "203.0.113.7:40000", http.StatusForbidden},
+		{"/metrics", "198.51.100.7:40000", http.StatusOK},
+		{"/healthz", "203.0.113.7:40000", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		req.RemoteAddr = tt.remoteAddr
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("GET %s from %s: status %d, want %d", tt.path, tt.remoteAddr, w.Code, tt.want)
+		}
+	}
+}
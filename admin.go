@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminAuth 校验管理接口的 Authorization: Bearer <ADMIN_TOKEN>
+func AdminAuth(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		got := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			respondError(c, http.StatusUnauthorized, "invalid admin token")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// HandleListKeys 列出虚拟 key（GET /admin/keys）
+func (h *ProxyHandler) HandleListKeys(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": h.keyStore.List()})
+}
+
+// HandleCreateKey 签发虚拟 key（POST /admin/keys），响应中包含完整 key，只返回这一次
+func (h *ProxyHandler) HandleCreateKey(c *gin.Context) {
+	var req struct {
+		Name        string `json:"name"`
+		UpstreamKey string `json:"upstream_key"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Name == "" {
+		respondParamError(c, "name", "name is required")
+		return
+	}
+	if req.UpstreamKey == "" && h.keyStore.defaultUpstreamKey == "" {
+		respondParamError(c, "upstream_key", "upstream_key is required when ANTHROPIC_API_KEY is not set")
+		return
+	}
+
+	vk, err := h.keyStore.Create(req.Name, req.UpstreamKey)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusCreated, vk)
+}
+
+// HandleUpdateKey 启用/禁用虚拟 key（PATCH /admin/keys/:id，body: {"disabled": true}）
+func (h *ProxyHandler) HandleUpdateKey(c *gin.Context) {
+	var req struct {
+		Disabled *bool `json:"disabled"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Disabled == nil {
+		respondParamError(c, "disabled", "disabled is required")
+		return
+	}
+
+	vk, err := h.keyStore.SetDisabled(c.Param("id"), *req.Disabled)
+	if err != nil {
+		respondKeyStoreError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, vk.masked())
+}
+
+// HandleDeleteKey 删除虚拟 key（DELETE /admin/keys/:id）
+func (h *ProxyHandler) HandleDeleteKey(c *gin.Context) {
+	if err := h.keyStore.Delete(c.Param("id")); err != nil {
+		respondKeyStoreError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func respondKeyStoreError(c *gin.Context, err error) {
+	if errors.Is(err, errKeyNotFound) {
+		respondError(c, http.StatusNotFound, err.Error())
+		return
+	}
+	respondError(c, http.StatusInternalServerError, err.Error())
+}
+
+// HandleGetConfig 返回当前生效的运行时配置（GET /admin/config）
+func (h *ProxyHandler) HandleGetConfig(c *gin.Context) {
+	c.JSON(http.StatusOK, h.settings())
+}
+
+// HandleUpdateConfig 修改运行时配置（PUT /admin/config），立即对新请求生效，进程重启后恢复为环境变量配置
+func (h *ProxyHandler) HandleUpdateConfig(c *gin.Context) {
+	h.runtimeMu.Lock()
+	defer h.runtimeMu.Unlock()
+
+	cur := h.settings()
+	cache := cur.Cache
+	req := RuntimeSettingsUpdate{Cache: &cache}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	next, param, err := req.apply(cur)
+	if err != nil {
+		respondParamError(c, param, err.Error())
+		return
+	}
+	h.runtime.Store(next)
+
+	slog.Info("runtime config updated",
+		"model_mapping", len(next.ModelMapping),
+		"model_groups", len(next.ModelGroups),
+		"max_tokens_mapping", len(next.MaxTokensMapping),
+		"cache_enabled", next.Cache.Enabled,
+		"cache_ttl", next.Cache.TTL)
+	c.JSON(http.StatusOK, next)
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// auditDecisionKey gin context 中代理对请求的处理决定，未设置时按状态码判断
+const auditDecisionKey = "audit_decision"
+
+// 审计日志中的处理决定
+const (
+	auditAllowed            = "allowed"
+	auditUpstreamError      = "upstream_error"
+	auditRejected           = "rejected"            // 请求不合法或代理内部错误
+	auditBlockedIP          = "blocked_ip"          // IP 访问控制
+	auditUnauthenticated    = "unauthenticated"     // 没有 key 或认证失败
+	auditRateLimited        = "rate_limited"        // RPM / TPM 限流
+	auditConcurrencyLimited = "concurrency_limited" // 并发排队已满或超时
+	auditPolicyViolation    = "policy_violation"    // 命中 guardrail 策略
+)
+
+// AuditConfig 审计日志配置：与调试日志分开，只追加写入，每条记录带有链式哈希
+type AuditConfig struct {
+	Dir       string // 为空表示不启用
+	MaxBytes  int64  // 单个文件的大小上限，超过后切换到新文件
+	HMACKey   string // 设置后使用 HMAC-SHA256 计算哈希，没有密钥无法重新生成整条链
+	MaxFiles  int    // 保留的文件数，0 表示不删除
+	ExportMax int    // 导出接口单次最多返回的记录数
+}
+
+func loadAuditConfig() AuditConfig {
+	return AuditConfig{
+		Dir:       os.Getenv("AUDIT_LOG_DIR"),
+		MaxBytes:  int64(getEnvInt("AUDIT_LOG_MAX_MB", 100)) << 20,
+		HMACKey:   os.Getenv("AUDIT_LOG_HMAC_KEY"),
+		MaxFiles:  getEnvInt("AUDIT_LOG_MAX_FILES", 0),
+		ExportMax: getEnvInt("AUDIT_EXPORT_MAX_ENTRIES", 100000),
+	}
+}
+
+// AuditEntry 审计日志中的一行，Hash 覆盖除自身以外的所有字段和上一条记录的 Hash
+type AuditEntry struct {
+	Seq           int64     `json:"seq"`
+	Time          time.Time `json:"time"`
+	RequestID     string    `json:"request_id"`
+	ClientIP      string    `json:"client_ip"`
+	Principal     string    `json:"principal,omitempty"` // 虚拟 key 名称、OIDC 用户或 API Key 的 key_ 标识
+	Method        string    `json:"method"`
+	Path          string    `json:"path"`
+	Model         string    `json:"model,omitempty"`
+	Stream        bool      `json:"stream,omitempty"`
+	Status        int       `json:"status"`
+	Decision      string    `json:"decision"`
+	InputTokens   int       `json:"input_tokens"`
+	OutputTokens  int       `json:"output_tokens"`
+	CacheRead     int       `json:"cache_read_input_tokens,omitempty"`
+	CacheCreation int       `json:"cache_creation_input_tokens,omitempty"`
+	CostUSD       float64   `json:"cost_usd,omitempty"`
+	DurationMs    int64     `json:"duration_ms"`
+	PrevHash      string    `json:"prev_hash"`
+	Hash          string    `json:"hash,omitempty"`
+}
+
+// AuditLog 按顺序写入 audit-<时间>.jsonl，文件超过大小上限时切换，哈希链跨文件延续
+type AuditLog struct {
+	cfg AuditConfig
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	seq      int64
+	lastHash string
+}
+
+// NewAuditLog 创建目录并从最新的有效记录恢复哈希链，未配置 AUDIT_LOG_DIR 时返回 nil
+// 最新的文件可能是切换后还没写入就退出留下的空文件，或者只有一行写了一半的记录，这时继续向前查找更早的文件
+func NewAuditLog(cfg AuditConfig) (*AuditLog, error) {
+	if cfg.Dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create audit dir: %w", err)
+	}
+	a := &AuditLog{cfg: cfg}
+	files, err := a.files()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		last, err := lastAuditEntry(files[i])
+		if err != nil {
+			return nil, err
+		}
+		if last != nil {
+			a.seq, a.lastHash = last.Seq, last.Hash
+			break
+		}
+	}
+	return a, nil
+}
+
+// files 按时间顺序返回所有审计文件（文件名中的时间可以直接按字符串排序）
+func (a *AuditLog) files() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(a.cfg.Dir, "audit-*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// lastAuditEntry 返回文件中最后一条完整的记录；进程崩溃时最后一行可能只写了一半，跳过并记录警告
+func lastAuditEntry(path string) (*AuditEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var last *AuditEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			slog.Warn("skipped malformed audit entry", "file", path, "error", err)
+			continue
+		}
+		last = &entry
+	}
+	return last, scanner.Err()
+}
+
+func (a *AuditLog) newHash() hash.Hash {
+	if a.cfg.HMACKey != "" {
+		return hmac.New(sha256.New, []byte(a.cfg.HMACKey))
+	}
+	return sha256.New()
+}
+
+// entryHash 计算不含 Hash 字段的记录的哈希，PrevHash 已包含在记录中
+func (a *AuditLog) entryHash(entry AuditEntry) string {
+	entry.Hash = ""
+	data, _ := json.Marshal(entry)
+	h := a.newHash()
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Record 补全序号和哈希后追加写入；写入失败只记录日志，不影响请求
+func (a *AuditLog) Record(entry AuditEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	entry.Seq = a.seq + 1
+	entry.PrevHash = a.lastHash
+	entry.Hash = a.entryHash(entry)
+	line, err := json.Marshal(entry)
+	if err != nil {
+		slog.Error("marshal audit entry failed", "error", err)
+		return
+	}
+	line = append(line, '\n')
+
+	if a.file == nil || (a.cfg.MaxBytes > 0 && a.size+int64(len(line)) > a.cfg.MaxBytes) {
+		if err := a.rotateLocked(entry.Time); err != nil {
+			slog.Error("open audit file failed", "error", err)
+			return
+		}
+	}
+	if _, err := a.file.Write(line); err != nil {
+		slog.Error("write audit entry failed", "error", err)
+		a.discardPartialLocked()
+		return
+	}
+	a.size += int64(len(line))
+	a.seq, a.lastHash = entry.Seq, entry.Hash
+}
+
+// discardPartialLocked 写入失败后截掉可能已写入的半行，保证下一条记录紧接在上一条完整记录之后；
+// 截断失败时关闭文件，下一条记录写到新文件
+func (a *AuditLog) discardPartialLocked() {
+	err := a.file.Truncate(a.size)
+	if err == nil {
+		return
+	}
+	slog.Error("truncate audit file failed", "file", a.file.Name(), "error", err)
+	a.file.Close()
+	a.file = nil
+}
+
+// rotateLocked 打开新文件，并按 AUDIT_LOG_MAX_FILES 删除最旧的文件
+func (a *AuditLog) rotateLocked(now time.Time) error {
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+	name := filepath.Join(a.cfg.Dir, "audit-"+now.UTC().Format("20060102T150405.000000000")+".jsonl")
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	a.file, a.size = file, info.Size()
+
+	if a.cfg.MaxFiles > 0 {
+		files, err := a.files()
+		if err != nil {
+			return nil
+		}
+		for len(files) > a.cfg.MaxFiles {
+			if err := os.Remove(files[0]); err != nil {
+				slog.Warn("remove old audit file failed", "file", files[0], "error", err)
+			}
+			files = files[1:]
+		}
+	}
+	return nil
+}
+
+// Middleware 请求结束后写入审计记录，需要在 IP 访问控制之前注册，被拒绝的请求也会记录
+func (a *AuditLog) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		path := c.FullPath()
+		if path == "" || !isAPIPath(path) {
+			return
+		}
+		entry := AuditEntry{
+			Time:       start.UTC(),
+			RequestID:  c.GetString(reqIDKey),
+			ClientIP:   c.ClientIP(),
+			Principal:  c.GetString(usageKeyKey),
+			Method:     c.Request.Method,
+			Path:       path,
+			Model:      c.GetString(metricsModelKey),
+			Stream:     c.GetBool(streamKey),
+			Status:     c.Writer.Status(),
+			Decision:   auditDecision(c),
+			CostUSD:    c.GetFloat64(costKey),
+			DurationMs: time.Since(start).Milliseconds(),
+		}
+		if usage, ok := c.Get(requestUsageKey); ok {
+			u := usage.(AnthropicUsage)
+			entry.InputTokens = u.InputTokens
+			entry.OutputTokens = u.OutputTokens
+			entry.CacheRead = u.CacheReadInputTokens
+			entry.CacheCreation = u.CacheCreationInputTokens
+		}
+		a.Record(entry)
+	}
+}
+
+// auditDecision 优先使用拒绝请求的位置设置的决定，其余按状态码判断：
+// 代理自身的限流已单独标记，剩下的 429 和 5xx 视为上游错误，其他 4xx 为请求被拒绝
+func auditDecision(c *gin.Context) string {
+	if decision := c.GetString(auditDecisionKey); decision != "" {
+		return decision
+	}
+	status := c.Writer.Status()
+	switch {
+	case status < 400:
+		return auditAllowed
+	case status == http.StatusUnauthorized:
+		return auditUnauthenticated
+	case status >= 500 || status == http.StatusTooManyRequests:
+		return auditUpstreamError
+	}
+	return auditRejected
+}
+
+// exportFilter 导出条件，零值表示不限制
+type exportFilter struct {
+	since, until time.Time
+	principal    string
+	decision     string
+}
+
+func (f exportFilter) match(entry *AuditEntry) bool {
+	if !f.since.IsZero() && entry.Time.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && !entry.Time.Before(f.until) {
+		return false
+	}
+	if f.principal != "" && entry.Principal != f.principal {
+		return false
+	}
+	return f.decision == "" || entry.Decision == f.decision
+}
+
+// scan 按顺序读取所有文件中的记录，fn 返回 false 时停止
+func (a *AuditLog) scan(fn func(file string, line []byte, entry *AuditEntry) bool) error {
+	files, err := a.files()
+	if err != nil {
+		return err
+	}
+	for _, path := range files {
+		stop, err := scanAuditFile(path, fn)
+		if err != nil {
+			return err
+		}
+		if stop {
+			return nil
+		}
+	}
+	return nil
+}
+
+func scanAuditFile(path string, fn func(file string, line []byte, entry *AuditEntry) bool) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			if !fn(path, scanner.Bytes(), nil) {
+				return true, nil
+			}
+			continue
+		}
+		if !fn(path, scanner.Bytes(), &entry) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// AuditVerifyResult 哈希链校验结果
+type AuditVerifyResult struct {
+	OK       bool   `json:"ok"`
+	Entries  int64  `json:"entries"`
+	Files    int    `json:"files"`
+	BrokenAt int64  `json:"broken_at_seq,omitempty"` // 第一条校验失败的记录
+	File     string `json:"file,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Verify 重新计算每条记录的哈希，检查序号连续和 prev_hash 衔接，校验到开始时的最后一条记录为止，不阻塞写入
+// 开启了 AUDIT_LOG_MAX_FILES 时最旧的文件已被删除，第一条记录的 prev_hash 无法校验
+func (a *AuditLog) Verify() AuditVerifyResult {
+	a.mu.Lock()
+	lastSeq := a.seq
+	a.mu.Unlock()
+
+	result := AuditVerifyResult{OK: true}
+	files, err := a.files()
+	if err != nil {
+		return AuditVerifyResult{Error: err.Error()}
+	}
+	result.Files = len(files)
+
+	var prev *AuditEntry
+	err = a.scan(func(file string, _ []byte, entry *AuditEntry) bool {
+		if prev != nil && prev.Seq >= lastSeq {
+			return false
+		}
+		fail := func(seq int64, reason string) bool {
+			result.OK, result.BrokenAt, result.File, result.Error = false, seq, filepath.Base(file), reason
+			return false
+		}
+		if entry == nil {
+			var seq int64
+			if prev != nil {
+				seq = prev.Seq + 1
+			}
+			return fail(seq, "malformed entry")
+		}
+		if entry.Hash != a.entryHash(*entry) {
+			return fail(entry.Seq, "hash mismatch")
+		}
+		if prev != nil && (entry.Seq != prev.Seq+1 || entry.PrevHash != prev.Hash) {
+			return fail(entry.Seq, "chain broken")
+		}
+		if prev == nil && a.cfg.MaxFiles == 0 && (entry.Seq != 1 || entry.PrevHash != "") {
+			return fail(entry.Seq, "chain does not start at the first entry")
+		}
+		result.Entries++
+		prev = entry
+		return true
+	})
+	if err != nil {
+		result.OK, result.Error = false, err.Error()
+	}
+	return result
+}
+
+// HandleAuditExport 导出审计记录（GET /admin/audit），JSON lines 格式，原样输出文件中的行以便在外部校验哈希
+// 支持 since / until（RFC 3339）、principal、decision 过滤，最多返回 AUDIT_EXPORT_MAX_ENTRIES 条，更多记录用 since 分批导出
+func (h *ProxyHandler) HandleAuditExport(c *gin.Context) {
+	var filter exportFilter
+	for name, t := range map[string]*time.Time{"since": &filter.since, "until": &filter.until} {
+		if v := c.Query(name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				respondParamError(c, name, fmt.Sprintf("invalid %s, expected RFC 3339 time", name))
+				return
+			}
+			*t = parsed
+		}
+	}
+	filter.principal = c.Query("principal")
+	filter.decision = c.Query("decision")
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", `attachment; filename="audit.jsonl"`)
+	c.Status(http.StatusOK)
+
+	count := 0
+	err := h.audit.scan(func(_ string, line []byte, entry *AuditEntry) bool {
+		if entry == nil || !filter.match(entry) {
+			return true
+		}
+		if count >= h.audit.cfg.ExportMax {
+			return false
+		}
+		c.Writer.Write(line)
+		c.Writer.Write([]byte("\n"))
+		count++
+		return true
+	})
+	if err != nil {
+		reqLog(requestID(c)).Error("audit export failed", "error", err)
+	}
+}
+
+// HandleAuditVerify 校验哈希链（GET /admin/audit/verify）
+func (h *ProxyHandler) HandleAuditVerify(c *gin.Context) {
+	result := h.audit.Verify()
+	status := http.StatusOK
+	if !result.OK {
+		status = http.StatusConflict
+	}
+	c.JSON(status, result)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 最新的文件为空或只有半行记录时，哈希链从更早文件的最后一条记录继续
+func TestAuditLogRestoresChainFromOlderFile(t *testing.T) {
+	dir := t.TempDir()
+	cfg := AuditConfig{Dir: dir}
+	a, err := NewAuditLog(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	a.Record(AuditEntry{Time: now, RequestID: "r1"})
+	a.Record(AuditEntry{Time: now, RequestID: "r2"})
+	seq, hash := a.seq, a.lastHash
+	a.file.Close()
+
+	// 切换后还没写入就退出留下的空文件，以及之后只写了半行的文件
+	later := now.Add(time.Hour)
+	empty := filepath.Join(dir, "audit-"+later.Format("20060102T150405.000000000")+".jsonl")
+	torn := filepath.Join(dir, "audit-"+later.Add(time.Hour).Format("20060102T150405.000000000")+".jsonl")
+	if err := os.WriteFile(empty, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(torn, []byte(`{"seq":3,"time":`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := NewAuditLog(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.seq != seq || restored.lastHash != hash {
+		t.Errorf("restored seq=%d hash=%q, want seq=%d hash=%q", restored.seq, restored.lastHash, seq, hash)
+	}
+}
+
+// 写入失败时截掉半行，下一条记录仍然接在上一条完整记录之后
+func TestAuditLogDiscardsPartialWrite(t *testing.T) {
+	a, err := NewAuditLog(AuditConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	a.Record(AuditEntry{Time: now, RequestID: "r1"})
+	name := a.file.Name()
+
+	// 模拟写了一半：文件末尾多出半行，但 size 仍是上一条完整记录的结尾
+	if _, err := a.file.Write([]byte(`{"seq":2,"ti`)); err != nil {
+		t.Fatal(err)
+	}
+	a.discardPartialLocked()
+	a.Record(AuditEntry{Time: now, RequestID: "r2"})
+	a.file.Close()
+
+	last, err := lastAuditEntry(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last == nil || last.Seq != 2 || last.RequestID != "r2" {
+		t.Fatalf("last entry = %+v, want seq 2 from r2", last)
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(name); info.Size() != a.size || data[len(data)-1] != '\n' {
+		t.Errorf("file size = %d, tracked size = %d, want equal and ending in a newline", info.Size(), a.size)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AzureDeployment 兼容 Azure OpenAI 的 URL 格式：/openai/deployments/{deployment}/chat/completions?api-version=...
+// Azure 的请求体不带 model，模型由 URL 中的部署名决定；这里把部署名写入请求体的 model，之后与普通请求一样经过 MODEL_MAPPING
+// api-version 只用于兼容，不影响转换；api-key 头由 extractAPIKey 处理
+func AzureDeployment() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		deployment := c.Param("deployment")
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				respondError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", maxErr.Limit))
+			} else {
+				respondError(c, http.StatusBadRequest, err.Error())
+			}
+			c.Abort()
+			return
+		}
+
+		// 不是 JSON 对象时原样交给处理器，由处理器返回 400
+		var fields map[string]json.RawMessage
+		if json.Unmarshal(body, &fields) == nil && fields != nil {
+			model, _ := json.Marshal(deployment)
+			fields["model"] = model
+			if rewritten, err := json.Marshal(fields); err == nil {
+				body = rewritten
+			}
+		}
+		slog.Debug("azure deployment request", "deployment", deployment, "api_version", c.Query("api-version"))
+
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		c.Request.ContentLength = int64(len(body))
+		c.Next()
+	}
+}
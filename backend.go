@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sort"
+)
+
+// Backend 上游协议适配器
+// 所有前端接口都先转换为 Anthropic 请求，由后端转换为自己的协议发送；
+// 上游响应再由后端转换回 Anthropic 格式（非流式为 JSON，流式为 SSE 事件），之后的处理与 Anthropic 上游完全相同
+type Backend interface {
+	Name() string
+	// DefaultBaseURL 路由只写后端名称时使用的地址
+	DefaultBaseURL() string
+	// NewRequest 构造发送给上游的 HTTP 请求，必须使用传入的 ctx
+	NewRequest(ctx context.Context, baseURL string, req *BackendRequest) (*http.Request, error)
+	// ConvertResponse 将上游成功响应的 body 转换为 Anthropic 格式
+	ConvertResponse(body io.ReadCloser, req *BackendRequest) io.ReadCloser
+	// ConvertError 将上游错误响应的 body 转换为 Anthropic 错误 JSON，便于统一转换为 OpenAI 错误
+	ConvertError(status int, body []byte) []byte
+}
+
+// BackendRequest 发送给后端的请求
+type BackendRequest struct {
+	Anthropic *AnthropicRequest
+	Body      []byte // Anthropic 格式的请求体
+	Model     string // 实际请求的模型（备用上游可能替换模型）
+	APIKey    string
+	Betas     string // anthropic-beta 请求头
+	RequestID string // 代理的请求 ID，转发给上游便于关联
+}
+
+// backends 可在 ROUTES 中指定的后端
+var backends = map[string]Backend{
+	"anthropic": anthropicBackend{},
+	"gemini":    geminiBackend{},
+	"bedrock":   bedrockBackend{},
+	"openai":    openaiBackend{},
+}
+
+func backendNames() []string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// backend 目标未指定后端时为 Anthropic
+func (t upstreamTarget) backend() Backend {
+	if t.Backend == nil {
+		return anthropicBackend{}
+	}
+	return t.Backend
+}
+
+// anthropicBackend Anthropic Messages API，请求和响应都不需要转换
+type anthropicBackend struct{}
+
+func (anthropicBackend) Name() string { return "anthropic" }
+
+func (anthropicBackend) DefaultBaseURL() string { return "https://api.anthropic.com" }
+
+func (anthropicBackend) NewRequest(ctx context.Context, baseURL string, req *BackendRequest) (*http.Request, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", baseURL+"/v1/messages", bytes.NewReader(req.Body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("x-api-key", req.APIKey)
+	httpReq.Header.Set("anthropic-version", "2023-06-01")
+	if req.Betas != "" {
+		httpReq.Header.Set("anthropic-beta", req.Betas)
+	}
+	if req.RequestID != "" {
+		httpReq.Header.Set(upstreamRequestIDHeader, req.RequestID)
+	}
+	return httpReq, nil
+}
+
+func (anthropicBackend) ConvertResponse(body io.ReadCloser, req *BackendRequest) io.ReadCloser {
+	return body
+}
+
+func (anthropicBackend) ConvertError(status int, body []byte) []byte {
+	return body
+}
+
+// convertStream 在 goroutine 中把上游流转换为 Anthropic SSE，convert 返回的错误在读取时返回
+func convertStream(upstream io.ReadCloser, convert func(w io.Writer) error) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(convert(pw))
+	}()
+	return &convertedStream{PipeReader: pr, upstream: upstream}
+}
+
+// convertedStream 关闭时同时关闭上游响应，结束转换 goroutine
+type convertedStream struct {
+	*io.PipeReader
+	upstream io.ReadCloser
+}
+
+func (b *convertedStream) Close() error {
+	b.PipeReader.Close()
+	return b.upstream.Close()
+}
+
+// errReader 读取时返回转换失败的错误
+type errReader struct{ err error }
+
+func (r *errReader) Read([]byte) (int, error) { return 0, r.err }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+)
+
+func init() {
+	RegisterTransformer("banned_words", newBannedWordsTransformer)
+}
+
+// bannedWordsTransformer 内置插件：将响应文本中的 BANNED_WORDS（不区分大小写）替换为等长的 *
+// 流式响应按 text_delta 逐段替换，跨两个 delta 的词无法识别
+type bannedWordsTransformer struct {
+	pattern *regexp.Regexp
+}
+
+func newBannedWordsTransformer() (Transformer, error) {
+	words := parseModelList(os.Getenv("BANNED_WORDS"))
+	if len(words) == 0 {
+		return nil, fmt.Errorf("BANNED_WORDS is empty")
+	}
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		quoted[i] = regexp.QuoteMeta(word)
+	}
+	slog.Info("banned words filter enabled", "words", len(words))
+	return &bannedWordsTransformer{pattern: regexp.MustCompile("(?i)" + strings.Join(quoted, "|"))}, nil
+}
+
+func (t *bannedWordsTransformer) Name() string { return "banned_words" }
+
+func (t *bannedWordsTransformer) mask(text string) string {
+	return t.pattern.ReplaceAllStringFunc(text, func(word string) string {
+		return strings.Repeat("*", runeLen(word))
+	})
+}
+
+func (t *bannedWordsTransformer) TransformResponse(_ *TransformContext, resp *AnthropicResponse) error {
+	for i, content := range resp.Content {
+		if content.Type == "text" && content.Text != nil {
+			resp.Content[i].Text = stringPtr(t.mask(*content.Text))
+		}
+	}
+	return nil
+}
+
+func (t *bannedWordsTransformer) TransformEvent(_ *TransformContext, event map[string]interface{}) {
+	if event["type"] != "content_block_delta" {
+		return
+	}
+	if delta, ok := event["delta"].(map[string]interface{}); ok && delta["type"] == "text_delta" {
+		if text, ok := delta["text"].(string); ok {
+			delta["text"] = t.mask(text)
+		}
+	}
+}
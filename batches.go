@@ -0,0 +1,832 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OpenAI Batch API（/v1/files + /v1/batches）转换为 Anthropic Message Batches API
+// 上传的输入文件只保存在内存中；批次 ID 即 Anthropic 的批次 ID，状态和结果每次都从上游查询，
+// 输出文件和错误文件的 ID 由批次 ID 派生，下载时读取上游结果并转换为 OpenAI 格式
+
+const (
+	batchEndpoint         = "/v1/chat/completions" // 目前只支持聊天请求
+	batchCompletionWindow = "24h"
+	batchFileTTL          = 24 * time.Hour
+	batchInfoTTL          = 29 * 24 * time.Hour // Anthropic 保留批次结果 29 天
+	batchOutputFilePrefix = "file-batch-output-"
+	batchErrorFilePrefix  = "file-batch-errors-"
+	anthropicBatchesPath  = "/v1/messages/batches"
+	maxBatchFilesPerOwner = 100
+)
+
+// batchCustomIDPattern Anthropic 对 custom_id 的要求
+var batchCustomIDPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// BatchFile OpenAI 文件对象，data 为上传的内容
+type BatchFile struct {
+	ID        string `json:"id"`
+	Object    string `json:"object"`
+	Bytes     int    `json:"bytes"`
+	CreatedAt int64  `json:"created_at"`
+	Filename  string `json:"filename"`
+	Purpose   string `json:"purpose"`
+	Status    string `json:"status"`
+
+	owner string
+	data  []byte
+}
+
+// batchRequestFlags 结果中需要还原的请求转换
+type batchRequestFlags struct {
+	unwrapJSON      bool // json_schema 通过合成工具实现
+	legacyFunctions bool // 旧版 functions 请求
+}
+
+// batchInfo 通过本代理创建的批次在上游没有保存的信息，进程重启后丢失（结果仍可下载，只是不再还原上述转换）
+type batchInfo struct {
+	inputFileID string
+	metadata    map[string]string
+	created     time.Time
+	requests    map[string]batchRequestFlags // custom_id -> 转换
+}
+
+// BatchStore 上传的文件和批次信息
+type BatchStore struct {
+	mu      sync.Mutex
+	files   map[string]*BatchFile
+	batches map[string]*batchInfo
+}
+
+func NewBatchStore() *BatchStore {
+	return &BatchStore{files: make(map[string]*BatchFile), batches: make(map[string]*batchInfo)}
+}
+
+// sweep 清理过期的文件和批次信息，调用方持有锁
+func (s *BatchStore) sweep(now time.Time) {
+	for id, f := range s.files {
+		if now.Sub(time.Unix(f.CreatedAt, 0)) > batchFileTTL {
+			delete(s.files, id)
+		}
+	}
+	for id, b := range s.batches {
+		if now.Sub(b.created) > batchInfoTTL {
+			delete(s.batches, id)
+		}
+	}
+}
+
+func (s *BatchStore) addFile(f *BatchFile) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(time.Now())
+
+	n := 0
+	for _, existing := range s.files {
+		if existing.owner == f.owner {
+			n++
+		}
+	}
+	if n >= maxBatchFilesPerOwner {
+		return fmt.Errorf("too many files, delete some first (limit %d)", maxBatchFilesPerOwner)
+	}
+	s.files[f.ID] = f
+	return nil
+}
+
+// file 返回调用者自己上传的文件
+func (s *BatchStore) file(id, owner string) (*BatchFile, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[id]
+	if !ok || f.owner != owner || time.Since(time.Unix(f.CreatedAt, 0)) > batchFileTTL {
+		return nil, false
+	}
+	return f, true
+}
+
+func (s *BatchStore) listFiles(owner string) []*BatchFile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(time.Now())
+
+	files := []*BatchFile{}
+	for _, f := range s.files {
+		if f.owner == owner {
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].CreatedAt > files[j].CreatedAt })
+	return files
+}
+
+func (s *BatchStore) deleteFile(id, owner string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[id]
+	if !ok || f.owner != owner {
+		return false
+	}
+	delete(s.files, id)
+	return true
+}
+
+func (s *BatchStore) addBatch(id string, info *batchInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(time.Now())
+	s.batches[id] = info
+}
+
+func (s *BatchStore) batch(id string) *batchInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.batches[id]
+}
+
+func newFileID() string {
+	var b [12]byte
+	rand.Read(b[:])
+	return "file-" + hex.EncodeToString(b[:])
+}
+
+// anthropicBatch Anthropic 批次对象
+type anthropicBatch struct {
+	ID               string `json:"id"`
+	ProcessingStatus string `json:"processing_status"` // in_progress / canceling / ended
+	RequestCounts    struct {
+		Processing int `json:"processing"`
+		Succeeded  int `json:"succeeded"`
+		Errored    int `json:"errored"`
+		Canceled   int `json:"canceled"`
+		Expired    int `json:"expired"`
+	} `json:"request_counts"`
+	CreatedAt         string `json:"created_at"`
+	EndedAt           string `json:"ended_at"`
+	ExpiresAt         string `json:"expires_at"`
+	CancelInitiatedAt string `json:"cancel_initiated_at"`
+	ResultsURL        string `json:"results_url"`
+}
+
+// OpenAIBatch OpenAI 批次对象
+type OpenAIBatch struct {
+	ID               string            `json:"id"`
+	Object           string            `json:"object"`
+	Endpoint         string            `json:"endpoint"`
+	Errors           interface{}       `json:"errors"`
+	InputFileID      string            `json:"input_file_id"`
+	CompletionWindow string            `json:"completion_window"`
+	Status           string            `json:"status"`
+	OutputFileID     *string           `json:"output_file_id"`
+	ErrorFileID      *string           `json:"error_file_id"`
+	CreatedAt        int64             `json:"created_at"`
+	InProgressAt     *int64            `json:"in_progress_at"`
+	ExpiresAt        *int64            `json:"expires_at"`
+	FinalizingAt     *int64            `json:"finalizing_at"`
+	CompletedAt      *int64            `json:"completed_at"`
+	FailedAt         *int64            `json:"failed_at"`
+	ExpiredAt        *int64            `json:"expired_at"`
+	CancellingAt     *int64            `json:"cancelling_at"`
+	CancelledAt      *int64            `json:"cancelled_at"`
+	RequestCounts    BatchCounts       `json:"request_counts"`
+	Metadata         map[string]string `json:"metadata"`
+}
+
+type BatchCounts struct {
+	Total     int `json:"total"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+}
+
+// unixTime RFC 3339 时间转为 Unix 秒，空值或无法解析时为 nil
+func unixTime(s string) *int64 {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil
+	}
+	sec := t.Unix()
+	return &sec
+}
+
+// convertBatch Anthropic 批次转换为 OpenAI 批次，info 为 nil 表示不是本代理创建的（或进程已重启）
+func convertBatch(b *anthropicBatch, info *batchInfo) OpenAIBatch {
+	counts := b.RequestCounts
+	failed := counts.Errored + counts.Canceled + counts.Expired
+	out := OpenAIBatch{
+		ID:               b.ID,
+		Object:           "batch",
+		Endpoint:         batchEndpoint,
+		CompletionWindow: batchCompletionWindow,
+		ExpiresAt:        unixTime(b.ExpiresAt),
+		RequestCounts: BatchCounts{
+			Total:     counts.Processing + counts.Succeeded + failed,
+			Completed: counts.Succeeded,
+			Failed:    failed,
+		},
+	}
+	if created := unixTime(b.CreatedAt); created != nil {
+		out.CreatedAt = *created
+		out.InProgressAt = created
+	}
+	if info != nil {
+		out.InputFileID = info.inputFileID
+		out.Metadata = info.metadata
+	}
+
+	ended := unixTime(b.EndedAt)
+	switch {
+	case b.ProcessingStatus == "canceling":
+		out.Status = "cancelling"
+		out.CancellingAt = unixTime(b.CancelInitiatedAt)
+	case b.ProcessingStatus != "ended":
+		out.Status = "in_progress"
+	case b.CancelInitiatedAt != "":
+		out.Status = "cancelled"
+		out.CancellingAt = unixTime(b.CancelInitiatedAt)
+		out.CancelledAt = ended
+	case counts.Expired > 0 && counts.Succeeded+counts.Errored == 0:
+		out.Status = "expired"
+		out.ExpiredAt = ended
+	default:
+		out.Status = "completed"
+		out.FinalizingAt = ended
+		out.CompletedAt = ended
+	}
+	if b.ProcessingStatus == "ended" {
+		if counts.Succeeded > 0 {
+			id := batchOutputFilePrefix + b.ID
+			out.OutputFileID = &id
+		}
+		if failed > 0 {
+			id := batchErrorFilePrefix + b.ID
+			out.ErrorFileID = &id
+		}
+	}
+	return out
+}
+
+// batchInputLine OpenAI 批量输入文件的一行
+type batchInputLine struct {
+	CustomID string          `json:"custom_id"`
+	Method   string          `json:"method"`
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// anthropicBatchRequest Anthropic 批次中的一个请求
+type anthropicBatchRequest struct {
+	CustomID string            `json:"custom_id"`
+	Params   *AnthropicRequest `json:"params"`
+}
+
+// convertBatchRequest 按 /v1/chat/completions 的流程转换一个请求（模型映射、参数配置、thinking、缓存、guardrail、插件等），不发送
+func (h *ProxyHandler) convertBatchRequest(c *gin.Context, tc *TransformContext, body json.RawMessage, apiKey string, reqID string) (*AnthropicRequest, batchRequestFlags, error) {
+	var flags batchRequestFlags
+	if params := findUnsupportedParams(body); len(params) > 0 {
+		if h.strictParams {
+			return nil, flags, fmt.Errorf("unsupported parameters: %s", strings.Join(params, ", "))
+		}
+		if h.rejectLogprobs {
+			for _, param := range params {
+				if param == "logprobs" || param == "top_logprobs" {
+					return nil, flags, errors.New("logprobs are not supported: Claude models do not return token log probabilities")
+				}
+			}
+		}
+	}
+
+	var openaiReq OpenAIRequest
+	if err := json.Unmarshal(body, &openaiReq); err != nil {
+		return nil, flags, err
+	}
+	if openaiReq.N > 1 {
+		return nil, flags, errors.New("n > 1 is not supported in batches")
+	}
+	flags.legacyFunctions = convertLegacyFunctions(&openaiReq)
+	flags.unwrapJSON = usesJSONResponseTool(openaiReq)
+	if _, perr := normalizeSampling(&openaiReq, h.temperatureMode); perr != nil {
+		return nil, flags, fmt.Errorf("%s: %s", perr.Param, perr.Message)
+	}
+
+	settings := h.settings()
+	profile := h.modelProfile(openaiReq.Model)
+	openaiReq.Model = h.mapRequestModel(c, settings, openaiReq.Model, reqID)
+	if target := h.resolveUpstream(openaiReq.Model); target.BaseURL != h.anthropicURL || target.Backend != nil {
+		return nil, flags, fmt.Errorf("model %s is routed to %s, batches are only sent to ANTHROPIC_BASE_URL", openaiReq.Model, target.BaseURL)
+	}
+
+	anthropicReq, err := ConvertOpenAIToAnthropic(openaiReq, settings.MaxTokensMapping, apiKey)
+	if err != nil {
+		return nil, flags, err
+	}
+	applyThinking(anthropicReq, h.thinkingBudgets, reqID)
+	applyModelProfile(anthropicReq, profile, reqID)
+	h.fitMaxTokens(anthropicReq)
+	h.applyPromptTemplate(anthropicReq, settings.Cache, reqID)
+	applyCacheControl(anthropicReq, settings.Cache)
+	h.applyServerTools(anthropicReq, reqID)
+	if v := h.matchGuardrails(c, anthropicReq, reqID); v != nil {
+		return nil, flags, errors.New("request blocked by content policy: " + v.Reason)
+	}
+	for _, t := range h.requestTransformers {
+		if err := t.TransformRequest(tc, anthropicReq); err != nil {
+			return nil, flags, fmt.Errorf("rejected by %s: %w", t.Name(), err)
+		}
+	}
+	anthropicReq.Stream = false
+	return anthropicReq, flags, nil
+}
+
+// batchRequest 请求 Anthropic Message Batches API，失败时把错误转换为 OpenAI 格式写入响应并返回 false
+func (h *ProxyHandler) batchRequest(c *gin.Context, method, target string, body []byte, apiKey, betas string, reqID string) (*http.Response, bool) {
+	logger := reqLog(reqID)
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	httpReq, err := http.NewRequestWithContext(c.Request.Context(), method, target, reader)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return nil, false
+	}
+	if body != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	httpReq.Header.Set("x-api-key", apiKey)
+	httpReq.Header.Set("anthropic-version", "2023-06-01")
+	if betas != "" {
+		httpReq.Header.Set("anthropic-beta", betas)
+	}
+	httpReq.Header.Set(upstreamRequestIDHeader, reqID)
+
+	httpResp, err := h.client.Do(httpReq)
+	if err != nil {
+		logger.Error("batch upstream request failed", "method", method, "url", target, "error", err)
+		respondError(c, http.StatusBadGateway, err.Error())
+		return nil, false
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(httpResp.Body)
+		httpResp.Body.Close()
+		logger.Error("batch upstream error response", "method", method, "url", target, "status", httpResp.StatusCode,
+			"upstream_request_id", httpResp.Header.Get("request-id"), "body", string(respBody))
+		setRateLimitHeaders(c, httpResp.Header)
+		respondUpstreamError(c, &upstreamError{StatusCode: httpResp.StatusCode, Message: string(respBody), Header: httpResp.Header})
+		return nil, false
+	}
+	return httpResp, true
+}
+
+// batchJSON 请求 Message Batches API 并解析 JSON 响应
+func (h *ProxyHandler) batchJSON(c *gin.Context, method, path string, body []byte, apiKey, betas string, out interface{}, reqID string) bool {
+	httpResp, ok := h.batchRequest(c, method, h.anthropicURL+path, body, apiKey, betas, reqID)
+	if !ok {
+		return false
+	}
+	defer httpResp.Body.Close()
+	if err := json.NewDecoder(httpResp.Body).Decode(out); err != nil {
+		reqLog(reqID).Error("failed to parse batch response", "error", err)
+		respondError(c, http.StatusBadGateway, "failed to parse upstream batch response: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// HandleUploadFile 上传批量输入文件（POST /v1/files，multipart：purpose=batch、file）
+func (h *ProxyHandler) HandleUploadFile(c *gin.Context) {
+	reqID := requestID(c)
+	if _, ok := h.extractAPIKey(c, reqID); !ok {
+		return
+	}
+
+	if purpose := c.PostForm("purpose"); purpose != "batch" {
+		respondParamError(c, "purpose", "only purpose \"batch\" is supported")
+		return
+	}
+	header, err := c.FormFile("file")
+	if err != nil {
+		respondParamError(c, "file", "file is required: "+err.Error())
+		return
+	}
+	f, err := header.Open()
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		respondParamError(c, "file", "file is empty")
+		return
+	}
+
+	file := &BatchFile{
+		ID:        newFileID(),
+		Object:    "file",
+		Bytes:     len(data),
+		CreatedAt: time.Now().Unix(),
+		Filename:  header.Filename,
+		Purpose:   "batch",
+		Status:    "processed",
+		owner:     c.GetString(usageKeyKey),
+		data:      data,
+	}
+	if err := h.batches.addFile(file); err != nil {
+		respondError(c, http.StatusTooManyRequests, err.Error())
+		return
+	}
+	reqLog(reqID).Info("batch file uploaded", "file_id", file.ID, "bytes", file.Bytes, "filename", file.Filename)
+	c.JSON(http.StatusOK, file)
+}
+
+// HandleListFiles 列出调用者上传的文件（GET /v1/files）
+func (h *ProxyHandler) HandleListFiles(c *gin.Context) {
+	reqID := requestID(c)
+	if _, ok := h.extractAPIKey(c, reqID); !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": h.batches.listFiles(c.GetString(usageKeyKey))})
+}
+
+// HandleGetFile 查询文件（GET /v1/files/:file_id），包括批次的输出文件和错误文件
+func (h *ProxyHandler) HandleGetFile(c *gin.Context) {
+	reqID := requestID(c)
+	if _, ok := h.extractAPIKey(c, reqID); !ok {
+		return
+	}
+
+	id := c.Param("file_id")
+	if f, ok := h.batches.file(id, c.GetString(usageKeyKey)); ok {
+		c.JSON(http.StatusOK, f)
+		return
+	}
+	if batchID, _, ok := batchResultFile(id); ok {
+		// 结果文件的大小要下载后才知道
+		c.JSON(http.StatusOK, BatchFile{
+			ID:        id,
+			Object:    "file",
+			CreatedAt: time.Now().Unix(),
+			Filename:  batchID + ".jsonl",
+			Purpose:   "batch_output",
+			Status:    "processed",
+		})
+		return
+	}
+	respondError(c, http.StatusNotFound, "no such file: "+id)
+}
+
+// HandleDeleteFile 删除上传的文件（DELETE /v1/files/:file_id）
+func (h *ProxyHandler) HandleDeleteFile(c *gin.Context) {
+	reqID := requestID(c)
+	if _, ok := h.extractAPIKey(c, reqID); !ok {
+		return
+	}
+
+	id := c.Param("file_id")
+	if !h.batches.deleteFile(id, c.GetString(usageKeyKey)) {
+		respondError(c, http.StatusNotFound, "no such file: "+id)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": id, "object": "file", "deleted": true})
+}
+
+// batchResultFile 解析输出文件 / 错误文件 ID
+func batchResultFile(id string) (batchID string, errorsFile bool, ok bool) {
+	if batchID, ok := strings.CutPrefix(id, batchOutputFilePrefix); ok && batchID != "" {
+		return batchID, false, true
+	}
+	if batchID, ok := strings.CutPrefix(id, batchErrorFilePrefix); ok && batchID != "" {
+		return batchID, true, true
+	}
+	return "", false, false
+}
+
+// HandleFileContent 下载文件内容（GET /v1/files/:file_id/content），结果文件从上游读取并转换为 OpenAI 批量输出格式
+func (h *ProxyHandler) HandleFileContent(c *gin.Context) {
+	reqID := requestID(c)
+	apiKey, ok := h.extractAPIKey(c, reqID)
+	if !ok {
+		return
+	}
+
+	id := c.Param("file_id")
+	if f, ok := h.batches.file(id, c.GetString(usageKeyKey)); ok {
+		c.Data(http.StatusOK, "application/jsonl", f.data)
+		return
+	}
+	batchID, errorsFile, ok := batchResultFile(id)
+	if !ok {
+		respondError(c, http.StatusNotFound, "no such file: "+id)
+		return
+	}
+
+	var batch anthropicBatch
+	if !h.batchJSON(c, http.MethodGet, anthropicBatchesPath+"/"+url.PathEscape(batchID), nil, apiKey, "", &batch, reqID) {
+		return
+	}
+	if batch.ProcessingStatus != "ended" || batch.ResultsURL == "" {
+		respondError(c, http.StatusBadRequest, "batch "+batchID+" has not finished yet")
+		return
+	}
+	httpResp, ok := h.batchRequest(c, http.MethodGet, batch.ResultsURL, nil, apiKey, "", reqID)
+	if !ok {
+		return
+	}
+	defer httpResp.Body.Close()
+
+	h.writeBatchResults(c, httpResp.Body, batchID, errorsFile, reqID)
+}
+
+// anthropicBatchResult Anthropic 结果文件的一行
+type anthropicBatchResult struct {
+	CustomID string `json:"custom_id"`
+	Result   struct {
+		Type    string            `json:"type"` // succeeded / errored / canceled / expired
+		Message AnthropicResponse `json:"message"`
+		Error   json.RawMessage   `json:"error"`
+	} `json:"result"`
+}
+
+// writeBatchResults 逐行转换结果：输出文件只包含成功的请求，其余写入错误文件
+func (h *ProxyHandler) writeBatchResults(c *gin.Context, results io.Reader, batchID string, errorsFile bool, reqID string) {
+	logger := reqLog(reqID)
+	info := h.batches.batch(batchID)
+	tc := newTransformContext(c, reqID)
+
+	c.Header("Content-Type", "application/jsonl")
+	c.Status(http.StatusOK)
+
+	reader := bufio.NewReaderSize(results, 64<<10)
+	written := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var result anthropicBatchResult
+			if jerr := json.Unmarshal(line, &result); jerr != nil {
+				logger.Error("failed to parse batch result", "error", jerr)
+				return
+			}
+			if (result.Result.Type != "succeeded") == errorsFile {
+				out := h.convertBatchResult(&result, batchID, info, tc, reqID)
+				data, _ := json.Marshal(out)
+				c.Writer.Write(append(data, '\n'))
+				written++
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// 响应头已写出，只能中断输出
+			logger.Error("failed to read batch results", "error", err)
+			return
+		}
+	}
+	logger.Info("batch results converted", "batch_id", batchID, "errors_file", errorsFile, "lines", written)
+}
+
+// convertBatchResult 转换为 OpenAI 批量输出的一行
+func (h *ProxyHandler) convertBatchResult(result *anthropicBatchResult, batchID string, info *batchInfo, tc *TransformContext, reqID string) gin.H {
+	sum := sha256.Sum256([]byte(batchID + "\x00" + result.CustomID))
+	out := gin.H{
+		"id":        "batch_req_" + hex.EncodeToString(sum[:12]),
+		"custom_id": result.CustomID,
+		"response":  nil,
+		"error":     nil,
+	}
+
+	switch result.Result.Type {
+	case "succeeded":
+		msg := &result.Result.Message
+		for _, t := range h.responseTransformers {
+			if err := t.TransformResponse(tc, msg); err != nil {
+				reqLog(reqID).Warn("batch result rejected by transformer", "transformer", t.Name(), "custom_id", result.CustomID, "error", err)
+				out["response"] = gin.H{"status_code": http.StatusBadGateway, "request_id": msg.ID, "body": gin.H{"error": newOpenAIError(http.StatusBadGateway, err.Error())}}
+				return out
+			}
+		}
+		var flags batchRequestFlags
+		if info != nil {
+			flags = info.requests[result.CustomID]
+		}
+		if flags.unwrapJSON {
+			unwrapJSONResponseTool(msg)
+		}
+		resp := ConvertAnthropicToOpenAI(*msg)
+		if flags.legacyFunctions {
+			legacyFunctionResponse(&resp)
+		}
+		out["response"] = gin.H{"status_code": http.StatusOK, "request_id": msg.ID, "body": resp}
+	case "errored":
+		// error 为 Anthropic 错误响应体 {"type": "error", "error": {...}}
+		status, e := translateAnthropicError(http.StatusInternalServerError, string(result.Result.Error))
+		out["response"] = gin.H{"status_code": status, "request_id": "", "body": gin.H{"error": e}}
+	case "canceled":
+		out["error"] = gin.H{"code": "batch_cancelled", "message": "the batch was cancelled before this request was processed"}
+	case "expired":
+		out["error"] = gin.H{"code": "batch_expired", "message": "this request could not be processed before the batch expired"}
+	default:
+		out["error"] = gin.H{"code": "unknown_result", "message": "unknown result type: " + result.Result.Type}
+	}
+	return out
+}
+
+// HandleCreateBatch 创建批次（POST /v1/batches）：转换输入文件中的每个请求，提交到 Anthropic Message Batches API
+func (h *ProxyHandler) HandleCreateBatch(c *gin.Context) {
+	reqID := requestID(c)
+	logger := reqLog(reqID)
+	apiKey, ok := h.extractAPIKey(c, reqID)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		InputFileID      string            `json:"input_file_id"`
+		Endpoint         string            `json:"endpoint"`
+		CompletionWindow string            `json:"completion_window"`
+		Metadata         map[string]string `json:"metadata"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Endpoint != batchEndpoint {
+		respondParamError(c, "endpoint", "only "+batchEndpoint+" is supported")
+		return
+	}
+	if req.CompletionWindow != batchCompletionWindow {
+		respondParamError(c, "completion_window", "completion_window must be 24h")
+		return
+	}
+	file, ok := h.batches.file(req.InputFileID, c.GetString(usageKeyKey))
+	if !ok {
+		respondParamError(c, "input_file_id", "no such file: "+req.InputFileID)
+		return
+	}
+
+	// 同步转换全部请求，任意一行无效时整个批次返回 400（OpenAI 是异步校验后把批次置为 failed）
+	tc := newTransformContext(c, reqID)
+	info := &batchInfo{inputFileID: file.ID, metadata: req.Metadata, created: time.Now(), requests: make(map[string]batchRequestFlags)}
+	var requests []anthropicBatchRequest
+	var betas []string
+	seen := make(map[string]bool)
+	for i, raw := range bytes.Split(file.data, []byte("\n")) {
+		if len(bytes.TrimSpace(raw)) == 0 {
+			continue
+		}
+		lineErr := func(format string, args ...interface{}) {
+			msg := fmt.Sprintf("line %d: ", i+1) + fmt.Sprintf(format, args...)
+			logger.Warn("invalid batch request", "file_id", file.ID, "error", msg)
+			respondParamError(c, "input_file_id", msg)
+		}
+
+		var line batchInputLine
+		if err := json.Unmarshal(raw, &line); err != nil {
+			lineErr("invalid JSON: %v", err)
+			return
+		}
+		if !batchCustomIDPattern.MatchString(line.CustomID) {
+			lineErr("custom_id must be 1-64 characters of letters, digits, '-' and '_'")
+			return
+		}
+		if seen[line.CustomID] {
+			lineErr("duplicate custom_id %q", line.CustomID)
+			return
+		}
+		seen[line.CustomID] = true
+		if line.Method != http.MethodPost || line.URL != req.Endpoint {
+			lineErr("method and url must be POST %s", req.Endpoint)
+			return
+		}
+
+		anthropicReq, flags, err := h.convertBatchRequest(c, tc, line.Body, apiKey, reqID)
+		if err != nil {
+			lineErr("%v", err)
+			return
+		}
+		if flags != (batchRequestFlags{}) {
+			info.requests[line.CustomID] = flags
+		}
+		requests = append(requests, anthropicBatchRequest{CustomID: line.CustomID, Params: anthropicReq})
+		for _, beta := range strings.Split(anthropicBetas(anthropicReq, h.settings().Cache.Enabled, h.betas.forModel(anthropicReq.Model)), ",") {
+			if beta != "" && !slices.Contains(betas, beta) {
+				betas = append(betas, beta)
+			}
+		}
+	}
+	if len(requests) == 0 {
+		respondParamError(c, "input_file_id", "input file contains no requests")
+		return
+	}
+
+	body, err := json.Marshal(gin.H{"requests": requests})
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var batch anthropicBatch
+	if !h.batchJSON(c, http.MethodPost, anthropicBatchesPath, body, apiKey, strings.Join(betas, ","), &batch, reqID) {
+		return
+	}
+	h.batches.addBatch(batch.ID, info)
+
+	logger.Info("batch created", "batch_id", batch.ID, "file_id", file.ID, "requests", len(requests))
+	c.JSON(http.StatusOK, convertBatch(&batch, info))
+}
+
+// HandleGetBatch 查询批次（GET /v1/batches/:batch_id）
+func (h *ProxyHandler) HandleGetBatch(c *gin.Context) {
+	reqID := requestID(c)
+	apiKey, ok := h.extractAPIKey(c, reqID)
+	if !ok {
+		return
+	}
+
+	id := c.Param("batch_id")
+	var batch anthropicBatch
+	if !h.batchJSON(c, http.MethodGet, anthropicBatchesPath+"/"+url.PathEscape(id), nil, apiKey, "", &batch, reqID) {
+		return
+	}
+	c.JSON(http.StatusOK, convertBatch(&batch, h.batches.batch(batch.ID)))
+}
+
+// HandleCancelBatch 取消批次（POST /v1/batches/:batch_id/cancel）
+func (h *ProxyHandler) HandleCancelBatch(c *gin.Context) {
+	reqID := requestID(c)
+	apiKey, ok := h.extractAPIKey(c, reqID)
+	if !ok {
+		return
+	}
+
+	id := c.Param("batch_id")
+	var batch anthropicBatch
+	if !h.batchJSON(c, http.MethodPost, anthropicBatchesPath+"/"+url.PathEscape(id)+"/cancel", nil, apiKey, "", &batch, reqID) {
+		return
+	}
+	reqLog(reqID).Info("batch cancelled", "batch_id", batch.ID)
+	c.JSON(http.StatusOK, convertBatch(&batch, h.batches.batch(batch.ID)))
+}
+
+// HandleListBatches 列出批次（GET /v1/batches?limit=&after=）
+func (h *ProxyHandler) HandleListBatches(c *gin.Context) {
+	reqID := requestID(c)
+	apiKey, ok := h.extractAPIKey(c, reqID)
+	if !ok {
+		return
+	}
+
+	query := url.Values{}
+	if limit := c.Query("limit"); limit != "" {
+		query.Set("limit", limit)
+	}
+	if after := c.Query("after"); after != "" {
+		query.Set("after_id", after)
+	}
+	path := anthropicBatchesPath
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	var list struct {
+		Data    []anthropicBatch `json:"data"`
+		HasMore bool             `json:"has_more"`
+		FirstID *string          `json:"first_id"`
+		LastID  *string          `json:"last_id"`
+	}
+	if !h.batchJSON(c, http.MethodGet, path, nil, apiKey, "", &list, reqID) {
+		return
+	}
+	data := make([]OpenAIBatch, 0, len(list.Data))
+	for i := range list.Data {
+		data = append(data, convertBatch(&list.Data[i], h.batches.batch(list.Data[i].ID)))
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"object":   "list",
+		"data":     data,
+		"first_id": list.FirstID,
+		"last_id":  list.LastID,
+		"has_more": list.HasMore,
+	})
+}
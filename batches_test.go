@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeBatchesAPI 模拟 Anthropic Message Batches API：创建的批次立即结束，一个请求成功、一个失败
+func fakeBatchesAPI(t *testing.T, submitted *[]byte) *httptest.Server {
+	t.Helper()
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == anthropicBatchesPath:
+			*submitted, _ = io.ReadAll(r.Body)
+			io.WriteString(w, `{"id":"msgbatch_1","processing_status":"in_progress","created_at":"2026-01-02T03:04:05Z",`+
+				`"request_counts":{"processing":2}}`)
+		case r.Method == http.MethodGet && r.URL.Path == anthropicBatchesPath+"/msgbatch_1":
+			io.WriteString(w, `{"id":"msgbatch_1","processing_status":"ended","created_at":"2026-01-02T03:04:05Z",`+
+				`"ended_at":"2026-01-02T03:10:00Z","request_counts":{"succeeded":1,"errored":1},"results_url":"`+srv.URL+`/results"}`)
+		case r.Method == http.MethodGet && r.URL.Path == "/results":
+			io.WriteString(w, `{"custom_id":"req-1","result":{"type":"succeeded","message":{"id":"msg_1","type":"message",`+
+				`"role":"assistant","model":"claude-test","content":[{"type":"text","text":"hi"}],"stop_reason":"end_turn",`+
+				`"usage":{"input_tokens":3,"output_tokens":1}}}}`+"\n")
+			io.WriteString(w, `{"custom_id":"req-2","result":{"type":"errored","error":{"type":"error",`+
+				`"error":{"type":"invalid_request_error","message":"bad request"}}}}`+"\n")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// 上传输入文件、创建批次、查询状态并下载转换后的输出文件和错误文件；其他 key 看不到该文件
+func TestBatchesFlow(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var submitted []byte
+	upstream := fakeBatchesAPI(t, &submitted)
+	h, err := NewProxyHandler(ProxyConfig{AnthropicURL: upstream.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := gin.New()
+	r.POST("/v1/files", h.HandleUploadFile)
+	r.GET("/v1/files/:file_id/content", h.HandleFileContent)
+	r.POST("/v1/batches", h.HandleCreateBatch)
+	r.GET("/v1/batches/:batch_id", h.HandleGetBatch)
+
+	call := func(apiKey string, req *http.Request) *httptest.ResponseRecorder {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	upload := func(apiKey, content string) string {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("purpose", "batch")
+		fw, _ := mw.CreateFormFile("file", "input.jsonl")
+		io.WriteString(fw, content)
+		mw.Close()
+		req := httptest.NewRequest(http.MethodPost, "/v1/files", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := call(apiKey, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("upload: status = %d: %s", w.Code, w.Body)
+		}
+		var file BatchFile
+		json.Unmarshal(w.Body.Bytes(), &file)
+		return file.ID
+	}
+	createBatch := func(apiKey, fileID string) *httptest.ResponseRecorder {
+		body := `{"input_file_id":"` + fileID + `","endpoint":"/v1/chat/completions","completion_window":"24h","metadata":{"job":"nightly"}}`
+		req := httptest.NewRequest(http.MethodPost, "/v1/batches", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		return call(apiKey, req)
+	}
+
+	input := `{"custom_id":"req-1","method":"POST","url":"/v1/chat/completions","body":{"model":"claude-test","max_tokens":32,"messages":[{"role":"user","content":"hello"}]}}` + "\n" +
+		`{"custom_id":"req-2","method":"POST","url":"/v1/chat/completions","body":{"model":"claude-test","max_tokens":32,"messages":[{"role":"user","content":"again"}]}}` + "\n"
+	fileID := upload("sk-alice", input)
+
+	if w := createBatch("sk-bob", fileID); w.Code != http.StatusBadRequest {
+		t.Errorf("create batch with another key's file: status = %d, want 400", w.Code)
+	}
+	invalid := upload("sk-alice", input+`{"custom_id":"req-1","method":"POST","url":"/v1/chat/completions","body":{}}`+"\n")
+	if w := createBatch("sk-alice", invalid); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "line 3") {
+		t.Errorf("create batch with a duplicate custom_id: status = %d, body = %s; want 400 naming line 3", w.Code, w.Body)
+	}
+
+	w := createBatch("sk-alice", fileID)
+	if w.Code != http.StatusOK {
+		t.Fatalf("create batch: status = %d: %s", w.Code, w.Body)
+	}
+	var sent struct {
+		Requests []struct {
+			CustomID string           `json:"custom_id"`
+			Params   AnthropicRequest `json:"params"`
+		} `json:"requests"`
+	}
+	if err := json.Unmarshal(submitted, &sent); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent.Requests) != 2 || sent.Requests[0].CustomID != "req-1" || sent.Requests[0].Params.Model != "claude-test" || sent.Requests[0].Params.MaxTokens != 32 {
+		t.Fatalf("submitted batch = %s", submitted)
+	}
+
+	w = call("sk-alice", httptest.NewRequest(http.MethodGet, "/v1/batches/msgbatch_1", nil))
+	var batch OpenAIBatch
+	if err := json.Unmarshal(w.Body.Bytes(), &batch); err != nil {
+		t.Fatal(err)
+	}
+	if batch.Status != "completed" || batch.InputFileID != fileID || batch.Metadata["job"] != "nightly" ||
+		batch.OutputFileID == nil || batch.ErrorFileID == nil || batch.RequestCounts != (BatchCounts{Total: 2, Completed: 1, Failed: 1}) {
+		t.Fatalf("batch = %s", w.Body)
+	}
+
+	w = call("sk-alice", httptest.NewRequest(http.MethodGet, "/v1/files/"+*batch.OutputFileID+"/content", nil))
+	var output struct {
+		CustomID string `json:"custom_id"`
+		Response struct {
+			StatusCode int            `json:"status_code"`
+			Body       OpenAIResponse `json:"body"`
+		} `json:"response"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &output); err != nil {
+		t.Fatalf("output file = %s: %v", w.Body, err)
+	}
+	if output.CustomID != "req-1" || output.Response.StatusCode != http.StatusOK || output.Response.Body.Choices[0].Message.Content != "hi" {
+		t.Errorf("output file = %s", w.Body)
+	}
+
+	w = call("sk-alice", httptest.NewRequest(http.MethodGet, "/v1/files/"+*batch.ErrorFileID+"/content", nil))
+	if lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n"); len(lines) != 1 || !strings.Contains(lines[0], `"custom_id":"req-2"`) || !strings.Contains(lines[0], `"status_code":400`) {
+		t.Errorf("error file = %s", w.Body)
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// bedrockBackend AWS Bedrock 上的 Claude（InvokeModel / InvokeModelWithResponseStream）
+// 请求体与 Messages API 基本相同：模型放在 URL 中，版本和 beta 写入请求体；
+// 非流式响应无需转换，流式响应为 AWS event stream，每个事件的 payload 中是 base64 编码的 Anthropic 流式事件
+// 认证不使用客户端的 API Key：设置了 AWS_BEARER_TOKEN_BEDROCK 时使用 Bedrock API Key，否则用 AWS 凭证做 SigV4 签名
+type bedrockBackend struct{}
+
+// bedrockAnthropicVersion Bedrock 要求的 anthropic_version
+const bedrockAnthropicVersion = "bedrock-2023-05-31"
+
+func (bedrockBackend) Name() string { return "bedrock" }
+
+func (bedrockBackend) DefaultBaseURL() string {
+	return "https://bedrock-runtime." + awsRegion("") + ".amazonaws.com"
+}
+
+func (bedrockBackend) NewRequest(ctx context.Context, baseURL string, req *BackendRequest) (*http.Request, error) {
+	body, err := bedrockBody(req.Body, req.Betas)
+	if err != nil {
+		return nil, err
+	}
+
+	action := "invoke"
+	if req.Anthropic.Stream {
+		action = "invoke-with-response-stream"
+	}
+	// 模型 ID 中的 ":"（版本号）和 "/"（推理配置文件 ARN）都需要编码
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	basePath := strings.TrimRight(u.EscapedPath(), "/")
+	u.Path = strings.TrimRight(u.Path, "/") + "/model/" + req.Model + "/" + action
+	u.RawPath = basePath + "/model/" + awsURIEncode(req.Model) + "/" + action
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Accept", "application/json")
+
+	if token := os.Getenv("AWS_BEARER_TOKEN_BEDROCK"); token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+token)
+		return httpReq, nil
+	}
+	creds := awsCredentialsFromEnv()
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, errors.New("bedrock: AWS_ACCESS_KEY_ID / AWS_SECRET_ACCESS_KEY or AWS_BEARER_TOKEN_BEDROCK is not set")
+	}
+	signSigV4(httpReq, body, creds, awsRegion(u.Host), "bedrock", time.Now())
+	return httpReq, nil
+}
+
+// bedrockBody 去掉 Bedrock 不接受的字段，加上 anthropic_version 和 anthropic_beta
+func bedrockBody(anthropicBody []byte, betas string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(anthropicBody, &fields); err != nil {
+		return nil, err
+	}
+	delete(fields, "model")
+	delete(fields, "stream")
+	delete(fields, "metadata") // Bedrock 拒绝未知字段
+	fields["anthropic_version"], _ = json.Marshal(bedrockAnthropicVersion)
+	// Bedrock 上 prompt caching 不需要 beta，未知的 beta 会被拒绝
+	var flags []string
+	for _, beta := range strings.Split(betas, ",") {
+		if beta != "" && beta != "prompt-caching-2024-07-31" {
+			flags = append(flags, beta)
+		}
+	}
+	if len(flags) > 0 {
+		fields["anthropic_beta"], _ = json.Marshal(flags)
+	}
+	return json.Marshal(fields)
+}
+
+func (bedrockBackend) ConvertResponse(body io.ReadCloser, req *BackendRequest) io.ReadCloser {
+	if !req.Anthropic.Stream {
+		return body
+	}
+	return convertStream(body, func(w io.Writer) error {
+		return convertBedrockStream(body, w)
+	})
+}
+
+// bedrockErrorTypes HTTP 状态码 -> Anthropic 错误类型（Bedrock 的错误体只有 message）
+var bedrockErrorTypes = map[int]string{
+	http.StatusBadRequest:          "invalid_request_error",
+	http.StatusUnauthorized:        "authentication_error",
+	http.StatusForbidden:           "permission_error",
+	http.StatusNotFound:            "not_found_error",
+	http.StatusTooManyRequests:     "rate_limit_error",
+	http.StatusInternalServerError: "api_error",
+	http.StatusServiceUnavailable:  "overloaded_error",
+}
+
+func (bedrockBackend) ConvertError(status int, body []byte) []byte {
+	var resp struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &resp) != nil || resp.Message == "" {
+		return body
+	}
+	errorType, ok := bedrockErrorTypes[status]
+	if !ok {
+		errorType = "api_error"
+	}
+	converted, _ := json.Marshal(map[string]interface{}{"type": "error", "error": map[string]interface{}{"type": errorType, "message": resp.Message}})
+	return converted
+}
+
+// bedrockExceptionTypes 流中途的异常 -> Anthropic 错误类型
+var bedrockExceptionTypes = map[string]string{
+	"throttlingException":           "rate_limit_error",
+	"serviceUnavailableException":   "overloaded_error",
+	"modelStreamErrorException":     "api_error",
+	"internalServerException":       "api_error",
+	"validationException":           "invalid_request_error",
+	"modelTimeoutException":         "api_error",
+	"modelNotReadyException":        "overloaded_error",
+	"accessDeniedException":         "permission_error",
+	"resourceNotFoundException":     "not_found_error",
+	"serviceQuotaExceededException": "rate_limit_error",
+}
+
+// convertBedrockStream 解码 event stream，输出 Anthropic SSE
+// chunk 事件的 payload 为 {"bytes": base64(Anthropic 事件 JSON)}；exception 转换为 error 事件
+func convertBedrockStream(body io.Reader, w io.Writer) error {
+	r := bufio.NewReader(body)
+	for {
+		headers, payload, err := readEventStreamMessage(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch headers[":message-type"] {
+		case "event":
+			if headers[":event-type"] != "chunk" {
+				continue
+			}
+			var chunk struct {
+				Bytes []byte `json:"bytes"` // encoding/json 按 base64 解码
+			}
+			if err := json.Unmarshal(payload, &chunk); err != nil {
+				return fmt.Errorf("parse bedrock chunk: %w", err)
+			}
+			var event struct {
+				Type string `json:"type"`
+			}
+			if err := json.Unmarshal(chunk.Bytes, &event); err != nil {
+				return fmt.Errorf("parse bedrock event: %w", err)
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, chunk.Bytes); err != nil {
+				return err
+			}
+
+		case "exception", "error":
+			exception := headers[":exception-type"]
+			if exception == "" {
+				exception = headers[":error-code"]
+			}
+			var detail struct {
+				Message string `json:"message"`
+			}
+			json.Unmarshal(payload, &detail)
+			if detail.Message == "" {
+				detail.Message = headers[":error-message"]
+			}
+			errorType, ok := bedrockExceptionTypes[exception]
+			if !ok {
+				errorType = "api_error"
+			}
+			data, _ := json.Marshal(map[string]interface{}{"type": "error", "error": map[string]interface{}{"type": errorType, "message": detail.Message}})
+			_, err := fmt.Fprintf(w, "event: error\ndata: %s\n\n", data)
+			return err
+		}
+	}
+}
+
+// readEventStreamMessage 读取一条 AWS event stream 消息（application/vnd.amazon.eventstream）
+// 格式：总长度(4) 头部长度(4) prelude CRC(4) 头部 payload 消息 CRC(4)，只解析字符串类型的头部
+func readEventStreamMessage(r io.Reader) (map[string]string, []byte, error) {
+	prelude := make([]byte, 12)
+	if _, err := io.ReadFull(r, prelude); err != nil {
+		return nil, nil, err
+	}
+	totalLen := binary.BigEndian.Uint32(prelude[0:4])
+	headersLen := binary.BigEndian.Uint32(prelude[4:8])
+	if crc32.ChecksumIEEE(prelude[:8]) != binary.BigEndian.Uint32(prelude[8:12]) {
+		return nil, nil, errors.New("event stream: prelude checksum mismatch")
+	}
+	if totalLen < 16+headersLen || totalLen > 16<<20 {
+		return nil, nil, fmt.Errorf("event stream: invalid message length %d", totalLen)
+	}
+
+	rest := make([]byte, totalLen-12)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, nil, err
+	}
+	crc := crc32.NewIEEE()
+	crc.Write(prelude)
+	crc.Write(rest[:len(rest)-4])
+	if crc.Sum32() != binary.BigEndian.Uint32(rest[len(rest)-4:]) {
+		return nil, nil, errors.New("event stream: message checksum mismatch")
+	}
+
+	headers := make(map[string]string)
+	raw := rest[:headersLen]
+	for len(raw) > 0 {
+		nameLen := int(raw[0])
+		if len(raw) < 2+nameLen {
+			return nil, nil, errors.New("event stream: truncated header")
+		}
+		name := string(raw[1 : 1+nameLen])
+		valueType := raw[1+nameLen]
+		raw = raw[2+nameLen:]
+
+		var size int
+		switch valueType {
+		case 0, 1: // bool
+			size = 0
+		case 2: // byte
+			size = 1
+		case 3: // short
+			size = 2
+		case 4: // int
+			size = 4
+		case 5, 8: // long, timestamp
+			size = 8
+		case 6, 7: // bytes, string
+			if len(raw) < 2 {
+				return nil, nil, errors.New("event stream: truncated header")
+			}
+			size = 2 + int(binary.BigEndian.Uint16(raw))
+		case 9: // uuid
+			size = 16
+		default:
+			return nil, nil, fmt.Errorf("event stream: unknown header type %d", valueType)
+		}
+		if len(raw) < size {
+			return nil, nil, errors.New("event stream: truncated header")
+		}
+		if valueType == 7 {
+			headers[name] = string(raw[2:size])
+		}
+		raw = raw[size:]
+	}
+	return headers, rest[headersLen : len(rest)-4], nil
+}
+
+// awsCredentials AWS 访问凭证
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// awsCredentialsFromEnv 从标准环境变量读取凭证
+func awsCredentialsFromEnv() awsCredentials {
+	return awsCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+}
+
+// awsRegion 优先从 bedrock-runtime.{region}.amazonaws.com 形式的地址中取区域，否则使用 AWS_REGION / AWS_DEFAULT_REGION，默认 us-east-1
+func awsRegion(host string) string {
+	parts := strings.Split(host, ".")
+	if len(parts) >= 4 && strings.HasPrefix(parts[0], "bedrock-runtime") && parts[2] == "amazonaws" {
+		return parts[1]
+	}
+	for _, key := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region := os.Getenv(key); region != "" {
+			return region
+		}
+	}
+	return "us-east-1"
+}
+
+// signSigV4 为请求添加 AWS Signature Version 4 签名
+// 非 S3 服务的规范 URI 需要对已编码的路径再编码一次
+func signSigV4(req *http.Request, body []byte, creds awsCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	segments := strings.Split(req.URL.EscapedPath(), "/")
+	for i, segment := range segments {
+		segments[i] = awsURIEncode(segment)
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		strings.Join(segments, "/"),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// awsURIEncode 按 SigV4 规则编码：只保留 RFC 3986 非保留字符
+func awsURIEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
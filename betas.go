@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+)
+
+// BetaConfig 额外发送的 anthropic-beta 值：全局列表加上第一个匹配模型的列表
+// prompt caching 和服务端工具需要的 beta 仍然自动添加
+type BetaConfig struct {
+	Global []string
+	Models []ModelBetas
+}
+
+// ModelBetas 按模型名（映射后）匹配的 beta 列表
+type ModelBetas struct {
+	Pattern string
+	Betas   []string
+}
+
+// loadBetaConfig 读取 ANTHROPIC_BETAS（逗号分隔）和 MODEL_BETAS（"glob=beta1|beta2"，逗号分隔）
+func loadBetaConfig() BetaConfig {
+	cfg := BetaConfig{Global: parseModelList(os.Getenv("ANTHROPIC_BETAS"))}
+
+	for _, item := range strings.Split(os.Getenv("MODEL_BETAS"), ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		pattern := strings.TrimSpace(parts[0])
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			slog.Warn("invalid model betas pattern", "pattern", pattern, "error", err)
+			continue
+		}
+
+		entry := ModelBetas{Pattern: pattern}
+		for _, beta := range strings.Split(parts[1], "|") {
+			if beta = strings.TrimSpace(beta); beta != "" {
+				entry.Betas = append(entry.Betas, beta)
+			}
+		}
+		if len(entry.Betas) > 0 {
+			cfg.Models = append(cfg.Models, entry)
+		}
+	}
+	return cfg
+}
+
+// forModel 返回模型需要额外发送的 beta
+func (cfg BetaConfig) forModel(model string) []string {
+	betas := cfg.Global
+	for _, m := range cfg.Models {
+		if ok, _ := path.Match(m.Pattern, model); ok {
+			return append(append([]string(nil), betas...), m.Betas...)
+		}
+	}
+	return betas
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errResponseTooLarge 上游非流式响应体超过 MAX_RESPONSE_BODY_MB
+var errResponseTooLarge = errors.New("upstream response body too large")
+
+// BodyLimit 限制请求体大小，Content-Length 已超限时直接返回 413
+// 未声明长度（chunked）的请求在读取时由 MaxBytesReader 截断
+func BodyLimit(maxBytes int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if maxBytes > 0 && c.Request.Body != nil {
+			if c.Request.ContentLength > maxBytes {
+				respondError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", maxBytes))
+				c.Abort()
+				return
+			}
+			c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes)
+		}
+		c.Next()
+	}
+}
+
+// readRequestBody 读取请求体并保存在 context 中（供 tape 录制），失败时写入错误响应（超过大小限制返回 413）
+func readRequestBody(c *gin.Context, reqID string) ([]byte, bool) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			reqLog(reqID).Warn("request body too large", "limit", maxErr.Limit)
+			respondError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", maxErr.Limit))
+			return nil, false
+		}
+		reqLog(reqID).Error("failed to read request body", "error", err)
+		respondError(c, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	c.Set(rawRequestBodyKey, body)
+	return body, true
+}
+
+// readResponseBody 读取上游非流式响应体，超过 limit 字节时返回 errResponseTooLarge
+func readResponseBody(r io.Reader, limit int64) ([]byte, error) {
+	if limit <= 0 {
+		return io.ReadAll(r)
+	}
+	body, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, errResponseTooLarge
+	}
+	return body, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// maxCacheBreakpoints Anthropic 单个请求最多允许 4 个 cache_control 标记
+const maxCacheBreakpoints = 4
+
+// CacheConfig prompt caching 策略
+type CacheConfig struct {
+	Enabled   bool   `json:"enabled"`
+	TTL       string `json:"ttl"`        // "5m" 或 "1h"
+	System    bool   `json:"system"`     // 标记 system 的最后一个块
+	Tools     bool   `json:"tools"`      // 标记最后一个工具定义
+	Documents bool   `json:"documents"`  // 标记最后一个 document 块（PDF 等大文件）
+	Assistant bool   `json:"assistant"`  // 标记倒数第 2 条 assistant 消息
+	UserTurns int    `json:"user_turns"` // 标记最后 N 条 user 消息，0 表示不标记
+	Sticky    bool   `json:"sticky"`     // 请求带 user 时按会话放置消息断点，代替 assistant / user 策略
+}
+
+// loadCacheConfig 从环境变量读取 prompt caching 策略
+// 默认与之前的硬编码行为一致：1h TTL，标记 system 和倒数第 2 条 assistant 消息
+func loadCacheConfig() CacheConfig {
+	cfg := CacheConfig{
+		Enabled: getEnvBool("PROMPT_CACHE_ENABLED", true),
+		TTL:     "1h",
+	}
+
+	switch ttl := strings.TrimSpace(os.Getenv("PROMPT_CACHE_TTL")); ttl {
+	case "":
+	case "5m", "1h":
+		cfg.TTL = ttl
+	default:
+		slog.Warn("invalid PROMPT_CACHE_TTL, using 1h", "value", ttl)
+	}
+
+	targets := os.Getenv("PROMPT_CACHE_TARGETS")
+	if targets == "" {
+		targets = "system,assistant"
+	}
+	cfg.Sticky = getEnvBool("PROMPT_CACHE_STICKY", false)
+	userTurns := getEnvInt("PROMPT_CACHE_USER_TURNS", 1)
+	for _, target := range strings.Split(targets, ",") {
+		switch strings.ToLower(strings.TrimSpace(target)) {
+		case "system":
+			cfg.System = true
+		case "tools":
+			cfg.Tools = true
+		case "documents":
+			cfg.Documents = true
+		case "assistant":
+			cfg.Assistant = true
+		case "user":
+			cfg.UserTurns = userTurns
+		case "":
+		default:
+			slog.Warn("unknown PROMPT_CACHE_TARGETS entry ignored", "target", target)
+		}
+	}
+
+	return cfg
+}
+
+func (cfg CacheConfig) cacheControl() *CacheControl {
+	return &CacheControl{Type: "ephemeral", TTL: cfg.TTL}
+}
+
+// applyCacheControl 按策略为请求添加 cache_control 标记
+// 超过 Anthropic 的 4 个标记上限时，优先保留 system、tools、documents、assistant，再按从后往前的顺序标记 user 消息
+// 提示词模板的前缀已自带标记，计入上限；返回请求中的标记总数
+func applyCacheControl(req *AnthropicRequest, cfg CacheConfig) int {
+	if !cfg.Enabled {
+		return 0
+	}
+	used := 0
+	for _, block := range req.System {
+		if block.CacheControl != nil {
+			used++
+		}
+	}
+
+	if cfg.System && len(req.System) > 0 && req.System[len(req.System)-1].CacheControl == nil {
+		req.System[len(req.System)-1].CacheControl = cfg.cacheControl()
+		used++
+		slog.Debug("added cache_control to system", "ttl", cfg.TTL)
+	}
+
+	if cfg.Tools && len(req.Tools) > 0 && used < maxCacheBreakpoints {
+		if tool, ok := req.Tools[len(req.Tools)-1].(AnthropicTool); ok {
+			tool.CacheControl = cfg.cacheControl()
+			req.Tools[len(req.Tools)-1] = tool
+			used++
+			slog.Debug("added cache_control to last tool", "ttl", cfg.TTL)
+		}
+	}
+
+	if cfg.Documents && used < maxCacheBreakpoints {
+		if document := lastDocumentBlock(req); document != nil {
+			document.CacheControl = cfg.cacheControl()
+			used++
+			slog.Debug("added cache_control to last document", "ttl", cfg.TTL)
+		}
+	}
+
+	if cfg.Assistant && len(req.Messages) >= 2 && used < maxCacheBreakpoints {
+		secondLast := &req.Messages[len(req.Messages)-2]
+		if secondLast.Role == "assistant" && addCacheControlToMessage(secondLast, cfg.cacheControl()) {
+			used++
+			slog.Debug("added cache_control to second-to-last assistant message", "ttl", cfg.TTL)
+		}
+	}
+
+	marked := 0
+	for i := len(req.Messages) - 1; i >= 0 && marked < cfg.UserTurns && used < maxCacheBreakpoints; i-- {
+		if req.Messages[i].Role != "user" {
+			continue
+		}
+		if addCacheControlToMessage(&req.Messages[i], cfg.cacheControl()) {
+			marked++
+			used++
+		}
+	}
+	if marked > 0 {
+		slog.Debug("added cache_control to user messages", "count", marked, "ttl", cfg.TTL)
+	}
+	return used
+}
+
+// lastDocumentBlock 返回请求中最后一个 document 块，没有时返回 nil
+func lastDocumentBlock(req *AnthropicRequest) *AnthropicContent {
+	for i := len(req.Messages) - 1; i >= 0; i-- {
+		content, ok := req.Messages[i].Content.([]AnthropicContent)
+		if !ok {
+			continue
+		}
+		for j := len(content) - 1; j >= 0; j-- {
+			if content[j].Type == "document" {
+				return &content[j]
+			}
+		}
+	}
+	return nil
+}
+
+// addCacheControlToMessage 为消息的最后一个内容块添加 cache_control，返回是否添加成功
+func addCacheControlToMessage(msg *AnthropicMessage, cacheControl *CacheControl) bool {
+	switch content := msg.Content.(type) {
+	case []AnthropicContent:
+		if len(content) > 0 {
+			content[len(content)-1].CacheControl = cacheControl
+			msg.Content = content
+			return true
+		}
+	case string:
+		if content != "" {
+			msg.Content = []AnthropicContent{
+				{
+					Type:         "text",
+					Text:         stringPtr(content),
+					CacheControl: cacheControl,
+				},
+			}
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// cacheSessionKey gin context 中的会话 key，用于在记录用量时更新会话的缓存命中率
+const cacheSessionKey = "cache_session"
+
+// CacheSessions 会话粘性的 cache 断点（PROMPT_CACHE_STICKY）
+// 默认策略按相对位置（倒数第 2 条 assistant、最后 N 条 user）放置断点，长的 agent 对话中每轮新增的内容块较多时，
+// 新断点距离上一轮写入的缓存超过 Anthropic 的回溯范围（约 20 个内容块），导致缓存未命中。
+// 这里按 API Key + user 字段（Cursor 等客户端以会话为单位设置）记住上一轮断点所在的消息，
+// 下一轮在同一位置放置断点读取缓存，同时在最后一条消息上写入新的缓存
+type CacheSessions struct {
+	mu        sync.Mutex
+	sessions  map[string]*cacheSession
+	lastSweep time.Time
+}
+
+type cacheSession struct {
+	breakpoint int      // 上一轮写入断点所在的消息下标
+	prefixHash [32]byte // messages[:breakpoint+1] 的哈希，用于确认本轮是同一对话的延续
+	lastSeen   time.Time
+
+	// 累计用量，用于计算会话的缓存命中率
+	requests   int
+	input      int
+	cacheRead  int
+	cacheWrite int
+}
+
+func NewCacheSessions() *CacheSessions {
+	return &CacheSessions{sessions: make(map[string]*cacheSession)}
+}
+
+// sessionID API Key 和 user 的哈希，日志中不出现原始值
+func sessionID(apiKey, user string) string {
+	sum := sha256.Sum256([]byte(apiKey + "\x00" + user))
+	return hex.EncodeToString(sum[:8])
+}
+
+// hashMessages 计算消息前缀的哈希（在添加 cache_control 之前调用）
+func hashMessages(messages []AnthropicMessage) [32]byte {
+	data, _ := json.Marshal(messages)
+	return sha256.Sum256(data)
+}
+
+// applySessionCache 添加 cache_control：开启 PROMPT_CACHE_STICKY 且请求带 user 时按会话放置消息断点，否则使用默认策略
+func (h *ProxyHandler) applySessionCache(c *gin.Context, req *AnthropicRequest, cfg CacheConfig, apiKey, user string, reqID string) {
+	if !cfg.Enabled || !cfg.Sticky || user == "" || len(req.Messages) == 0 {
+		applyCacheControl(req, cfg)
+		return
+	}
+	logger := reqLog(reqID)
+	id := sessionID(apiKey, user)
+	c.Set(cacheSessionKey, id)
+
+	// 断点需要的哈希在添加 cache_control 之前计算，保证与下一轮的计算结果一致
+	last := len(req.Messages) - 1
+	readAt := -1
+	ttl := cacheTTL(cfg)
+	if prev, ok := h.cacheSessions.lookup(id, ttl); ok && prev.breakpoint < last && hashMessages(req.Messages[:prev.breakpoint+1]) == prev.prefixHash {
+		readAt = prev.breakpoint
+	}
+	writeHash := hashMessages(req.Messages)
+
+	// system / tools / documents 仍按配置标记，消息断点由会话决定
+	base := cfg
+	base.Assistant = false
+	base.UserTurns = 0
+	used := applyCacheControl(req, base)
+
+	if used < maxCacheBreakpoints && addCacheControlToMessage(&req.Messages[last], cfg.cacheControl()) {
+		used++
+	}
+	if readAt >= 0 && used < maxCacheBreakpoints && addCacheControlToMessage(&req.Messages[readAt], cfg.cacheControl()) {
+		used++
+	}
+	logger.Debug("session cache breakpoints", "session", id, "read_at", readAt, "write_at", last, "breakpoints", used)
+
+	h.cacheSessions.store(id, last, writeHash)
+}
+
+// cacheTTL 缓存的有效期，超过后会话记录的断点不再有意义
+func cacheTTL(cfg CacheConfig) time.Duration {
+	if cfg.TTL == "5m" {
+		return 5 * time.Minute
+	}
+	return time.Hour
+}
+
+func (s *CacheSessions) lookup(id string, ttl time.Duration) (cacheSession, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastSweep) > time.Minute {
+		for key, session := range s.sessions {
+			if now.Sub(session.lastSeen) > ttl {
+				delete(s.sessions, key)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	session, ok := s.sessions[id]
+	if !ok || now.Sub(session.lastSeen) > ttl {
+		return cacheSession{}, false
+	}
+	return *session, true
+}
+
+func (s *CacheSessions) store(id string, breakpoint int, prefixHash [32]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok {
+		session = &cacheSession{}
+		s.sessions[id] = session
+	}
+	session.breakpoint = breakpoint
+	session.prefixHash = prefixHash
+	session.lastSeen = time.Now()
+}
+
+// observeSessionCache 请求按会话放置了断点时，累计会话用量并记录命中率
+func (h *ProxyHandler) observeSessionCache(c *gin.Context, usage *AnthropicUsage, reqID string) {
+	if session := c.GetString(cacheSessionKey); session != "" {
+		h.cacheSessions.observe(session, usage, reqID)
+	}
+}
+
+// observe 累计会话的用量并记录命中率：缓存读取的 token 占全部输入 token 的比例
+func (s *CacheSessions) observe(id string, usage *AnthropicUsage, reqID string) {
+	s.mu.Lock()
+	session, ok := s.sessions[id]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	session.requests++
+	session.input += usage.InputTokens
+	session.cacheRead += usage.CacheReadInputTokens
+	session.cacheWrite += usage.CacheCreationInputTokens
+	stats := *session
+	s.mu.Unlock()
+
+	reqLog(reqID).Info("session cache",
+		"session", id,
+		"requests", stats.requests,
+		"hit_rate", cacheHitRate(usage.InputTokens, usage.CacheReadInputTokens, usage.CacheCreationInputTokens),
+		"session_hit_rate", cacheHitRate(stats.input, stats.cacheRead, stats.cacheWrite))
+}
+
+func cacheHitRate(input, cacheRead, cacheWrite int) float64 {
+	total := input + cacheRead + cacheWrite
+	if total == 0 {
+		return 0
+	}
+	return float64(cacheRead) / float64(total)
+}
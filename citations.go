@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// citationFootnotes 将 Anthropic 文本块的 citations 转换为脚注标记和 OpenAI annotations
+// 同一来源（URL、文档或搜索结果）在整个响应中只分配一个编号
+type citationFootnotes struct {
+	sources     []citationSource
+	numbers     map[string]int
+	annotations []map[string]interface{}
+}
+
+// citationSource 被引用的来源，url 为空表示请求中提供的文档
+type citationSource struct {
+	key   string
+	title string
+	url   string
+}
+
+// citationSourceOf 根据引用类型确定来源
+// web_search_result_location 指向网页，search_result_location 指向搜索结果，其余（char/page/content_block_location）指向文档
+func citationSourceOf(citation map[string]interface{}) citationSource {
+	title, _ := citation["title"].(string)
+	switch citation["type"] {
+	case "web_search_result_location":
+		url, _ := citation["url"].(string)
+		return citationSource{key: "url:" + url, title: title, url: url}
+	case "search_result_location":
+		source, _ := citation["source"].(string)
+		src := citationSource{key: fmt.Sprintf("search_result:%v:%s", citation["search_result_index"], source), title: title}
+		if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+			src.url = source
+		} else if title == "" {
+			src.title = source
+		}
+		return src
+	default:
+		docTitle, _ := citation["document_title"].(string)
+		src := citationSource{key: fmt.Sprintf("document:%v", citation["document_index"]), title: docTitle}
+		if index, ok := citation["document_index"].(float64); ok && docTitle == "" {
+			src.title = fmt.Sprintf("document %d", int(index)+1)
+		}
+		return src
+	}
+}
+
+// cite 为内容中 [start, end) 范围（按字符计）的文本记录引用
+// 返回追加在该文本后的脚注标记（如 "[1][2]"）和本次新增的 annotations
+func (f *citationFootnotes) cite(citations []map[string]interface{}, start, end int) (string, []map[string]interface{}) {
+	if f.numbers == nil {
+		f.numbers = make(map[string]int)
+	}
+
+	var marker strings.Builder
+	var added []map[string]interface{}
+	marked := make(map[int]bool)
+	for _, citation := range citations {
+		src := citationSourceOf(citation)
+		number, ok := f.numbers[src.key]
+		if !ok {
+			f.sources = append(f.sources, src)
+			number = len(f.sources)
+			f.numbers[src.key] = number
+		}
+		if !marked[number] {
+			marked[number] = true
+			fmt.Fprintf(&marker, "[%d]", number)
+		}
+		added = append(added, citationAnnotation(citation, src, start, end))
+	}
+	f.annotations = append(f.annotations, added...)
+	return marker.String(), added
+}
+
+// citationAnnotation 网页来源使用 OpenAI 的 url_citation，文档来源使用 document_citation 并保留原始位置信息
+func citationAnnotation(citation map[string]interface{}, src citationSource, start, end int) map[string]interface{} {
+	if src.url != "" {
+		return map[string]interface{}{
+			"type": "url_citation",
+			"url_citation": map[string]interface{}{
+				"start_index": start,
+				"end_index":   end,
+				"url":         src.url,
+				"title":       src.title,
+			},
+		}
+	}
+
+	detail := map[string]interface{}{
+		"start_index": start,
+		"end_index":   end,
+		"title":       src.title,
+	}
+	for key, value := range citation {
+		switch key {
+		case "type", "encrypted_index", "document_title", "title":
+		default:
+			detail[key] = value
+		}
+	}
+	return map[string]interface{}{
+		"type":              "document_citation",
+		"document_citation": detail,
+	}
+}
+
+// references 返回追加在内容末尾的来源列表，没有引用时为空
+func (f *citationFootnotes) references() string {
+	if len(f.sources) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("\n\n")
+	for i, src := range f.sources {
+		switch {
+		case src.url != "" && src.title != "":
+			fmt.Fprintf(&sb, "[%d] %s: %s\n", i+1, src.title, src.url)
+		case src.url != "":
+			fmt.Fprintf(&sb, "[%d] %s\n", i+1, src.url)
+		default:
+			fmt.Fprintf(&sb, "[%d] %s\n", i+1, src.title)
+		}
+	}
+	return sb.String()
+}
+
+// responsesAnnotations 转换为 Responses API 的格式：类型专属字段直接放在 annotation 上
+func responsesAnnotations(annotations []map[string]interface{}) []interface{} {
+	flat := make([]interface{}, 0, len(annotations))
+	for _, annotation := range annotations {
+		annotationType, _ := annotation["type"].(string)
+		item := map[string]interface{}{"type": annotationType}
+		if detail, ok := annotation[annotationType].(map[string]interface{}); ok {
+			for key, value := range detail {
+				item[key] = value
+			}
+		}
+		flat = append(flat, item)
+	}
+	return flat
+}
+
+// runeLen 内容长度按字符计算，与 annotations 的 start_index / end_index 一致
+func runeLen(s string) int {
+	return utf8.RuneCountInString(s)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultCompactionModel = "claude-haiku-4-5"
+	compactionMaxTokens    = 4096
+	compactionTTL          = 24 * time.Hour
+	// transcriptToolResultChars 摘要输入中每个工具结果保留的字符数，工具输出往往很长且大多不需要保留原文
+	transcriptToolResultChars = 4000
+)
+
+// compactionPrompt 生成摘要的 system 提示
+const compactionPrompt = "You are compacting the history of a long conversation between a user and an AI assistant " +
+	"so that the assistant can continue the work with only your summary and the most recent messages. " +
+	"Write a concise but complete summary that preserves the user's goals and requirements, decisions made, " +
+	"important facts, file paths, code identifiers, results of tool calls, errors encountered and open tasks. " +
+	"If a previous summary is given, merge it with the new messages into one summary. Output only the summary."
+
+// Compactions 按会话（API Key + user 字段）缓存的历史摘要
+// 同一会话后续的请求以相同的历史开头，摘要仍然够用时直接复用，不再调用摘要模型，摘要在多轮之间保持不变也不影响 prompt cache
+type Compactions struct {
+	mu        sync.Mutex
+	sessions  map[string]*compaction
+	lastSweep time.Time
+}
+
+type compaction struct {
+	cut        int      // 被摘要替换的消息数
+	prefixHash [32]byte // messages[:cut] 的哈希，用于确认本轮是同一对话的延续
+	summary    string
+	lastSeen   time.Time
+}
+
+func NewCompactions() *Compactions {
+	return &Compactions{sessions: make(map[string]*compaction)}
+}
+
+// lookup 返回会话上次的摘要，要求本轮消息以被摘要的历史开头，且之后仍有可以作为第一条消息的 user 消息
+func (s *Compactions) lookup(id string, messages []AnthropicMessage) (compaction, bool) {
+	s.mu.Lock()
+	now := time.Now()
+	if now.Sub(s.lastSweep) > time.Minute {
+		for key, session := range s.sessions {
+			if now.Sub(session.lastSeen) > compactionTTL {
+				delete(s.sessions, key)
+			}
+		}
+		s.lastSweep = now
+	}
+	session, ok := s.sessions[id]
+	var prev compaction
+	if ok {
+		prev = *session
+	}
+	s.mu.Unlock()
+
+	if !ok || prev.cut >= len(messages) || !isTurnStart(messages[prev.cut]) {
+		return compaction{}, false
+	}
+	if hashMessages(messages[:prev.cut]) != prev.prefixHash {
+		return compaction{}, false
+	}
+	return prev, true
+}
+
+func (s *Compactions) store(id string, cut int, prefixHash [32]byte, summary string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[id] = &compaction{cut: cut, prefixHash: prefixHash, summary: summary, lastSeen: time.Now()}
+}
+
+// touch 复用摘要时刷新会话的过期时间
+func (s *Compactions) touch(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if session, ok := s.sessions[id]; ok {
+		session.lastSeen = time.Now()
+	}
+}
+
+// compactHistory 把较早的轮次压缩为摘要，保留的最近轮次不超过 limit 的一半
+// 会话上次的摘要之后又有新的轮次需要压缩时，只把新增部分和上次的摘要一起交给摘要模型；失败时返回 false
+func (h *ProxyHandler) compactHistory(c *gin.Context, req *AnthropicRequest, costs []int, fixed, limit int, apiKey, user string, reqID string) bool {
+	logger := reqLog(reqID)
+	id := sessionID(apiKey, user)
+
+	prev, hasPrev := h.compactions.lookup(id, req.Messages)
+	if hasPrev {
+		rest := fixed + estimateTextTokens(prev.summary)
+		for _, cost := range costs[prev.cut:] {
+			rest += cost
+		}
+		if rest <= limit {
+			h.compactions.touch(id)
+			logger.Info("context compaction reused", "session", id, "summarized_messages", prev.cut, "estimate", rest, "limit", limit)
+			replaceWithSummary(c, req, prev.cut, prev.summary)
+			return true
+		}
+	}
+
+	kept, _ := truncateHistory(req.Messages, costs, fixed, limit/2)
+	cut := len(req.Messages) - len(kept)
+	if cut == 0 {
+		return false
+	}
+
+	from, previous := 0, ""
+	if hasPrev && prev.cut <= cut {
+		from, previous = prev.cut, prev.summary
+	}
+	start := time.Now()
+	summary, err := h.summarizeHistory(c, req.Messages[from:cut], previous, apiKey, reqID)
+	if err != nil {
+		logger.Warn("context compaction failed", "model", h.overflow.CompactionModel, "error", err)
+		return false
+	}
+	h.compactions.store(id, cut, hashMessages(req.Messages[:cut]), summary)
+	logger.Info("context compacted", "session", id, "model", h.overflow.CompactionModel,
+		"summarized_messages", cut, "incremental", from > 0, "summary_tokens", estimateTextTokens(summary),
+		"duration", time.Since(start))
+	replaceWithSummary(c, req, cut, summary)
+	return true
+}
+
+// summarizeHistory 调用摘要模型压缩消息，previous 为同一会话上次的摘要
+// 摘要请求同样经过 guardrails 和转换插件（如 pii 脱敏），摘要模型只看到占位符，返回的摘要再由响应插件还原
+func (h *ProxyHandler) summarizeHistory(c *gin.Context, messages []AnthropicMessage, previous string, apiKey string, reqID string) (string, error) {
+	prompt := "<transcript>\n" + renderTranscript(messages) + "</transcript>"
+	if previous != "" {
+		prompt = "<previous_summary>\n" + previous + "\n</previous_summary>\n\n" + prompt
+	}
+	summaryReq := &AnthropicRequest{
+		Model:     h.overflow.CompactionModel,
+		MaxTokens: compactionMaxTokens,
+		System:    []AnthropicSystemBlock{{Type: "text", Text: compactionPrompt}},
+		Messages:  []AnthropicMessage{{Role: "user", Content: prompt}},
+	}
+	if err := h.transformHelperRequest(c, &AnthropicRequest{Messages: messages}, summaryReq, reqID); err != nil {
+		return "", err
+	}
+	result := h.completeOnce(c.Request.Context(), summaryReq, apiKey, reqID)
+	if result.err != nil {
+		return "", result.err
+	}
+	if err := h.transformHelperResponse(c, result.resp, reqID); err != nil {
+		return "", err
+	}
+
+	var summary strings.Builder
+	for _, block := range result.resp.Content {
+		if block.Type == "text" && block.Text != nil {
+			summary.WriteString(*block.Text)
+		}
+	}
+	if strings.TrimSpace(summary.String()) == "" {
+		return "", errors.New("empty summary")
+	}
+	reqLog(reqID).Debug("compaction usage", "input_tokens", result.resp.Usage.InputTokens, "output_tokens", result.resp.Usage.OutputTokens)
+	return strings.TrimSpace(summary.String()), nil
+}
+
+// replaceWithSummary 用摘要替换前 cut 条消息：摘要放在保留的第一条 user 消息开头，
+// 并通过 x-proxy-context-compacted 告知客户端被替换的消息数
+func replaceWithSummary(c *gin.Context, req *AnthropicRequest, cut int, summary string) {
+	first := req.Messages[cut]
+	blocks := []AnthropicContent{{Type: "text", Text: stringPtr("<conversation_summary>\n" + summary + "\n</conversation_summary>")}}
+	switch content := first.Content.(type) {
+	case string:
+		blocks = append(blocks, AnthropicContent{Type: "text", Text: stringPtr(content)})
+	case []AnthropicContent:
+		blocks = append(blocks, content...)
+	}
+	first.Content = blocks
+
+	messages := make([]AnthropicMessage, 0, len(req.Messages)-cut)
+	messages = append(messages, first)
+	req.Messages = append(messages, req.Messages[cut+1:]...)
+	c.Header("x-proxy-context-compacted", strconv.Itoa(cut))
+}
+
+// renderTranscript 把要压缩的消息渲染为文本，工具调用和结果以标记形式保留，图片和文档只保留占位
+func renderTranscript(messages []AnthropicMessage) string {
+	var b strings.Builder
+	for _, msg := range messages {
+		b.WriteString(msg.Role)
+		b.WriteString(":\n")
+		switch content := msg.Content.(type) {
+		case string:
+			b.WriteString(content)
+			b.WriteString("\n")
+		case []AnthropicContent:
+			for _, block := range content {
+				if text := renderBlock(block); text != "" {
+					b.WriteString(text)
+					b.WriteString("\n")
+				}
+			}
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// renderBlock 渲染单个内容块，thinking 不进入摘要
+func renderBlock(block AnthropicContent) string {
+	switch block.Type {
+	case "text":
+		if block.Text != nil {
+			return *block.Text
+		}
+	case "tool_use":
+		input, _ := json.Marshal(block.Input)
+		return fmt.Sprintf("[tool call %s %s]", block.Name, input)
+	case "tool_result":
+		var result string
+		switch content := block.Content.(type) {
+		case string:
+			result = content
+		case []AnthropicContent:
+			parts := make([]string, 0, len(content))
+			for _, b := range content {
+				parts = append(parts, renderBlock(b))
+			}
+			result = strings.Join(parts, "\n")
+		}
+		if runes := []rune(result); len(runes) > transcriptToolResultChars {
+			result = string(runes[:transcriptToolResultChars]) + "..."
+		}
+		return "[tool result]\n" + result
+	case "image":
+		return "[image]"
+	case "document":
+		return "[document " + block.Title + "]"
+	case "thinking", "redacted_thinking":
+		return ""
+	default:
+		return "[" + block.Type + "]"
+	}
+	return ""
+}
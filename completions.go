@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CompletionRequest 旧版 OpenAI Completions API 请求（/v1/completions）
+type CompletionRequest struct {
+	Model       string      `json:"model"`
+	Prompt      interface{} `json:"prompt"` // string or []string
+	MaxTokens   int         `json:"max_tokens,omitempty"`
+	Temperature *float64    `json:"temperature,omitempty"`
+	TopP        float64     `json:"top_p,omitempty"`
+	TopK        int         `json:"top_k,omitempty"`
+	Stream      bool        `json:"stream,omitempty"`
+	Echo        bool        `json:"echo,omitempty"`
+	Stop        interface{} `json:"stop,omitempty"` // string or []string
+	User        string      `json:"user,omitempty"`
+	Seed        *int64      `json:"seed,omitempty"`
+
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+}
+
+type CompletionChoice struct {
+	Text         string      `json:"text"`
+	Index        int         `json:"index"`
+	Logprobs     interface{} `json:"logprobs"`
+	FinishReason *string     `json:"finish_reason"`
+}
+
+type CompletionResponse struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object"`
+	Created int64              `json:"created"`
+	Model   string             `json:"model"`
+	Choices []CompletionChoice `json:"choices"`
+	Usage   *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+		TotalTokens      int `json:"total_tokens"`
+	} `json:"usage,omitempty"`
+	// SystemFingerprint 请求带 seed 时返回
+	SystemFingerprint string `json:"system_fingerprint,omitempty"`
+}
+
+// HandleCompletions 将旧版 text completion 请求转换为单条 user 消息的 Anthropic 请求
+func (h *ProxyHandler) HandleCompletions(c *gin.Context) {
+	reqID := requestID(c)
+	logger := reqLog(reqID)
+
+	apiKey, ok := h.extractAPIKey(c, reqID)
+	if !ok {
+		return
+	}
+
+	_, parseSpan := startSpan(c.Request.Context(), "parse request", spanKindInternal)
+	rawBody, ok := readRequestBody(c, reqID)
+	if !ok {
+		parseSpan.SetError("invalid request body")
+		parseSpan.End()
+		return
+	}
+	parseSpan.SetAttr("body_bytes", len(rawBody))
+
+	logger.Debug("raw completions request", "body", string(rawBody))
+
+	var compReq CompletionRequest
+	if err := json.Unmarshal(rawBody, &compReq); err != nil {
+		parseSpan.SetError(err.Error())
+		parseSpan.End()
+		logger.Error("failed to parse request", "error", err)
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	parseSpan.End()
+
+	if !h.checkUnknownFields(c, rawBody, compReq, reqID) {
+		return
+	}
+	if !h.checkUnsupportedParams(c, rawBody, reqID) {
+		return
+	}
+
+	prompt, err := getPromptText(compReq.Prompt)
+	if err != nil {
+		logger.Warn("invalid prompt", "error", err)
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// 复用 chat 的转换逻辑：prompt 作为唯一的 user 消息
+	openaiReq := OpenAIRequest{
+		Model:       compReq.Model,
+		Messages:    []OpenAIMessage{{Role: "user", Content: prompt}},
+		MaxTokens:   compReq.MaxTokens,
+		Temperature: compReq.Temperature,
+		TopP:        compReq.TopP,
+		TopK:        compReq.TopK,
+		Stream:      compReq.Stream,
+		Stop:        compReq.Stop,
+		User:        compReq.User,
+
+		StreamOptions: compReq.StreamOptions,
+	}
+	if mapped := mapLocalInferenceParams(rawBody, &openaiReq); len(mapped) > 0 {
+		logger.Info("local inference parameters mapped", "params", mapped)
+	}
+	c.Set(streamKey, openaiReq.Stream)
+	logger.Info("completions request", "model", openaiReq.Model, "stream", openaiReq.Stream, "max_tokens", openaiReq.MaxTokens)
+
+	// temperature/top_p 转换到 Anthropic 支持的范围
+	if !applySampling(c, &openaiReq, h.temperatureMode, reqID) {
+		return
+	}
+
+	settings := h.settings()
+	profile := h.modelProfile(openaiReq.Model)
+	openaiReq.Model = h.mapRequestModel(c, settings, openaiReq.Model, reqID)
+
+	if !h.checkRateLimit(c, apiKey, openaiReq.Model, reqID) {
+		return
+	}
+	release, ok := h.acquireConcurrency(c, apiKey, reqID)
+	if !ok {
+		return
+	}
+	defer release()
+
+	_, convertSpan := startSpan(c.Request.Context(), "convert request", spanKindInternal)
+	anthropicReq, err := ConvertOpenAIToAnthropic(openaiReq, settings.MaxTokensMapping, apiKey)
+	if err != nil {
+		convertSpan.SetError(err.Error())
+		convertSpan.End()
+		logger.Error("conversion failed", "error", err)
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	applyThinking(anthropicReq, h.thinkingBudgets, reqID)
+	applyModelProfile(anthropicReq, profile, reqID)
+	h.clampMaxTokens(c, anthropicReq, reqID)
+	acceptSeed(c, compReq.Seed, anthropicReq.Model, reqID)
+	h.applyPromptTemplate(anthropicReq, settings.Cache, reqID)
+	h.applySessionCache(c, anthropicReq, settings.Cache, apiKey, openaiReq.User, reqID)
+	convertSpan.SetAttr("gen_ai.request.model", anthropicReq.Model)
+	convertSpan.End()
+
+	httpResp, ok := h.sendAnthropicRequest(c, anthropicReq, apiKey, reqID)
+	if !ok {
+		return
+	}
+	defer httpResp.Body.Close()
+
+	// echo 模式下在输出前附加 prompt
+	prefix := ""
+	if compReq.Echo {
+		prefix = prompt
+	}
+
+	if compReq.Stream {
+		h.handleCompletionStream(c, httpResp, openaiReq.Model, prefix, openaiReq.includeUsage(), reqID)
+	} else {
+		h.handleCompletionResponse(c, httpResp, prefix, reqID)
+	}
+}
+
+func (h *ProxyHandler) handleCompletionResponse(c *gin.Context, httpResp *http.Response, prefix string, reqID string) {
+	bodyBytes, err := readResponseBody(httpResp.Body, h.maxResponseBytes)
+	if err != nil {
+		reqLog(reqID).Error("read response body failed", "error", err)
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var anthropicResp AnthropicResponse
+	if err := json.Unmarshal(bodyBytes, &anthropicResp); err != nil {
+		reqLog(reqID).Error("parse anthropic response failed", "error", err)
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	h.recordUsage(c, reqID, anthropicResp.Model, &anthropicResp.Usage)
+	if !h.transformResponse(c, &anthropicResp, reqID) {
+		return
+	}
+
+	resp := ConvertAnthropicToCompletion(anthropicResp, prefix)
+	resp.Model = responseModel(c, resp.Model)
+	resp.SystemFingerprint = c.GetString(systemFingerprintKey)
+	c.JSON(http.StatusOK, resp)
+}
+
+// ConvertAnthropicToCompletion 将 Anthropic 响应转换为 text_completion 格式
+func ConvertAnthropicToCompletion(anthResp AnthropicResponse, prefix string) CompletionResponse {
+	var text strings.Builder
+	text.WriteString(prefix)
+	for _, content := range anthResp.Content {
+		if content.Type == "text" && content.Text != nil {
+			text.WriteString(*content.Text)
+		}
+	}
+
+	finishReason := convertStopReason(anthResp.StopReason)
+	resp := CompletionResponse{
+		ID:      anthResp.ID,
+		Object:  "text_completion",
+		Created: getCurrentTimestamp(),
+		Model:   anthResp.Model,
+		Choices: []CompletionChoice{
+			{
+				Text:         text.String(),
+				Index:        0,
+				FinishReason: &finishReason,
+			},
+		},
+	}
+	resp.Usage = &struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+		TotalTokens      int `json:"total_tokens"`
+	}{
+		PromptTokens:     anthResp.Usage.InputTokens,
+		CompletionTokens: anthResp.Usage.OutputTokens,
+		TotalTokens:      anthResp.Usage.InputTokens + anthResp.Usage.OutputTokens,
+	}
+	return resp
+}
+
+func (h *ProxyHandler) handleCompletionStream(c *gin.Context, httpResp *http.Response, model string, prefix string, includeUsage bool, reqID string) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		reqLog(reqID).Error("streaming not supported by client")
+		respondError(c, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	var messageID string
+	usage := &AnthropicUsage{}
+	fingerprint := c.GetString(systemFingerprintKey)
+	created := getCurrentTimestamp()
+	start := time.Now()
+	newChunk := func(text string, finishReason *string) CompletionResponse {
+		return CompletionResponse{
+			ID:      messageID,
+			Object:  "text_completion",
+			Created: created,
+			Model:   responseModel(c, model),
+			Choices: []CompletionChoice{
+				{Text: text, Index: 0, FinishReason: finishReason},
+			},
+			SystemFingerprint: fingerprint,
+		}
+	}
+
+	_, relaySpan := startSpan(c.Request.Context(), "stream relay", spanKindInternal)
+	defer relaySpan.End()
+
+	finishSent, upstreamFailed := false, false
+	tc := h.streamTransformContext(c, reqID)
+	defer closeOnDisconnect(c, httpResp.Body)()
+	scanner := newHeartbeatScanner(httpResp.Body, h.heartbeatInterval, h.streamIdleTimeout, ssePing(c, flusher))
+	defer scanner.Stop()
+	for scanner.Scan() {
+		data := scanner.Event().Data
+		if data == "[DONE]" || data == "" {
+			continue
+		}
+
+		var event map[string]interface{}
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			reqLog(reqID).Warn("failed to parse event", "error", err, "data", data)
+			continue
+		}
+		for _, event := range h.transformEvent(tc, event) {
+			switch event["type"] {
+			case "message_start":
+				if msg, ok := event["message"].(map[string]interface{}); ok {
+					messageID, _ = msg["id"].(string)
+					if u, ok := msg["usage"].(map[string]interface{}); ok {
+						usage = parseUsage(u)
+					}
+				}
+				if prefix != "" {
+					sendSSE(c, newChunk(prefix, nil), flusher)
+				}
+
+			case "content_block_delta":
+				if delta, ok := event["delta"].(map[string]interface{}); ok {
+					if text, ok := delta["text"].(string); ok && delta["type"] == "text_delta" {
+						sendSSE(c, newChunk(text, nil), flusher)
+					}
+				}
+
+			case "message_delta":
+				if u, ok := event["usage"].(map[string]interface{}); ok {
+					mergeDeltaUsage(usage, parseUsage(u))
+				}
+				if delta, ok := event["delta"].(map[string]interface{}); ok {
+					if stopReason, ok := delta["stop_reason"].(string); ok {
+						finishReason := convertStopReason(stopReason)
+						sendSSE(c, newChunk("", &finishReason), flusher)
+						finishSent = true
+					}
+				}
+
+			case "error":
+				reqLog(reqID).Error("upstream stream error", "body", data)
+				sendSSE(c, streamEventError(data, reqID), flusher)
+				upstreamFailed = true
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil && !finishSent && !upstreamFailed && c.Request.Context().Err() == nil {
+		sendSSE(c, streamReadError(err, reqID), flusher)
+	}
+
+	logStreamEnd(c, reqID, scanner.Err())
+	if err := scanner.Err(); err != nil {
+		relaySpan.SetError(err.Error())
+	}
+
+	h.recordUsage(c, reqID, model, usage)
+	metrics.ObserveStream(model, usage.OutputTokens, time.Since(start))
+
+	// stream_options.include_usage：最后单独发送 usage chunk
+	if includeUsage {
+		final := newChunk("", nil)
+		final.Choices = []CompletionChoice{}
+		final.Usage = &struct {
+			PromptTokens     int `json:"prompt_tokens"`
+			CompletionTokens int `json:"completion_tokens"`
+			TotalTokens      int `json:"total_tokens"`
+		}{usage.InputTokens, usage.OutputTokens, usage.InputTokens + usage.OutputTokens}
+		sendSSE(c, final, flusher)
+	}
+
+	fmt.Fprintf(c.Writer, "data: [DONE]\n\n")
+	flusher.Flush()
+}
+
+// getPromptText 从 prompt 字段中提取文本，仅支持单个 prompt
+func getPromptText(prompt interface{}) (string, error) {
+	switch v := prompt.(type) {
+	case string:
+		return v, nil
+	case []interface{}:
+		if len(v) == 1 {
+			if str, ok := v[0].(string); ok {
+				return str, nil
+			}
+		}
+		return "", fmt.Errorf("only a single string prompt is supported")
+	case nil:
+		return "", fmt.Errorf("prompt is required")
+	default:
+		return "", fmt.Errorf("unsupported prompt type %T", prompt)
+	}
+}
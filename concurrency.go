@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ConcurrencyConfig 每个身份的并发上限，超出的请求排队等待而不是直接打到上游
+type ConcurrencyConfig struct {
+	MaxConcurrent int           // 每个身份同时进行的请求数，0 表示不限制
+	MaxQueue      int           // 每个身份最多排队的请求数，超出时直接返回 429，0 表示不排队
+	QueueTimeout  time.Duration // 排队超过该时间返回 429
+	ByIP          bool          // 与限流相同，按客户端 IP 而不是 API Key 区分
+}
+
+// loadConcurrencyConfig 从环境变量读取并发限制配置
+func loadConcurrencyConfig(byIP bool) ConcurrencyConfig {
+	return ConcurrencyConfig{
+		MaxConcurrent: getEnvInt("MAX_CONCURRENT_PER_KEY", 0),
+		MaxQueue:      getEnvIntOrOff("MAX_QUEUE_PER_KEY", 32),
+		QueueTimeout:  getEnvSeconds("QUEUE_TIMEOUT_SECONDS", 60*time.Second),
+		ByIP:          byIP,
+	}
+}
+
+var (
+	errQueueFull    = errors.New("too many concurrent requests for this key and the queue is full")
+	errQueueTimeout = errors.New("timed out waiting for a concurrency slot for this key")
+)
+
+// keySlots 单个身份的并发槽位，refs 为持有或等待槽位的请求数，归零时回收
+type keySlots struct {
+	sem     chan struct{}
+	waiting int
+	refs    int
+}
+
+// ConcurrencyLimiter 按身份限制并发，等待者按到达顺序获得槽位
+type ConcurrencyLimiter struct {
+	cfg   ConcurrencyConfig
+	mu    sync.Mutex
+	slots map[string]*keySlots
+}
+
+func NewConcurrencyLimiter(cfg ConcurrencyConfig) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{cfg: cfg, slots: make(map[string]*keySlots)}
+}
+
+// Acquire 获取一个槽位，必要时排队；成功时返回释放函数和排队时间
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context, id string) (func(), time.Duration, error) {
+	l.mu.Lock()
+	s, ok := l.slots[id]
+	if !ok {
+		s = &keySlots{sem: make(chan struct{}, l.cfg.MaxConcurrent)}
+		l.slots[id] = s
+	}
+	select {
+	case s.sem <- struct{}{}:
+		s.refs++
+		l.mu.Unlock()
+		return l.releaser(id, s), 0, nil
+	default:
+	}
+	if s.waiting >= l.cfg.MaxQueue {
+		l.mu.Unlock()
+		return nil, 0, errQueueFull
+	}
+	s.waiting++
+	s.refs++
+	l.mu.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(l.cfg.QueueTimeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case s.sem <- struct{}{}:
+	case <-timer.C:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	s.waiting--
+	if err != nil {
+		l.unrefLocked(id, s)
+	}
+	l.mu.Unlock()
+	if err != nil {
+		return nil, time.Since(start), err
+	}
+	return l.releaser(id, s), time.Since(start), nil
+}
+
+func (l *ConcurrencyLimiter) releaser(id string, s *keySlots) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-s.sem
+			l.mu.Lock()
+			l.unrefLocked(id, s)
+			l.mu.Unlock()
+		})
+	}
+}
+
+func (l *ConcurrencyLimiter) unrefLocked(id string, s *keySlots) {
+	s.refs--
+	if s.refs == 0 {
+		delete(l.slots, id)
+	}
+}
+
+// acquireConcurrency 获取并发槽位，调用方结束时调用返回的 release
+// 队列已满或排队超时时写入 429 并返回 false；客户端在排队时断开则直接返回 false
+func (h *ProxyHandler) acquireConcurrency(c *gin.Context, apiKey string, reqID string) (func(), bool) {
+	if h.concurrency == nil {
+		return func() {}, true
+	}
+	id := clientID(c, apiKey, h.concurrency.cfg.ByIP)
+
+	release, waited, err := h.concurrency.Acquire(c.Request.Context(), id)
+	switch {
+	case err == nil:
+		if waited > 0 {
+			reqLog(reqID).Info("request dequeued", "id", id, "waited", waited)
+		}
+		return release, true
+	case errors.Is(err, errQueueFull), errors.Is(err, errQueueTimeout):
+		reqLog(reqID).Warn("concurrency limit", "id", id, "error", err, "waited", waited)
+		c.Header("retry-after", fmt.Sprint(1))
+		c.Set(auditDecisionKey, auditConcurrencyLimited)
+		respondError(c, http.StatusTooManyRequests, err.Error())
+	default:
+		reqLog(reqID).Warn("client disconnected while queued", "waited", waited)
+	}
+	return nil, false
+}
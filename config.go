@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProxyConfig 代理处理器配置，由 main 从环境变量解析后传入
+type ProxyConfig struct {
+	AnthropicURL      string
+	ModelMapping      map[string]string
+	ModelGroups       map[string][]ModelGroupTarget
+	DefaultModel      string // 未映射的未知模型改用的模型，为空时原样转发
+	EchoRequestModel  bool
+	MaxTokensMapping  map[string]int
+	ThinkingBudgets   map[string]int
+	TemperatureMode   string // clamp 或 scale
+	PredictionMode    string // ignore 或 prefill
+	StrictParams      bool
+	StrictJSON        bool
+	RejectLogprobs    bool
+	StaticModels      []string
+	Routes            []Route
+	MaxN              int
+	FanoutConcurrency int
+	Retry             RetryConfig
+	MaxResponseBytes  int64
+	HeartbeatInterval time.Duration
+	UpstreamTimeout   time.Duration
+	StreamIdleTimeout time.Duration
+	KeyStore          *KeyStore
+	Authenticators    []Authenticator
+	TrustedKey        string
+	Audit             *AuditLog
+	Cache             CacheConfig
+	RateLimit         RateLimitConfig
+	Concurrency       ConcurrencyConfig
+	Readiness         ReadinessConfig
+	UsageStore        *UsageStore
+	Pricing           []ModelPrice
+	OutputLimits      []OutputLimit
+	Overflow          OverflowConfig
+	Reverse           ReverseConfig
+	StreamUpgrade     bool
+	UpgradeMinTokens  int
+	Embeddings        EmbeddingsConfig
+	Moderation        ModerationConfig
+	Guardrails        *Guardrails
+	ServerTools       []ServerTool
+	Betas             BetaConfig
+	PromptTemplates   []PromptTemplate
+	ModelProfiles     []ModelProfile
+	OllamaAPIKey      string
+	Failover          FailoverConfig
+	ResponseCache     ResponseCacheConfig
+	KeyPool           *KeyPool
+	Tape              *Tape
+	Shadow            *Shadow
+	Transformers      []Transformer
+	AdminToken        string
+	HTTPClient        HTTPClientConfig
+}
+
+// getEnvInt 读取正整数环境变量，未设置或非法时返回默认值
+func getEnvInt(key string, def int) int {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+	return def
+}
+
+// getEnvIntOrOff 与 getEnvInt 相同，但 "0" 表示关闭（返回 0）
+func getEnvIntOrOff(key string, def int) int {
+	if os.Getenv(key) == "0" {
+		return 0
+	}
+	return getEnvInt(key, def)
+}
+
+// getEnvSeconds 读取以秒为单位的环境变量
+func getEnvSeconds(key string, def time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return time.Duration(n) * time.Second
+		}
+	}
+	return def
+}
+
+// getEnvSecondsOrOff 与 getEnvSeconds 相同，但 "0" 表示关闭（返回 0）
+func getEnvSecondsOrOff(key string, def time.Duration) time.Duration {
+	if os.Getenv(key) == "0" {
+		return 0
+	}
+	return getEnvSeconds(key, def)
+}
+
+// getEnvMillis 读取以毫秒为单位的环境变量
+func getEnvMillis(key string, def time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return time.Duration(n) * time.Millisecond
+		}
+	}
+	return def
+}
+
+// getEnvBool 读取布尔环境变量（true/1/yes/on）
+func getEnvBool(key string, def bool) bool {
+	switch strings.ToLower(strings.TrimSpace(os.Getenv(key))) {
+	case "true", "1", "yes", "on":
+		return true
+	case "false", "0", "no", "off":
+		return false
+	default:
+		return def
+	}
+}
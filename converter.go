@@ -4,7 +4,7 @@ import (
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"strconv"
 	"strings"
@@ -48,12 +48,76 @@ func generateStableUserID(apiKey string, clientUser string) string {
 
 	userID := fmt.Sprintf("user_%x_account__session_%s", hash, sessionUUID)
 	
-	log.Printf("[INFO] Session TTL: %d minutes, TimeWindow: %d, UserID: %s...%s", 
-		sessionTTLMinutes, timeWindow, userID[:40], userID[len(userID)-20:])
+	slog.Debug("session user_id", "ttl_minutes", sessionTTLMinutes, "time_window", timeWindow,
+		"user_id", userID[:40]+"..."+userID[len(userID)-20:])
 	
 	return userID
 }
 
+// maxMetadataUserIDLen Anthropic metadata.user_id 的长度上限
+const maxMetadataUserIDLen = 256
+
+// metadataUserID 根据 USER_ID_MODE 生成 metadata.user_id
+// session（默认）：Claude Code 风格的稳定 user_id，见 generateStableUserID
+// hash：客户端 user 字段的 SHA-256，未传 user 时不设置
+// raw：原样转发客户端 user 字段（注意不要包含邮箱等个人信息），未传 user 时不设置
+// none：不设置 metadata
+func metadataUserID(apiKey string, clientUser string) string {
+	switch strings.ToLower(os.Getenv("USER_ID_MODE")) {
+	case "hash":
+		if clientUser == "" {
+			return ""
+		}
+		return fmt.Sprintf("%x", sha256.Sum256([]byte(clientUser)))
+	case "raw":
+		if len(clientUser) > maxMetadataUserIDLen {
+			return clientUser[:maxMetadataUserIDLen]
+		}
+		return clientUser
+	case "none":
+		return ""
+	default:
+		return generateStableUserID(apiKey, clientUser)
+	}
+}
+
+// messageMerge 连续相同角色消息的合并方式（MESSAGE_MERGE）
+// concat（默认）：纯文本消息以 MESSAGE_MERGE_SEPARATOR（默认一个空格）拼接为一条
+// parts：合并为一条消息，各消息的内容作为独立的内容块，不改动文本
+// off：不合并，原样转发（Anthropic 会把连续相同角色的消息视为同一轮）
+func messageMerge() (mode string, separator string) {
+	mode = strings.ToLower(os.Getenv("MESSAGE_MERGE"))
+	switch mode {
+	case "parts", "off":
+	default:
+		mode = "concat"
+	}
+	separator, ok := os.LookupEnv("MESSAGE_MERGE_SEPARATOR")
+	if !ok {
+		separator = " "
+	}
+	return mode, unescapeSeparator(separator)
+}
+
+// unescapeSeparator 环境变量中不方便写换行，支持 \n 和 \t
+func unescapeSeparator(s string) string {
+	return strings.NewReplacer(`\n`, "\n", `\t`, "\t").Replace(s)
+}
+
+// contentParts 把消息内容转换为内容块数组，字符串内容转为一个 text 块
+func contentParts(content interface{}) []interface{} {
+	switch c := content.(type) {
+	case nil:
+		return nil
+	case string:
+		return []interface{}{map[string]interface{}{"type": "text", "text": c}}
+	case []interface{}:
+		return c
+	default:
+		return []interface{}{c}
+	}
+}
+
 // ConvertOpenAIToAnthropic 完全参考 new-api/relay/channel/claude/relay-claude.go:75-482
 func ConvertOpenAIToAnthropic(req OpenAIRequest, maxTokensMapping map[string]int, apiKey string) (*AnthropicRequest, error) {
 	// 转换工具定义
@@ -86,51 +150,97 @@ func ConvertOpenAIToAnthropic(req OpenAIRequest, maxTokensMapping map[string]int
 	}
 
 	anthReq := &AnthropicRequest{
-		Model:       req.Model,
-		MaxTokens:   req.MaxTokens,
-		Temperature: req.Temperature,
-		TopP:        req.TopP,
-		Stream:      req.Stream,
-		Tools:       claudeTools,
+		Model:         req.Model,
+		MaxTokens:     req.MaxTokens,
+		Temperature:   req.Temperature,
+		TopP:          req.TopP,
+		TopK:          req.TopK,
+		Stream:        req.Stream,
+		Tools:         claudeTools,
+		StopSequences: convertStopSequences(req.Stop),
+		Extra:         req.ExtraBody,
+	}
+
+	// 没有工具时 Anthropic 不接受 tool_choice
+	if len(claudeTools) > 0 {
+		anthReq.ToolChoice = convertToolChoice(req.ToolChoice)
+		if req.ParallelToolCalls != nil && !*req.ParallelToolCalls {
+			anthReq.ToolChoice = disableParallelToolUse(anthReq.ToolChoice)
+		}
 	}
 
-	// 生成稳定的 metadata.user_id（基于 API Key）
-	anthReq.Metadata = &Metadata{
-		UserID: generateStableUserID(apiKey, req.User),
+	// 生成 metadata.user_id（USER_ID_MODE 控制生成方式）
+	if userID := metadataUserID(apiKey, req.User); userID != "" {
+		anthReq.Metadata = &Metadata{UserID: userID}
 	}
-	log.Printf("[INFO] Generated stable user_id: %s...%s", 
-		anthReq.Metadata.UserID[:30], 
-		anthReq.Metadata.UserID[len(anthReq.Metadata.UserID)-20:])
 
 	if anthReq.MaxTokens == 0 {
 		// 根据模型选择默认的 max_tokens
 		anthReq.MaxTokens = getDefaultMaxTokens(req.Model, maxTokensMapping)
 	}
 
+	// STRICT_FIDELITY：不改动消息文本（不拼接、不加占位符和标记），只做 Anthropic 要求的结构转换
+	strict := getEnvBool("STRICT_FIDELITY", false)
+
 	// 格式化消息：合并连续相同角色的消息
+	mergeMode, mergeSeparator := messageMerge()
+	if strict && mergeMode == "concat" {
+		mergeMode = "parts"
+	}
 	formatMessages := make([]OpenAIMessage, 0)
 	var lastMessage OpenAIMessage
 	lastMessage.Role = "tool"
+	inConversation := false
 
-	for _, message := range req.Messages {
+	for i, message := range req.Messages {
 		if message.Role == "" {
 			message.Role = "user"
 		}
+		// developer 是新版 OpenAI 模型中 system 的别名
+		if message.Role == "developer" {
+			message.Role = "system"
+		}
 
-		// 合并连续相同角色的消息（tool 除外）
-		if lastMessage.Role == message.Role && lastMessage.Role != "tool" {
-			if isStringContent(lastMessage.Content) && isStringContent(message.Content) {
-				// 合并文本内容
-				combined := fmt.Sprintf("%s %s", getStringContent(lastMessage.Content), getStringContent(message.Content))
-				message.Content = strings.Trim(combined, "\"")
-				// 删除上一条消息
+		// 只有开头的 system 消息放入 Anthropic 的 system，对话中间的 system 消息转为带标记的 user 文本，保留原有顺序
+		// 严格模式下原样转为 user 消息，不加标记
+		if message.Role == "system" && inConversation && strict {
+			message = OpenAIMessage{Role: "user", Content: message.Content}
+			slog.Debug("converted mid-conversation system message to user message")
+		} else if message.Role == "system" && inConversation {
+			message = OpenAIMessage{
+				Role:    "user",
+				Content: "<system_message>\n" + strings.Join(systemTexts(message.Content), "\n") + "\n</system_message>",
+			}
+			slog.Debug("converted mid-conversation system message to user text")
+		} else if message.Role != "system" {
+			inConversation = true
+		}
+
+		// 合并连续相同角色的消息（tool 和带 tool_calls 的消息除外，否则会丢失工具调用）
+		if lastMessage.Role == message.Role && lastMessage.Role != "tool" && mergeMode != "off" &&
+			len(lastMessage.ToolCalls) == 0 && len(message.ToolCalls) == 0 {
+			switch {
+			case mergeMode == "parts":
+				parts := append(contentParts(lastMessage.Content), contentParts(message.Content)...)
+				message.Content = parts
+				formatMessages = formatMessages[:len(formatMessages)-1]
+			case isStringContent(lastMessage.Content) && isStringContent(message.Content):
+				message.Content = getStringContent(lastMessage.Content) + mergeSeparator + getStringContent(message.Content)
 				formatMessages = formatMessages[:len(formatMessages)-1]
 			}
 		}
 
-		// 如果 content 是 nil，设置为占位符
-		if message.Content == nil {
-			message.Content = "..."
+		// 如果 content 是 nil，设置为占位符（带 tool_calls 的消息内容可以为空）；严格模式下丢弃空消息，
+		// tool 消息保留为没有内容的 tool_result，不编造结果文本
+		// 最后一条空的 assistant 消息直接丢弃，否则占位符会被当作 prefill
+		if message.Content == nil && len(message.ToolCalls) == 0 {
+			if (strict && (message.Role != "tool" || message.ToolCallID == "")) || (message.Role == "assistant" && i == len(req.Messages)-1) {
+				slog.Debug("dropping message without content", "role", message.Role)
+				continue
+			}
+			if !strict {
+				message.Content = "..."
+			}
 		}
 
 		formatMessages = append(formatMessages, message)
@@ -145,33 +255,20 @@ func ConvertOpenAIToAnthropic(req OpenAIRequest, maxTokensMapping map[string]int
 	for _, message := range formatMessages {
 		// 提取 system 消息
 		if message.Role == "system" {
-			if isStringContent(message.Content) {
+			for _, text := range systemTexts(message.Content) {
 				systemMessages = append(systemMessages, AnthropicSystemBlock{
 					Type: "text",
-					Text: getStringContent(message.Content),
+					Text: text,
 				})
-			} else if contentArray, ok := message.Content.([]interface{}); ok {
-				for _, item := range contentArray {
-					if contentMap, ok := item.(map[string]interface{}); ok {
-						if contentType, _ := contentMap["type"].(string); contentType == "text" {
-							if text, ok := contentMap["text"].(string); ok {
-								systemMessages = append(systemMessages, AnthropicSystemBlock{
-									Type: "text",
-									Text: text,
-								})
-							}
-						}
-					}
-				}
 			}
 			continue
 		}
 
-		// 确保第一条消息是 user
+		// 确保第一条消息是 user，Anthropic 要求如此，严格模式下同样补上
 		if isFirstMessage {
 			isFirstMessage = false
 			if message.Role != "user" {
-				log.Println("[INFO] First message is not user, adding placeholder user message")
+				slog.Debug("first message is not user, adding placeholder user message")
 				claudeMessages = append(claudeMessages, AnthropicMessage{
 					Role: "user",
 					Content: []AnthropicContent{
@@ -181,39 +278,33 @@ func ConvertOpenAIToAnthropic(req OpenAIRequest, maxTokensMapping map[string]int
 			}
 		}
 
+		// 没有 tool_call_id 的 tool 消息无法转换为 tool_result，按 user 文本发送
+		if message.Role == "tool" && message.ToolCallID == "" {
+			slog.Warn("tool message without tool_call_id, sending as user message")
+			message.Role = "user"
+		}
+
 		anthMsg := AnthropicMessage{
 			Role: message.Role,
 		}
 
 		// 处理 tool 结果
-		if message.Role == "tool" && message.ToolCallID != "" {
+		if message.Role == "tool" {
 			toolResult := AnthropicContent{
 				Type:      "tool_result",
 				ToolUseID: message.ToolCallID,
-				Content:   message.Content,
+				Content:   toolResultContent(message.Content),
 			}
 
-			// 尝试合并到上一条 user 消息
-			if len(claudeMessages) > 0 && claudeMessages[len(claudeMessages)-1].Role == "user" {
-				lastMsg := &claudeMessages[len(claudeMessages)-1]
-
-				// 确保 content 是数组格式
-				if strContent, ok := lastMsg.Content.(string); ok {
-					lastMsg.Content = []AnthropicContent{
-						{Type: "text", Text: stringPtr(strContent)},
-					}
-				}
-
-				if contents, ok := lastMsg.Content.([]AnthropicContent); ok {
-					lastMsg.Content = append(contents, toolResult)
-					log.Printf("[INFO] Merged tool_result into previous user message")
-					continue
-				}
-			} else {
-				// 创建新的 user 消息
-				anthMsg.Role = "user"
-				anthMsg.Content = []AnthropicContent{toolResult}
+			// 并行工具调用时客户端会连续发送多条 tool 消息（中间可能夹着 user 消息），
+			// 全部放入 assistant 之后的第一条 user 消息
+			if target := toolResultTarget(claudeMessages); target >= 0 {
+				insertToolResult(&claudeMessages[target], toolResult)
+				slog.Debug("merged tool_result into user message", "tool_use_id", message.ToolCallID)
+				continue
 			}
+			anthMsg.Role = "user"
+			anthMsg.Content = []AnthropicContent{toolResult}
 		} else if isStringContent(message.Content) && len(message.ToolCalls) == 0 {
 			// 纯文本消息
 			anthMsg.Content = getStringContent(message.Content)
@@ -221,39 +312,11 @@ func ConvertOpenAIToAnthropic(req OpenAIRequest, maxTokensMapping map[string]int
 			// 复杂内容或有 tool_calls
 			anthContents := make([]AnthropicContent, 0)
 
-			// 转换 content
-			if contentArray, ok := message.Content.([]interface{}); ok {
-				for _, item := range contentArray {
-					contentMap, ok := item.(map[string]interface{})
-					if !ok {
-						continue
-					}
-
-					contentType, _ := contentMap["type"].(string)
-
-					if contentType == "text" {
-						text, _ := contentMap["text"].(string)
-						if text == "" {
-							log.Println("[DEBUG] Skipping empty text block")
-							continue // 跳过空文本块
-						}
-						anthContents = append(anthContents, AnthropicContent{
-							Type: "text",
-							Text: stringPtr(text),
-						})
-					} else if contentType == "image_url" {
-						if imageURL, ok := contentMap["image_url"].(map[string]interface{}); ok {
-							url, _ := imageURL["url"].(string)
-							anthContents = append(anthContents, AnthropicContent{
-								Type: "image",
-								Source: &ImageSource{
-									Type: "url",
-									URL:  url,
-								},
-							})
-						}
-					}
-				}
+			// 转换 content（带 tool_calls 的 assistant 消息可能是字符串内容）
+			if text := getStringContent(message.Content); text != "" {
+				anthContents = append(anthContents, AnthropicContent{Type: "text", Text: stringPtr(text)})
+			} else if contentArray, ok := message.Content.([]interface{}); ok {
+				anthContents = append(anthContents, convertContentParts(contentArray)...)
 			}
 
 			// 添加 tool_calls（不能跳过，否则后续的 tool_result 会找不到对应的 tool_use）
@@ -264,8 +327,8 @@ func ConvertOpenAIToAnthropic(req OpenAIRequest, maxTokensMapping map[string]int
 					if toolCall.Function.Arguments != "" && toolCall.Function.Arguments != "{}" {
 						// 解析 Arguments
 						if err := json.Unmarshal([]byte(toolCall.Function.Arguments), &input); err != nil {
-							log.Printf("[ERROR] Failed to parse tool call arguments: ID=%s, Name=%s, Error=%v",
-								toolCall.ID, toolCall.Function.Name, err)
+							slog.Warn("failed to parse tool call arguments",
+								"id", toolCall.ID, "name", toolCall.Function.Name, "error", err)
 							// 解析失败使用空对象
 						}
 					}
@@ -277,8 +340,7 @@ func ConvertOpenAIToAnthropic(req OpenAIRequest, maxTokensMapping map[string]int
 						Name:  toolCall.Function.Name,
 						Input: &input, // 指针，即使是空对象也会序列化为 {}
 					})
-					log.Printf("[DEBUG] Converted tool_call: ID=%s, Name=%s, InputLen=%d",
-						toolCall.ID, toolCall.Function.Name, len(input))
+					slog.Debug("converted tool_call", "id", toolCall.ID, "name", toolCall.Function.Name, "input_len", len(input))
 				}
 			}
 
@@ -286,7 +348,7 @@ func ConvertOpenAIToAnthropic(req OpenAIRequest, maxTokensMapping map[string]int
 				anthMsg.Content = anthContents
 			} else {
 				// 如果没有任何内容（所有 tool_calls 都被跳过），跳过这条消息
-				log.Printf("[WARN] Skipping empty message after tool_call filtering")
+				slog.Warn("skipping empty message after tool_call filtering")
 				continue
 			}
 		}
@@ -294,49 +356,187 @@ func ConvertOpenAIToAnthropic(req OpenAIRequest, maxTokensMapping map[string]int
 		claudeMessages = append(claudeMessages, anthMsg)
 	}
 
-	// 添加 system 消息并设置 cache_control
+	// 处理 response_format（JSON 模式）
+	systemMessages = applyResponseFormat(req, anthReq, systemMessages)
+
+	// cache_control 由 applyCacheControl 按配置添加
 	if len(systemMessages) > 0 {
-		systemMessages[len(systemMessages)-1].CacheControl = &CacheControl{
-			Type: "ephemeral",
-			TTL:  "1h",
-		}
-		log.Printf("[INFO] Added cache_control to system (1h TTL)")
 		anthReq.System = systemMessages
 	}
 
-	// 在倒数第2条 assistant 消息添加 cache_control
-	if len(claudeMessages) >= 2 {
-		secondLast := &claudeMessages[len(claudeMessages)-2]
-		if secondLast.Role == "assistant" {
-			addCacheControlToMessage(secondLast)
-			log.Printf("[INFO] Added cache_control to second-to-last assistant message (1h TTL)")
-		}
+	// 修复截断历史造成的 tool_use / tool_result 配对错误（严格模式下原样转发）
+	if !strict {
+		claudeMessages = repairToolPairing(claudeMessages)
 	}
 
-	anthReq.Messages = claudeMessages
+	anthReq.Messages = trimAssistantPrefill(claudeMessages)
 	return anthReq, nil
 }
 
-func addCacheControlToMessage(msg *AnthropicMessage) {
-	switch content := msg.Content.(type) {
+// trimAssistantPrefill 最后一条 assistant 消息作为 prefill 发送，模型从这段文本之后继续生成，响应中不包含这段文本
+// Anthropic 不接受以空白结尾的 prefill，这里去掉末尾的空白，去掉后为空的文本块和消息直接删除
+func trimAssistantPrefill(messages []AnthropicMessage) []AnthropicMessage {
+	if len(messages) == 0 || messages[len(messages)-1].Role != "assistant" {
+		return messages
+	}
+	last := &messages[len(messages)-1]
+	switch content := last.Content.(type) {
+	case string:
+		text := strings.TrimRight(content, " \t\r\n")
+		if text == "" {
+			slog.Debug("dropped empty trailing assistant message")
+			return messages[:len(messages)-1]
+		}
+		last.Content = text
 	case []AnthropicContent:
-		if len(content) > 0 {
-			content[len(content)-1].CacheControl = &CacheControl{
-				Type: "ephemeral",
-				TTL:  "1h",
+		// 以 tool_use 等非文本块结尾时不是 prefill，不做处理
+		for len(content) > 0 {
+			tail := &content[len(content)-1]
+			if tail.Type != "text" || tail.Text == nil {
+				break
+			}
+			if text := strings.TrimRight(*tail.Text, " \t\r\n"); text != "" {
+				tail.Text = stringPtr(text)
+				break
+			}
+			content = content[:len(content)-1]
+		}
+		if len(content) == 0 {
+			slog.Debug("dropped empty trailing assistant message")
+			return messages[:len(messages)-1]
+		}
+		last.Content = content
+	}
+	slog.Debug("trailing assistant message sent as prefill")
+	return messages
+}
+
+// systemTexts 提取 system 消息的文本，content 可以是字符串或 text 块数组
+func systemTexts(content interface{}) []string {
+	if isStringContent(content) {
+		return []string{getStringContent(content)}
+	}
+	var texts []string
+	if contentArray, ok := content.([]interface{}); ok {
+		for _, item := range contentArray {
+			if contentMap, ok := item.(map[string]interface{}); ok {
+				if contentType, _ := contentMap["type"].(string); contentType == "text" {
+					if text, ok := contentMap["text"].(string); ok {
+						texts = append(texts, text)
+					}
+				}
 			}
-			msg.Content = content
 		}
+	}
+	return texts
+}
+
+// convertContentParts 将 OpenAI content 数组中的 text / image_url / file 部分转换为 Anthropic 内容块
+func convertContentParts(parts []interface{}) []AnthropicContent {
+	contents := make([]AnthropicContent, 0, len(parts))
+	for _, item := range parts {
+		contentMap, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		contentType, _ := contentMap["type"].(string)
+
+		if contentType == "text" {
+			text, _ := contentMap["text"].(string)
+			if text == "" {
+				slog.Debug("skipping empty text block")
+				continue // 跳过空文本块
+			}
+			contents = append(contents, AnthropicContent{
+				Type: "text",
+				Text: stringPtr(text),
+			})
+		} else if contentType == "image_url" {
+			if imageURL, ok := contentMap["image_url"].(map[string]interface{}); ok {
+				url, _ := imageURL["url"].(string)
+				contents = append(contents, AnthropicContent{
+					Type:   "image",
+					Source: convertImageURL(url),
+				})
+			}
+		} else if contentType == "file" {
+			if file, ok := contentMap["file"].(map[string]interface{}); ok {
+				if document, ok := convertFilePart(file); ok {
+					contents = append(contents, document)
+				}
+			}
+		}
+	}
+	return contents
+}
+
+// toolResultTarget 返回末尾连续 user 消息中的第一条，最后一条不是 user 消息时返回 -1
+func toolResultTarget(messages []AnthropicMessage) int {
+	i := len(messages)
+	for i > 0 && messages[i-1].Role == "user" {
+		i--
+	}
+	if i == len(messages) {
+		return -1
+	}
+	return i
+}
+
+// insertToolResult 把 tool_result 插入到消息已有的 tool_result 之后、其他内容之前
+// Anthropic 要求 tool_result 块位于 user 消息的开头
+func insertToolResult(msg *AnthropicMessage, block AnthropicContent) {
+	var contents []AnthropicContent
+	switch c := msg.Content.(type) {
 	case string:
-		if content != "" {
-			msg.Content = []AnthropicContent{
-				{
-					Type:         "text",
-					Text:         stringPtr(content),
-					CacheControl: &CacheControl{Type: "ephemeral", TTL: "1h"},
-				},
+		contents = []AnthropicContent{{Type: "text", Text: stringPtr(c)}}
+	case []AnthropicContent:
+		contents = c
+	}
+	i := 0
+	for i < len(contents) && contents[i].Type == "tool_result" {
+		i++
+	}
+	merged := make([]AnthropicContent, 0, len(contents)+1)
+	merged = append(merged, contents[:i]...)
+	merged = append(merged, block)
+	msg.Content = append(merged, contents[i:]...)
+}
+
+// toolResultContent 转换 tool 消息的内容：字符串原样保留，content 数组（如截图）转换为 tool_result 内嵌的 text / image 块
+func toolResultContent(content interface{}) interface{} {
+	parts, ok := content.([]interface{})
+	if !ok {
+		return content
+	}
+	contents := convertContentParts(parts)
+	if len(contents) == 0 {
+		return nil
+	}
+	return contents
+}
+
+// convertImageURL 将 OpenAI image_url 转换为 Anthropic 图片来源
+// data:image/png;base64,xxx 形式转为 base64 来源，其余按 URL 透传
+func convertImageURL(url string) *ImageSource {
+	if strings.HasPrefix(url, "data:") {
+		meta, data, found := strings.Cut(strings.TrimPrefix(url, "data:"), ",")
+		if found && strings.HasSuffix(meta, ";base64") {
+			mediaType := strings.TrimSuffix(meta, ";base64")
+			// 去掉 charset 等附加参数
+			mediaType, _, _ = strings.Cut(mediaType, ";")
+			return &ImageSource{
+				Type:      "base64",
+				MediaType: mediaType,
+				Data:      data,
 			}
 		}
+		slog.Warn("unsupported data URL image (expected base64), forwarding as url")
+	}
+
+	return &ImageSource{
+		Type: "url",
+		URL:  url,
 	}
 }
 
@@ -352,6 +552,8 @@ func getStringContent(content interface{}) string {
 	return ""
 }
 
+// convertToolChoice 将 OpenAI tool_choice 转换为 Anthropic 格式
+// auto -> auto, none -> none, required -> any, {"function": {"name": x}} -> {"type": "tool", "name": x}
 func convertToolChoice(choice interface{}) interface{} {
 	if choice == nil {
 		return nil
@@ -359,13 +561,69 @@ func convertToolChoice(choice interface{}) interface{} {
 
 	switch v := choice.(type) {
 	case string:
-		if v == "auto" || v == "required" || v == "none" {
+		switch v {
+		case "auto", "none":
 			return map[string]string{"type": v}
+		case "required":
+			return map[string]string{"type": "any"}
 		}
 	case map[string]interface{}:
-		return v
+		// OpenAI 强制调用指定函数
+		if function, ok := v["function"].(map[string]interface{}); ok {
+			if name, ok := function["name"].(string); ok && name != "" {
+				return map[string]string{"type": "tool", "name": name}
+			}
+		}
+		// 已经是 Anthropic 格式的直接透传
+		switch v["type"] {
+		case "auto", "any", "none", "tool":
+			return v
+		}
 	}
 
+	slog.Warn("unsupported tool_choice ignored", "tool_choice", choice)
+	return nil
+}
+
+// disableParallelToolUse 对应 parallel_tool_calls: false，未指定 tool_choice 时使用 auto
+// tool_choice 为 none 时不会调用工具，保持不变
+func disableParallelToolUse(choice interface{}) interface{} {
+	result := map[string]interface{}{"type": "auto"}
+	switch v := choice.(type) {
+	case map[string]string:
+		for key, value := range v {
+			result[key] = value
+		}
+	case map[string]interface{}:
+		for key, value := range v {
+			result[key] = value
+		}
+	}
+	if result["type"] == "none" {
+		return choice
+	}
+	result["disable_parallel_tool_use"] = true
+	return result
+}
+
+// convertStopSequences 将 OpenAI stop（string 或 []string）转换为 Anthropic stop_sequences
+func convertStopSequences(stop interface{}) []string {
+	switch v := stop.(type) {
+	case string:
+		if v != "" {
+			return []string{v}
+		}
+	case []interface{}:
+		sequences := make([]string, 0, len(v))
+		for _, item := range v {
+			if str, ok := item.(string); ok && str != "" {
+				sequences = append(sequences, str)
+			}
+		}
+		if len(sequences) > 0 {
+			return sequences
+		}
+	}
 	return nil
 }
 
@@ -393,32 +651,40 @@ func ConvertAnthropicToOpenAI(anthResp AnthropicResponse) OpenAIResponse {
 	resp.Usage.PromptTokensDetails.AudioTokens = 0
 
 	// 填充 completion_tokens_details
-	resp.Usage.CompletionTokensDetails.ReasoningTokens = 0
 	resp.Usage.CompletionTokensDetails.AudioTokens = 0
 	resp.Usage.CompletionTokensDetails.AcceptedPredictionTokens = 0
 	resp.Usage.CompletionTokensDetails.RejectedPredictionTokens = 0
 
 	// 初始化 choices
-	resp.Choices = make([]struct {
-		Index   int `json:"index"`
-		Message struct {
-			Role      string     `json:"role"`
-			Content   string     `json:"content,omitempty"`
-			ToolCalls []ToolCall `json:"tool_calls,omitempty"`
-		} `json:"message"`
-		FinishReason string `json:"finish_reason"`
-	}, 1)
+	resp.Choices = make([]OpenAIChoice, 1)
 
 	// 转换内容
 	var textParts []string
+	var thinkingParts []string
 	var toolCalls []ToolCall
+	var footnotes citationFootnotes
 
 	for _, content := range anthResp.Content {
 		switch content.Type {
 		case "text":
 			if content.Text != nil {
 				textParts = append(textParts, *content.Text)
+				if len(content.Citations) > 0 {
+					// 引用以脚注标记附在被引用的文本后
+					end := runeLen(strings.Join(textParts, ""))
+					marker, _ := footnotes.cite(content.Citations, end-runeLen(*content.Text), end)
+					textParts = append(textParts, marker)
+				}
+			}
+		case "thinking":
+			thinkingParts = append(thinkingParts, content.Thinking)
+		case "server_tool_use":
+			// 服务端工具由 Anthropic 执行，调用和结果以文本形式展示，不作为 tool_calls 返回
+			var input map[string]interface{}
+			if content.Input != nil {
+				input = *content.Input
 			}
+			textParts = append(textParts, renderServerToolUse(content.Name, input))
 		case "tool_use":
 			argsBytes, _ := json.Marshal(content.Input)
 			toolCalls = append(toolCalls, ToolCall{
@@ -432,12 +698,22 @@ func ConvertAnthropicToOpenAI(anthResp AnthropicResponse) OpenAIResponse {
 					Arguments: string(argsBytes),
 				},
 			})
+		default:
+			if isServerToolResult(content.Type) {
+				textParts = append(textParts, renderServerToolResult(content))
+			}
 		}
 	}
 
+	textParts = append(textParts, footnotes.references())
+
 	resp.Choices[0].Message.Role = anthResp.Role
 	resp.Choices[0].Message.Content = strings.Join(textParts, "")
+	resp.Choices[0].Message.Annotations = footnotes.annotations
 	resp.Choices[0].Message.ToolCalls = toolCalls
+	resp.Choices[0].Message.ReasoningContent = strings.Join(thinkingParts, "")
+	resp.Usage.CompletionTokensDetails.ReasoningTokens = estimateReasoningTokens(
+		resp.Choices[0].Message.ReasoningContent, anthResp.Usage.OutputTokens)
 
 	if len(toolCalls) > 0 {
 		resp.Choices[0].FinishReason = "tool_calls"
@@ -445,9 +721,29 @@ func ConvertAnthropicToOpenAI(anthResp AnthropicResponse) OpenAIResponse {
 		resp.Choices[0].FinishReason = convertStopReason(anthResp.StopReason)
 	}
 
+	if anthResp.StopReason == "stop_sequence" && anthResp.StopSequence != nil {
+		resp.Choices[0].StopReason = anthResp.StopSequence
+	}
+
 	return resp
 }
 
+// eventStopReason 从 message_delta / message_stop 事件中取出 stop_reason 和 stop_sequence
+// 标准位置是 message_delta.delta，兼容放在事件顶层或 message 中的网关
+func eventStopReason(event map[string]interface{}) (string, string) {
+	for _, key := range []string{"delta", "message"} {
+		if m, ok := event[key].(map[string]interface{}); ok {
+			if reason, _ := m["stop_reason"].(string); reason != "" {
+				seq, _ := m["stop_sequence"].(string)
+				return reason, seq
+			}
+		}
+	}
+	reason, _ := event["stop_reason"].(string)
+	seq, _ := event["stop_sequence"].(string)
+	return reason, seq
+}
+
 func convertStopReason(reason string) string {
 	switch reason {
 	case "end_turn":
@@ -458,13 +754,18 @@ func convertStopReason(reason string) string {
 		return "stop"
 	case "tool_use":
 		return "tool_calls"
+	case "pause_turn":
+		// 服务端工具调用过多时上游暂停了本轮，已生成的内容按正常结束返回
+		return "stop"
+	case "refusal":
+		return "content_filter"
 	default:
 		return reason
 	}
 }
 
 func getCurrentTimestamp() int64 {
-	return int64(1765521600)
+	return time.Now().Unix()
 }
 
 // getDefaultMaxTokens 根据模型名称返回默认的 max_tokens
@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+// 严格模式下没有内容的 tool 消息转为空的 tool_result，不编造 "..." 结果
+func TestStrictFidelityEmptyToolResult(t *testing.T) {
+	t.Setenv("STRICT_FIDELITY", "true")
+	call := ToolCall{ID: "call_1", Type: "function"}
+	call.Function.Name = "run"
+	call.Function.Arguments = "{}"
+	req := OpenAIRequest{
+		Model: "claude-test",
+		Messages: []OpenAIMessage{
+			{Role: "user", Content: "run it"},
+			{Role: "assistant", ToolCalls: []ToolCall{call}},
+			{Role: "tool", ToolCallID: "call_1"},
+		},
+	}
+	anthReq, err := ConvertOpenAIToAnthropic(req, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := anthReq.Messages[len(anthReq.Messages)-1]
+	blocks, ok := last.Content.([]AnthropicContent)
+	if !ok || len(blocks) != 1 || blocks[0].Type != "tool_result" {
+		t.Fatalf("last message = %+v, want a single tool_result", last)
+	}
+	if blocks[0].ToolUseID != "call_1" || blocks[0].Content != nil {
+		t.Errorf("tool_result = %+v, want call_1 without content", blocks[0])
+	}
+}
+
+// 严格模式下第一条消息不是 user 时仍要补上 user 消息，否则 Anthropic 会拒绝
+func TestStrictFidelityLeadingUserMessage(t *testing.T) {
+	t.Setenv("STRICT_FIDELITY", "true")
+	req := OpenAIRequest{
+		Model: "claude-test",
+		Messages: []OpenAIMessage{
+			{Role: "system", Content: "be brief"},
+			{Role: "assistant", Content: "Hi, how can I help?"},
+			{Role: "user", Content: "hello"},
+		},
+	}
+	anthReq, err := ConvertOpenAIToAnthropic(req, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(anthReq.Messages) != 3 {
+		t.Fatalf("got %d messages, want 3", len(anthReq.Messages))
+	}
+	if anthReq.Messages[0].Role != "user" || anthReq.Messages[1].Role != "assistant" {
+		t.Errorf("roles = %s, %s, want user, assistant", anthReq.Messages[0].Role, anthReq.Messages[1].Role)
+	}
+}
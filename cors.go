@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CORSConfig 浏览器直接调用 /v1 接口时的跨域配置
+type CORSConfig struct {
+	AllowedOrigins []string // 精确匹配或 glob（如 https://*.example.com），"*" 表示任意来源；为空表示不启用
+	AllowedHeaders []string
+	AllowedMethods []string
+	ExposedHeaders []string // 允许浏览器读取的响应头
+	MaxAge         time.Duration
+}
+
+// defaultCORSHeaders OpenAI / Anthropic SDK 在浏览器中会发送的请求头
+const defaultCORSHeaders = "Authorization, Content-Type, x-api-key, api-key, anthropic-version, anthropic-beta, " +
+	"anthropic-dangerous-direct-browser-access, x-proxy-model, x-request-id, OpenAI-Organization, OpenAI-Project, OpenAI-Beta, " +
+	"X-Stainless-Arch, X-Stainless-Lang, X-Stainless-OS, X-Stainless-Package-Version, " +
+	"X-Stainless-Retry-Count, X-Stainless-Runtime, X-Stainless-Runtime-Version, X-Stainless-Timeout"
+
+// defaultCORSExposedHeaders 代理返回的提示头和限流头
+const defaultCORSExposedHeaders = "retry-after, x-request-id, X-Proxy-Warning, x-proxy-cache, x-proxy-cost-usd, " +
+	"x-proxy-fallback-model, x-proxy-max-tokens-clamped, x-proxy-context-truncated, x-proxy-context-compacted, " + rateLimitExposedHeaders
+
+// loadCORSConfig 从环境变量读取跨域配置
+func loadCORSConfig() CORSConfig {
+	headers := os.Getenv("CORS_ALLOWED_HEADERS")
+	if headers == "" {
+		headers = defaultCORSHeaders
+	}
+	methods := os.Getenv("CORS_ALLOWED_METHODS")
+	if methods == "" {
+		methods = "GET, POST, OPTIONS"
+	}
+	exposed := os.Getenv("CORS_EXPOSED_HEADERS")
+	if exposed == "" {
+		exposed = defaultCORSExposedHeaders
+	}
+	return CORSConfig{
+		AllowedOrigins: parseModelList(os.Getenv("CORS_ALLOWED_ORIGINS")),
+		AllowedHeaders: parseModelList(headers),
+		AllowedMethods: parseModelList(methods),
+		ExposedHeaders: parseModelList(exposed),
+		MaxAge:         getEnvSeconds("CORS_MAX_AGE_SECONDS", 10*time.Minute),
+	}
+}
+
+func (cfg CORSConfig) enabled() bool {
+	return len(cfg.AllowedOrigins) > 0
+}
+
+// allowOrigin 返回 Access-Control-Allow-Origin 的值，来源不被允许时返回 false
+func (cfg CORSConfig) allowOrigin(origin string) (string, bool) {
+	for _, allowed := range cfg.AllowedOrigins {
+		if allowed == "*" {
+			return "*", true
+		}
+		if ok, _ := path.Match(allowed, origin); ok || strings.EqualFold(allowed, origin) {
+			return origin, true
+		}
+	}
+	return "", false
+}
+
+// CORS 处理 /v1 接口的跨域请求：预检请求（OPTIONS）直接返回 204，不进入路由
+// 不带 Origin 的请求（非浏览器客户端）不受影响
+func CORS(cfg CORSConfig) gin.HandlerFunc {
+	allowHeaders := strings.Join(cfg.AllowedHeaders, ", ")
+	allowMethods := strings.Join(cfg.AllowedMethods, ", ")
+	exposeHeaders := strings.Join(cfg.ExposedHeaders, ", ")
+	maxAge := strconv.Itoa(int(cfg.MaxAge.Seconds()))
+
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" || !strings.HasPrefix(c.Request.URL.Path, "/v1/") {
+			c.Next()
+			return
+		}
+
+		preflight := c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != ""
+		allowed, ok := cfg.allowOrigin(origin)
+		if !ok {
+			if preflight {
+				respondError(c, http.StatusForbidden, "origin "+origin+" is not allowed")
+				c.Abort()
+				return
+			}
+			// 不返回 CORS 头，浏览器会拦截响应
+			c.Next()
+			return
+		}
+
+		c.Header("Access-Control-Allow-Origin", allowed)
+		if allowed != "*" {
+			c.Writer.Header().Add("Vary", "Origin")
+		}
+		if !preflight {
+			if exposeHeaders != "" {
+				c.Header("Access-Control-Expose-Headers", exposeHeaders)
+			}
+			c.Next()
+			return
+		}
+
+		c.Header("Access-Control-Allow-Methods", allowMethods)
+		if allowHeaders == "*" {
+			// 原样允许预检请求声明的请求头
+			c.Header("Access-Control-Allow-Headers", c.GetHeader("Access-Control-Request-Headers"))
+		} else {
+			c.Header("Access-Control-Allow-Headers", allowHeaders)
+		}
+		c.Header("Access-Control-Max-Age", maxAge)
+		c.AbortWithStatus(http.StatusNoContent)
+	}
+}
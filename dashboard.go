@@ -0,0 +1,242 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 管理面板：GET /dashboard 返回内嵌的页面，页面使用 ADMIN_TOKEN 轮询 GET /admin/dashboard 获取数据
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// requestUsageKey gin context 中当前请求累计的 token 用量，供面板展示
+const requestUsageKey = "request_usage"
+
+const (
+	dashboardWindow         = time.Hour // 请求量和错误率的统计窗口，按分钟分桶
+	dashboardRecentRequests = 100
+)
+
+// dashboard 面板的请求统计，所有 handler 共用
+var dashboard = NewActivity(dashboardWindow, dashboardRecentRequests)
+
+// RecentRequest 面板展示的请求摘要，不包含请求内容，key 已脱敏
+type RecentRequest struct {
+	Time         time.Time `json:"time"`
+	RequestID    string    `json:"request_id"`
+	Method       string    `json:"method"`
+	Path         string    `json:"path"`
+	Status       int       `json:"status"`
+	LatencyMs    int64     `json:"latency_ms"`
+	Model        string    `json:"model,omitempty"`
+	Key          string    `json:"key,omitempty"`
+	Stream       bool      `json:"stream"`
+	InputTokens  int       `json:"input_tokens"`
+	OutputTokens int       `json:"output_tokens"`
+	CacheRead    int       `json:"cache_read_input_tokens"`
+	CostUSD      float64   `json:"cost_usd"`
+}
+
+// ActivityBucket 一分钟内的请求数
+type ActivityBucket struct {
+	Time         time.Time `json:"time"`
+	Requests     int       `json:"requests"`
+	ClientErrors int       `json:"client_errors"` // 4xx
+	ServerErrors int       `json:"server_errors"` // 5xx
+}
+
+func (b *ActivityBucket) add(status int) {
+	b.Requests++
+	switch {
+	case status >= 500:
+		b.ServerErrors++
+	case status >= 400:
+		b.ClientErrors++
+	}
+}
+
+// Activity 最近一段时间的请求量和最近的请求，只保存在内存中
+type Activity struct {
+	mu      sync.Mutex
+	started time.Time
+	window  time.Duration
+	buckets []ActivityBucket // 按时间升序，只保留窗口内的分钟
+	total   ActivityBucket   // 启动以来的合计
+	recent  []RecentRequest  // 环形缓冲
+	next    int
+}
+
+func NewActivity(window time.Duration, recent int) *Activity {
+	return &Activity{
+		started: time.Now(),
+		window:  window,
+		recent:  make([]RecentRequest, 0, recent),
+	}
+}
+
+// Record 记录一个已完成的请求
+func (a *Activity) Record(r RecentRequest) {
+	minute := r.Time.Truncate(time.Minute)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.total.add(r.Status)
+	if n := len(a.buckets); n == 0 || a.buckets[n-1].Time.Before(minute) {
+		a.buckets = append(a.buckets, ActivityBucket{Time: minute})
+	}
+	a.buckets[len(a.buckets)-1].add(r.Status)
+	a.trim(r.Time)
+
+	if len(a.recent) < cap(a.recent) {
+		a.recent = append(a.recent, r)
+	} else {
+		a.recent[a.next] = r
+	}
+	a.next = (a.next + 1) % cap(a.recent)
+}
+
+// trim 丢弃窗口以外的分桶
+func (a *Activity) trim(now time.Time) {
+	cutoff := now.Add(-a.window)
+	i := 0
+	for i < len(a.buckets) && !a.buckets[i].Time.After(cutoff) {
+		i++
+	}
+	a.buckets = a.buckets[i:]
+}
+
+// Snapshot 返回窗口内的分桶、启动以来的合计和最近的请求（新的在前）
+func (a *Activity) Snapshot() (buckets []ActivityBucket, total ActivityBucket, recent []RecentRequest) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.trim(time.Now())
+
+	buckets = append([]ActivityBucket{}, a.buckets...)
+	recent = make([]RecentRequest, 0, len(a.recent))
+	for i := 1; i <= len(a.recent); i++ {
+		recent = append(recent, a.recent[(a.next-i+len(a.recent))%len(a.recent)])
+	}
+	return buckets, a.total, recent
+}
+
+// Middleware 记录每个 API 请求，面板、管理接口、指标和健康检查本身不计入
+func (a *Activity) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		path := c.FullPath()
+		if path == "" || !isAPIPath(path) {
+			return
+		}
+		r := RecentRequest{
+			Time:      start,
+			RequestID: c.GetString(reqIDKey),
+			Method:    c.Request.Method,
+			Path:      path,
+			Status:    c.Writer.Status(),
+			LatencyMs: time.Since(start).Milliseconds(),
+			Model:     c.GetString(metricsModelKey),
+			Key:       c.GetString(usageKeyKey),
+			Stream:    c.GetBool(streamKey),
+			CostUSD:   c.GetFloat64(costKey),
+		}
+		if usage, ok := c.Get(requestUsageKey); ok {
+			u := usage.(AnthropicUsage)
+			r.InputTokens = u.InputTokens
+			r.OutputTokens = u.OutputTokens
+			r.CacheRead = u.CacheReadInputTokens
+		}
+		a.Record(r)
+	}
+}
+
+func isAPIPath(path string) bool {
+	for _, prefix := range []string{"/admin", "/dashboard", "/metrics", "/health", "/readyz"} {
+		if strings.HasPrefix(path, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// addRequestUsage 累加当前请求的 token 用量（重试、fallback、n > 1 时会有多次上游调用）
+func addRequestUsage(c *gin.Context, usage *AnthropicUsage) {
+	var total AnthropicUsage
+	if v, ok := c.Get(requestUsageKey); ok {
+		total = v.(AnthropicUsage)
+	}
+	total.InputTokens += usage.InputTokens
+	total.OutputTokens += usage.OutputTokens
+	total.CacheReadInputTokens += usage.CacheReadInputTokens
+	total.CacheCreationInputTokens += usage.CacheCreationInputTokens
+	c.Set(requestUsageKey, total)
+}
+
+// ModelUsage 面板中按模型汇总的当天用量
+type ModelUsage struct {
+	UsageRecord
+	CacheHitRate float64 `json:"cache_hit_rate"`
+}
+
+// HandleDashboard 返回管理面板页面（GET /dashboard），页面本身不含数据
+func (h *ProxyHandler) HandleDashboard(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", dashboardHTML)
+}
+
+// HandleDashboardStats 面板数据（GET /admin/dashboard）：最近一小时的请求量和错误数、当天各模型用量、最近的请求
+func (h *ProxyHandler) HandleDashboardStats(c *gin.Context) {
+	buckets, total, recent := dashboard.Snapshot()
+
+	resp := gin.H{
+		"uptime_seconds": int64(time.Since(dashboard.started).Seconds()),
+		"total": gin.H{
+			"requests":      total.Requests,
+			"client_errors": total.ClientErrors,
+			"server_errors": total.ServerErrors,
+		},
+		"minutes": buckets,
+		"recent":  recent,
+	}
+
+	// 各模型用量来自用量统计（USAGE_FILE），未启用或查询失败时为 null
+	resp["usage"] = nil
+	if h.usageStore != nil {
+		today := time.Now().UTC().Format(usageDateLayout)
+		records, sum, err := h.usageStore.Query(UsageQuery{From: today, To: today})
+		if err != nil {
+			reqLog(requestID(c)).Error("usage query failed", "error", err)
+			c.JSON(http.StatusOK, resp)
+			return
+		}
+		byModel := make(map[string]*ModelUsage)
+		for i := range records {
+			m, ok := byModel[records[i].Model]
+			if !ok {
+				m = &ModelUsage{UsageRecord: UsageRecord{Model: records[i].Model}}
+				byModel[records[i].Model] = m
+			}
+			m.add(&records[i])
+		}
+		models := make([]*ModelUsage, 0, len(byModel))
+		for _, m := range byModel {
+			m.CacheHitRate = cacheHitRate(int(m.InputTokens), int(m.CacheReadInputTokens), int(m.CacheCreationInputTokens))
+			models = append(models, m)
+		}
+		sort.Slice(models, func(i, j int) bool { return models[i].Model < models[j].Model })
+		resp["usage"] = gin.H{
+			"date":           today,
+			"models":         models,
+			"total":          sum,
+			"cache_hit_rate": cacheHitRate(int(sum.InputTokens), int(sum.CacheReadInputTokens), int(sum.CacheCreationInputTokens)),
+		}
+	}
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/base64"
+	"log/slog"
+	"path"
+	"strings"
+)
+
+// convertFilePart 将 OpenAI 的 file 内容（{"type":"file","file":{...}}）转换为 Anthropic document 块
+// 支持 base64 data URL 形式的 PDF 和纯文本，以及 file_url（Responses 的 input_file）；
+// file_id 引用的是 OpenAI 的文件存储，无法转换
+func convertFilePart(file map[string]interface{}) (AnthropicContent, bool) {
+	filename, _ := file["filename"].(string)
+	document := AnthropicContent{Type: "document", Title: filename}
+
+	if data, ok := file["file_data"].(string); ok && data != "" {
+		source, ok := documentSource(data, filename)
+		if !ok {
+			return AnthropicContent{}, false
+		}
+		document.Source = source
+		return document, true
+	}
+	if url, ok := file["file_url"].(string); ok && url != "" {
+		document.Source = &ImageSource{Type: "url", URL: url}
+		return document, true
+	}
+	if fileID, ok := file["file_id"].(string); ok {
+		slog.Warn("skipping file part with file_id (OpenAI file storage is not available)", "file_id", fileID)
+	}
+	return AnthropicContent{}, false
+}
+
+// documentSource 解析 file_data：PDF 保持 base64，文本文件解码为 text 来源
+// 部分客户端只发送 base64 而不带 data URL 前缀，此时按文件扩展名判断类型（默认为 PDF）
+func documentSource(fileData, filename string) (*ImageSource, bool) {
+	mediaType, data := documentMediaType(filename), fileData
+	if rest, ok := strings.CutPrefix(fileData, "data:"); ok {
+		meta, encoded, found := strings.Cut(rest, ",")
+		if !found || !strings.HasSuffix(meta, ";base64") {
+			slog.Warn("skipping file part with unsupported data URL (expected base64)", "filename", filename)
+			return nil, false
+		}
+		mediaType, _, _ = strings.Cut(strings.TrimSuffix(meta, ";base64"), ";")
+		data = encoded
+	}
+
+	switch {
+	case mediaType == "application/pdf":
+		return &ImageSource{Type: "base64", MediaType: mediaType, Data: data}, true
+	case strings.HasPrefix(mediaType, "text/"):
+		text, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			slog.Warn("skipping text file part with invalid base64", "filename", filename, "error", err)
+			return nil, false
+		}
+		return &ImageSource{Type: "text", MediaType: "text/plain", Data: string(text)}, true
+	default:
+		slog.Warn("skipping file part with unsupported media type", "filename", filename, "media_type", mediaType)
+		return nil, false
+	}
+}
+
+// documentMediaType 根据文件扩展名推断媒体类型
+func documentMediaType(filename string) string {
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".txt", ".md", ".csv":
+		return "text/plain"
+	default:
+		return "application/pdf"
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// EmbeddingsConfig /v1/embeddings 的后端配置（Anthropic 没有 embeddings API）
+type EmbeddingsConfig struct {
+	Backend      string // voyage / openai / local，为空表示未启用
+	BaseURL      string
+	APIKey       string
+	DefaultModel string            // 未命中 ModelMapping 的模型统一替换为该模型，为空时原样转发
+	ModelMapping map[string]string // 客户端模型名 -> 后端模型名
+}
+
+// embeddingsDefaultURLs 各后端的默认地址；local 默认指向 Ollama 的 OpenAI 兼容接口
+var embeddingsDefaultURLs = map[string]string{
+	"voyage": "https://api.voyageai.com",
+	"openai": "https://api.openai.com",
+	"local":  "http://localhost:11434",
+}
+
+// loadEmbeddingsConfig 从环境变量读取 embeddings 后端配置
+func loadEmbeddingsConfig() EmbeddingsConfig {
+	cfg := EmbeddingsConfig{
+		Backend:      strings.ToLower(os.Getenv("EMBEDDINGS_BACKEND")),
+		BaseURL:      strings.TrimRight(os.Getenv("EMBEDDINGS_BASE_URL"), "/"),
+		APIKey:       os.Getenv("EMBEDDINGS_API_KEY"),
+		DefaultModel: os.Getenv("EMBEDDINGS_MODEL"),
+		ModelMapping: parseModelMapping(os.Getenv("EMBEDDINGS_MODEL_MAPPING")),
+	}
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = embeddingsDefaultURLs[cfg.Backend]
+	}
+	return cfg
+}
+
+func (cfg EmbeddingsConfig) mapModel(model string) string {
+	if mapped, ok := cfg.ModelMapping[model]; ok {
+		return mapped
+	}
+	if cfg.DefaultModel != "" {
+		return cfg.DefaultModel
+	}
+	return model
+}
+
+// EmbeddingsRequest OpenAI embeddings 请求中需要处理的字段
+type EmbeddingsRequest struct {
+	Model          string      `json:"model"`
+	Input          interface{} `json:"input"` // string / []string / token 数组
+	EncodingFormat string      `json:"encoding_format,omitempty"`
+	Dimensions     int         `json:"dimensions,omitempty"`
+}
+
+// EmbeddingsResponse OpenAI 格式的 embeddings 响应
+type EmbeddingsResponse struct {
+	Object string          `json:"object"`
+	Data   []EmbeddingData `json:"data"`
+	Model  string          `json:"model"`
+	Usage  struct {
+		PromptTokens int `json:"prompt_tokens"`
+		TotalTokens  int `json:"total_tokens"`
+	} `json:"usage"`
+}
+
+type EmbeddingData struct {
+	Object    string          `json:"object"`
+	Index     int             `json:"index"`
+	Embedding json.RawMessage `json:"embedding"` // float 数组或 base64 字符串
+}
+
+// HandleEmbeddings 将 OpenAI embeddings 请求转发到配置的后端（POST /v1/embeddings）
+// openai / local 后端原样转发请求体；voyage 后端转换参数与响应格式
+func (h *ProxyHandler) HandleEmbeddings(c *gin.Context) {
+	reqID := requestID(c)
+	logger := reqLog(reqID)
+
+	// 仍然校验客户端 key，虚拟 key、限流和用量统计对 embeddings 同样生效
+	apiKey, ok := h.extractAPIKey(c, reqID)
+	if !ok {
+		return
+	}
+	if h.embeddings.Backend == "" {
+		respondError(c, http.StatusNotFound, "embeddings are not configured, set EMBEDDINGS_BACKEND to enable them")
+		return
+	}
+
+	rawBody, ok := readRequestBody(c, reqID)
+	if !ok {
+		return
+	}
+
+	// 完整保留请求字段，openai 后端原样转发未识别的参数
+	var body map[string]interface{}
+	var embReq EmbeddingsRequest
+	if err := json.Unmarshal(rawBody, &body); err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := json.Unmarshal(rawBody, &embReq); err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if embReq.Input == nil {
+		respondParamError(c, "input", "input is required")
+		return
+	}
+
+	model := h.embeddings.mapModel(embReq.Model)
+	c.Set(metricsModelKey, model)
+	logger.Info("embeddings request", "backend", h.embeddings.Backend, "model", embReq.Model, "mapped_model", model)
+	if !h.checkRateLimit(c, apiKey, model, reqID) {
+		return
+	}
+
+	var upstreamBody []byte
+	var err error
+	if h.embeddings.Backend == "voyage" {
+		upstreamBody, err = voyageEmbeddingsBody(embReq, model)
+		if err != nil {
+			respondParamError(c, "input", err.Error())
+			return
+		}
+	} else {
+		body["model"] = model
+		upstreamBody, err = json.Marshal(body)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	targetURL := h.embeddings.BaseURL + "/v1/embeddings"
+	call := newUpstreamCall(c.Request.Context(), h.upstreamTimeout)
+	defer call.release()
+	newRequest := func() (*http.Request, error) {
+		httpReq, err := http.NewRequestWithContext(call.ctx, "POST", targetURL, bytes.NewReader(upstreamBody))
+		if err != nil {
+			return nil, err
+		}
+		httpReq.Header.Set("Content-Type", "application/json")
+		if h.embeddings.APIKey != "" {
+			httpReq.Header.Set("Authorization", "Bearer "+h.embeddings.APIKey)
+		}
+		return httpReq, nil
+	}
+
+	logger.Debug("forwarding embeddings request", "url", targetURL)
+	httpResp, err := h.doWithRetry(newRequest, model, reqID)
+	if err != nil {
+		upErr := call.upstreamError(err)
+		logger.Error("embeddings request failed", "status", upErr.StatusCode, "error", err)
+		respondError(c, upErr.StatusCode, upErr.Message)
+		return
+	}
+	defer httpResp.Body.Close()
+
+	respBody, err := readResponseBody(httpResp.Body, h.maxResponseBytes)
+	if err != nil {
+		logger.Error("read embeddings response failed", "error", err)
+		respondError(c, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	if httpResp.StatusCode != http.StatusOK {
+		logger.Error("embeddings error response", "status", httpResp.StatusCode, "body", string(respBody))
+		respondEmbeddingsError(c, httpResp.StatusCode, respBody)
+		return
+	}
+
+	var resp EmbeddingsResponse
+	if err := json.Unmarshal(respBody, &resp); err != nil {
+		logger.Error("parse embeddings response failed", "error", err)
+		respondError(c, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	if h.embeddings.Backend == "voyage" {
+		// Voyage 的 usage 只有 total_tokens
+		var voyageUsage struct {
+			Usage struct {
+				TotalTokens int `json:"total_tokens"`
+			} `json:"usage"`
+		}
+		_ = json.Unmarshal(respBody, &voyageUsage)
+		resp.Object = "list"
+		resp.Usage.PromptTokens = voyageUsage.Usage.TotalTokens
+		resp.Usage.TotalTokens = voyageUsage.Usage.TotalTokens
+		for i := range resp.Data {
+			resp.Data[i].Object = "embedding"
+		}
+	}
+
+	h.recordUsage(c, reqID, model, &AnthropicUsage{InputTokens: resp.Usage.PromptTokens})
+
+	if h.embeddings.Backend == "voyage" {
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+	c.Data(http.StatusOK, "application/json", respBody)
+}
+
+// voyageEmbeddingsBody 将 OpenAI 参数转换为 Voyage AI 的请求体
+func voyageEmbeddingsBody(req EmbeddingsRequest, model string) ([]byte, error) {
+	var input []string
+	switch v := req.Input.(type) {
+	case string:
+		input = []string{v}
+	case []interface{}:
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("voyage embeddings only support string inputs, not token arrays")
+			}
+			input = append(input, s)
+		}
+	default:
+		return nil, fmt.Errorf("input must be a string or an array of strings")
+	}
+
+	body := map[string]interface{}{
+		"input": input,
+		"model": model,
+	}
+	if req.Dimensions > 0 {
+		body["output_dimension"] = req.Dimensions
+	}
+	if req.EncodingFormat == "base64" {
+		body["encoding_format"] = "base64"
+	}
+	return json.Marshal(body)
+}
+
+// respondEmbeddingsError 后端已返回 OpenAI 错误格式时原样返回，否则（如 Voyage 的 {"detail": ...}）转换为 OpenAI 格式
+func respondEmbeddingsError(c *gin.Context, status int, body []byte) {
+	var parsed struct {
+		Error  json.RawMessage `json:"error"`
+		Detail string          `json:"detail"`
+	}
+	if err := json.Unmarshal(body, &parsed); err == nil {
+		if len(parsed.Error) > 0 && parsed.Error[0] == '{' {
+			c.Data(status, "application/json", body)
+			return
+		}
+		if parsed.Detail != "" {
+			respondError(c, status, parsed.Detail)
+			return
+		}
+	}
+	respondError(c, status, string(body))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OpenAIError OpenAI 格式的错误信息，响应体为 {"error": OpenAIError}
+type OpenAIError struct {
+	Message   string  `json:"message"`
+	Type      string  `json:"type"`
+	Param     *string `json:"param"`
+	Code      *string `json:"code"`
+	RequestID string  `json:"request_id,omitempty"` // 本次请求的 ID，便于与代理日志关联
+}
+
+// anthropicErrorMapping Anthropic 错误类型 -> OpenAI 状态码、错误类型和错误码
+var anthropicErrorMapping = map[string]struct {
+	Status int
+	Type   string
+	Code   string
+}{
+	"invalid_request_error": {http.StatusBadRequest, "invalid_request_error", ""},
+	"authentication_error":  {http.StatusUnauthorized, "invalid_request_error", "invalid_api_key"},
+	"permission_error":      {http.StatusForbidden, "invalid_request_error", "permission_denied"},
+	"not_found_error":       {http.StatusNotFound, "invalid_request_error", "not_found"},
+	"request_too_large":     {http.StatusRequestEntityTooLarge, "invalid_request_error", "request_too_large"},
+	"rate_limit_error":      {http.StatusTooManyRequests, "requests", "rate_limit_exceeded"},
+	"api_error":             {http.StatusInternalServerError, "server_error", ""},
+	"overloaded_error":      {http.StatusServiceUnavailable, "server_error", "overloaded"},
+}
+
+// newOpenAIError 按状态码推断错误类型
+func newOpenAIError(status int, message string) OpenAIError {
+	e := OpenAIError{Message: message, Type: "invalid_request_error"}
+	switch {
+	case status == http.StatusUnauthorized:
+		e.Code = stringPtr("invalid_api_key")
+	case status == http.StatusTooManyRequests:
+		e.Type = "requests"
+		e.Code = stringPtr("rate_limit_exceeded")
+	case status >= 500:
+		e.Type = "server_error"
+	}
+	return e
+}
+
+// translateAnthropicError 将 Anthropic 错误响应转换为 OpenAI 格式
+// body 不是 Anthropic 错误 JSON 时（如连接失败）按状态码推断错误类型，原文作为 message
+func translateAnthropicError(status int, body string) (int, OpenAIError) {
+	var anthErr struct {
+		Type  string `json:"type"`
+		Error struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(body), &anthErr); err != nil || anthErr.Error.Type == "" {
+		return status, newOpenAIError(status, body)
+	}
+
+	mapping, ok := anthropicErrorMapping[anthErr.Error.Type]
+	if !ok {
+		e := newOpenAIError(status, anthErr.Error.Message)
+		e.Code = stringPtr(anthErr.Error.Type)
+		return status, e
+	}
+	e := OpenAIError{Message: anthErr.Error.Message, Type: mapping.Type}
+	if mapping.Code != "" {
+		e.Code = stringPtr(mapping.Code)
+	}
+	return mapping.Status, e
+}
+
+// streamEventError 将流中途的 Anthropic error 事件（如 overloaded_error）转换为 OpenAI 错误 chunk
+func streamEventError(data string, reqID string) gin.H {
+	_, e := translateAnthropicError(http.StatusInternalServerError, data)
+	e.RequestID = reqID
+	return gin.H{"error": e}
+}
+
+// streamReadError 读取上游流失败（连接断开、空闲超时）时发送给客户端的错误 chunk
+func streamReadError(err error, reqID string) gin.H {
+	status := http.StatusBadGateway
+	if errors.Is(err, errStreamIdle) {
+		status = http.StatusGatewayTimeout
+	}
+	e := newOpenAIError(status, "upstream stream interrupted: "+err.Error())
+	e.RequestID = reqID
+	return gin.H{"error": e}
+}
+
+// writeError 写入错误响应，Ollama 接口的请求只返回错误信息（{"error": "..."}）
+func writeError(c *gin.Context, status int, e OpenAIError) {
+	if c.GetBool(ollamaErrorsKey) {
+		c.JSON(status, gin.H{"error": e.Message})
+		return
+	}
+	e.RequestID = c.GetString(reqIDKey)
+	c.JSON(status, gin.H{"error": e})
+}
+
+// respondError 以 OpenAI 错误格式写入响应
+func respondError(c *gin.Context, status int, message string) {
+	writeError(c, status, newOpenAIError(status, message))
+}
+
+// respondParamError 参数非法，返回带 param 的 invalid_request_error
+func respondParamError(c *gin.Context, param string, message string) {
+	e := newOpenAIError(http.StatusBadRequest, message)
+	e.Param = &param
+	writeError(c, http.StatusBadRequest, e)
+}
+
+// respondUpstreamError 将上游错误转换为 OpenAI 错误格式写入响应
+func respondUpstreamError(c *gin.Context, upErr *upstreamError) {
+	status, e := translateAnthropicError(upErr.StatusCode, upErr.Message)
+	writeError(c, status, e)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+)
+
+// reservedExtraParams 由代理决定或已经过代理处理的请求字段，不能通过 extra_body 覆盖
+// system、tools、tool_choice 要经过 guardrails 和提示词模板，max_tokens 要经过上限截断，
+// metadata 和 thinking 由转换逻辑生成，覆盖它们会绕过这些处理
+var reservedExtraParams = []string{
+	"model", "messages", "stream",
+	"system", "tools", "tool_choice", "max_tokens", "metadata", "thinking",
+}
+
+// checkExtraBody extra_body 中出现保留字段时返回错误
+func checkExtraBody(extra map[string]interface{}) *paramError {
+	for _, name := range reservedExtraParams {
+		if _, ok := extra[name]; ok {
+			return &paramError{
+				Param:   "extra_body." + name,
+				Message: "extra_body must not set " + name,
+			}
+		}
+	}
+	return nil
+}
+
+// MarshalJSON 把 Extra 中的字段合并到请求体，与已有字段同名时以 Extra 为准（如 top_k、service_tier）
+func (r AnthropicRequest) MarshalJSON() ([]byte, error) {
+	type plain AnthropicRequest
+	data, err := json.Marshal(plain(r))
+	if err != nil || len(r.Extra) == 0 {
+		return data, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for name, value := range r.Extra {
+		if slices.Contains(reservedExtraParams, name) {
+			continue
+		}
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		fields[name] = raw
+	}
+	return json.Marshal(fields)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FailoverConfig 备用上游：主上游连接失败、超时或返回 529/5xx 时切换
+type FailoverConfig struct {
+	BaseURL          string            // 为空表示不启用
+	APIKey           string            // 可选，覆盖请求中的 API Key
+	Model            string            // 可选，切换到备用上游时替换请求的模型
+	FailureThreshold int               // 连续失败多少次后熔断
+	OpenDuration     time.Duration     // 熔断持续时间，之后放行一个探测请求
+	OverloadModels   map[string]string // 上游过载（529）时降级使用的模型，可以链式降级
+}
+
+// loadFailoverConfig 从环境变量读取备用上游与熔断配置
+func loadFailoverConfig() FailoverConfig {
+	return FailoverConfig{
+		BaseURL:          strings.TrimRight(os.Getenv("FALLBACK_BASE_URL"), "/"),
+		APIKey:           os.Getenv("FALLBACK_API_KEY"),
+		Model:            os.Getenv("FALLBACK_MODEL"),
+		FailureThreshold: getEnvInt("CIRCUIT_FAILURE_THRESHOLD", 5),
+		OpenDuration:     getEnvSeconds("CIRCUIT_OPEN_SECONDS", 30*time.Second),
+		OverloadModels:   parseModelMapping(os.Getenv("OVERLOAD_FALLBACK_MODELS")),
+	}
+}
+
+// upstreamTarget 一次上游请求的目标
+type upstreamTarget struct {
+	BaseURL string
+	APIKey  string  // 非空时覆盖请求中的 API Key
+	Model   string  // 非空时替换请求体中的模型
+	Backend Backend // 为 nil 表示 Anthropic，备用上游总是 Anthropic
+}
+
+// isFailoverStatus 值得切换上游的状态码（上游过载或故障），4xx 是请求本身的问题，切换也不会成功
+func isFailoverStatus(code int) bool {
+	return code == 529 || code >= 500
+}
+
+// doUpstream 先请求主上游（含重试），失败时切换到备用上游；熔断中的上游直接跳过，全部熔断时返回 circuitOpenError
+// newRequest 根据目标构造请求，必须使用传入的 ctx；返回的 upstreamCall 由调用方 bind 或 release
+func (h *ProxyHandler) doUpstream(ctx context.Context, primary upstreamTarget, newRequest func(ctx context.Context, target upstreamTarget) (*http.Request, error), model string, reqID string) (*http.Response, *upstreamCall, error) {
+	logger := reqLog(reqID)
+
+	targets := []upstreamTarget{primary}
+	if h.failover.BaseURL != "" && h.failover.BaseURL != primary.BaseURL {
+		targets = append(targets, upstreamTarget{BaseURL: h.failover.BaseURL, APIKey: h.failover.APIKey, Model: h.failover.Model})
+	}
+
+	var openErr *circuitOpenError
+	for i, target := range targets {
+		last := i == len(targets)-1
+		breaker := h.breakers.get(target.BaseURL)
+		if wait, ok := breaker.allow(); !ok {
+			logger.Warn("upstream circuit open, skipping", "upstream", target.BaseURL)
+			if openErr == nil || wait < openErr.retryAfter {
+				openErr = &circuitOpenError{retryAfter: wait}
+			}
+			continue
+		}
+
+		targetModel := model
+		if target.Model != "" {
+			targetModel = target.Model
+		}
+		call := newUpstreamCall(ctx, h.upstreamTimeout)
+		httpResp, err := h.doWithRetry(func() (*http.Request, error) {
+			return newRequest(call.ctx, target)
+		}, targetModel, reqID)
+
+		// 客户端断开不算上游故障
+		if ctx.Err() != nil {
+			breaker.abort()
+			return httpResp, call, err
+		}
+		failed := err != nil || isFailoverStatus(httpResp.StatusCode)
+		breaker.record(!failed)
+		if !failed || last {
+			if i > 0 {
+				logger.Info("served by fallback upstream", "upstream", target.BaseURL, "model", targetModel)
+			}
+			return httpResp, call, err
+		}
+
+		if err != nil {
+			logger.Warn("upstream failed, failing over", "upstream", target.BaseURL, "error", call.upstreamError(err).Message)
+		} else {
+			io.Copy(io.Discard, httpResp.Body)
+			httpResp.Body.Close()
+			logger.Warn("upstream failed, failing over", "upstream", target.BaseURL, "status", httpResp.StatusCode)
+		}
+		call.release()
+	}
+
+	// 所有上游都在熔断中，直接失败而不是等待连接超时
+	return nil, newUpstreamCall(ctx, 0), openErr
+}
+
+// retryOnOverload 请求返回 529 时按 OVERLOAD_FALLBACK_MODELS 换用更便宜的模型重新请求
+// 降级后的模型仍然过载时继续沿映射降级，返回最终使用的模型，未能降级时返回原错误
+func (h *ProxyHandler) retryOnOverload(ctx context.Context, anthropicReq *AnthropicRequest, apiKey string, upErr *upstreamError, reqID string) (*http.Response, string, *upstreamError) {
+	model := anthropicReq.Model
+	tried := map[string]bool{model: true}
+	for upErr.StatusCode == 529 {
+		next, ok := h.failover.OverloadModels[model]
+		if !ok || tried[next] || ctx.Err() != nil {
+			break
+		}
+		tried[next] = true
+		reqLog(reqID).Warn("upstream overloaded, downgrading model", "from", model, "to", next)
+
+		downgraded := *anthropicReq
+		downgraded.Model = next
+		// 降级后的模型输出上限可能更小
+		if requested, clamped := h.fitMaxTokens(&downgraded); clamped {
+			reqLog(reqID).Info("max_tokens clamped", "model", next, "requested", requested, "max_tokens", downgraded.MaxTokens)
+		}
+		httpResp, err := h.doAnthropicRequest(ctx, &downgraded, apiKey, reqID)
+		if err == nil {
+			return httpResp, next, nil
+		}
+		model, upErr = next, err
+	}
+	return nil, "", upErr
+}
+
+// circuitOpenError 上游熔断中，请求被快速拒绝
+type circuitOpenError struct {
+	retryAfter time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("upstream temporarily unavailable: circuit breaker open after repeated failures, retry in %ds", int(math.Ceil(e.retryAfter.Seconds())))
+}
+
+// withModel 替换 JSON 请求体中的 model 字段，其余字段保持原样
+func withModel(body []byte, model string) []byte {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return body
+	}
+	fields["model"], _ = json.Marshal(model)
+	replaced, err := json.Marshal(fields)
+	if err != nil {
+		return body
+	}
+	return replaced
+}
+
+// 熔断器状态
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half_open"
+)
+
+// circuitBreaker 单个上游的熔断器：连续失败达到阈值后打开，持续 openDuration 后放行一个探测请求
+type circuitBreaker struct {
+	threshold    int
+	openDuration time.Duration
+
+	mu        sync.Mutex
+	state     string
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// allow 是否可以向该上游发送请求，半开状态同一时间只放行一个探测请求
+// 不放行时返回距离下次探测的时间
+func (b *circuitBreaker) allow() (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if wait := time.Until(b.openUntil); wait > 0 {
+			return wait, false
+		}
+		b.state = circuitHalfOpen
+		b.probing = true
+	case circuitHalfOpen:
+		// 探测请求进行中，其余请求按一个熔断周期计算等待时间
+		if b.probing {
+			return b.openDuration, false
+		}
+		b.probing = true
+	}
+	return 0, true
+}
+
+// available 不改变状态地判断是否可以请求：熔断打开且未到探测时间时返回 false
+func (b *circuitBreaker) available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state != circuitOpen || !time.Now().Before(b.openUntil)
+}
+
+// abort 请求未得出结果（客户端断开），释放探测名额，不改变状态
+func (b *circuitBreaker) abort() {
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+func (b *circuitBreaker) record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if success {
+		b.state = circuitClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= b.threshold {
+		b.state = circuitOpen
+		b.openUntil = time.Now().Add(b.openDuration)
+	}
+}
+
+// CircuitBreakers 按上游地址维护熔断器
+type CircuitBreakers struct {
+	threshold    int
+	openDuration time.Duration
+
+	mu       sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+func NewCircuitBreakers(threshold int, openDuration time.Duration) *CircuitBreakers {
+	return &CircuitBreakers{
+		threshold:    threshold,
+		openDuration: openDuration,
+		breakers:     make(map[string]*circuitBreaker),
+	}
+}
+
+func (cb *CircuitBreakers) get(baseURL string) *circuitBreaker {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	b, ok := cb.breakers[baseURL]
+	if !ok {
+		b = &circuitBreaker{threshold: cb.threshold, openDuration: cb.openDuration, state: circuitClosed}
+		cb.breakers[baseURL] = b
+	}
+	return b
+}
+
+// available 上游当前是否可以请求，没有请求过的上游视为可用
+func (cb *CircuitBreakers) available(baseURL string) bool {
+	cb.mu.Lock()
+	b, ok := cb.breakers[baseURL]
+	cb.mu.Unlock()
+	return !ok || b.available()
+}
+
+// UpstreamStatus /health 中展示的上游熔断状态
+type UpstreamStatus struct {
+	State     string     `json:"state"`
+	Failures  int        `json:"consecutive_failures"`
+	OpenUntil *time.Time `json:"open_until,omitempty"`
+}
+
+// Status 返回所有已请求过的上游的熔断状态
+func (cb *CircuitBreakers) Status() map[string]UpstreamStatus {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	status := make(map[string]UpstreamStatus, len(cb.breakers))
+	for baseURL, b := range cb.breakers {
+		b.mu.Lock()
+		s := UpstreamStatus{State: b.state, Failures: b.failures}
+		if b.state == circuitOpen {
+			openUntil := b.openUntil
+			s.OpenUntil = &openUntil
+		}
+		b.mu.Unlock()
+		status[baseURL] = s
+	}
+	return status
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 连续失败达到阈值后熔断，到期后只放行一个探测请求，探测失败重新熔断，成功则恢复
+func TestCircuitBreakerStates(t *testing.T) {
+	b := &circuitBreaker{threshold: 2, openDuration: 20 * time.Millisecond, state: circuitClosed}
+
+	for i := 0; i < 2; i++ {
+		if _, ok := b.allow(); !ok {
+			t.Fatalf("failure %d: request not allowed while closed", i)
+		}
+		b.record(false)
+	}
+	if wait, ok := b.allow(); ok || wait <= 0 {
+		t.Fatalf("after threshold: allow = %v, %v; want rejected with a wait", wait, ok)
+	}
+
+	time.Sleep(25 * time.Millisecond)
+	if _, ok := b.allow(); !ok {
+		t.Fatal("probe not allowed after the open period")
+	}
+	if _, ok := b.allow(); ok {
+		t.Error("second request allowed while the probe is in flight")
+	}
+	b.record(false)
+	if _, ok := b.allow(); ok || b.state != circuitOpen {
+		t.Fatalf("failed probe: state = %s, want open", b.state)
+	}
+
+	time.Sleep(25 * time.Millisecond)
+	if _, ok := b.allow(); !ok {
+		t.Fatal("probe not allowed after the second open period")
+	}
+	b.record(true)
+	if _, ok := b.allow(); !ok || b.state != circuitClosed || b.failures != 0 {
+		t.Errorf("successful probe: state = %s, failures = %d; want closed with no failures", b.state, b.failures)
+	}
+}
+
+// 主上游失败时切换到备用上游并替换模型；主上游熔断后不再请求，两个上游都熔断时直接返回 503
+func TestFailoverAndCircuitBreaker(t *testing.T) {
+	var primaryCalls atomic.Int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryCalls.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, `{"type":"error","error":{"type":"api_error","message":"boom"}}`)
+	}))
+	defer primary.Close()
+
+	var fallbackCalls atomic.Int32
+	var fallbackDown atomic.Bool
+	var fallbackModel atomic.Value
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fallbackCalls.Add(1)
+		var req struct {
+			Model string `json:"model"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		fallbackModel.Store(req.Model)
+		if fallbackDown.Load() {
+			w.WriteHeader(529)
+			io.WriteString(w, `{"type":"error","error":{"type":"overloaded_error","message":"overloaded"}}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-fallback",`+
+			`"content":[{"type":"text","text":"hi"}],"stop_reason":"end_turn","usage":{"input_tokens":1,"output_tokens":1}}`)
+	}))
+	defer fallback.Close()
+
+	h, err := NewProxyHandler(ProxyConfig{
+		AnthropicURL: primary.URL,
+		Failover:     FailoverConfig{BaseURL: fallback.URL, Model: "claude-fallback", FailureThreshold: 2, OpenDuration: time.Minute},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func() (int, *upstreamError) {
+		req := &AnthropicRequest{Model: "claude-test", MaxTokens: 16, Messages: []AnthropicMessage{{Role: "user", Content: "hello"}}}
+		httpResp, upErr := h.doAnthropicRequest(context.Background(), req, "sk-test", "test")
+		if upErr != nil {
+			return upErr.StatusCode, upErr
+		}
+		io.Copy(io.Discard, httpResp.Body)
+		httpResp.Body.Close()
+		return httpResp.StatusCode, nil
+	}
+
+	for i := 0; i < 3; i++ {
+		if status, upErr := send(); status != http.StatusOK {
+			t.Fatalf("request %d: status = %d (%v), want 200 from the fallback", i, status, upErr)
+		}
+	}
+	if got := primaryCalls.Load(); got != 2 {
+		t.Errorf("primary received %d requests, want 2 before the circuit opened", got)
+	}
+	if got := fallbackCalls.Load(); got != 3 {
+		t.Errorf("fallback received %d requests, want 3", got)
+	}
+	if got := fallbackModel.Load(); got != "claude-fallback" {
+		t.Errorf("fallback model = %v, want claude-fallback", got)
+	}
+	if s := h.breakers.Status()[primary.URL]; s.State != circuitOpen || s.OpenUntil == nil {
+		t.Errorf("primary status = %+v, want open", s)
+	}
+
+	fallbackDown.Store(true)
+	for i := 0; i < 2; i++ {
+		if status, _ := send(); status != 529 {
+			t.Errorf("fallback failure %d: status = %d, want the upstream 529", i, status)
+		}
+	}
+	calls := fallbackCalls.Load()
+	status, upErr := send()
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("all circuits open: status = %d (%v), want 503", status, upErr)
+	}
+	if fallbackCalls.Load() != calls || primaryCalls.Load() != 2 {
+		t.Error("a request reached an upstream whose circuit is open")
+	}
+}
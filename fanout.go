@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fanoutResult 单个非流式子请求解析后的结果
+type fanoutResult struct {
+	resp *AnthropicResponse
+	err  *upstreamError
+}
+
+// handleFanout 模拟 OpenAI n > 1：并发发出 n 个非流式 Anthropic 请求，合并为多个 choice
+// 流式请求见 handleFanoutStream
+func (h *ProxyHandler) handleFanout(c *gin.Context, anthropicReq *AnthropicRequest, openaiReq OpenAIRequest, apiKey string, unwrapJSON bool, reqID string) {
+	n := openaiReq.N
+	if n > h.maxN {
+		reqLog(reqID).Warn("n exceeds limit", "n", n, "limit", h.maxN)
+		respondError(c, http.StatusBadRequest, fmt.Sprintf("n must be <= %d", h.maxN))
+		return
+	}
+
+	if !h.checkGuardrails(c, anthropicReq, reqID) {
+		return
+	}
+	if !h.transformRequest(c, anthropicReq, reqID) {
+		return
+	}
+	reqLog(reqID).Info("fan-out", "n", n, "concurrency", h.fanoutConcurrency, "stream", openaiReq.Stream)
+	c.Set(metricsModelKey, anthropicReq.Model)
+
+	if openaiReq.Stream {
+		h.handleFanoutStream(c, anthropicReq, openaiReq, apiKey, unwrapJSON, reqID)
+		return
+	}
+
+	subReq := *anthropicReq
+	subReq.Stream = false
+
+	calls := make([]upstreamResult, n)
+	results := make([]fanoutResult, n)
+	sem := make(chan struct{}, h.fanoutConcurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			calls[i] = h.callUpstream(c, &subReq, apiKey, i, reqID)
+			results[i] = h.readFanoutResult(calls[i])
+		}(i)
+	}
+	wg.Wait()
+	applyFanoutCalls(c, calls)
+
+	// 任意一个失败则整体失败，与单请求的错误处理保持一致
+	for i, r := range results {
+		if r.err != nil {
+			reqLog(reqID).Error("fan-out choice failed", "choice", i, "error", r.err)
+			respondUpstreamError(c, r.err)
+			return
+		}
+	}
+
+	merged := OpenAIResponse{}
+	for i, r := range results {
+		// 部分 choice 命中缓存时只统计实际发给上游的部分
+		if !calls[i].cacheHit {
+			h.observeUsage(c, r.resp.Model, &r.resp.Usage)
+		}
+		if !h.transformResponse(c, r.resp, reqID) {
+			return
+		}
+		prependPrefill(c, r.resp)
+		if unwrapJSON {
+			unwrapJSONResponseTool(r.resp)
+		}
+		metrics.ObserveToolCalls(r.resp.Model, countToolUses(r.resp.Content))
+
+		resp := ConvertAnthropicToOpenAI(*r.resp)
+		if i == 0 {
+			merged = resp
+			merged.Choices = nil
+		} else {
+			// usage 为各子请求之和，反映实际消耗
+			merged.Usage.PromptTokens += resp.Usage.PromptTokens
+			merged.Usage.CompletionTokens += resp.Usage.CompletionTokens
+			merged.Usage.TotalTokens += resp.Usage.TotalTokens
+			merged.Usage.PromptTokensDetails.CachedTokens += resp.Usage.PromptTokensDetails.CachedTokens
+			details := &merged.Usage.CompletionTokensDetails
+			details.ReasoningTokens += resp.Usage.CompletionTokensDetails.ReasoningTokens
+			details.AcceptedPredictionTokens += resp.Usage.CompletionTokensDetails.AcceptedPredictionTokens
+			details.RejectedPredictionTokens += resp.Usage.CompletionTokensDetails.RejectedPredictionTokens
+		}
+		choice := resp.Choices[0]
+		choice.Index = i
+		merged.Choices = append(merged.Choices, choice)
+	}
+	merged.Model = responseModel(c, merged.Model)
+	merged.SystemFingerprint = c.GetString(systemFingerprintKey)
+
+	if c.GetBool(legacyFunctionsKey) {
+		legacyFunctionResponse(&merged)
+	}
+	c.JSON(http.StatusOK, merged)
+}
+
+// handleFanoutStream n > 1 的流式请求：同时打开 n 个上游流，各个流转换后的 chunk 按到达顺序交错输出，
+// choices[].index 为流的序号，每个 choice 有自己的结束块
+// 建立连接时任意一个失败则整体失败；开始输出后单个流中途出错时输出错误 chunk，其他流继续
+func (h *ProxyHandler) handleFanoutStream(c *gin.Context, anthropicReq *AnthropicRequest, openaiReq OpenAIRequest, apiKey string, unwrapJSON bool, reqID string) {
+	n := openaiReq.N
+	subReq := *anthropicReq
+	subReq.Stream = true
+
+	// N_CONCURRENCY 只限制同时建立的连接数，连接建立后所有流同时转发
+	calls := make([]upstreamResult, n)
+	sem := make(chan struct{}, h.fanoutConcurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			calls[i] = h.callUpstream(c, &subReq, apiKey, i, reqID)
+		}(i)
+	}
+	wg.Wait()
+	defer func() {
+		for _, call := range calls {
+			if call.resp != nil {
+				call.resp.Body.Close()
+			}
+		}
+	}()
+
+	applyFanoutCalls(c, calls)
+	for i, call := range calls {
+		if call.err != nil {
+			reqLog(reqID).Error("fan-out choice failed", "choice", i, "error", call.err)
+			respondUpstreamError(c, call.err)
+			return
+		}
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		reqLog(reqID).Error("streaming not supported by client")
+		respondError(c, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	// 所有 choice 的 chunk 使用同一个 id（最先到达的上游消息 ID）和 created
+	var (
+		mu      sync.Mutex
+		id      string
+		created = getCurrentTimestamp()
+		ping    = ssePing(c, flusher)
+	)
+	includeUsage := openaiReq.includeUsage()
+	results := make([]streamResult, n)
+	for i := range calls {
+		out := streamOutput{
+			send: func(chunk map[string]interface{}) {
+				mu.Lock()
+				defer mu.Unlock()
+				if _, ok := chunk["choices"]; ok {
+					if id == "" {
+						id, _ = chunk["id"].(string)
+					}
+					chunk["id"], chunk["created"] = id, created
+				}
+				sendSSE(c, chunk, flusher)
+			},
+			ping: func() {
+				mu.Lock()
+				defer mu.Unlock()
+				ping()
+			},
+			choice: i,
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = h.relayStream(c, calls[i].resp.Body, openaiReq.Model, unwrapJSON, !includeUsage, out, reqID)
+		}(i)
+	}
+	wg.Wait()
+
+	// usage 为各个流之和
+	var total *AnthropicUsage
+	var reasoning strings.Builder
+	for _, res := range results {
+		h.observeStream(c, openaiReq.Model, res, reqID)
+		if res.usage == nil {
+			continue
+		}
+		if total == nil {
+			total = &AnthropicUsage{}
+		}
+		total.InputTokens += res.usage.InputTokens
+		total.OutputTokens += res.usage.OutputTokens
+		total.CacheReadInputTokens += res.usage.CacheReadInputTokens
+		total.CacheCreationInputTokens += res.usage.CacheCreationInputTokens
+		reasoning.WriteString(res.reasoning)
+	}
+	if includeUsage && total != nil {
+		sendSSE(c, map[string]interface{}{
+			"id":      id,
+			"object":  "chat.completion.chunk",
+			"created": created,
+			"model":   responseModel(c, openaiReq.Model),
+			"choices": []map[string]interface{}{},
+			"usage":   streamUsage(total, reasoning.String()),
+		}, flusher)
+	}
+
+	fmt.Fprintf(c.Writer, "data: [DONE]\n\n")
+	flusher.Flush()
+}
+
+// completeOnce 直接发送一个非流式请求并解析响应，不经过 callUpstream（不录制、不缓存、不复制影子流量），
+// 用于摘要、审核等代理自己发出的辅助请求
+func (h *ProxyHandler) completeOnce(ctx context.Context, anthropicReq *AnthropicRequest, apiKey string, reqID string) fanoutResult {
+	httpResp, upErr := h.doAnthropicRequest(ctx, anthropicReq, apiKey, reqID)
+	return h.readFanoutResult(upstreamResult{resp: httpResp, err: upErr})
+}
+
+// readFanoutResult 读取并解析一个非流式子请求的响应
+func (h *ProxyHandler) readFanoutResult(call upstreamResult) fanoutResult {
+	if call.err != nil {
+		return fanoutResult{err: call.err}
+	}
+	defer call.resp.Body.Close()
+
+	bodyBytes, err := readResponseBody(call.resp.Body, h.maxResponseBytes)
+	if err != nil {
+		return fanoutResult{err: &upstreamError{StatusCode: http.StatusBadGateway, Message: err.Error()}}
+	}
+
+	var anthropicResp AnthropicResponse
+	if err := json.Unmarshal(bodyBytes, &anthropicResp); err != nil {
+		return fanoutResult{err: &upstreamError{StatusCode: http.StatusInternalServerError, Message: err.Error()}}
+	}
+	return fanoutResult{resp: &anthropicResp}
+}
+
+// applyFanoutCalls 合并各个子请求的结果写入客户端响应：全部命中缓存时才标记为缓存命中，
+// 任一子请求降级时返回降级模型，限流头以剩余请求数最少的子请求为准
+func applyFanoutCalls(c *gin.Context, calls []upstreamResult) {
+	merged := upstreamResult{cached: true, cacheHit: true}
+	for _, call := range calls {
+		merged.cached = merged.cached && call.cached
+		merged.cacheHit = merged.cacheHit && call.cacheHit
+		if merged.fallbackModel == "" {
+			merged.fallbackModel = call.fallbackModel
+		}
+		if call.header != nil && (merged.header == nil || remainingRequests(call.header) < remainingRequests(merged.header)) {
+			merged.header = call.header
+		}
+	}
+	applyUpstreamResult(c, merged)
+}
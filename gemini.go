@@ -0,0 +1,586 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// geminiBackend Google Gemini API（generateContent / streamGenerateContent）
+// 不支持的内容（服务端工具、redacted_thinking 等）转换时跳过
+type geminiBackend struct{}
+
+// geminiToolIDPrefix Gemini 的函数调用没有稳定的 ID，而且需要在下一轮请求中带回 thoughtSignature；
+// 生成的 tool_use ID 中编码了签名（base64url），客户端带回工具结果时再还原
+const geminiToolIDPrefix = "gemini_"
+
+func (geminiBackend) Name() string { return "gemini" }
+
+func (geminiBackend) DefaultBaseURL() string { return "https://generativelanguage.googleapis.com" }
+
+func (geminiBackend) NewRequest(ctx context.Context, baseURL string, req *BackendRequest) (*http.Request, error) {
+	body, err := json.Marshal(convertAnthropicToGemini(req.Anthropic))
+	if err != nil {
+		return nil, err
+	}
+	slog.Debug("gemini request body", "body", string(body))
+
+	endpoint := baseURL + "/v1beta/models/" + url.PathEscape(req.Model) + ":generateContent"
+	if req.Anthropic.Stream {
+		endpoint = baseURL + "/v1beta/models/" + url.PathEscape(req.Model) + ":streamGenerateContent?alt=sse"
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("x-goog-api-key", req.APIKey)
+	return httpReq, nil
+}
+
+// convertAnthropicToGemini 将 Anthropic 请求转换为 Gemini generateContent 请求
+func convertAnthropicToGemini(req *AnthropicRequest) map[string]interface{} {
+	body := map[string]interface{}{}
+
+	if len(req.System) > 0 {
+		parts := make([]interface{}, 0, len(req.System))
+		for _, block := range req.System {
+			parts = append(parts, map[string]interface{}{"text": block.Text})
+		}
+		body["systemInstruction"] = map[string]interface{}{"parts": parts}
+	}
+
+	// tool_result 只带 tool_use_id，Gemini 的 functionResponse 需要函数名
+	toolNames := make(map[string]string)
+	contents := make([]interface{}, 0, len(req.Messages))
+	for _, msg := range req.Messages {
+		role := "user"
+		if msg.Role == "assistant" {
+			role = "model"
+		}
+		var parts []interface{}
+		for _, block := range anthropicBlocks(msg.Content) {
+			if part := geminiPart(block, toolNames); part != nil {
+				parts = append(parts, part)
+			}
+		}
+		if len(parts) > 0 {
+			contents = append(contents, map[string]interface{}{"role": role, "parts": parts})
+		}
+	}
+	body["contents"] = contents
+
+	config := map[string]interface{}{}
+	if req.MaxTokens > 0 {
+		config["maxOutputTokens"] = req.MaxTokens
+	}
+	if req.Temperature != nil {
+		config["temperature"] = *req.Temperature
+	}
+	if req.TopP > 0 {
+		config["topP"] = req.TopP
+	}
+	if req.TopK > 0 {
+		config["topK"] = req.TopK
+	}
+	if len(req.StopSequences) > 0 {
+		config["stopSequences"] = req.StopSequences
+	}
+	if req.Thinking != nil && req.Thinking.Type == "enabled" {
+		config["thinkingConfig"] = map[string]interface{}{
+			"thinkingBudget":  req.Thinking.BudgetTokens,
+			"includeThoughts": true,
+		}
+	}
+	if len(config) > 0 {
+		body["generationConfig"] = config
+	}
+
+	var declarations []interface{}
+	for _, tool := range req.Tools {
+		t, ok := tool.(AnthropicTool)
+		if !ok {
+			slog.Warn("skipping tool not supported by gemini backend", "tool", tool)
+			continue
+		}
+		declarations = append(declarations, map[string]interface{}{
+			"name":                 t.Name,
+			"description":          t.Description,
+			"parametersJsonSchema": withoutNulls(t.InputSchema),
+		})
+	}
+	if len(declarations) > 0 {
+		body["tools"] = []interface{}{map[string]interface{}{"functionDeclarations": declarations}}
+		if config := geminiToolConfig(req.ToolChoice); config != nil {
+			body["toolConfig"] = map[string]interface{}{"functionCallingConfig": config}
+		}
+	}
+	return body
+}
+
+// withoutNulls 去掉 schema 中值为 null 的字段（转换器会补上 properties / required），Gemini 不接受 null
+func withoutNulls(schema map[string]interface{}) map[string]interface{} {
+	cleaned := make(map[string]interface{}, len(schema))
+	for key, value := range schema {
+		switch v := value.(type) {
+		case nil:
+			continue
+		case map[string]interface{}:
+			cleaned[key] = withoutNulls(v)
+		default:
+			cleaned[key] = v
+		}
+	}
+	return cleaned
+}
+
+// anthropicBlocks 将消息内容统一为内容块数组（字符串内容、转换器生成的块或原始 JSON）
+func anthropicBlocks(content interface{}) []AnthropicContent {
+	switch v := content.(type) {
+	case string:
+		return []AnthropicContent{{Type: "text", Text: &v}}
+	case []AnthropicContent:
+		return v
+	}
+	var blocks []AnthropicContent
+	if data, err := json.Marshal(content); err == nil {
+		json.Unmarshal(data, &blocks)
+	}
+	return blocks
+}
+
+// geminiPart 转换单个内容块，不支持的块返回 nil
+func geminiPart(block AnthropicContent, toolNames map[string]string) map[string]interface{} {
+	switch block.Type {
+	case "text":
+		if block.Text == nil || *block.Text == "" {
+			return nil
+		}
+		return map[string]interface{}{"text": *block.Text}
+
+	case "image", "document":
+		if block.Source == nil {
+			return nil
+		}
+		switch block.Source.Type {
+		case "base64":
+			return map[string]interface{}{"inlineData": map[string]interface{}{"mimeType": block.Source.MediaType, "data": block.Source.Data}}
+		case "text":
+			return map[string]interface{}{"text": block.Source.Data}
+		case "url":
+			return map[string]interface{}{"fileData": map[string]interface{}{"mimeType": geminiMimeType(block), "fileUri": block.Source.URL}}
+		}
+		return nil
+
+	case "tool_use":
+		toolNames[block.ID] = block.Name
+		args := map[string]interface{}{}
+		if block.Input != nil {
+			args = *block.Input
+		}
+		part := map[string]interface{}{"functionCall": map[string]interface{}{"name": block.Name, "args": args}}
+		if signature := geminiToolSignature(block.ID); signature != "" {
+			part["thoughtSignature"] = signature
+		}
+		return part
+
+	case "tool_result":
+		return map[string]interface{}{"functionResponse": map[string]interface{}{
+			"name":     toolNames[block.ToolUseID],
+			"response": map[string]interface{}{"content": toolResultText(block.Content)},
+		}}
+
+	default:
+		return nil
+	}
+}
+
+// geminiMimeType URL 来源没有媒体类型，按扩展名推断
+func geminiMimeType(block AnthropicContent) string {
+	if block.Type == "document" {
+		return "application/pdf"
+	}
+	switch strings.ToLower(path.Ext(block.Source.URL)) {
+	case ".png":
+		return "image/png"
+	case ".gif":
+		return "image/gif"
+	case ".webp":
+		return "image/webp"
+	default:
+		return "image/jpeg"
+	}
+}
+
+// toolResultText 提取 tool_result 内容中的文本
+func toolResultText(content interface{}) string {
+	if s, ok := content.(string); ok {
+		return s
+	}
+	var texts []string
+	for _, block := range anthropicBlocks(content) {
+		if block.Type == "text" && block.Text != nil {
+			texts = append(texts, *block.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// geminiToolConfig 转换 tool_choice：auto -> AUTO，any -> ANY，tool -> 只允许指定函数的 ANY，none -> NONE
+func geminiToolConfig(toolChoice interface{}) map[string]interface{} {
+	if toolChoice == nil {
+		return nil
+	}
+	var choice struct {
+		Type string `json:"type"`
+		Name string `json:"name"`
+	}
+	data, _ := json.Marshal(toolChoice)
+	if json.Unmarshal(data, &choice) != nil {
+		return nil
+	}
+	switch choice.Type {
+	case "auto":
+		return map[string]interface{}{"mode": "AUTO"}
+	case "any":
+		return map[string]interface{}{"mode": "ANY"}
+	case "tool":
+		return map[string]interface{}{"mode": "ANY", "allowedFunctionNames": []string{choice.Name}}
+	case "none":
+		return map[string]interface{}{"mode": "NONE"}
+	}
+	return nil
+}
+
+// geminiToolID 生成 tool_use ID，签名为空时只有序号
+func geminiToolID(index int, signature string) string {
+	id := fmt.Sprintf("%s%d", geminiToolIDPrefix, index)
+	if signature != "" {
+		if raw, err := base64.StdEncoding.DecodeString(signature); err == nil {
+			id += "_" + base64.RawURLEncoding.EncodeToString(raw)
+		}
+	}
+	return id
+}
+
+// geminiToolSignature 从 geminiToolID 生成的 ID 中还原 thoughtSignature
+func geminiToolSignature(id string) string {
+	rest, ok := strings.CutPrefix(id, geminiToolIDPrefix)
+	if !ok {
+		return ""
+	}
+	_, encoded, found := strings.Cut(rest, "_")
+	if !found {
+		return ""
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+// geminiResponse generateContent 的响应，流式响应的每个事件也是这个结构
+type geminiResponse struct {
+	Candidates []struct {
+		Content struct {
+			Parts []struct {
+				Text             string `json:"text"`
+				Thought          bool   `json:"thought"`
+				ThoughtSignature string `json:"thoughtSignature"`
+				FunctionCall     *struct {
+					Name string                 `json:"name"`
+					Args map[string]interface{} `json:"args"`
+				} `json:"functionCall"`
+			} `json:"parts"`
+		} `json:"content"`
+		FinishReason string `json:"finishReason"`
+	} `json:"candidates"`
+	PromptFeedback *struct {
+		BlockReason string `json:"blockReason"`
+	} `json:"promptFeedback"`
+	UsageMetadata *struct {
+		PromptTokenCount        int `json:"promptTokenCount"`
+		CandidatesTokenCount    int `json:"candidatesTokenCount"`
+		ThoughtsTokenCount      int `json:"thoughtsTokenCount"`
+		CachedContentTokenCount int `json:"cachedContentTokenCount"`
+	} `json:"usageMetadata"`
+	ResponseID string       `json:"responseId"`
+	Error      *geminiError `json:"error"`
+}
+
+type geminiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Status  string `json:"status"`
+}
+
+// usage 缓存命中的 token 计入 cache_read，thinking 的 token 计入输出
+func (r *geminiResponse) usage() (AnthropicUsage, bool) {
+	if r.UsageMetadata == nil {
+		return AnthropicUsage{}, false
+	}
+	u := r.UsageMetadata
+	return AnthropicUsage{
+		InputTokens:          u.PromptTokenCount - u.CachedContentTokenCount,
+		CacheReadInputTokens: u.CachedContentTokenCount,
+		OutputTokens:         u.CandidatesTokenCount + u.ThoughtsTokenCount,
+	}, true
+}
+
+// geminiStopReason finishReason 转换为 Anthropic 的 stop_reason，安全拦截对应 refusal
+func geminiStopReason(finishReason string, toolUse bool) string {
+	switch finishReason {
+	case "MAX_TOKENS":
+		return "max_tokens"
+	case "SAFETY", "RECITATION", "BLOCKLIST", "PROHIBITED_CONTENT", "SPII", "IMAGE_SAFETY":
+		return "refusal"
+	}
+	if toolUse {
+		return "tool_use"
+	}
+	return "end_turn"
+}
+
+func (geminiBackend) ConvertResponse(body io.ReadCloser, req *BackendRequest) io.ReadCloser {
+	if req.Anthropic.Stream {
+		return convertStream(body, func(w io.Writer) error {
+			return convertGeminiStream(body, w, req.Model)
+		})
+	}
+
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return io.NopCloser(&errReader{err: err})
+	}
+	var resp geminiResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return io.NopCloser(&errReader{err: fmt.Errorf("parse gemini response: %w", err)})
+	}
+	converted, _ := json.Marshal(convertGeminiResponse(&resp, req.Model))
+	return io.NopCloser(bytes.NewReader(converted))
+}
+
+// convertGeminiResponse 非流式响应转换为 Anthropic 响应
+func convertGeminiResponse(resp *geminiResponse, model string) AnthropicResponse {
+	out := AnthropicResponse{
+		ID:      "msg_" + resp.ResponseID,
+		Type:    "message",
+		Role:    "assistant",
+		Model:   model,
+		Content: []AnthropicContent{},
+	}
+	if usage, ok := resp.usage(); ok {
+		out.Usage = usage
+	}
+	if len(resp.Candidates) == 0 {
+		if resp.PromptFeedback != nil && resp.PromptFeedback.BlockReason != "" {
+			slog.Warn("gemini blocked the prompt", "reason", resp.PromptFeedback.BlockReason)
+		}
+		out.StopReason = "refusal"
+		return out
+	}
+
+	candidate := resp.Candidates[0]
+	toolUse := false
+	for _, part := range candidate.Content.Parts {
+		switch {
+		case part.FunctionCall != nil:
+			input := part.FunctionCall.Args
+			if input == nil {
+				input = map[string]interface{}{}
+			}
+			out.Content = append(out.Content, AnthropicContent{
+				Type:  "tool_use",
+				ID:    geminiToolID(len(out.Content), part.ThoughtSignature),
+				Name:  part.FunctionCall.Name,
+				Input: &input,
+			})
+			toolUse = true
+		case part.Thought:
+			out.Content = append(out.Content, AnthropicContent{Type: "thinking", Thinking: part.Text})
+		case part.Text != "":
+			// 相邻的文本片段合并为一个块
+			if last := len(out.Content) - 1; last >= 0 && out.Content[last].Type == "text" {
+				out.Content[last].Text = stringPtr(*out.Content[last].Text + part.Text)
+				continue
+			}
+			out.Content = append(out.Content, AnthropicContent{Type: "text", Text: stringPtr(part.Text)})
+		}
+	}
+	out.StopReason = geminiStopReason(candidate.FinishReason, toolUse)
+	return out
+}
+
+// convertGeminiStream 将 Gemini 的 SSE（每个事件是一个完整的 generateContent 响应片段）转换为 Anthropic 的 SSE 事件
+func convertGeminiStream(body io.Reader, w io.Writer, model string) error {
+	var (
+		started    bool
+		index      int
+		openBlock  string // 当前未结束的 text / thinking 块
+		toolUse    bool
+		stopReason string
+		usage      AnthropicUsage
+		writeErr   error
+	)
+	emit := func(event map[string]interface{}) {
+		if writeErr != nil {
+			return
+		}
+		data, _ := json.Marshal(event)
+		_, writeErr = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event["type"], data)
+	}
+	closeBlock := func() {
+		if openBlock != "" {
+			emit(map[string]interface{}{"type": "content_block_stop", "index": index})
+			index++
+			openBlock = ""
+		}
+	}
+	openText := func(blockType string) {
+		if openBlock == blockType {
+			return
+		}
+		closeBlock()
+		block := map[string]interface{}{"type": blockType, "text": ""}
+		if blockType == "thinking" {
+			block = map[string]interface{}{"type": "thinking", "thinking": ""}
+		}
+		emit(map[string]interface{}{"type": "content_block_start", "index": index, "content_block": block})
+		openBlock = blockType
+	}
+
+	reader := newSSEReader(body)
+	for writeErr == nil {
+		ev, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if ev.Data == "" {
+			continue
+		}
+
+		var chunk geminiResponse
+		if err := json.Unmarshal([]byte(ev.Data), &chunk); err != nil {
+			slog.Warn("failed to parse gemini event", "error", err, "data", ev.Data)
+			continue
+		}
+		if chunk.Error != nil {
+			emit(map[string]interface{}{"type": "error", "error": anthropicErrorFromGemini(chunk.Error)})
+			return writeErr
+		}
+		if u, ok := chunk.usage(); ok {
+			usage = u
+		}
+		if !started {
+			emit(map[string]interface{}{
+				"type": "message_start",
+				"message": map[string]interface{}{
+					"id": "msg_" + chunk.ResponseID, "type": "message", "role": "assistant", "model": model,
+					"content": []interface{}{}, "stop_reason": nil, "stop_sequence": nil, "usage": usage,
+				},
+			})
+			started = true
+		}
+		if len(chunk.Candidates) == 0 {
+			if chunk.PromptFeedback != nil && chunk.PromptFeedback.BlockReason != "" {
+				stopReason = "refusal"
+			}
+			continue
+		}
+
+		candidate := chunk.Candidates[0]
+		for _, part := range candidate.Content.Parts {
+			switch {
+			case part.FunctionCall != nil:
+				closeBlock()
+				args := part.FunctionCall.Args
+				if args == nil {
+					args = map[string]interface{}{}
+				}
+				argsJSON, _ := json.Marshal(args)
+				emit(map[string]interface{}{"type": "content_block_start", "index": index, "content_block": map[string]interface{}{
+					"type": "tool_use", "id": geminiToolID(index, part.ThoughtSignature), "name": part.FunctionCall.Name, "input": map[string]interface{}{},
+				}})
+				emit(map[string]interface{}{"type": "content_block_delta", "index": index, "delta": map[string]interface{}{"type": "input_json_delta", "partial_json": string(argsJSON)}})
+				emit(map[string]interface{}{"type": "content_block_stop", "index": index})
+				index++
+				toolUse = true
+			case part.Thought:
+				openText("thinking")
+				emit(map[string]interface{}{"type": "content_block_delta", "index": index, "delta": map[string]interface{}{"type": "thinking_delta", "thinking": part.Text}})
+			case part.Text != "":
+				openText("text")
+				emit(map[string]interface{}{"type": "content_block_delta", "index": index, "delta": map[string]interface{}{"type": "text_delta", "text": part.Text}})
+			}
+		}
+		if candidate.FinishReason != "" {
+			stopReason = geminiStopReason(candidate.FinishReason, toolUse)
+		}
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	if !started {
+		return errors.New("gemini stream ended without any response")
+	}
+
+	closeBlock()
+	if stopReason == "" {
+		stopReason = geminiStopReason("", toolUse)
+	}
+	emit(map[string]interface{}{
+		"type":  "message_delta",
+		"delta": map[string]interface{}{"stop_reason": stopReason, "stop_sequence": nil},
+		"usage": usage,
+	})
+	emit(map[string]interface{}{"type": "message_stop"})
+	return writeErr
+}
+
+// geminiErrorTypes Gemini 错误状态 -> Anthropic 错误类型
+var geminiErrorTypes = map[string]string{
+	"INVALID_ARGUMENT":    "invalid_request_error",
+	"FAILED_PRECONDITION": "invalid_request_error",
+	"OUT_OF_RANGE":        "invalid_request_error",
+	"UNAUTHENTICATED":     "authentication_error",
+	"PERMISSION_DENIED":   "permission_error",
+	"NOT_FOUND":           "not_found_error",
+	"RESOURCE_EXHAUSTED":  "rate_limit_error",
+	"UNAVAILABLE":         "overloaded_error",
+}
+
+func anthropicErrorFromGemini(e *geminiError) map[string]interface{} {
+	errorType, ok := geminiErrorTypes[e.Status]
+	if !ok {
+		errorType = "api_error"
+	}
+	return map[string]interface{}{"type": errorType, "message": e.Message}
+}
+
+func (geminiBackend) ConvertError(status int, body []byte) []byte {
+	// 流式请求的错误可能是只有一个元素的数组
+	var resp geminiResponse
+	if json.Unmarshal(body, &resp) != nil || resp.Error == nil {
+		var list []geminiResponse
+		if json.Unmarshal(body, &list) != nil || len(list) == 0 || list[0].Error == nil {
+			return body
+		}
+		resp = list[0]
+	}
+	converted, _ := json.Marshal(map[string]interface{}{"type": "error", "error": anthropicErrorFromGemini(resp.Error)})
+	return converted
+}
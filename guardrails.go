@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// guardrailTopic 一条话题规则：话题名 → 正则（不区分大小写）
+type guardrailTopic struct {
+	Name    string
+	Pattern *regexp.Regexp
+}
+
+// Guardrails 转发前检查请求的策略，命中任一规则时以 400 content_policy_violation 拒绝
+type Guardrails struct {
+	Keywords    *regexp.Regexp // GUARDRAIL_BLOCKED_KEYWORDS 合并后的正则，未配置时为 nil
+	Topics      []guardrailTopic
+	MaxTools    int      // 客户端定义的工具数上限，0 表示不限制
+	BannedTools []string // 工具名，支持 * 通配（path.Match）
+}
+
+// guardrailViolation 命中的规则，Rule 用于指标和日志，Reason 返回给客户端
+type guardrailViolation struct {
+	Rule   string
+	Param  string
+	Reason string
+	Match  string // 命中的内容，只写入日志
+}
+
+// loadGuardrails 从环境变量读取策略，没有配置任何规则时返回 nil
+// GUARDRAIL_BLOCKED_TOPICS 格式：话题=正则，逗号分隔，如 weapons=\bexplosives?\b|\bgunpowder\b,cheating=exam answers
+func loadGuardrails() (*Guardrails, error) {
+	g := &Guardrails{
+		MaxTools:    getEnvInt("GUARDRAIL_MAX_TOOLS", 0),
+		BannedTools: parseModelList(os.Getenv("GUARDRAIL_BANNED_TOOLS")),
+	}
+	if words := parseModelList(os.Getenv("GUARDRAIL_BLOCKED_KEYWORDS")); len(words) > 0 {
+		quoted := make([]string, len(words))
+		for i, word := range words {
+			quoted[i] = regexp.QuoteMeta(word)
+		}
+		g.Keywords = regexp.MustCompile("(?i)" + strings.Join(quoted, "|"))
+	}
+	for _, item := range parseModelList(os.Getenv("GUARDRAIL_BLOCKED_TOPICS")) {
+		name, pattern, ok := strings.Cut(item, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || pattern == "" {
+			return nil, fmt.Errorf("GUARDRAIL_BLOCKED_TOPICS: invalid rule %q, expected topic=regex", item)
+		}
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return nil, fmt.Errorf("GUARDRAIL_BLOCKED_TOPICS: %s: %w", name, err)
+		}
+		g.Topics = append(g.Topics, guardrailTopic{Name: name, Pattern: re})
+	}
+	for _, pattern := range g.BannedTools {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("GUARDRAIL_BANNED_TOOLS: invalid pattern %q", pattern)
+		}
+	}
+	if g.Keywords == nil && len(g.Topics) == 0 && g.MaxTools <= 0 && len(g.BannedTools) == 0 {
+		return nil, nil
+	}
+	return g, nil
+}
+
+// Check 检查工具定义、system 和 user 消息（含工具结果），assistant 的历史输出不检查
+// 违规的 Param 为 tools、system 或 messages，客户端据此定位触发规则的字段
+func (g *Guardrails) Check(req *AnthropicRequest) *guardrailViolation {
+	if v := g.checkTools(req.Tools); v != nil {
+		return v
+	}
+	for _, block := range req.System {
+		if v := g.checkText(block.Text, "system"); v != nil {
+			return v
+		}
+	}
+	for _, msg := range req.Messages {
+		if msg.Role != "user" {
+			continue
+		}
+		for _, text := range messageTexts(msg.Content) {
+			if v := g.checkText(text, "messages"); v != nil {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+func (g *Guardrails) checkText(text string, param string) *guardrailViolation {
+	if g.Keywords != nil {
+		if m := g.Keywords.FindString(text); m != "" {
+			return &guardrailViolation{Rule: "keyword", Param: param, Reason: "the request contains a blocked keyword", Match: m}
+		}
+	}
+	for _, topic := range g.Topics {
+		if m := topic.Pattern.FindString(text); m != "" {
+			return &guardrailViolation{Rule: "topic:" + topic.Name, Param: param, Reason: fmt.Sprintf("the topic %q is not allowed", topic.Name), Match: m}
+		}
+	}
+	return nil
+}
+
+// checkTools 服务端工具（web_search 等带 type 的工具）不计入 MaxTools，但同样检查名称
+func (g *Guardrails) checkTools(tools []interface{}) *guardrailViolation {
+	custom := 0
+	for _, tool := range tools {
+		var name, toolType, description string
+		switch t := tool.(type) {
+		case AnthropicTool:
+			name, description = t.Name, t.Description
+		case map[string]interface{}:
+			name, _ = t["name"].(string)
+			toolType, _ = t["type"].(string)
+			description, _ = t["description"].(string)
+		}
+		if toolType == "" || toolType == "custom" {
+			custom++
+		}
+		for _, pattern := range g.BannedTools {
+			if ok, _ := path.Match(pattern, name); ok {
+				return &guardrailViolation{Rule: "banned_tool", Param: "tools", Reason: fmt.Sprintf("the tool %q is not allowed", name), Match: name}
+			}
+		}
+		if v := g.checkText(description, "tools"); v != nil {
+			return v
+		}
+	}
+	if g.MaxTools > 0 && custom > g.MaxTools {
+		return &guardrailViolation{Rule: "max_tools", Param: "tools", Reason: fmt.Sprintf("at most %d tools are allowed, got %d", g.MaxTools, custom), Match: fmt.Sprint(custom)}
+	}
+	return nil
+}
+
+// messageTexts 提取消息中的文本和工具结果文本，content 可以是字符串、[]AnthropicContent 或解析 JSON 得到的 []interface{}
+func messageTexts(content interface{}) []string {
+	var texts []string
+	switch v := content.(type) {
+	case string:
+		texts = append(texts, v)
+	case []AnthropicContent:
+		for _, block := range v {
+			switch block.Type {
+			case "text":
+				if block.Text != nil {
+					texts = append(texts, *block.Text)
+				}
+			case "tool_result":
+				texts = append(texts, messageTexts(block.Content)...)
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			block, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			switch block["type"] {
+			case "text":
+				if text, ok := block["text"].(string); ok {
+					texts = append(texts, text)
+				}
+			case "tool_result":
+				texts = append(texts, messageTexts(block["content"])...)
+			}
+		}
+	}
+	return texts
+}
+
+// checkGuardrails 命中策略时写入 OpenAI 格式的 content_policy_violation 错误并返回 false
+func (h *ProxyHandler) checkGuardrails(c *gin.Context, req *AnthropicRequest, reqID string) bool {
+	v := h.matchGuardrails(c, req, reqID)
+	if v == nil {
+		return true
+	}
+	e := newOpenAIError(http.StatusBadRequest, "Request blocked by content policy: "+v.Reason)
+	e.Param = &v.Param
+	e.Code = stringPtr("content_policy_violation")
+	writeError(c, http.StatusBadRequest, e)
+	return false
+}
+
+// checkAnthropicGuardrails 同 checkGuardrails，以 Anthropic 格式返回错误
+func (h *ProxyHandler) checkAnthropicGuardrails(c *gin.Context, req *AnthropicRequest, reqID string) bool {
+	v := h.matchGuardrails(c, req, reqID)
+	if v == nil {
+		return true
+	}
+	respondAnthropicError(c, http.StatusBadRequest, "Request blocked by content policy: "+v.Reason)
+	return false
+}
+
+func (h *ProxyHandler) matchGuardrails(c *gin.Context, req *AnthropicRequest, reqID string) *guardrailViolation {
+	if h.guardrails == nil {
+		return nil
+	}
+	v := h.guardrails.Check(req)
+	if v == nil {
+		return nil
+	}
+	reqLog(reqID).Warn("request blocked by guardrail", "rule", v.Rule, "match", truncate(v.Match, 100), "model", req.Model)
+	metrics.ObserveGuardrailBlock(req.Model, v.Rule)
+	c.Set(auditDecisionKey, auditPolicyViolation)
+	return v
+}
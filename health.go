@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// healthPaths 健康检查端点，编排系统会频繁调用，不生成链路追踪
+var healthPaths = map[string]bool{"/health": true, "/healthz": true, "/readyz": true}
+
+// ReadinessConfig 就绪检查配置
+type ReadinessConfig struct {
+	Probe    string        // off / head / models，off 时就绪检查不访问上游
+	APIKey   string        // models 探测使用的 key，为空时不带 key（401 也说明上游可达）
+	Timeout  time.Duration // 单次探测超时
+	CacheTTL time.Duration // 探测结果缓存时间，避免每次就绪检查都请求上游
+}
+
+// loadReadinessConfig 从环境变量读取就绪检查配置
+func loadReadinessConfig() ReadinessConfig {
+	apiKey := os.Getenv("READINESS_API_KEY")
+	if apiKey == "" {
+		apiKey = os.Getenv("ANTHROPIC_API_KEY")
+	}
+	return ReadinessConfig{
+		Probe:    strings.ToLower(os.Getenv("READINESS_PROBE")),
+		APIKey:   apiKey,
+		Timeout:  getEnvSeconds("READINESS_TIMEOUT_SECONDS", 5*time.Second),
+		CacheTTL: getEnvSeconds("READINESS_CACHE_SECONDS", 10*time.Second),
+	}
+}
+
+func (cfg ReadinessConfig) enabled() bool {
+	return cfg.Probe == "head" || cfg.Probe == "models"
+}
+
+// ProbeResult 一次上游探测的结果
+type ProbeResult struct {
+	Upstream  string    `json:"upstream"`
+	Reachable bool      `json:"reachable"`
+	Status    int       `json:"status,omitempty"`
+	LatencyMS int64     `json:"latency_ms"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// upstreamProbe 缓存最近一次探测结果，并发的就绪检查共用一次探测
+type upstreamProbe struct {
+	mu   sync.Mutex
+	last *ProbeResult
+}
+
+// probeUpstream 探测主上游是否可达：head 收到任何 HTTP 响应即视为可达，models 要求非 5xx
+// 探测不跟随调用方的 context，调用方断开不会让结果缓存为失败
+func (h *ProxyHandler) probeUpstream() ProbeResult {
+	h.probe.mu.Lock()
+	defer h.probe.mu.Unlock()
+	if last := h.probe.last; last != nil && time.Since(last.CheckedAt) < h.readiness.CacheTTL {
+		return *last
+	}
+
+	result := ProbeResult{Upstream: h.anthropicURL, CheckedAt: time.Now()}
+	ctx, cancel := context.WithTimeout(context.Background(), h.readiness.Timeout)
+	defer cancel()
+
+	method, url := http.MethodHead, h.anthropicURL
+	if h.readiness.Probe == "models" {
+		method, url = http.MethodGet, h.anthropicURL+"/v1/models?limit=1"
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if h.readiness.Probe == "models" {
+		req.Header.Set("anthropic-version", "2023-06-01")
+		if h.readiness.APIKey != "" {
+			req.Header.Set("x-api-key", h.readiness.APIKey)
+		}
+	}
+
+	start := time.Now()
+	resp, err := h.client.Do(req)
+	result.LatencyMS = time.Since(start).Milliseconds()
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		resp.Body.Close()
+		result.Status = resp.StatusCode
+		result.Reachable = h.readiness.Probe == "head" || resp.StatusCode < 500
+		if !result.Reachable {
+			result.Error = fmt.Sprintf("upstream returned %d", resp.StatusCode)
+		}
+	}
+
+	h.probe.last = &result
+	return result
+}
+
+// logStartupProbe 启动时探测一次上游，不可达只记录警告，不阻止启动
+func (h *ProxyHandler) logStartupProbe() {
+	result := h.probeUpstream()
+	if result.Reachable {
+		slog.Info("upstream reachable", "upstream", result.Upstream, "status", result.Status, "latency_ms", result.LatencyMS)
+	} else {
+		slog.Warn("upstream unreachable at startup", "upstream", result.Upstream, "error", result.Error)
+	}
+}
+
+// HandleHealth 健康检查，附带当前映射配置、各上游的熔断状态和 key 池状态
+func (h *ProxyHandler) HandleHealth(c *gin.Context) {
+	settings := h.settings()
+	resp := gin.H{
+		"status":             "ok",
+		"service":            "OpenAI to Anthropic Proxy",
+		"model_mapping":      settings.ModelMapping,
+		"model_groups":       settings.ModelGroups,
+		"max_tokens_mapping": settings.MaxTokensMapping,
+		"upstreams":          h.breakers.Status(),
+	}
+	if h.keyPool != nil {
+		resp["key_pool"] = h.keyPool.Status()
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// HandleLiveness 存活检查（GET /healthz）：进程能处理请求即返回 200
+func (h *ProxyHandler) HandleLiveness(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// HandleReadiness 就绪检查（GET /readyz）：启用探测时上游不可达返回 503
+func (h *ProxyHandler) HandleReadiness(c *gin.Context) {
+	if !h.readiness.enabled() {
+		c.JSON(http.StatusOK, gin.H{"status": "ready"})
+		return
+	}
+
+	result := h.probeUpstream()
+	if !result.Reachable {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not_ready", "upstream": result})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ready", "upstream": result})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// heartbeatScanner 逐个读取上游 SSE 事件，上游静默超过 interval 时调用 ping 发送心跳，
+// 静默超过 idleTimeout 时结束读取并返回 errStreamIdle
+// 用法与 bufio.Scanner 类似（Scan/Event/Err）；ping 在调用 Scan 的 goroutine 中执行，
+// 且只会发生在两个事件之间，不会与响应写入并发
+type heartbeatScanner struct {
+	interval    time.Duration
+	idleTimeout time.Duration
+	ping        func()
+
+	reader *sseReader // interval 与 idleTimeout 都 <= 0 时直接同步读取
+
+	events  chan sseEvent
+	done    chan struct{}
+	event   sseEvent
+	err     error // 读取 goroutine 的错误，events 关闭后才能读取
+	idleErr error
+}
+
+func newHeartbeatScanner(r io.Reader, interval, idleTimeout time.Duration, ping func()) *heartbeatScanner {
+	s := &heartbeatScanner{interval: interval, idleTimeout: idleTimeout, ping: ping}
+	if interval <= 0 && idleTimeout <= 0 {
+		s.reader = newSSEReader(r)
+		return s
+	}
+
+	s.events = make(chan sseEvent)
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.events)
+		reader := newSSEReader(r)
+		for {
+			ev, err := reader.Next()
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					s.err = err
+				}
+				return
+			}
+			select {
+			case s.events <- ev:
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	return s
+}
+
+func (s *heartbeatScanner) Scan() bool {
+	if s.reader != nil {
+		ev, err := s.reader.Next()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				s.err = err
+			}
+			return false
+		}
+		s.event = ev
+		return true
+	}
+
+	if s.idleErr != nil {
+		return false
+	}
+
+	var nextPing, deadline time.Time
+	now := time.Now()
+	if s.interval > 0 {
+		nextPing = now.Add(s.interval)
+	}
+	if s.idleTimeout > 0 {
+		deadline = now.Add(s.idleTimeout)
+	}
+
+	timer := time.NewTimer(untilEarliest(now, nextPing, deadline))
+	defer timer.Stop()
+	for {
+		select {
+		case ev, ok := <-s.events:
+			if !ok {
+				return false
+			}
+			s.event = ev
+			return true
+		case now := <-timer.C:
+			if !deadline.IsZero() && !now.Before(deadline) {
+				s.idleErr = errStreamIdle
+				return false
+			}
+			if !nextPing.IsZero() && !now.Before(nextPing) {
+				s.ping()
+				nextPing = now.Add(s.interval)
+			}
+			timer.Reset(untilEarliest(time.Now(), nextPing, deadline))
+		}
+	}
+}
+
+// untilEarliest 距离 a、b 中较早的非零时间点还有多久
+func untilEarliest(now time.Time, a, b time.Time) time.Duration {
+	t := a
+	if t.IsZero() || (!b.IsZero() && b.Before(t)) {
+		t = b
+	}
+	return t.Sub(now)
+}
+
+// Event 返回 Scan 读到的事件
+func (s *heartbeatScanner) Event() sseEvent {
+	return s.event
+}
+
+func (s *heartbeatScanner) Err() error {
+	if s.idleErr != nil {
+		return s.idleErr
+	}
+	return s.err
+}
+
+// Stop 结束后台读取 goroutine，处理完流后必须调用
+func (s *heartbeatScanner) Stop() {
+	if s.done != nil {
+		close(s.done)
+	}
+}
+
+// ssePing 返回写入 SSE 注释行的心跳函数（客户端会忽略注释）
+func ssePing(c *gin.Context, flusher http.Flusher) func() {
+	return func() {
+		fmt.Fprint(c.Writer, ": ping\n\n")
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// HTTPClientConfig 上游 HTTP 客户端的连接池与 TLS 配置
+type HTTPClientConfig struct {
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	ConnectTimeout      time.Duration // TCP 连接与 TLS 握手各自的超时
+	TLSSkipVerify       bool
+	TLSCAFile           string
+	ProxyURL            string // 上游代理，支持 http / https / socks5 / socks5h，为空时读取 HTTPS_PROXY / HTTP_PROXY / NO_PROXY
+	HTTP2               bool   // 上游支持时使用 HTTP/2
+}
+
+// loadHTTPClientConfig 从环境变量读取 HTTP 客户端配置
+func loadHTTPClientConfig() HTTPClientConfig {
+	return HTTPClientConfig{
+		MaxIdleConns:        getEnvInt("HTTP_MAX_IDLE_CONNS", 200),
+		MaxIdleConnsPerHost: getEnvInt("HTTP_MAX_IDLE_CONNS_PER_HOST", 100),
+		IdleConnTimeout:     getEnvSeconds("HTTP_IDLE_CONN_TIMEOUT", 90*time.Second),
+		ConnectTimeout:      getEnvSeconds("HTTP_CONNECT_TIMEOUT", 10*time.Second),
+		TLSSkipVerify:       getEnvBool("HTTP_TLS_INSECURE_SKIP_VERIFY", false),
+		TLSCAFile:           os.Getenv("HTTP_TLS_CA_FILE"),
+		ProxyURL:            os.Getenv("UPSTREAM_PROXY"),
+		HTTP2:               getEnvBool("HTTP_ENABLE_HTTP2", true),
+	}
+}
+
+// proxyFunc 返回上游代理的选择函数：配置了 UPSTREAM_PROXY 时所有上游请求都经过该代理
+func (cfg HTTPClientConfig) proxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	if cfg.ProxyURL == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	u, err := url.Parse(cfg.ProxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UPSTREAM_PROXY: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported UPSTREAM_PROXY scheme %q, expected http, https, socks5 or socks5h", u.Scheme)
+	}
+	return http.ProxyURL(u), nil
+}
+
+// proxyDescription 日志中展示的代理配置，隐藏密码
+func (cfg HTTPClientConfig) proxyDescription() string {
+	if cfg.ProxyURL != "" {
+		if u, err := url.Parse(cfg.ProxyURL); err == nil {
+			return u.Redacted()
+		}
+		return cfg.ProxyURL
+	}
+	for _, key := range []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy"} {
+		if os.Getenv(key) != "" {
+			return "from environment (" + key + ")"
+		}
+	}
+	return "none"
+}
+
+// newHTTPClient 创建共享的上游 HTTP 客户端
+// 不设置整体超时，流式响应可能持续很久；整体超时由 UPSTREAM_TIMEOUT_SECONDS 通过 context 控制
+func newHTTPClient(cfg HTTPClientConfig) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = cfg.MaxIdleConns
+	transport.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	transport.IdleConnTimeout = cfg.IdleConnTimeout
+	transport.DialContext = (&net.Dialer{Timeout: cfg.ConnectTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = cfg.ConnectTimeout
+
+	proxy, err := cfg.proxyFunc()
+	if err != nil {
+		return nil, err
+	}
+	transport.Proxy = proxy
+
+	if !cfg.HTTP2 {
+		// 非 nil 的空 TLSNextProto 禁用 HTTP/2
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: cfg.TLSSkipVerify,
+	}
+	if cfg.TLSCAFile != "" {
+		pem, err := os.ReadFile(cfg.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no valid certificates in CA file %s", cfg.TLSCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	return &http.Client{Transport: transport}, nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyPoolConfig 上游 API Key 池：虚拟 key 未指定 upstream_key 时轮流使用池中的 key
+type KeyPoolConfig struct {
+	Keys     []string
+	Strategy string        // round_robin（默认）/ least_used
+	Cooldown time.Duration // key 收到 429 且上游没有给出 retry-after 时的冷却时间
+}
+
+// loadKeyPoolConfig 从环境变量读取 key 池配置
+func loadKeyPoolConfig() KeyPoolConfig {
+	strategy := strings.ToLower(os.Getenv("KEY_POOL_STRATEGY"))
+	if strategy == "" {
+		strategy = "round_robin"
+	}
+	return KeyPoolConfig{
+		Keys:     parseModelList(os.Getenv("ANTHROPIC_API_KEYS")),
+		Strategy: strategy,
+		Cooldown: getEnvSeconds("KEY_POOL_COOLDOWN_SECONDS", 60*time.Second),
+	}
+}
+
+// pooledKey 池中单个 key 的使用情况
+type pooledKey struct {
+	key           string
+	inFlight      int
+	requests      int64
+	rateLimited   int64
+	cooldownUntil time.Time
+	// 上游最近一次响应头中的剩余额度
+	remainingRequests string
+	remainingTokens   string
+}
+
+// KeyPool 按策略分配上游 key，收到 429 的 key 冷却一段时间后再参与分配
+type KeyPool struct {
+	strategy string
+	cooldown time.Duration
+	// marker 代表"从池中取 key"的占位 key，每次启动随机生成，客户端无法伪造
+	marker string
+
+	mu   sync.Mutex
+	keys []*pooledKey
+	next int
+}
+
+// NewKeyPool 创建 key 池，未配置 key 时返回 nil
+func NewKeyPool(cfg KeyPoolConfig) (*KeyPool, error) {
+	if len(cfg.Keys) == 0 {
+		return nil, nil
+	}
+	if cfg.Strategy != "round_robin" && cfg.Strategy != "least_used" {
+		return nil, fmt.Errorf("unknown KEY_POOL_STRATEGY %q, expected round_robin or least_used", cfg.Strategy)
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	p := &KeyPool{strategy: cfg.Strategy, cooldown: cfg.Cooldown, marker: "key-pool-" + hex.EncodeToString(buf)}
+	for _, key := range cfg.Keys {
+		p.keys = append(p.keys, &pooledKey{key: key})
+	}
+	return p, nil
+}
+
+// acquire 选出一个 key 并计入进行中的请求
+// 所有 key 都在冷却时选最早结束冷却的，由上游决定是否接受
+func (p *KeyPool) acquire() *pooledKey {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var picked *pooledKey
+	for i := range p.keys {
+		idx := i
+		if p.strategy == "round_robin" {
+			idx = (p.next + i) % len(p.keys)
+		}
+		k := p.keys[idx]
+		if now.Before(k.cooldownUntil) {
+			continue
+		}
+		if p.strategy == "round_robin" {
+			picked = k
+			p.next = idx + 1
+			break
+		}
+		if picked == nil || k.inFlight < picked.inFlight || (k.inFlight == picked.inFlight && k.requests < picked.requests) {
+			picked = k
+		}
+	}
+	if picked == nil {
+		picked = p.keys[0]
+		for _, k := range p.keys[1:] {
+			if k.cooldownUntil.Before(picked.cooldownUntil) {
+				picked = k
+			}
+		}
+		slog.Warn("all upstream keys cooling down, using the one that recovers first", "key", maskKey(picked.key))
+	}
+
+	picked.inFlight++
+	picked.requests++
+	return picked
+}
+
+// record 根据上游响应更新 key 的额度信息，429 时开始冷却
+func (p *KeyPool) record(k *pooledKey, resp *http.Response) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if v := resp.Header.Get("anthropic-ratelimit-requests-remaining"); v != "" {
+		k.remainingRequests = v
+	}
+	if v := resp.Header.Get("anthropic-ratelimit-tokens-remaining"); v != "" {
+		k.remainingTokens = v
+	}
+	if resp.StatusCode != http.StatusTooManyRequests {
+		return
+	}
+	cooldown, ok := parseRetryAfter(resp.Header.Get("retry-after"))
+	if !ok || cooldown <= 0 {
+		cooldown = p.cooldown
+	}
+	k.rateLimited++
+	k.cooldownUntil = time.Now().Add(cooldown)
+	slog.Warn("upstream key rate limited, cooling down", "key", maskKey(k.key), "cooldown", cooldown)
+}
+
+func (p *KeyPool) release(k *pooledKey) {
+	p.mu.Lock()
+	k.inFlight--
+	p.mu.Unlock()
+}
+
+// KeyStatus 池中 key 的状态，供 /health 展示
+type KeyStatus struct {
+	Key               string `json:"key"`
+	State             string `json:"state"` // available / cooling_down
+	InFlight          int    `json:"in_flight"`
+	Requests          int64  `json:"requests"`
+	RateLimited       int64  `json:"rate_limited"`
+	CooldownSeconds   int    `json:"cooldown_seconds,omitempty"`
+	RemainingRequests string `json:"remaining_requests,omitempty"`
+	RemainingTokens   string `json:"remaining_tokens,omitempty"`
+}
+
+// Status 返回各 key 的状态，key 只显示首尾部分
+func (p *KeyPool) Status() []KeyStatus {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	status := make([]KeyStatus, 0, len(p.keys))
+	for _, k := range p.keys {
+		s := KeyStatus{
+			Key:               maskKey(k.key),
+			State:             "available",
+			InFlight:          k.inFlight,
+			Requests:          k.requests,
+			RateLimited:       k.rateLimited,
+			RemainingRequests: k.remainingRequests,
+			RemainingTokens:   k.remainingTokens,
+		}
+		if wait := time.Until(k.cooldownUntil); wait > 0 {
+			s.State = "cooling_down"
+			s.CooldownSeconds = int(wait.Seconds()) + 1
+		}
+		status = append(status, s)
+	}
+	return status
+}
+
+// keyPoolTransport 将请求中的占位 key 替换为池中的 key
+// 在 transport 层替换，重试的每次尝试都会重新选择 key，避开刚收到 429 的 key
+type keyPoolTransport struct {
+	pool *KeyPool
+	base http.RoundTripper
+}
+
+func (t *keyPoolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("x-api-key") != t.pool.marker {
+		return t.base.RoundTrip(req)
+	}
+
+	k := t.pool.acquire()
+	pooled := req.Clone(req.Context())
+	pooled.Header.Set("x-api-key", k.key)
+
+	resp, err := t.base.RoundTrip(pooled)
+	if err != nil {
+		t.pool.release(k)
+		return nil, err
+	}
+	t.pool.record(k, resp)
+
+	// 流式响应持续期间仍算作进行中的请求
+	var once sync.Once
+	resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: func() {
+		once.Do(func() { t.pool.release(k) })
+	}}
+	return resp, nil
+}
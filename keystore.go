@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// virtualKeyPrefix 代理签发的虚拟 key 前缀
+const virtualKeyPrefix = "sk-proxy-"
+
+// keyNameKey gin context 中虚拟 key 的名称，供日志和统计使用
+const keyNameKey = "key_name"
+
+// VirtualKey 代理签发给用户的 key，映射到真实的 Anthropic key
+// 管理接口通过 ID 操作 key，完整的 Key 只在签发时返回一次
+type VirtualKey struct {
+	ID          string    `json:"id"`
+	Key         string    `json:"key"`
+	Name        string    `json:"name"`
+	UpstreamKey string    `json:"upstream_key,omitempty"` // 为空时使用 ANTHROPIC_API_KEY
+	Disabled    bool      `json:"disabled"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// KeyStore 基于 JSON 文件的虚拟 key 存储，修改后立即写回文件
+type KeyStore struct {
+	mu                 sync.RWMutex
+	path               string
+	keys               map[string]*VirtualKey
+	defaultUpstreamKey string
+	allowPassthrough   bool // 非虚拟 key 是否直接转发给上游
+}
+
+var (
+	errKeyNotFound = errors.New("key not found")
+	errKeyDisabled = errors.New("key is disabled")
+	errUnknownKey  = errors.New("unknown API key")
+)
+
+// NewKeyStore 从文件加载虚拟 key，文件不存在时创建空存储
+func NewKeyStore(path, defaultUpstreamKey string, allowPassthrough bool) (*KeyStore, error) {
+	s := &KeyStore{
+		path:               path,
+		keys:               make(map[string]*VirtualKey),
+		defaultUpstreamKey: defaultUpstreamKey,
+		allowPassthrough:   allowPassthrough,
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*VirtualKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for _, k := range keys {
+		// 早期的文件没有 id，由 key 派生，每次加载结果相同
+		if k.ID == "" {
+			k.ID = virtualKeyID(k.Key)
+		}
+		s.keys[k.Key] = k
+	}
+	return s, nil
+}
+
+// virtualKeyID 由 key 的哈希派生的标识，可以放在 URL 和日志中
+func virtualKeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "vk_" + hex.EncodeToString(sum[:8])
+}
+
+// apiKeyID 非虚拟 key 在用量统计和审计日志中的标识，由完整 key 的哈希派生，
+// 短 key 不会原样出现，首尾相同的不同 key 也不会被当作同一个身份
+func apiKeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "key_" + hex.EncodeToString(sum[:8])
+}
+
+// byIDLocked 按 ID 查找虚拟 key，调用方持有锁
+func (s *KeyStore) byIDLocked(id string) (*VirtualKey, bool) {
+	for _, vk := range s.keys {
+		if vk.ID == id {
+			return vk, true
+		}
+	}
+	return nil, false
+}
+
+// Resolve 将客户端传入的 key 转换为上游 key，返回虚拟 key 的名称（非虚拟 key 时为空）
+func (s *KeyStore) Resolve(key string) (upstreamKey string, name string, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	vk, ok := s.keys[key]
+	if !ok {
+		if s.allowPassthrough {
+			return key, "", nil
+		}
+		return "", "", errUnknownKey
+	}
+	if vk.Disabled {
+		return "", vk.Name, errKeyDisabled
+	}
+	if vk.UpstreamKey != "" {
+		return vk.UpstreamKey, vk.Name, nil
+	}
+	return s.defaultUpstreamKey, vk.Name, nil
+}
+
+// Create 签发新的虚拟 key
+func (s *KeyStore) Create(name, upstreamKey string) (*VirtualKey, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	key := virtualKeyPrefix + hex.EncodeToString(buf)
+	vk := &VirtualKey{
+		ID:          virtualKeyID(key),
+		Key:         key,
+		Name:        name,
+		UpstreamKey: upstreamKey,
+		CreatedAt:   time.Now().UTC(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[vk.Key] = vk
+	if err := s.saveLocked(); err != nil {
+		delete(s.keys, vk.Key)
+		return nil, err
+	}
+	return vk, nil
+}
+
+// SetDisabled 启用或禁用虚拟 key
+func (s *KeyStore) SetDisabled(id string, disabled bool) (*VirtualKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vk, ok := s.byIDLocked(id)
+	if !ok {
+		return nil, errKeyNotFound
+	}
+	prev := vk.Disabled
+	vk.Disabled = disabled
+	if err := s.saveLocked(); err != nil {
+		vk.Disabled = prev
+		return nil, err
+	}
+	return vk, nil
+}
+
+// Delete 删除虚拟 key
+func (s *KeyStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vk, ok := s.byIDLocked(id)
+	if !ok {
+		return errKeyNotFound
+	}
+	delete(s.keys, vk.Key)
+	if err := s.saveLocked(); err != nil {
+		s.keys[vk.Key] = vk
+		return err
+	}
+	return nil
+}
+
+// List 按创建时间返回所有虚拟 key（key 和上游 key 已脱敏）
+func (s *KeyStore) List() []VirtualKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]VirtualKey, 0, len(s.keys))
+	for _, vk := range s.keys {
+		list = append(list, vk.masked())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+func (vk *VirtualKey) masked() VirtualKey {
+	m := *vk
+	m.Key = maskKey(m.Key)
+	if m.UpstreamKey != "" {
+		m.UpstreamKey = maskKey(m.UpstreamKey)
+	}
+	return m
+}
+
+// saveLocked 写入临时文件后重命名，避免写到一半时损坏文件
+func (s *KeyStore) saveLocked() error {
+	keys := make([]*VirtualKey, 0, len(s.keys))
+	for _, vk := range s.keys {
+		keys = append(keys, vk)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".keys-*.json")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	// 文件包含上游 key，只允许所有者读写
+	if err := os.Chmod(tmp.Name(), 0o600); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// resolveAPIKey 依次尝试认证方式（如 OIDC）和虚拟 key，把客户端凭证换成上游 key，失败时写入 401 并返回 false
+func (h *ProxyHandler) resolveAPIKey(c *gin.Context, apiKey string, reqID string) (string, bool) {
+	c.Set(usageKeyKey, apiKeyID(apiKey))
+	for _, auth := range h.authenticators {
+		identity, err := auth.Authenticate(c.Request.Context(), apiKey)
+		if errors.Is(err, errAuthSkip) {
+			continue
+		}
+		if err != nil {
+			reqLog(reqID).Warn("authentication failed", "provider", auth.Name(), "error", err)
+			respondError(c, http.StatusUnauthorized, "Authentication failed: "+err.Error())
+			return "", false
+		}
+		c.Set(keyNameKey, identity.Name)
+		c.Set(usageKeyKey, identity.Name)
+		return identity.UpstreamKey, true
+	}
+	if h.keyStore == nil {
+		return apiKey, true
+	}
+	upstreamKey, name, err := h.keyStore.Resolve(apiKey)
+	if err != nil {
+		reqLog(reqID).Warn("api key rejected", "key", maskKey(apiKey), "name", name, "error", err)
+		respondError(c, http.StatusUnauthorized, "Invalid API key: "+err.Error())
+		return "", false
+	}
+	if name != "" {
+		c.Set(keyNameKey, name)
+		c.Set(usageKeyKey, name)
+	}
+	return upstreamKey, true
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 非虚拟 key 的用量身份由完整 key 的哈希派生：短 key 不会原样出现，首尾相同的 key 不会合并
+func TestUsageIdentityForRawKeys(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h := &ProxyHandler{}
+	seen := make(map[string]string)
+	for _, key := range []string{
+		"sk-short",
+		"sk-ant-REDACTED",
+		"sk-ant-REDACTED",
+	} {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		if _, ok := h.resolveAPIKey(c, key, "test"); !ok {
+			t.Fatalf("%s: rejected", key)
+		}
+		id := c.GetString(usageKeyKey)
+		if !strings.HasPrefix(id, "key_") || strings.Contains(id, key[:8]) {
+			t.Errorf("%s: usage identity = %q, want a key_ hash", key, id)
+		}
+		if other, ok := seen[id]; ok {
+			t.Errorf("%s and %s share usage identity %q", other, key, id)
+		}
+		seen[id] = key
+	}
+}
+
+// 通过管理接口签发、禁用、启用和删除虚拟 key，每一步都立即影响认证结果并写回文件
+func TestKeyStoreAdminFlow(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	path := filepath.Join(t.TempDir(), "keys.json")
+	store, err := NewKeyStore(path, "sk-ant-default", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &ProxyHandler{keyStore: store}
+	r := gin.New()
+	admin := r.Group("/admin", AdminAuth("admin-token"))
+	admin.GET("/keys", h.HandleListKeys)
+	admin.POST("/keys", h.HandleCreateKey)
+	admin.PATCH("/keys/:id", h.HandleUpdateKey)
+	admin.DELETE("/keys/:id", h.HandleDeleteKey)
+
+	call := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin-token")
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w
+	}
+	// resolve 用虚拟 key 认证，返回上游 key 和状态码
+	resolve := func(key string) (string, int) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		upstream, _ := h.resolveAPIKey(c, key, "test")
+		return upstream, w.Code
+	}
+
+	w := call(http.MethodPost, "/admin/keys", `{"name":"alice","upstream_key":"sk-ant-alice"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status = %d: %s", w.Code, w.Body)
+	}
+	var created VirtualKey
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(created.Key, virtualKeyPrefix) || created.ID != virtualKeyID(created.Key) {
+		t.Fatalf("created key = %+v", created)
+	}
+	if upstream, code := resolve(created.Key); upstream != "sk-ant-alice" || code != http.StatusOK {
+		t.Errorf("resolve new key = %q, %d; want sk-ant-alice", upstream, code)
+	}
+
+	// 列表中的 key 已脱敏
+	w = call(http.MethodGet, "/admin/keys", "")
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), created.Key) || strings.Contains(w.Body.String(), "sk-ant-alice") {
+		t.Errorf("list: status = %d, body = %s; want masked keys", w.Code, w.Body)
+	}
+
+	if w := call(http.MethodPatch, "/admin/keys/"+created.ID, `{"disabled":true}`); w.Code != http.StatusOK {
+		t.Fatalf("disable: status = %d: %s", w.Code, w.Body)
+	}
+	if _, code := resolve(created.Key); code != http.StatusUnauthorized {
+		t.Errorf("resolve disabled key: status = %d, want 401", code)
+	}
+	reloaded, err := NewKeyStore(path, "sk-ant-default", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := reloaded.Resolve(created.Key); !errors.Is(err, errKeyDisabled) {
+		t.Errorf("reloaded disabled key: error = %v, want %v", err, errKeyDisabled)
+	}
+
+	if w := call(http.MethodPatch, "/admin/keys/"+created.ID, `{"disabled":false}`); w.Code != http.StatusOK {
+		t.Fatalf("enable: status = %d: %s", w.Code, w.Body)
+	}
+	if _, code := resolve(created.Key); code != http.StatusOK {
+		t.Errorf("resolve re-enabled key: status = %d, want 200", code)
+	}
+
+	if w := call(http.MethodDelete, "/admin/keys/"+created.ID, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: status = %d: %s", w.Code, w.Body)
+	}
+	if _, code := resolve(created.Key); code != http.StatusUnauthorized {
+		t.Errorf("resolve deleted key: status = %d, want 401", code)
+	}
+	if w := call(http.MethodPatch, "/admin/keys/"+created.ID, `{"disabled":true}`); w.Code != http.StatusNotFound {
+		t.Errorf("update deleted key: status = %d, want 404", w.Code)
+	}
+	reloaded, err = NewKeyStore(path, "sk-ant-default", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := reloaded.List(); len(keys) != 0 {
+		t.Errorf("reloaded keys = %+v, want none", keys)
+	}
+
+	// 没有管理 token 的请求被拒绝
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/keys", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("list without admin token: status = %d, want 401", w.Code)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+)
+
+// legacyFunctionsKey 请求使用旧版 functions/function_call 格式，响应也以 function_call 返回
+const legacyFunctionsKey = "legacy_functions"
+
+// OpenAIFunction 旧版 functions 参数中的函数定义
+type OpenAIFunction struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Parameters  interface{} `json:"parameters"`
+}
+
+// FunctionCall 旧版 function_call（请求中 assistant 消息的调用和响应中的调用）
+type FunctionCall struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
+}
+
+// convertLegacyFunctions 将旧版 functions/function_call 转换为 tools/tool_choice，返回请求是否使用了旧版格式
+// 旧版消息没有调用 ID：assistant 的 function_call 分配合成 ID，role=function 的结果按函数名依次对应
+func convertLegacyFunctions(req *OpenAIRequest) bool {
+	legacy := len(req.Functions) > 0 || req.FunctionCall != nil
+	for _, msg := range req.Messages {
+		if msg.FunctionCall != nil || msg.Role == "function" {
+			legacy = true
+		}
+	}
+	if !legacy {
+		return false
+	}
+
+	for _, fn := range req.Functions {
+		tool := OpenAITool{Type: "function"}
+		tool.Function.Name = fn.Name
+		tool.Function.Description = fn.Description
+		tool.Function.Parameters = fn.Parameters
+		req.Tools = append(req.Tools, tool)
+	}
+	req.Functions = nil
+
+	if req.ToolChoice == nil {
+		switch fc := req.FunctionCall.(type) {
+		case string:
+			req.ToolChoice = fc
+		case map[string]interface{}:
+			if name, _ := fc["name"].(string); name != "" {
+				req.ToolChoice = map[string]interface{}{"type": "function", "function": map[string]interface{}{"name": name}}
+			}
+		}
+	}
+	req.FunctionCall = nil
+
+	// 旧版响应只能表示一个调用
+	if req.ParallelToolCalls == nil {
+		parallel := false
+		req.ParallelToolCalls = &parallel
+	}
+
+	pending := make(map[string][]string)
+	for i := range req.Messages {
+		msg := &req.Messages[i]
+		switch {
+		case msg.FunctionCall != nil:
+			tc := ToolCall{ID: fmt.Sprintf("call_legacy_%d", i), Type: "function"}
+			tc.Function.Name = msg.FunctionCall.Name
+			tc.Function.Arguments = msg.FunctionCall.Arguments
+			msg.ToolCalls = append(msg.ToolCalls, tc)
+			msg.FunctionCall = nil
+			pending[tc.Function.Name] = append(pending[tc.Function.Name], tc.ID)
+		case msg.Role == "function":
+			if ids := pending[msg.Name]; len(ids) > 0 {
+				msg.Role = "tool"
+				msg.ToolCallID = ids[0]
+				pending[msg.Name] = ids[1:]
+			} else {
+				// 找不到对应的调用（如历史被截断），作为普通文本保留
+				msg.Role = "user"
+				msg.Content = fmt.Sprintf("Result of function %s:\n%s", msg.Name, contentString(msg.Content))
+			}
+		}
+	}
+	return true
+}
+
+// legacyFunctionResponse 将响应中的 tool_calls 改为旧版 function_call
+func legacyFunctionResponse(resp *OpenAIResponse) {
+	for i := range resp.Choices {
+		choice := &resp.Choices[i]
+		if len(choice.Message.ToolCalls) > 0 {
+			tc := choice.Message.ToolCalls[0]
+			choice.Message.FunctionCall = &FunctionCall{Name: tc.Function.Name, Arguments: tc.Function.Arguments}
+			choice.Message.ToolCalls = nil
+		}
+		if choice.FinishReason == "tool_calls" {
+			choice.FinishReason = "function_call"
+		}
+	}
+}
+
+// legacyFunctionChunk 将流式 chunk 中的 tool_calls 增量改为旧版 function_call 增量，只保留第一个调用
+// chunk 只包含被丢弃的调用时返回 false，不需要发送
+func legacyFunctionChunk(data interface{}) bool {
+	chunk, ok := data.(map[string]interface{})
+	if !ok {
+		return true
+	}
+	choices, _ := chunk["choices"].([]map[string]interface{})
+	keep := len(choices) == 0
+	for _, choice := range choices {
+		if choice["finish_reason"] == "tool_calls" {
+			choice["finish_reason"] = "function_call"
+		}
+		delta, _ := choice["delta"].(map[string]interface{})
+		toolCalls, ok := delta["tool_calls"].([]map[string]interface{})
+		if !ok {
+			keep = true
+			continue
+		}
+		delete(delta, "tool_calls")
+		for _, tc := range toolCalls {
+			if tc["index"] != 0 {
+				continue
+			}
+			fn, _ := tc["function"].(map[string]string)
+			call := map[string]string{"arguments": fn["arguments"]}
+			if name := fn["name"]; name != "" {
+				call["name"] = name
+			}
+			delta["function_call"] = call
+		}
+		if len(delta) > 0 || choice["finish_reason"] != nil {
+			keep = true
+		}
+	}
+	return keep
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ListenerTLSConfig 监听端口的 TLS 配置，没有反向代理时由代理直接提供 HTTPS
+type ListenerTLSConfig struct {
+	CertFile     string // 证书（PEM，可包含中间证书），为空表示使用 HTTP
+	KeyFile      string
+	ClientCAFile string // 设置后校验客户端证书（mTLS）
+	ClientAuth   string // require（默认）：必须提供证书；optional：提供了才校验
+}
+
+// loadListenerTLSConfig 从环境变量读取监听端口的 TLS 配置
+func loadListenerTLSConfig() ListenerTLSConfig {
+	clientAuth := strings.ToLower(os.Getenv("LISTEN_TLS_CLIENT_AUTH"))
+	if clientAuth == "" {
+		clientAuth = "require"
+	}
+	return ListenerTLSConfig{
+		CertFile:     os.Getenv("LISTEN_TLS_CERT"),
+		KeyFile:      os.Getenv("LISTEN_TLS_KEY"),
+		ClientCAFile: os.Getenv("LISTEN_TLS_CLIENT_CA"),
+		ClientAuth:   clientAuth,
+	}
+}
+
+func (cfg ListenerTLSConfig) enabled() bool {
+	return cfg.CertFile != "" || cfg.KeyFile != ""
+}
+
+// tlsConfig 构造监听端口的 TLS 配置，证书在 ListenAndServeTLS 时加载
+func (cfg ListenerTLSConfig) tlsConfig() (*tls.Config, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, errors.New("LISTEN_TLS_CERT and LISTEN_TLS_KEY must be set together")
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.ClientCAFile == "" {
+		return tlsConfig, nil
+	}
+
+	pem, err := os.ReadFile(cfg.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("read client CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no valid certificates in client CA file %s", cfg.ClientCAFile)
+	}
+	tlsConfig.ClientCAs = pool
+
+	switch cfg.ClientAuth {
+	case "require":
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("unknown LISTEN_TLS_CLIENT_AUTH %q, expected require or optional", cfg.ClientAuth)
+	}
+	return tlsConfig, nil
+}
+
+// serve 启动 HTTP 服务，配置了证书时提供 HTTPS
+// ctx 结束后停止接受新连接，等待进行中的请求完成（最多 drainTimeout）后返回
+func serve(ctx context.Context, handler http.Handler, addr string, cfg ListenerTLSConfig, drainTimeout time.Duration) error {
+	srv := &http.Server{Addr: addr, Handler: handler}
+	if cfg.enabled() {
+		tlsConfig, err := cfg.tlsConfig()
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = tlsConfig
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		if cfg.enabled() {
+			errc <- srv.ListenAndServeTLS(cfg.CertFile, cfg.KeyFile)
+		} else {
+			errc <- srv.ListenAndServe()
+		}
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down, waiting for in-flight requests", "timeout", drainTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("shutdown: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// gin context 中的请求字段，供访问日志使用
+const (
+	reqIDKey  = "req_id"
+	streamKey = "stream"
+)
+
+// setupLogger 根据 LOG_LEVEL（debug/info/warn/error）和 LOG_FORMAT（text/json）初始化全局 slog
+// 标准库 log 的输出也会经过该 handler
+func setupLogger() {
+	var level slog.Level
+	switch strings.ToLower(os.Getenv("LOG_LEVEL")) {
+	case "debug":
+		level = slog.LevelDebug
+	case "warn", "warning":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	default:
+		level = slog.LevelInfo
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	if strings.ToLower(os.Getenv("LOG_FORMAT")) == "json" {
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// reqLog 返回带 req_id 字段的 logger
+func reqLog(reqID string) *slog.Logger {
+	return slog.Default().With("req_id", reqID)
+}
+
+// truncate 截断过长的日志内容
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n] + "..."
+	}
+	return s
+}
+
+// AccessLog 每个请求结束后输出一条访问日志（替代 gin 默认的 Logger）
+func AccessLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		attrs := []any{
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"latency", time.Since(start),
+			"client_ip", c.ClientIP(),
+		}
+		if reqID, ok := c.Get(reqIDKey); ok {
+			attrs = append(attrs, "req_id", reqID)
+		}
+		if name := c.GetString(keyNameKey); name != "" {
+			attrs = append(attrs, "key_name", name)
+		}
+		if model := c.GetString(metricsModelKey); model != "" {
+			attrs = append(attrs, "model", model)
+		}
+		if stream, ok := c.Get(streamKey); ok {
+			attrs = append(attrs, "stream", stream)
+		}
+
+		switch status := c.Writer.Status(); {
+		case status >= 500:
+			slog.Error("request completed", attrs...)
+		case status >= 400:
+			slog.Warn("request completed", attrs...)
+		default:
+			slog.Info("request completed", attrs...)
+		}
+	}
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
-	"log"
+	"context"
+	"log/slog"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
@@ -14,6 +18,14 @@ func main() {
 	// 加载环境变量
 	_ = godotenv.Load()
 
+	// replay 子命令：重新发送 tape 中录制的请求
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
+	}
+
+	// 初始化日志（LOG_LEVEL / LOG_FORMAT）
+	setupLogger()
+
 	// 获取配置
 	anthropicURL := os.Getenv("ANTHROPIC_BASE_URL")
 	if anthropicURL == "" {
@@ -28,47 +40,528 @@ func main() {
 	// 解析模型映射配置
 	modelMapping := parseModelMapping(os.Getenv("MODEL_MAPPING"))
 
+	// 解析按权重分流的模型组
+	modelGroups, err := parseModelGroups(os.Getenv("MODEL_GROUPS"))
+	if err != nil {
+		slog.Error("invalid MODEL_GROUPS", "error", err)
+		os.Exit(1)
+	}
+
 	// 解析 max_tokens 映射配置
 	maxTokensMapping := parseMaxTokensMapping(os.Getenv("MAX_TOKENS_MAPPING"))
 
-	// 创建 Gin 路由
-	r := gin.Default()
-
-	// 健康检查
-	r.GET("/health", func(c *gin.Context) {
-		c.JSON(200, gin.H{
-			"status":             "ok",
-			"service":            "OpenAI to Anthropic Proxy",
-			"model_mapping":      modelMapping,
-			"max_tokens_mapping": maxTokensMapping,
-		})
-	})
+	// 解析 extended thinking 预算配置（格式与 MAX_TOKENS_MAPPING 相同）
+	thinkingBudgets := parseMaxTokensMapping(os.Getenv("THINKING_BUDGET_MAPPING"))
+
+	// 解析多上游路由配置
+	routes := parseRoutes(os.Getenv("ROUTES"))
+
+	// 解析 /v1/models 额外返回的静态模型列表
+	staticModels := parseModelList(os.Getenv("STATIC_MODELS"))
+
+	// 创建 Gin 路由，访问日志由 AccessLog 统一输出
+	r := gin.New()
+	r.Use(gin.Recovery(), RequestID(), AccessLog(), metrics.Middleware(), dashboard.Middleware())
+
+	// OpenTelemetry 链路追踪（可选）：设置 OTLP endpoint 后启用
+	if tracingConfig := loadTracingConfig(); tracingConfig.Endpoint != "" {
+		tracer = NewTracer(tracingConfig)
+		go tracer.Run()
+		slog.Info("tracing enabled", "endpoint", tracingConfig.Endpoint, "service", tracingConfig.ServiceName, "sample_ratio", tracingConfig.SampleRatio)
+	}
+	r.Use(Tracing())
+
+	// 跨域（可选）：浏览器直接调用 /v1 接口时处理预检请求
+	if corsConfig := loadCORSConfig(); corsConfig.enabled() {
+		r.Use(CORS(corsConfig))
+		slog.Info("cors enabled", "origins", corsConfig.AllowedOrigins, "max_age", corsConfig.MaxAge)
+	}
+
+	// 请求体大小限制（默认 32MB，与 Anthropic Messages API 上限一致）
+	maxRequestBytes := int64(getEnvInt("MAX_REQUEST_BODY_MB", 32)) << 20
+	r.Use(BodyLimit(maxRequestBytes))
+
+	// 审计日志（可选）：在 IP 访问控制之前注册，被拒绝的请求也会记录
+	// 与其他全局中间件一样必须在注册任何路由之前添加
+	auditLog, err := NewAuditLog(loadAuditConfig())
+	if err != nil {
+		slog.Error("invalid audit log config", "error", err)
+		os.Exit(1)
+	}
+	if auditLog != nil {
+		r.Use(auditLog.Middleware())
+	}
+
+	// 上游 key 池（可选）：未指定 upstream_key 的虚拟 key 轮流使用池中的 key
+	keyPool, err := NewKeyPool(loadKeyPoolConfig())
+	if err != nil {
+		slog.Error("invalid key pool config", "error", err)
+		os.Exit(1)
+	}
+	defaultUpstreamKey := os.Getenv("ANTHROPIC_API_KEY")
+	if keyPool != nil {
+		defaultUpstreamKey = keyPool.marker
+	}
+
+	// 按 IP 的访问控制（可选）：IP 白名单 / 黑名单，内网免认证
+	// 必须在注册任何路由之前添加，gin 注册路由时会复制当时的中间件链
+	aclConfig, err := loadACLConfig(defaultUpstreamKey)
+	if err != nil {
+		slog.Error("invalid ACL config", "error", err)
+		os.Exit(1)
+	}
+	// 默认信任所有地址的 X-Forwarded-For，启用 IP 访问控制时改为只使用连接的对端地址，除非配置了 TRUSTED_PROXIES
+	if len(aclConfig.Proxies) > 0 || aclConfig.enabled() {
+		if err := r.SetTrustedProxies(aclConfig.Proxies); err != nil {
+			slog.Error("invalid TRUSTED_PROXIES", "error", err)
+			os.Exit(1)
+		}
+	}
+	if aclConfig.enabled() {
+		r.Use(NetworkACL(aclConfig))
+	}
+
+	// Prometheus 指标
+	r.GET("/metrics", metrics.Handler)
+
+	// 上游 HTTP 客户端连接池配置
+	httpClientConfig := loadHTTPClientConfig()
+
+	// 上游失败重试策略
+	retryConfig := loadRetryConfig()
+
+	// 流式响应心跳间隔，0 表示关闭
+	heartbeatInterval := getEnvSecondsOrOff("SSE_HEARTBEAT_SECONDS", 15*time.Second)
+
+	// 上游超时，0 表示不限制
+	upstreamTimeout := getEnvSecondsOrOff("UPSTREAM_TIMEOUT_SECONDS", 600*time.Second)
+	streamIdleTimeout := getEnvSecondsOrOff("STREAM_IDLE_TIMEOUT_SECONDS", 300*time.Second)
+
+	// prompt caching 策略
+	cacheConfig := loadCacheConfig()
+
+	// 按 key / IP 限流
+	rateLimitConfig := loadRateLimitConfig()
+	concurrencyConfig := loadConcurrencyConfig(rateLimitConfig.ByIP)
+
+	// 就绪检查的上游探测
+	readinessConfig := loadReadinessConfig()
+
+	// 请求/响应录制（可选）
+	tape, err := NewTape(loadTapeConfig())
+	if err != nil {
+		slog.Error("invalid tape config", "error", err)
+		os.Exit(1)
+	}
+
+	// 影子流量（可选）
+	shadowConfig, err := loadShadowConfig()
+	if err != nil {
+		slog.Error("invalid shadow config", "error", err)
+		os.Exit(1)
+	}
+	shadow, err := NewShadow(shadowConfig)
+	if err != nil {
+		slog.Error("invalid shadow config", "error", err)
+		os.Exit(1)
+	}
+
+	// 转换插件（可选），按 TRANSFORMERS 的顺序执行
+	transformers, err := loadTransformers()
+	if err != nil {
+		slog.Error("invalid transformers config", "error", err)
+		os.Exit(1)
+	}
+	if keyPool != nil && readinessConfig.APIKey == "" {
+		readinessConfig.APIKey = keyPool.marker
+	}
+
+	// 虚拟 key（可选）：客户端使用代理签发的 key，由代理替换为真实的 Anthropic key
+	var keyStore *KeyStore
+	if path := os.Getenv("VIRTUAL_KEYS_FILE"); path != "" {
+		ks, err := NewKeyStore(path, defaultUpstreamKey, getEnvBool("VIRTUAL_KEYS_ALLOW_PASSTHROUGH", false))
+		if err != nil {
+			slog.Error("failed to load virtual keys", "path", path, "error", err)
+			os.Exit(1)
+		}
+		keyStore = ks
+	}
+
+	// /v1/moderations 的实现方式（可选）
+	moderationConfig, err := loadModerationConfig()
+	if err != nil {
+		slog.Error("invalid moderation config", "error", err)
+		os.Exit(1)
+	}
+
+	// 转发前的请求策略（可选）
+	guardrails, err := loadGuardrails()
+	if err != nil {
+		slog.Error("invalid guardrail config", "error", err)
+		os.Exit(1)
+	}
+
+	// OIDC 认证（可选）：校验企业 SSO 签发的 JWT，按用户统计用量，上游使用服务端配置的 key
+	var authenticators []Authenticator
+	oidc, err := NewOIDCAuthenticator(loadOIDCConfig(), defaultUpstreamKey)
+	if err != nil {
+		slog.Error("invalid OIDC config", "error", err)
+		os.Exit(1)
+	}
+	if oidc != nil {
+		authenticators = append(authenticators, oidc)
+	}
+
+	// 用量统计（可选）：按 key / 模型 / 日期聚合，定期写入 SQLite
+	var usageStore *UsageStore
+	if path := os.Getenv("USAGE_FILE"); path != "" {
+		us, err := NewUsageStore(path)
+		if err != nil {
+			slog.Error("failed to open usage database", "path", path, "error", err)
+			os.Exit(1)
+		}
+		usageStore = us
+		go usageStore.Run(getEnvSeconds("USAGE_FLUSH_SECONDS", 10*time.Second))
+	}
+
+	// 费用估算的价格表（美元 / 百万 token）
+	pricing := parseModelPricing(os.Getenv("MODEL_PRICING"))
+
+	// Anthropic 服务端工具（web_search 等），按模型追加到工具列表
+	serverTools := parseServerTools(os.Getenv("SERVER_TOOLS"), getEnvInt("SERVER_TOOLS_MAX_USES", 0))
+
+	// 额外的 anthropic-beta（全局和按模型）
+	betaConfig := loadBetaConfig()
+	overflowConfig := loadOverflowConfig()
+
+	// 按模型注入的 system 前缀/后缀
+	promptTemplates, err := loadPromptTemplates()
+	if err != nil {
+		slog.Error("invalid prompt templates", "error", err)
+		os.Exit(1)
+	}
+
+	// 按客户端模型名强制覆盖的参数
+	modelProfiles, err := loadModelProfiles()
+	if err != nil {
+		slog.Error("invalid model profiles", "error", err)
+		os.Exit(1)
+	}
+
+	adminToken := os.Getenv("ADMIN_TOKEN")
 
 	// 创建代理处理器（不需要预配置 API Key）
-	handler := NewProxyHandler(anthropicURL, modelMapping, maxTokensMapping)
+	handler, err := NewProxyHandler(ProxyConfig{
+		AnthropicURL:      anthropicURL,
+		ModelMapping:      modelMapping,
+		ModelGroups:       modelGroups,
+		DefaultModel:      strings.TrimSpace(os.Getenv("DEFAULT_TARGET_MODEL")),
+		EchoRequestModel:  getEnvBool("ECHO_REQUEST_MODEL", false),
+		MaxTokensMapping:  maxTokensMapping,
+		ThinkingBudgets:   thinkingBudgets,
+		TemperatureMode:   strings.ToLower(os.Getenv("TEMPERATURE_MODE")),
+		PredictionMode:    strings.ToLower(os.Getenv("PREDICTION_MODE")),
+		StrictParams:      getEnvBool("STRICT_PARAMS", false),
+		StrictJSON:        getEnvBool("STRICT_JSON", false),
+		RejectLogprobs:    getEnvBool("REJECT_LOGPROBS", false),
+		StaticModels:      staticModels,
+		Routes:            routes,
+		MaxN:              getEnvInt("MAX_N", 8),
+		FanoutConcurrency: getEnvInt("N_CONCURRENCY", 4),
+		Retry:             retryConfig,
+		MaxResponseBytes:  int64(getEnvInt("MAX_RESPONSE_BODY_MB", 64)) << 20,
+		HeartbeatInterval: heartbeatInterval,
+		UpstreamTimeout:   upstreamTimeout,
+		StreamIdleTimeout: streamIdleTimeout,
+		KeyStore:          keyStore,
+		Authenticators:    authenticators,
+		TrustedKey:        aclConfig.TrustedKey,
+		Audit:             auditLog,
+		Cache:             cacheConfig,
+		RateLimit:         rateLimitConfig,
+		Concurrency:       concurrencyConfig,
+		Readiness:         readinessConfig,
+		UsageStore:        usageStore,
+		Pricing:           pricing,
+		OutputLimits:      parseOutputLimits(os.Getenv("MODEL_MAX_OUTPUT_TOKENS")),
+		Overflow:          overflowConfig,
+		Reverse:           loadReverseConfig(),
+		StreamUpgrade:     getEnvBool("STREAM_UPGRADE", false),
+		UpgradeMinTokens:  getEnvInt("STREAM_UPGRADE_MIN_TOKENS", 0),
+		Embeddings:        loadEmbeddingsConfig(),
+		Moderation:        moderationConfig,
+		Guardrails:        guardrails,
+		ServerTools:       serverTools,
+		Betas:             betaConfig,
+		PromptTemplates:   promptTemplates,
+		ModelProfiles:     modelProfiles,
+		OllamaAPIKey:      os.Getenv("OLLAMA_API_KEY"),
+		Failover:          loadFailoverConfig(),
+		ResponseCache:     loadResponseCacheConfig(),
+		KeyPool:           keyPool,
+		Tape:              tape,
+		Shadow:            shadow,
+		Transformers:      transformers,
+		AdminToken:        adminToken,
+		HTTPClient:        httpClientConfig,
+	})
+	if err != nil {
+		slog.Error("failed to create proxy handler", "error", err)
+		os.Exit(1)
+	}
+
+	// 健康检查：/health 附带配置和熔断状态，/healthz 为存活检查，/readyz 为就绪检查
+	r.GET("/health", handler.HandleHealth)
+	r.GET("/healthz", handler.HandleLiveness)
+	r.GET("/readyz", handler.HandleReadiness)
 
 	// OpenAI 兼容的端点
 	r.POST("/v1/chat/completions", handler.HandleChatCompletions)
+	r.POST("/v1/completions", handler.HandleCompletions)
+	r.POST("/v1/responses", handler.HandleResponses)
+	r.POST("/v1/embeddings", handler.HandleEmbeddings)
+	r.POST("/v1/moderations", handler.HandleModerations)
+	r.GET("/v1/models", handler.HandleModels)
+	r.GET("/v1/models/:model", handler.HandleModel)
+	r.GET("/v1/usage", handler.HandleUsage)
+
+	// OpenAI Batch API，转换为 Anthropic Message Batches API
+	r.POST("/v1/files", handler.HandleUploadFile)
+	r.GET("/v1/files", handler.HandleListFiles)
+	r.GET("/v1/files/:file_id", handler.HandleGetFile)
+	r.GET("/v1/files/:file_id/content", handler.HandleFileContent)
+	r.DELETE("/v1/files/:file_id", handler.HandleDeleteFile)
+	r.POST("/v1/batches", handler.HandleCreateBatch)
+	r.GET("/v1/batches", handler.HandleListBatches)
+	r.GET("/v1/batches/:batch_id", handler.HandleGetBatch)
+	r.POST("/v1/batches/:batch_id/cancel", handler.HandleCancelBatch)
+
+	// Azure OpenAI 风格的端点：部署名作为模型名
+	azure := r.Group("/openai/deployments/:deployment", AzureDeployment())
+	azure.POST("/chat/completions", handler.HandleChatCompletions)
+	azure.POST("/completions", handler.HandleCompletions)
+	azure.POST("/embeddings", handler.HandleEmbeddings)
+
+	// Ollama 兼容的端点
+	r.POST("/api/chat", handler.HandleOllamaChat)
+	r.POST("/api/generate", handler.HandleOllamaGenerate)
+	r.GET("/api/tags", handler.HandleOllamaTags)
+	r.GET("/api/version", handler.HandleOllamaVersion)
+
+	// Anthropic 原生端点（透传，不转换）
+	r.POST("/v1/messages", handler.HandleMessages)
+
+	// Anthropic 格式的端点，转换为 Chat Completions 发送给 OpenAI 兼容上游
+	r.POST("/anthropic/v1/messages", handler.HandleAnthropicMessages)
+	r.POST("/anthropic/v1/messages/count_tokens", handler.HandleAnthropicCountTokens)
+
+	// 管理接口（需要 ADMIN_TOKEN），/dashboard 页面使用 ADMIN_TOKEN 读取 /admin/dashboard
+	if adminToken != "" {
+		r.GET("/dashboard", handler.HandleDashboard)
+		admin := r.Group("/admin", AdminAuth(adminToken))
+		admin.GET("/dashboard", handler.HandleDashboardStats)
+		admin.GET("/config", handler.HandleGetConfig)
+		admin.PUT("/config", handler.HandleUpdateConfig)
+		if keyStore != nil {
+			admin.GET("/keys", handler.HandleListKeys)
+			admin.POST("/keys", handler.HandleCreateKey)
+			admin.PATCH("/keys/:id", handler.HandleUpdateKey)
+			admin.DELETE("/keys/:id", handler.HandleDeleteKey)
+		}
+		if auditLog != nil {
+			admin.GET("/audit", handler.HandleAuditExport)
+			admin.GET("/audit/verify", handler.HandleAuditVerify)
+		}
+		if shadow != nil {
+			admin.GET("/shadow", handler.HandleShadowReport)
+			admin.DELETE("/shadow", handler.HandleResetShadowReport)
+		}
+	}
 
 	// 启动服务器
-	log.Printf("Starting proxy server on port %s", port)
-	log.Printf("Anthropic API URL: %s", anthropicURL)
-	log.Printf("Cache control: Enabled (1h TTL)")
-	log.Printf("API Key: From request Authorization header")
+	listenerTLS := loadListenerTLSConfig()
+	slog.Info("starting proxy server",
+		"version", version,
+		"port", port,
+		"tls", listenerTLS.enabled(),
+		"anthropic_url", anthropicURL,
+		"api_key", "from request Authorization header")
+	if listenerTLS.ClientCAFile != "" {
+		slog.Info("client certificate verification", "ca_file", listenerTLS.ClientCAFile, "client_auth", listenerTLS.ClientAuth)
+	}
+	if auditLog != nil {
+		slog.Info("audit log enabled",
+			"dir", auditLog.cfg.Dir,
+			"max_bytes", auditLog.cfg.MaxBytes,
+			"hmac", auditLog.cfg.HMACKey != "",
+			"seq", auditLog.seq)
+	}
+	if aclConfig.enabled() {
+		slog.Info("ip access control enabled",
+			"allow", len(aclConfig.Allow),
+			"deny", len(aclConfig.Deny),
+			"trusted_networks", len(aclConfig.Trusted),
+			"trusted_proxies", aclConfig.Proxies)
+	}
+	if oidc != nil {
+		slog.Info("OIDC authentication enabled",
+			"issuer", oidc.cfg.Issuer,
+			"audience", oidc.cfg.Audiences,
+			"user_claim", oidc.cfg.UserClaim,
+			"required", oidc.cfg.Required)
+	}
+	if keyStore != nil {
+		slog.Info("virtual keys enabled", "file", os.Getenv("VIRTUAL_KEYS_FILE"), "keys", len(keyStore.List()))
+	}
+	switch {
+	case keyPool != nil && keyStore != nil:
+		slog.Info("upstream key pool", "keys", len(keyPool.keys), "strategy", keyPool.strategy, "cooldown", keyPool.cooldown)
+	case keyPool != nil:
+		// 没有虚拟 key 时请求直接使用客户端的 key，key 池只用于就绪检查
+		slog.Warn("ANTHROPIC_API_KEYS is only used by virtual keys, set VIRTUAL_KEYS_FILE to enable it")
+	}
+	for _, t := range transformers {
+		slog.Info("transformer enabled", "name", t.Name())
+	}
+	if guardrails != nil {
+		slog.Info("guardrails enabled",
+			"keywords", guardrails.Keywords != nil,
+			"topics", len(guardrails.Topics),
+			"max_tools", guardrails.MaxTools,
+			"banned_tools", guardrails.BannedTools)
+	}
+	switch moderationConfig.Backend {
+	case "keywords":
+		slog.Info("moderation enabled", "backend", "keywords", "categories", len(moderationConfig.Keywords))
+	case "claude":
+		slog.Info("moderation enabled", "backend", "claude", "model", moderationConfig.Model, "threshold", moderationConfig.Threshold)
+	case "openai":
+		slog.Info("moderation enabled", "backend", "openai", "base_url", moderationConfig.BaseURL)
+	}
+	if shadow != nil {
+		slog.Info("shadow traffic enabled", "model", shadow.cfg.Model, "percent", shadow.cfg.Percent, "source_models", shadow.cfg.SourceModels, "dir", shadow.cfg.Dir, "max_concurrency", shadow.cfg.MaxConcurrency)
+	}
+	if tape != nil {
+		slog.Info("recording requests to tape", "dir", tape.cfg.Dir, "redact_content", tape.cfg.RedactContent, "stream_message", tape.cfg.StreamMessage)
+	}
+	for _, route := range routes {
+		slog.Info("route", "route", route.String())
+	}
+	if cacheConfig.Enabled {
+		slog.Info("prompt caching",
+			"ttl", cacheConfig.TTL,
+			"system", cacheConfig.System,
+			"tools", cacheConfig.Tools,
+			"assistant", cacheConfig.Assistant,
+			"user_turns", cacheConfig.UserTurns,
+			"sticky", cacheConfig.Sticky)
+	} else {
+		slog.Info("prompt caching disabled")
+	}
+	if len(betaConfig.Global) > 0 {
+		slog.Info("anthropic betas", "betas", betaConfig.Global)
+	}
+	for _, m := range betaConfig.Models {
+		slog.Info("model betas", "pattern", m.Pattern, "betas", m.Betas)
+	}
+	for _, t := range promptTemplates {
+		slog.Info("prompt template", "pattern", t.Model, "prefix_chars", runeLen(t.Prefix), "suffix_chars", runeLen(t.Suffix))
+	}
+	for _, p := range modelProfiles {
+		slog.Info("model profile", "pattern", p.Model)
+	}
+	switch overflowConfig.Mode {
+	case "truncate":
+		slog.Info("context overflow truncation", "count_tokens", overflowConfig.CountTokens)
+	case "summarize":
+		slog.Info("context compaction", "model", overflowConfig.CompactionModel,
+			"threshold", overflowConfig.CompactionThreshold, "count_tokens", overflowConfig.CountTokens)
+	}
+	if getEnvBool("STREAM_UPGRADE", false) {
+		slog.Info("stream upgrade enabled", "min_max_tokens", getEnvInt("STREAM_UPGRADE_MIN_TOKENS", 0))
+	}
+	for _, p := range pricing {
+		slog.Info("pricing", "pattern", p.Pattern, "input", p.Input, "output", p.Output, "cache_read", p.CacheRead, "cache_write", p.CacheWrite)
+	}
+	if usageStore != nil {
+		slog.Info("usage accounting enabled", "file", os.Getenv("USAGE_FILE"))
+	}
+	if rateLimitConfig.enabled() {
+		slog.Info("rate limit",
+			"rpm", rateLimitConfig.RPM,
+			"tpm", rateLimitConfig.TPM,
+			"model_rpm", rateLimitConfig.ModelRPM,
+			"by_ip", rateLimitConfig.ByIP)
+	}
+	if concurrencyConfig.MaxConcurrent > 0 {
+		slog.Info("concurrency limit",
+			"max_concurrent", concurrencyConfig.MaxConcurrent,
+			"max_queue", concurrencyConfig.MaxQueue,
+			"queue_timeout", concurrencyConfig.QueueTimeout,
+			"by_ip", concurrencyConfig.ByIP)
+	}
+	slog.Info("retry",
+		"max_attempts", retryConfig.MaxAttempts,
+		"base_delay", retryConfig.BaseDelay,
+		"max_delay", retryConfig.MaxDelay)
+	slog.Info("timeouts",
+		"connect", httpClientConfig.ConnectTimeout,
+		"upstream", upstreamTimeout,
+		"stream_idle", streamIdleTimeout)
+	slog.Info("http client",
+		"max_idle_conns", httpClientConfig.MaxIdleConns,
+		"max_idle_conns_per_host", httpClientConfig.MaxIdleConnsPerHost,
+		"idle_timeout", httpClientConfig.IdleConnTimeout,
+		"proxy", httpClientConfig.proxyDescription(),
+		"http2", httpClientConfig.HTTP2)
 	if len(modelMapping) > 0 {
-		log.Printf("Model mapping: %v", modelMapping)
+		slog.Info("model mapping", "mapping", modelMapping)
 	} else {
-		log.Printf("Model mapping: Disabled (passthrough)")
+		slog.Info("model mapping disabled (passthrough)")
+	}
+	for alias, targets := range modelGroups {
+		slog.Info("model group", "alias", alias, "targets", targets)
+	}
+	if handler.defaultModel != "" {
+		slog.Info("default target model", "model", handler.defaultModel)
+	}
+	if handler.echoRequestModel {
+		slog.Info("echo request model enabled")
+	}
+	if len(thinkingBudgets) > 0 {
+		slog.Info("thinking budgets", "mapping", thinkingBudgets)
 	}
 	if len(maxTokensMapping) > 0 {
-		log.Printf("Max tokens mapping: %v", maxTokensMapping)
+		slog.Info("max tokens mapping", "mapping", maxTokensMapping)
 	} else {
-		log.Printf("Max tokens mapping: Using defaults")
+		slog.Info("max tokens mapping: using defaults")
+	}
+	switch {
+	case readinessConfig.enabled():
+		slog.Info("readiness probe", "mode", readinessConfig.Probe, "cache", readinessConfig.CacheTTL)
+		// 启动时探测一次上游，结果只用于日志
+		go handler.logStartupProbe()
+	case readinessConfig.Probe != "" && readinessConfig.Probe != "off":
+		slog.Warn("unknown READINESS_PROBE, expected off, head or models", "value", readinessConfig.Probe)
 	}
 
-	if err := r.Run(":" + port); err != nil {
-		log.Fatal(err)
+	// 收到 SIGINT / SIGTERM 后停止接受新请求，等进行中的请求结束后再写入用量；再次收到信号时直接退出
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	err = serve(ctx, r, ":"+port, listenerTLS, getEnvSeconds("SHUTDOWN_TIMEOUT_SECONDS", 30*time.Second))
+	if usageStore != nil {
+		if cerr := usageStore.Close(); cerr != nil {
+			slog.Error("failed to save usage", "path", os.Getenv("USAGE_FILE"), "error", cerr)
+		}
+	}
+	if err != nil {
+		slog.Error("server stopped", "error", err)
+		os.Exit(1)
 	}
+	slog.Info("server stopped")
 }
 
 // parseModelMapping 解析模型映射配置
@@ -122,4 +615,3 @@ func parseMaxTokensMapping(mappingStr string) map[string]int {
 
 	return mapping
 }
-
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"log/slog"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OutputLimit 模型的最大输出 token 数，max_tokens 超过时 Anthropic 返回 400
+type OutputLimit struct {
+	Pattern   string // glob 模式，如 claude-sonnet-4*
+	MaxTokens int
+}
+
+// defaultOutputLimits 内置的模型输出上限，按书写顺序匹配，未匹配的模型不限制
+var defaultOutputLimits = []OutputLimit{
+	{"claude-opus-4-5*", 64000},
+	{"claude-opus-4*", 32000},
+	{"claude-sonnet-4*", 64000},
+	{"claude-haiku-4*", 64000},
+	{"claude-3-7-sonnet*", 64000},
+	{"claude-3-5-*", 8192},
+	{"claude-3-*", 4096},
+}
+
+// parseOutputLimits 解析 MODEL_MAX_OUTPUT_TOKENS，配置项优先于内置上限
+// 格式: "pattern=tokens"，示例: "claude-opus-4-1*=32000,my-proxy-model=8192"
+func parseOutputLimits(limitsStr string) []OutputLimit {
+	limits := make([]OutputLimit, 0, len(defaultOutputLimits))
+
+	for _, item := range strings.Split(limitsStr, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		pattern := strings.TrimSpace(parts[0])
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			slog.Warn("invalid max output tokens pattern", "pattern", pattern, "error", err)
+			continue
+		}
+		tokens, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || tokens <= 0 {
+			slog.Warn("invalid max output tokens", "pattern", pattern, "value", parts[1])
+			continue
+		}
+		limits = append(limits, OutputLimit{Pattern: pattern, MaxTokens: tokens})
+	}
+
+	return append(limits, defaultOutputLimits...)
+}
+
+// outputLimit 返回模型的输出上限，未配置时返回 false
+func (h *ProxyHandler) outputLimit(model string) (int, bool) {
+	for _, l := range h.outputLimits {
+		if ok, _ := path.Match(l.Pattern, model); ok {
+			return l.MaxTokens, true
+		}
+	}
+	return 0, false
+}
+
+// fitMaxTokens 将 max_tokens 限制在模型的输出上限内，返回调整前的值和是否调整
+// thinking 预算必须小于 max_tokens：放不下时减半，仍低于最小预算则关闭 thinking
+func (h *ProxyHandler) fitMaxTokens(req *AnthropicRequest) (int, bool) {
+	limit, ok := h.outputLimit(req.Model)
+	if !ok || req.MaxTokens <= limit {
+		return req.MaxTokens, false
+	}
+	requested := req.MaxTokens
+	req.MaxTokens = limit
+
+	if req.Thinking != nil && req.Thinking.BudgetTokens >= limit {
+		if budget := limit / 2; budget >= minThinkingBudget {
+			thinking := *req.Thinking
+			thinking.BudgetTokens = budget
+			req.Thinking = &thinking
+		} else {
+			req.Thinking = nil
+		}
+	}
+	return requested, true
+}
+
+// clampMaxTokens 调整超过模型输出上限的 max_tokens，并通过 x-proxy-max-tokens-clamped 告知客户端调整后的值
+func (h *ProxyHandler) clampMaxTokens(c *gin.Context, req *AnthropicRequest, reqID string) {
+	requested, clamped := h.fitMaxTokens(req)
+	if !clamped {
+		return
+	}
+	reqLog(reqID).Info("max_tokens clamped", "model", req.Model, "requested", requested, "max_tokens", req.MaxTokens)
+	c.Header("x-proxy-max-tokens-clamped", strconv.Itoa(req.MaxTokens))
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 轻量的 Prometheus 文本格式指标实现，避免引入额外依赖
+
+// metricsModelKey handler 通过 c.Set 记录实际使用的模型，供中间件打标签
+const metricsModelKey = "metrics_model"
+
+var (
+	latencyBuckets   = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+	tokenRateBuckets = []float64{5, 10, 20, 40, 60, 80, 100, 150, 200, 400}
+)
+
+type labelSet []string // 按 name1, value1, name2, value2 ... 排列
+
+func (l labelSet) key() string {
+	return strings.Join(l, "\xff")
+}
+
+func (l labelSet) String() string {
+	if len(l) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(l)/2)
+	for i := 0; i+1 < len(l); i += 2 {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, l[i], escapeLabelValue(l[i+1])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func escapeLabelValue(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `"`, `\"`)
+	return strings.ReplaceAll(v, "\n", `\n`)
+}
+
+type counterVec struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	values     map[string]float64
+	labelSets  map[string]labelSet
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{
+		name:      name,
+		help:      help,
+		labels:    labels,
+		values:    make(map[string]float64),
+		labelSets: make(map[string]labelSet),
+	}
+}
+
+func (c *counterVec) Add(v float64, values ...string) {
+	ls := makeLabelSet(c.labels, values)
+	k := ls.key()
+	c.mu.Lock()
+	c.values[k] += v
+	c.labelSets[k] = ls
+	c.mu.Unlock()
+}
+
+func (c *counterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, k := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelSets[k], formatFloat(c.values[k]))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+	mu         sync.Mutex
+	values     map[string]*histogram
+	labelSets  map[string]labelSet
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		name:      name,
+		help:      help,
+		labels:    labels,
+		buckets:   buckets,
+		values:    make(map[string]*histogram),
+		labelSets: make(map[string]labelSet),
+	}
+}
+
+func (hv *histogramVec) Observe(v float64, values ...string) {
+	ls := makeLabelSet(hv.labels, values)
+	k := ls.key()
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+	h, ok := hv.values[k]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(hv.buckets))}
+		hv.values[k] = h
+		hv.labelSets[k] = ls
+	}
+	for i, upper := range hv.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (hv *histogramVec) writeTo(w io.Writer) {
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", hv.name, hv.help, hv.name)
+	for _, k := range sortedKeys(hv.values) {
+		h := hv.values[k]
+		ls := hv.labelSets[k]
+		for i, upper := range hv.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", hv.name, append(ls[:len(ls):len(ls)], "le", formatFloat(upper)), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", hv.name, append(ls[:len(ls):len(ls)], "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", hv.name, ls, formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", hv.name, ls, h.count)
+	}
+}
+
+func makeLabelSet(names, values []string) labelSet {
+	ls := make(labelSet, 0, len(names)*2)
+	for i, name := range names {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		ls = append(ls, name, v)
+	}
+	return ls
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return fmt.Sprintf("%g", v)
+}
+
+// ProxyMetrics 代理暴露的全部指标
+type ProxyMetrics struct {
+	requests        *counterVec
+	upstreamLatency *histogramVec
+	streamTokenRate *histogramVec
+	tokens          *counterVec
+	toolCalls       *counterVec
+	upstreamRetries *counterVec
+	responseCache   *counterVec
+	guardrailBlocks *counterVec
+	modelGroups     *counterVec
+	shadow          *counterVec
+}
+
+var metrics = &ProxyMetrics{
+	requests: newCounterVec("proxy_requests_total",
+		"Total HTTP requests handled by the proxy.", "endpoint", "model", "status"),
+	upstreamLatency: newHistogramVec("proxy_upstream_latency_seconds",
+		"Time until the upstream returned response headers.", latencyBuckets, "model", "status"),
+	streamTokenRate: newHistogramVec("proxy_stream_tokens_per_second",
+		"Output tokens per second for streamed responses.", tokenRateBuckets, "model"),
+	tokens: newCounterVec("proxy_tokens_total",
+		"Tokens reported by the upstream usage, by type (input/output/cache_read/cache_creation).", "model", "type"),
+	toolCalls: newCounterVec("proxy_tool_calls_total",
+		"Tool calls returned by the upstream.", "model"),
+	upstreamRetries: newCounterVec("proxy_upstream_retries_total",
+		"Upstream attempts that failed and were retried, by the failing status (502 for connection errors).", "model", "status"),
+	responseCache: newCounterVec("proxy_response_cache_total",
+		"Response cache lookups for cacheable non-streaming requests, by result (hit/miss).", "model", "result"),
+	guardrailBlocks: newCounterVec("proxy_guardrail_blocks_total",
+		"Requests rejected by guardrails, by rule (keyword/topic:<name>/max_tools/banned_tool).", "model", "rule"),
+	modelGroups: newCounterVec("proxy_model_group_selections_total",
+		"Requests routed through a model group, by alias and selected target model.", "group", "model"),
+	shadow: newCounterVec("proxy_shadow_requests_total",
+		"Shadow requests by shadow model and result (ok/error/skipped).", "model", "result"),
+}
+
+// ObserveUpstream 记录上游响应延迟
+func (m *ProxyMetrics) ObserveUpstream(model string, status int, elapsed time.Duration) {
+	m.upstreamLatency.Observe(elapsed.Seconds(), model, fmt.Sprint(status))
+}
+
+// ObserveRetry 记录一次重试
+func (m *ProxyMetrics) ObserveRetry(model string, status int) {
+	m.upstreamRetries.Inc(model, fmt.Sprint(status))
+}
+
+// ObserveUsage 记录 token 用量
+func (m *ProxyMetrics) ObserveUsage(model string, usage *AnthropicUsage) {
+	if usage == nil {
+		return
+	}
+	m.tokens.Add(float64(usage.InputTokens), model, "input")
+	m.tokens.Add(float64(usage.OutputTokens), model, "output")
+	m.tokens.Add(float64(usage.CacheReadInputTokens), model, "cache_read")
+	m.tokens.Add(float64(usage.CacheCreationInputTokens), model, "cache_creation")
+}
+
+// ObserveStream 记录流式输出速率（output tokens / 流持续时间）
+func (m *ProxyMetrics) ObserveStream(model string, outputTokens int, elapsed time.Duration) {
+	if outputTokens > 0 && elapsed > 0 {
+		m.streamTokenRate.Observe(float64(outputTokens)/elapsed.Seconds(), model)
+	}
+}
+
+// ObserveToolCalls 记录工具调用次数
+func (m *ProxyMetrics) ObserveToolCalls(model string, n int) {
+	if n > 0 {
+		m.toolCalls.Add(float64(n), model)
+	}
+}
+
+// ObserveResponseCache 记录一次响应缓存查询
+func (m *ProxyMetrics) ObserveResponseCache(model string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.responseCache.Inc(model, result)
+}
+
+// ObserveGuardrailBlock 记录一次被 guardrail 拒绝的请求
+func (m *ProxyMetrics) ObserveGuardrailBlock(model string, rule string) {
+	m.guardrailBlocks.Inc(model, rule)
+}
+
+// ObserveModelGroup 记录模型组的一次目标选择
+func (m *ProxyMetrics) ObserveModelGroup(group string, model string) {
+	m.modelGroups.Inc(group, model)
+}
+
+// ObserveShadow 记录一次影子请求的结果
+func (m *ProxyMetrics) ObserveShadow(model string, result string) {
+	m.shadow.Inc(model, result)
+}
+
+// Middleware 按 endpoint/model/status 统计请求数
+func (m *ProxyMetrics) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		endpoint := c.FullPath()
+		if endpoint == "" || endpoint == "/metrics" {
+			return
+		}
+		m.requests.Inc(endpoint, c.GetString(metricsModelKey), fmt.Sprint(c.Writer.Status()))
+	}
+}
+
+// Handler 以 Prometheus 文本格式输出指标（GET /metrics）
+func (m *ProxyMetrics) Handler(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(http.StatusOK)
+	m.requests.writeTo(c.Writer)
+	m.upstreamLatency.writeTo(c.Writer)
+	m.streamTokenRate.writeTo(c.Writer)
+	m.tokens.writeTo(c.Writer)
+	m.toolCalls.writeTo(c.Writer)
+	m.upstreamRetries.writeTo(c.Writer)
+	m.responseCache.writeTo(c.Writer)
+	m.guardrailBlocks.writeTo(c.Writer)
+	m.modelGroups.writeTo(c.Writer)
+	m.shadow.writeTo(c.Writer)
+}
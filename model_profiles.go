@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+)
+
+// ModelProfile 按客户端请求的模型名（映射前）强制覆盖的参数，使一个别名代表一整套配置
+// 例如 gpt-4-creative 经 MODEL_MAPPING 映射到 sonnet，再由 profile 固定 temperature 1.0；未设置的字段不覆盖
+type ModelProfile struct {
+	Model          string   `json:"model"` // 客户端模型名 glob（映射前）
+	Temperature    *float64 `json:"temperature,omitempty"`
+	TopP           *float64 `json:"top_p,omitempty"`
+	TopK           *int     `json:"top_k,omitempty"`
+	MaxTokens      *int     `json:"max_tokens,omitempty"`
+	ThinkingBudget *int     `json:"thinking_budget,omitempty"` // 0 表示关闭 thinking（覆盖 THINKING_BUDGET_MAPPING）
+}
+
+// loadModelProfiles 从 MODEL_PROFILES_FILE（JSON 数组）读取参数覆盖表，未配置时返回 nil
+func loadModelProfiles() ([]ModelProfile, error) {
+	name := os.Getenv("MODEL_PROFILES_FILE")
+	if name == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var profiles []ModelProfile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", name, err)
+	}
+	for i, p := range profiles {
+		if _, err := path.Match(p.Model, ""); err != nil || p.Model == "" {
+			return nil, fmt.Errorf("%s: profile %d has invalid model pattern %q", name, i, p.Model)
+		}
+		// 使用 Anthropic 的取值范围；temperature 为 0 时会被省略（上游按默认值 1 处理），因此不允许
+		if p.Temperature != nil && (*p.Temperature <= 0 || *p.Temperature > 1) {
+			return nil, fmt.Errorf("%s: profile %s: temperature must be in (0, 1]", name, p.Model)
+		}
+		if p.TopP != nil && (*p.TopP <= 0 || *p.TopP > 1) {
+			return nil, fmt.Errorf("%s: profile %s: top_p must be in (0, 1]", name, p.Model)
+		}
+		if p.TopK != nil && *p.TopK <= 0 {
+			return nil, fmt.Errorf("%s: profile %s: top_k must be positive", name, p.Model)
+		}
+		if p.MaxTokens != nil && *p.MaxTokens <= 0 {
+			return nil, fmt.Errorf("%s: profile %s: max_tokens must be positive", name, p.Model)
+		}
+		if p.ThinkingBudget != nil && *p.ThinkingBudget != 0 && *p.ThinkingBudget < minThinkingBudget {
+			return nil, fmt.Errorf("%s: profile %s: thinking_budget must be 0 or at least %d", name, p.Model, minThinkingBudget)
+		}
+	}
+	return profiles, nil
+}
+
+// modelProfile 返回第一个匹配客户端模型名的 profile，没有时返回 nil
+func (h *ProxyHandler) modelProfile(model string) *ModelProfile {
+	for i := range h.modelProfiles {
+		if ok, _ := path.Match(h.modelProfiles[i].Model, model); ok {
+			return &h.modelProfiles[i]
+		}
+	}
+	return nil
+}
+
+// applyModelProfile 在转换和 THINKING_BUDGET_MAPPING 之后覆盖参数
+// thinking 开启时 Anthropic 不接受 temperature / top_p / top_k，此时忽略 profile 中的采样参数
+func applyModelProfile(req *AnthropicRequest, profile *ModelProfile, reqID string) {
+	if profile == nil {
+		return
+	}
+	logger := reqLog(reqID)
+
+	if profile.MaxTokens != nil {
+		req.MaxTokens = *profile.MaxTokens
+	}
+	if profile.ThinkingBudget != nil {
+		if *profile.ThinkingBudget == 0 {
+			req.Thinking = nil
+		} else {
+			req.Thinking = nil
+			enableThinking(req, *profile.ThinkingBudget, reqID)
+		}
+	}
+
+	if req.Thinking != nil {
+		if profile.Temperature != nil || profile.TopP != nil || profile.TopK != nil {
+			logger.Debug("profile sampling parameters ignored: thinking enabled", "pattern", profile.Model)
+		}
+	} else {
+		if profile.Temperature != nil {
+			req.Temperature = profile.Temperature
+		}
+		if profile.TopP != nil {
+			req.TopP = *profile.TopP
+		}
+		if profile.TopK != nil {
+			req.TopK = *profile.TopK
+		}
+	}
+	logger.Debug("applied model profile", "pattern", profile.Model, "max_tokens", req.MaxTokens,
+		"temperature", req.Temperature, "top_p", req.TopP, "top_k", req.TopK, "thinking", req.Thinking != nil)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// ModelGroupTarget 模型组中的一个目标模型，按 Weight 占比分配请求
+type ModelGroupTarget struct {
+	Model  string `json:"model"`
+	Weight int    `json:"weight"`
+}
+
+// parseModelGroups 解析 MODEL_GROUPS
+// 格式: "别名=模型1:权重1|模型2:权重2,别名2=..."，权重取最后一个冒号之后的部分，模型名本身可以带冒号
+// 示例: "gpt-4=claude-sonnet-4-5-20250929:70|claude-opus-4-1-20250805:30"
+func parseModelGroups(s string) (map[string][]ModelGroupTarget, error) {
+	groups := make(map[string][]ModelGroupTarget)
+	for _, item := range parseModelList(s) {
+		alias, spec, ok := strings.Cut(item, "=")
+		alias = strings.TrimSpace(alias)
+		if !ok || alias == "" {
+			return nil, fmt.Errorf("invalid group %q, expected alias=model:weight|model:weight", item)
+		}
+		var targets []ModelGroupTarget
+		for _, part := range strings.Split(spec, "|") {
+			part = strings.TrimSpace(part)
+			i := strings.LastIndex(part, ":")
+			if i < 0 {
+				return nil, fmt.Errorf("%s: target %q has no weight, expected model:weight", alias, part)
+			}
+			weight, err := strconv.Atoi(part[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid weight in %q", alias, part)
+			}
+			targets = append(targets, ModelGroupTarget{Model: strings.TrimSpace(part[:i]), Weight: weight})
+		}
+		groups[alias] = targets
+	}
+	if err := validateModelGroups(groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// validateModelGroups 每个组至少一个目标，模型名不为空，权重为正数
+func validateModelGroups(groups map[string][]ModelGroupTarget) error {
+	for alias, targets := range groups {
+		if alias == "" {
+			return fmt.Errorf("group alias must not be empty")
+		}
+		if len(targets) == 0 {
+			return fmt.Errorf("%s: group has no targets", alias)
+		}
+		for _, t := range targets {
+			if t.Model == "" {
+				return fmt.Errorf("%s: target model must not be empty", alias)
+			}
+			if t.Weight <= 0 {
+				return fmt.Errorf("%s: weight of %s must be positive, got %d", alias, t.Model, t.Weight)
+			}
+		}
+	}
+	return nil
+}
+
+// pickGroupTarget 按权重随机选择一个目标模型，上游处于熔断中的目标不参与选择；
+// 全部熔断时仍按权重在所有目标中选择，由 failover 处理
+func (h *ProxyHandler) pickGroupTarget(alias string, targets []ModelGroupTarget, reqID string) string {
+	candidates := make([]ModelGroupTarget, 0, len(targets))
+	for _, t := range targets {
+		if h.breakers.available(h.resolveUpstream(t.Model).BaseURL) {
+			candidates = append(candidates, t)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = targets
+	}
+
+	total := 0
+	for _, t := range candidates {
+		total += t.Weight
+	}
+	n := rand.Intn(total)
+	picked := candidates[len(candidates)-1].Model
+	for _, t := range candidates {
+		if n < t.Weight {
+			picked = t.Model
+			break
+		}
+		n -= t.Weight
+	}
+
+	reqLog(reqID).Info("model group target selected", "group", alias, "to", picked, "candidates", len(candidates), "targets", len(targets))
+	metrics.ObserveModelGroup(alias, picked)
+	return picked
+}
@@ -4,12 +4,33 @@ type OpenAIRequest struct {
 	Model       string          `json:"model"`
 	Messages    []OpenAIMessage `json:"messages"`
 	MaxTokens   int             `json:"max_tokens,omitempty"`
-	Temperature float64         `json:"temperature,omitempty"`
+	Temperature *float64        `json:"temperature,omitempty"` // nil 表示未设置，显式的 0 需要传给上游
 	TopP        float64         `json:"top_p,omitempty"`
+	TopK        int             `json:"top_k,omitempty"` // 非 OpenAI 标准参数，LiteLLM 等客户端会发送
 	Stream      bool            `json:"stream,omitempty"`
+	N           int             `json:"n,omitempty"`
 	Tools       []OpenAITool    `json:"tools,omitempty"`
 	ToolChoice  interface{}     `json:"tool_choice,omitempty"`
+	ParallelToolCalls *bool     `json:"parallel_tool_calls,omitempty"` // false 时最多调用一个工具
+	Functions    []OpenAIFunction `json:"functions,omitempty"`     // 旧版函数定义，等同于 tools
+	FunctionCall interface{}      `json:"function_call,omitempty"` // 旧版 "none" / "auto" / {"name": ...}，等同于 tool_choice
+	Stop        interface{}     `json:"stop,omitempty"` // string or []string
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+	StreamOptions  *StreamOptions  `json:"stream_options,omitempty"`
 	User        string          `json:"user,omitempty"` // OpenAI 的 user 字段，用于生成 metadata.user_id
+	Seed        *int64          `json:"seed,omitempty"` // Anthropic 不支持，仅用于返回 system_fingerprint
+	Prediction  *OpenAIPrediction `json:"prediction,omitempty"` // predicted outputs，见 applyPrediction
+	ExtraBody   map[string]interface{} `json:"extra_body,omitempty"` // 原样合并到 Anthropic 请求体，见 AnthropicRequest.Extra
+}
+
+// StreamOptions OpenAI stream_options 参数
+type StreamOptions struct {
+	// IncludeUsage 为 true 时在 [DONE] 之前单独发送一个 choices 为空、只带 usage 的 chunk
+	IncludeUsage bool `json:"include_usage"`
+}
+
+func (r OpenAIRequest) includeUsage() bool {
+	return r.Stream && r.StreamOptions != nil && r.StreamOptions.IncludeUsage
 }
 
 type OpenAIMessage struct {
@@ -17,6 +38,8 @@ type OpenAIMessage struct {
 	Content   interface{} `json:"content"` // string or []OpenAIContent
 	ToolCalls []ToolCall  `json:"tool_calls,omitempty"`
 	ToolCallID string     `json:"tool_call_id,omitempty"`
+	FunctionCall *FunctionCall `json:"function_call,omitempty"` // 旧版 assistant 函数调用
+	Name       string     `json:"name,omitempty"`             // 旧版 role=function 消息的函数名
 }
 
 type OpenAIContent struct {
@@ -51,13 +74,16 @@ type AnthropicRequest struct {
 	MaxTokens     int                     `json:"max_tokens"`
 	Messages      []AnthropicMessage      `json:"messages"`
 	System        []AnthropicSystemBlock  `json:"system,omitempty"`
-	Temperature   float64                 `json:"temperature,omitempty"`
+	Temperature   *float64                `json:"temperature,omitempty"`
 	TopP          float64                 `json:"top_p,omitempty"`
 	TopK          int                     `json:"top_k,omitempty"`
 	Stream        bool                    `json:"stream,omitempty"`
 	Tools         []interface{}           `json:"tools,omitempty"`
 	ToolChoice    interface{}             `json:"tool_choice,omitempty"`
+	StopSequences []string                `json:"stop_sequences,omitempty"`
+	Thinking      *ThinkingConfig         `json:"thinking,omitempty"`
 	Metadata      *Metadata               `json:"metadata,omitempty"` // Claude Code 需要的 metadata
+	Extra         map[string]interface{}  `json:"-"`                  // 来自 extra_body 的额外字段，序列化时合并
 }
 
 // Metadata Claude Code 需要的元数据
@@ -70,16 +96,23 @@ type AnthropicMessage struct {
 	Content interface{} `json:"content"` // string or []AnthropicContent
 }
 
+
 type AnthropicContent struct {
-	Type         string                  `json:"type"`
-	Text         *string                 `json:"text,omitempty"`
-	ToolUseID    string                  `json:"tool_use_id,omitempty"`
-	Content      interface{}             `json:"content,omitempty"` // 用于 tool_result
-	ID           string                  `json:"id,omitempty"`
-	Name         string                  `json:"name,omitempty"`
-	Input        *map[string]interface{} `json:"input,omitempty"` // 使用指针，tool_use 时设置为非 nil
-	CacheControl *CacheControl           `json:"cache_control,omitempty"`
-	Source       *ImageSource            `json:"source,omitempty"`
+	Type         string                   `json:"type"`
+	Text         *string                  `json:"text,omitempty"`
+	ToolUseID    string                   `json:"tool_use_id,omitempty"`
+	Content      interface{}              `json:"content,omitempty"`  // 用于 tool_result
+	IsError      bool                     `json:"is_error,omitempty"` // 用于 tool_result
+	ID           string                   `json:"id,omitempty"`
+	Name         string                   `json:"name,omitempty"`
+	Input        *map[string]interface{}  `json:"input,omitempty"` // 使用指针，tool_use 时设置为非 nil
+	CacheControl *CacheControl            `json:"cache_control,omitempty"`
+	Source       *ImageSource             `json:"source,omitempty"`
+	Thinking     string                   `json:"thinking,omitempty"`  // thinking 块的内容
+	Signature    string                   `json:"signature,omitempty"` // thinking 块的签名
+	Data         string                   `json:"data,omitempty"`      // redacted_thinking 块的加密内容
+	Citations    []map[string]interface{} `json:"citations,omitempty"` // 响应中文本块引用的来源
+	Title        string                   `json:"title,omitempty"`     // document 块的标题（文件名）
 }
 
 type AnthropicSystemBlock struct {
@@ -101,9 +134,10 @@ type ImageSource struct {
 }
 
 type AnthropicTool struct {
-	Name        string                 `json:"name"`
-	Description string                 `json:"description,omitempty"`
-	InputSchema map[string]interface{} `json:"input_schema"`
+	Name         string                 `json:"name"`
+	Description  string                 `json:"description,omitempty"`
+	InputSchema  map[string]interface{} `json:"input_schema"`
+	CacheControl *CacheControl          `json:"cache_control,omitempty"`
 }
 
 // OpenAI 响应结构
@@ -112,15 +146,7 @@ type OpenAIResponse struct {
 	Object  string `json:"object"`
 	Created int64  `json:"created"`
 	Model   string `json:"model"`
-	Choices []struct {
-		Index   int `json:"index"`
-		Message struct {
-			Role      string      `json:"role"`
-			Content   string      `json:"content,omitempty"`
-			ToolCalls []ToolCall  `json:"tool_calls,omitempty"`
-		} `json:"message"`
-		FinishReason string `json:"finish_reason"`
-	} `json:"choices"`
+	Choices []OpenAIChoice `json:"choices"`
 	Usage struct {
 		PromptTokens     int `json:"prompt_tokens"`
 		CompletionTokens int `json:"completion_tokens"`
@@ -137,6 +163,28 @@ type OpenAIResponse struct {
 		} `json:"completion_tokens_details"`
 	} `json:"usage"`
 	ServiceTier string `json:"service_tier,omitempty"`
+	// SystemFingerprint 请求带 seed 时返回，由目标模型和代理版本生成
+	SystemFingerprint string `json:"system_fingerprint,omitempty"`
+}
+
+type OpenAIChoice struct {
+	Index   int `json:"index"`
+	Message struct {
+		Role      string     `json:"role"`
+		Content   string     `json:"content,omitempty"`
+		ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+		// FunctionCall 请求使用旧版 functions 时代替 tool_calls
+		FunctionCall *FunctionCall `json:"function_call,omitempty"`
+		// ReasoningContent Anthropic extended thinking 的内容（与 DeepSeek 等兼容实现一致）
+		ReasoningContent string `json:"reasoning_content,omitempty"`
+		// Annotations 文本引用的来源（url_citation / document_citation），位置按字符计
+		Annotations []map[string]interface{} `json:"annotations,omitempty"`
+	} `json:"message"`
+	// Logprobs Anthropic 不返回 token 概率，总是 null（部分严格的 SDK 要求该字段存在）
+	Logprobs     interface{} `json:"logprobs"`
+	FinishReason string      `json:"finish_reason"`
+	// StopReason 命中 stop 参数时返回匹配到的 stop 字符串（与 vLLM 等兼容实现一致）
+	StopReason *string `json:"stop_reason,omitempty"`
 }
 
 // Anthropic 响应结构
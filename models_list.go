@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultClaudeModels 未配置 MODEL_MAPPING 和 STATIC_MODELS 时返回的模型列表
+var defaultClaudeModels = []string{
+	"claude-opus-4-5-20251101",
+	"claude-sonnet-4-5-20250929",
+	"claude-haiku-4-5-20251001",
+	"claude-opus-4-1-20250805",
+	"claude-sonnet-4-20250514",
+	"claude-3-7-sonnet-20250219",
+	"claude-3-5-haiku-20241022",
+}
+
+type OpenAIModel struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+type OpenAIModelList struct {
+	Object string        `json:"object"`
+	Data   []OpenAIModel `json:"data"`
+}
+
+// HandleModels 返回 OpenAI 格式的模型列表（GET /v1/models）
+// 列表由 MODEL_MAPPING 的源模型名和 STATIC_MODELS 组成
+func (h *ProxyHandler) HandleModels(c *gin.Context) {
+	c.JSON(http.StatusOK, OpenAIModelList{
+		Object: "list",
+		Data:   h.listModels(),
+	})
+}
+
+// HandleModel 返回单个模型信息（GET /v1/models/:model）
+func (h *ProxyHandler) HandleModel(c *gin.Context) {
+	id := c.Param("model")
+	for _, m := range h.listModels() {
+		if m.ID == id {
+			c.JSON(http.StatusOK, m)
+			return
+		}
+	}
+	respondError(c, http.StatusNotFound, "model not found: "+id)
+}
+
+func (h *ProxyHandler) listModels() []OpenAIModel {
+	settings := h.settings()
+	seen := make(map[string]bool)
+	ids := make([]string, 0, len(settings.ModelMapping)+len(settings.ModelGroups)+len(h.staticModels))
+
+	// 映射的源模型名和模型组别名排序后输出，保证列表稳定
+	sources := make([]string, 0, len(settings.ModelMapping)+len(settings.ModelGroups))
+	for source := range settings.ModelMapping {
+		sources = append(sources, source)
+	}
+	for alias := range settings.ModelGroups {
+		if _, ok := settings.ModelMapping[alias]; !ok {
+			sources = append(sources, alias)
+		}
+	}
+	sort.Strings(sources)
+
+	for _, id := range append(sources, h.staticModels...) {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	if len(ids) == 0 {
+		ids = defaultClaudeModels
+	}
+
+	models := make([]OpenAIModel, 0, len(ids))
+	for _, id := range ids {
+		models = append(models, OpenAIModel{
+			ID:      id,
+			Object:  "model",
+			Created: getCurrentTimestamp(),
+			OwnedBy: modelOwner(id),
+		})
+	}
+	return models
+}
+
+func modelOwner(model string) string {
+	if strings.HasPrefix(model, "claude") {
+		return "anthropic"
+	}
+	return "openai-claude-proxy"
+}
+
+// parseModelList 解析逗号分隔的模型列表
+// 格式: "model1,model2"
+func parseModelList(listStr string) []string {
+	models := make([]string, 0)
+	for _, m := range strings.Split(listStr, ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			models = append(models, m)
+		}
+	}
+	return models
+}
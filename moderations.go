@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultModerationModel = "claude-haiku-4-5"
+	moderationToolName     = "report_moderation"
+)
+
+// moderationCategories OpenAI omni-moderation 的分类，响应中始终返回全部分类
+var moderationCategories = []string{
+	"harassment", "harassment/threatening", "hate", "hate/threatening",
+	"illicit", "illicit/violent", "self-harm", "self-harm/intent", "self-harm/instructions",
+	"sexual", "sexual/minors", "violence", "violence/graphic",
+}
+
+// ModerationConfig /v1/moderations 的实现方式（Anthropic 没有 moderation API）
+type ModerationConfig struct {
+	Backend   string                    // keywords / claude / openai，为空表示未启用
+	Keywords  map[string]*regexp.Regexp // keywords：分类 → 正则（不区分大小写）
+	Model     string                    // claude：分类使用的模型
+	Threshold float64                   // claude：任一分类分数不低于该值时 flagged
+	BaseURL   string                    // openai：外部 moderation API 地址
+	APIKey    string
+}
+
+// loadModerationConfig 从环境变量读取 moderation 配置
+// MODERATION_KEYWORDS 格式：分类=正则，逗号分隔，如 harassment=idiot|moron,violence=\bkill\b
+func loadModerationConfig() (ModerationConfig, error) {
+	cfg := ModerationConfig{
+		Backend:   strings.ToLower(os.Getenv("MODERATION_BACKEND")),
+		Keywords:  make(map[string]*regexp.Regexp),
+		Model:     os.Getenv("MODERATION_MODEL"),
+		Threshold: 0.5,
+		BaseURL:   strings.TrimRight(os.Getenv("MODERATION_BASE_URL"), "/"),
+		APIKey:    os.Getenv("MODERATION_API_KEY"),
+	}
+	if cfg.Model == "" {
+		cfg.Model = defaultModerationModel
+	}
+	if v := os.Getenv("MODERATION_THRESHOLD"); v != "" {
+		threshold, err := strconv.ParseFloat(v, 64)
+		if err != nil || threshold <= 0 || threshold > 1 {
+			return cfg, fmt.Errorf("invalid MODERATION_THRESHOLD %q, expected a number in (0, 1]", v)
+		}
+		cfg.Threshold = threshold
+	}
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = "https://api.openai.com"
+	}
+	cfg.BaseURL = strings.TrimSuffix(cfg.BaseURL, "/v1")
+
+	for _, item := range parseModelList(os.Getenv("MODERATION_KEYWORDS")) {
+		category, pattern, ok := strings.Cut(item, "=")
+		category = strings.TrimSpace(category)
+		if !ok || !isModerationCategory(category) {
+			return cfg, fmt.Errorf("MODERATION_KEYWORDS: invalid rule %q, expected category=regex (categories: %s)", item, strings.Join(moderationCategories, ", "))
+		}
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return cfg, fmt.Errorf("MODERATION_KEYWORDS: %s: %w", category, err)
+		}
+		cfg.Keywords[category] = re
+	}
+
+	switch cfg.Backend {
+	case "":
+	case "keywords":
+		if len(cfg.Keywords) == 0 {
+			return cfg, fmt.Errorf("MODERATION_BACKEND=keywords requires MODERATION_KEYWORDS")
+		}
+	case "claude", "openai":
+	default:
+		return cfg, fmt.Errorf("unknown MODERATION_BACKEND %q, expected keywords, claude or openai", cfg.Backend)
+	}
+	return cfg, nil
+}
+
+func isModerationCategory(name string) bool {
+	for _, c := range moderationCategories {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ModerationResult OpenAI moderation 响应中的一项
+type ModerationResult struct {
+	Flagged        bool                `json:"flagged"`
+	Categories     map[string]bool     `json:"categories"`
+	CategoryScores map[string]float64  `json:"category_scores"`
+	AppliedTypes   map[string][]string `json:"category_applied_input_types"`
+}
+
+func newModerationResult(scores map[string]float64, threshold float64) ModerationResult {
+	r := ModerationResult{
+		Categories:     make(map[string]bool, len(moderationCategories)),
+		CategoryScores: make(map[string]float64, len(moderationCategories)),
+		AppliedTypes:   make(map[string][]string, len(moderationCategories)),
+	}
+	for _, category := range moderationCategories {
+		score := scores[category]
+		flagged := score >= threshold
+		r.CategoryScores[category] = score
+		r.Categories[category] = flagged
+		r.AppliedTypes[category] = []string{}
+		if flagged {
+			r.Flagged = true
+			r.AppliedTypes[category] = []string{"text"}
+		}
+	}
+	return r
+}
+
+// moderationInputs 提取待审核的文本：input 可以是字符串、字符串数组或 omni 格式的内容数组（图片不审核）
+func moderationInputs(input interface{}) ([]string, error) {
+	switch v := input.(type) {
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		var texts []string
+		multimodal := false
+		for _, item := range v {
+			switch part := item.(type) {
+			case string:
+				texts = append(texts, part)
+			case map[string]interface{}:
+				// omni 格式的多个部分属于同一个输入，合并为一项结果
+				multimodal = true
+				if part["type"] == "text" {
+					text, _ := part["text"].(string)
+					texts = append(texts, text)
+				}
+			default:
+				return nil, fmt.Errorf("input must be a string, an array of strings or an array of content parts")
+			}
+		}
+		if multimodal {
+			return []string{strings.Join(texts, "\n")}, nil
+		}
+		return texts, nil
+	}
+	return nil, fmt.Errorf("input must be a string, an array of strings or an array of content parts")
+}
+
+// HandleModerations OpenAI 兼容的 /v1/moderations，按 MODERATION_BACKEND 使用关键词、Claude 分类或外部 API
+// 客户端在调用模型前做预检时，代理没有对应接口会直接报错
+func (h *ProxyHandler) HandleModerations(c *gin.Context) {
+	reqID := requestID(c)
+	logger := reqLog(reqID)
+
+	apiKey, ok := h.extractAPIKey(c, reqID)
+	if !ok {
+		return
+	}
+	if h.moderation.Backend == "" {
+		respondError(c, http.StatusNotFound, "moderations are not configured, set MODERATION_BACKEND to enable them")
+		return
+	}
+
+	rawBody, ok := readRequestBody(c, reqID)
+	if !ok {
+		return
+	}
+	var req struct {
+		Model string      `json:"model"`
+		Input interface{} `json:"input"`
+	}
+	if err := json.Unmarshal(rawBody, &req); err != nil {
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Input == nil {
+		respondParamError(c, "input", "input is required")
+		return
+	}
+	inputs, err := moderationInputs(req.Input)
+	if err != nil {
+		respondParamError(c, "input", err.Error())
+		return
+	}
+
+	model := req.Model
+	if h.moderation.Backend == "claude" {
+		model = h.moderation.Model
+	} else if model == "" {
+		model = "omni-moderation-latest"
+	}
+	c.Set(metricsModelKey, model)
+	logger.Info("moderation request", "backend", h.moderation.Backend, "inputs", len(inputs))
+	if !h.checkRateLimit(c, apiKey, model, reqID) {
+		return
+	}
+
+	var results []ModerationResult
+	switch h.moderation.Backend {
+	case "openai":
+		h.forwardModeration(c, rawBody, reqID)
+		return
+	case "keywords":
+		for _, text := range inputs {
+			scores := make(map[string]float64)
+			for category, re := range h.moderation.Keywords {
+				if re.MatchString(text) {
+					scores[category] = 1
+				}
+			}
+			results = append(results, newModerationResult(scores, 1))
+		}
+	case "claude":
+		results, ok = h.classifyModeration(c, inputs, apiKey, reqID)
+		if !ok {
+			return
+		}
+	}
+
+	flagged := 0
+	for _, r := range results {
+		if r.Flagged {
+			flagged++
+		}
+	}
+	logger.Info("moderation result", "inputs", len(results), "flagged", flagged)
+
+	var id [12]byte
+	rand.Read(id[:])
+	c.JSON(http.StatusOK, gin.H{"id": "modr-" + hex.EncodeToString(id[:]), "model": model, "results": results})
+}
+
+// moderationPrompt Claude 分类使用的 system 提示
+var moderationPrompt = "You are a content moderation classifier. For each numbered input, score how likely it contains each category " +
+	"of harmful content, from 0 (certainly not) to 1 (certainly). Categories: " + strings.Join(moderationCategories, ", ") + ". " +
+	"Judge the content itself, not whether it discusses a topic neutrally or educationally. " +
+	"Report the scores with the " + moderationToolName + " tool, one entry per input in the same order."
+
+// classifyModeration 用 Claude 给所有输入打分，通过强制工具调用得到结构化结果
+func (h *ProxyHandler) classifyModeration(c *gin.Context, inputs []string, apiKey string, reqID string) ([]ModerationResult, bool) {
+	var prompt strings.Builder
+	for i, text := range inputs {
+		fmt.Fprintf(&prompt, "<input index=\"%d\">\n%s\n</input>\n", i, text)
+	}
+	scoreProps := make(map[string]interface{}, len(moderationCategories))
+	for _, category := range moderationCategories {
+		scoreProps[category] = map[string]interface{}{"type": "number", "minimum": 0, "maximum": 1}
+	}
+	tool := AnthropicTool{
+		Name:        moderationToolName,
+		Description: "Report moderation scores for every input.",
+		InputSchema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"results": map[string]interface{}{
+					"type": "array",
+					"items": map[string]interface{}{
+						"type":       "object",
+						"properties": map[string]interface{}{"index": map[string]interface{}{"type": "integer"}, "scores": map[string]interface{}{"type": "object", "properties": scoreProps}},
+						"required":   []string{"index", "scores"},
+					},
+				},
+			},
+			"required": []string{"results"},
+		},
+	}
+
+	result := h.completeOnce(c.Request.Context(), &AnthropicRequest{
+		Model:      h.moderation.Model,
+		MaxTokens:  256 + 256*len(inputs),
+		System:     []AnthropicSystemBlock{{Type: "text", Text: moderationPrompt}},
+		Messages:   []AnthropicMessage{{Role: "user", Content: prompt.String()}},
+		Tools:      []interface{}{tool},
+		ToolChoice: map[string]interface{}{"type": "tool", "name": moderationToolName},
+	}, apiKey, reqID)
+	if result.err != nil {
+		reqLog(reqID).Error("moderation classification failed", "status", result.err.StatusCode, "error", result.err.Message)
+		respondUpstreamError(c, result.err)
+		return nil, false
+	}
+	h.recordUsage(c, reqID, h.moderation.Model, &result.resp.Usage)
+
+	var report struct {
+		Results []struct {
+			Index  int                `json:"index"`
+			Scores map[string]float64 `json:"scores"`
+		} `json:"results"`
+	}
+	for _, block := range result.resp.Content {
+		if block.Type == "tool_use" && block.Name == moderationToolName && block.Input != nil {
+			data, _ := json.Marshal(*block.Input)
+			if err := json.Unmarshal(data, &report); err != nil {
+				slog.Warn("invalid moderation report", "req_id", reqID, "error", err)
+			}
+		}
+	}
+
+	scores := make([]map[string]float64, len(inputs))
+	for _, r := range report.Results {
+		if r.Index >= 0 && r.Index < len(inputs) {
+			scores[r.Index] = r.Scores
+		}
+	}
+	results := make([]ModerationResult, len(inputs))
+	for i := range inputs {
+		if scores[i] == nil {
+			respondError(c, http.StatusBadGateway, fmt.Sprintf("moderation model returned no scores for input %d", i))
+			return nil, false
+		}
+		results[i] = newModerationResult(scores[i], h.moderation.Threshold)
+	}
+	return results, true
+}
+
+// forwardModeration 原样转发给外部 OpenAI 兼容的 moderation API
+func (h *ProxyHandler) forwardModeration(c *gin.Context, body []byte, reqID string) {
+	logger := reqLog(reqID)
+	targetURL := h.moderation.BaseURL + "/v1/moderations"
+	call := newUpstreamCall(c.Request.Context(), h.upstreamTimeout)
+	defer call.release()
+	newRequest := func() (*http.Request, error) {
+		httpReq, err := http.NewRequestWithContext(call.ctx, "POST", targetURL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		httpReq.Header.Set("Content-Type", "application/json")
+		if h.moderation.APIKey != "" {
+			httpReq.Header.Set("Authorization", "Bearer "+h.moderation.APIKey)
+		}
+		return httpReq, nil
+	}
+
+	httpResp, err := h.doWithRetry(newRequest, "moderation", reqID)
+	if err != nil {
+		upErr := call.upstreamError(err)
+		logger.Error("moderation request failed", "status", upErr.StatusCode, "error", err)
+		respondError(c, upErr.StatusCode, upErr.Message)
+		return
+	}
+	defer httpResp.Body.Close()
+
+	respBody, err := readResponseBody(httpResp.Body, h.maxResponseBytes)
+	if err != nil {
+		respondError(c, http.StatusBadGateway, err.Error())
+		return
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		logger.Error("moderation error response", "status", httpResp.StatusCode, "body", string(respBody))
+		respondEmbeddingsError(c, httpResp.StatusCode, respBody)
+		return
+	}
+	c.Data(http.StatusOK, "application/json", respBody)
+}
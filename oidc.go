@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// jwksRefreshInterval JWKS 的缓存时间；遇到未知 kid（签名密钥轮换）时提前刷新，但两次刷新至少间隔 jwksMinRefresh
+	jwksRefreshInterval = time.Hour
+	jwksMinRefresh      = 30 * time.Second
+	// jwtLeeway 校验 exp / nbf 时容许的时钟偏差
+	jwtLeeway = time.Minute
+)
+
+// Identity 认证后的用户身份
+type Identity struct {
+	Name        string // 用于日志和用量统计
+	UpstreamKey string // 转发给上游的 API Key
+}
+
+// Authenticator 可插拔的认证方式，在虚拟 key 之前校验客户端凭证
+// 不是本认证方式能处理的凭证返回 errAuthSkip，交给后续的认证方式或虚拟 key
+type Authenticator interface {
+	Name() string
+	Authenticate(ctx context.Context, token string) (*Identity, error)
+}
+
+var errAuthSkip = errors.New("credential not handled")
+
+// OIDCConfig 校验 OIDC 签发的 JWT（如企业 SSO 的 ID Token / Access Token）
+type OIDCConfig struct {
+	Issuer      string
+	Audiences   []string // 为空时不校验 aud
+	JWKSURL     string   // 为空时通过 {issuer}/.well-known/openid-configuration 发现
+	UserClaim   string   // 作为用户标识的 claim，缺失时使用 sub
+	UpstreamKey string   // 认证通过的请求使用的上游 key，为空时使用 ANTHROPIC_API_KEY（或 key 池）
+	Required    bool     // 为 true 时拒绝非 JWT 的凭证
+}
+
+func loadOIDCConfig() OIDCConfig {
+	userClaim := os.Getenv("OIDC_USER_CLAIM")
+	if userClaim == "" {
+		userClaim = "email"
+	}
+	var audiences []string
+	for _, aud := range strings.Split(os.Getenv("OIDC_AUDIENCE"), ",") {
+		if aud = strings.TrimSpace(aud); aud != "" {
+			audiences = append(audiences, aud)
+		}
+	}
+	return OIDCConfig{
+		Issuer:      strings.TrimRight(os.Getenv("OIDC_ISSUER"), "/"),
+		Audiences:   audiences,
+		JWKSURL:     os.Getenv("OIDC_JWKS_URL"),
+		UserClaim:   userClaim,
+		UpstreamKey: os.Getenv("OIDC_UPSTREAM_KEY"),
+		Required:    getEnvBool("OIDC_REQUIRED", false),
+	}
+}
+
+// OIDCAuthenticator 使用发行方 JWKS 中的公钥校验 JWT 签名与 iss / aud / exp / nbf
+type OIDCAuthenticator struct {
+	cfg    OIDCConfig
+	client *http.Client
+
+	mu         sync.Mutex
+	jwksURL    string
+	keys       map[string]crypto.PublicKey
+	fetchedAt  time.Time     // 上一次开始刷新的时间
+	refreshing chan struct{} // 正在进行的刷新，完成时关闭
+	refreshErr error         // 上一次刷新的错误
+}
+
+// NewOIDCAuthenticator 未配置 OIDC_ISSUER 时返回 nil
+// JWKS 在第一次认证时获取，启动时发行方不可达不影响代理启动
+func NewOIDCAuthenticator(cfg OIDCConfig, defaultUpstreamKey string) (*OIDCAuthenticator, error) {
+	if cfg.Issuer == "" {
+		return nil, nil
+	}
+	if cfg.UpstreamKey == "" {
+		cfg.UpstreamKey = defaultUpstreamKey
+	}
+	if cfg.UpstreamKey == "" {
+		return nil, errors.New("OIDC_ISSUER requires OIDC_UPSTREAM_KEY, ANTHROPIC_API_KEY or ANTHROPIC_API_KEYS")
+	}
+	return &OIDCAuthenticator{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		jwksURL: cfg.JWKSURL,
+	}, nil
+}
+
+func (a *OIDCAuthenticator) Name() string { return "oidc" }
+
+// looksLikeJWT 三段 base64url 且头部以 {" 开头（eyJ）
+func looksLikeJWT(token string) bool {
+	return strings.HasPrefix(token, "eyJ") && strings.Count(token, ".") == 2
+}
+
+// Authenticate 校验 JWT，返回用户标识；非 JWT 的凭证在 OIDC_REQUIRED 未开启时交给虚拟 key 处理
+func (a *OIDCAuthenticator) Authenticate(ctx context.Context, token string) (*Identity, error) {
+	if !looksLikeJWT(token) {
+		if a.cfg.Required {
+			return nil, errors.New("a JWT from the configured OIDC issuer is required")
+		}
+		return nil, errAuthSkip
+	}
+
+	parts := strings.Split(token, ".")
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid JWT header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("invalid JWT signature encoding")
+	}
+	key, err := a.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWTSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid JWT claims: %w", err)
+	}
+	if err := a.checkClaims(claims); err != nil {
+		return nil, err
+	}
+
+	name, _ := claims[a.cfg.UserClaim].(string)
+	if name == "" {
+		name, _ = claims["sub"].(string)
+	}
+	if name == "" {
+		return nil, fmt.Errorf("JWT has neither %s nor sub claim", a.cfg.UserClaim)
+	}
+	return &Identity{Name: name, UpstreamKey: a.cfg.UpstreamKey}, nil
+}
+
+// checkClaims 校验 iss、aud、exp（必需）和 nbf
+func (a *OIDCAuthenticator) checkClaims(claims map[string]any) error {
+	if iss, _ := claims["iss"].(string); strings.TrimRight(iss, "/") != a.cfg.Issuer {
+		return fmt.Errorf("unexpected issuer %q", iss)
+	}
+	if len(a.cfg.Audiences) > 0 && !audienceAllowed(claims["aud"], a.cfg.Audiences) {
+		return errors.New("token audience is not allowed")
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("JWT has no exp claim")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return errors.New("token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token is not valid yet")
+	}
+	return nil
+}
+
+// audienceAllowed aud 可以是字符串或字符串数组，命中任意一个允许的值即可
+func audienceAllowed(aud any, allowed []string) bool {
+	var values []string
+	switch v := aud.(type) {
+	case string:
+		values = []string{v}
+	case []any:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	for _, v := range values {
+		for _, a := range allowed {
+			if v == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// jwtCurves ES* 算法对应的椭圆曲线
+var jwtCurves = map[string]string{
+	"ES256": "P-256",
+	"ES384": "P-384",
+	"ES512": "P-521",
+}
+
+// verifyJWTSignature 只接受 RS* / PS* / ES* 非对称签名，拒绝 none 和 HS*（公钥会被当作 HMAC 密钥）
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported JWT algorithm %q", alg)
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	}
+	if hash == 0 {
+		return fmt.Errorf("unsupported JWT algorithm %q", alg)
+	}
+	digest := jwtDigest(hash, signed)
+
+	switch alg[:2] {
+	case "RS", "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key type does not match algorithm %s", alg)
+		}
+		var err error
+		if alg[:2] == "RS" {
+			err = rsa.VerifyPKCS1v15(pub, hash, digest, signature)
+		} else {
+			err = rsa.VerifyPSS(pub, hash, digest, signature, nil)
+		}
+		if err != nil {
+			return errors.New("invalid JWT signature")
+		}
+		return nil
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key type does not match algorithm %s", alg)
+		}
+		// 每个 ES* 算法只能使用对应的曲线（RFC 7518 3.4），否则 ES384 可以用 P-256 的密钥签名
+		if pub.Curve.Params().Name != jwtCurves[alg] {
+			return fmt.Errorf("key curve %s does not match algorithm %s", pub.Curve.Params().Name, alg)
+		}
+		// JWS 的 ECDSA 签名是定长的 r || s
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid JWT signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid JWT signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported JWT algorithm %q", alg)
+}
+
+func jwtDigest(hash crypto.Hash, data []byte) []byte {
+	switch hash {
+	case crypto.SHA384:
+		sum := sha512.Sum384(data)
+		return sum[:]
+	case crypto.SHA512:
+		sum := sha512.Sum512(data)
+		return sum[:]
+	default:
+		sum := sha256.Sum256(data)
+		return sum[:]
+	}
+}
+
+// key 返回 kid 对应的公钥，缓存过期或 kid 未知时重新获取 JWKS
+// JWT 没有 kid 且 JWKS 中只有一个密钥时使用该密钥
+// 获取 JWKS 不持有 mu：同一时间只有一次刷新，已知 kid 的请求在刷新期间继续使用旧的密钥，只有未知 kid 的请求等待刷新结果
+func (a *OIDCAuthenticator) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	a.mu.Lock()
+	key, ok := a.lookupLocked(kid)
+	age := time.Since(a.fetchedAt)
+	done := a.refreshing
+	if !(ok && age < jwksRefreshInterval) && done == nil && age >= jwksMinRefresh {
+		done = make(chan struct{})
+		a.refreshing = done
+		a.fetchedAt = time.Now()
+		go a.refresh(a.jwksURL, done)
+	}
+	a.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if done == nil {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if key, ok := a.lookupLocked(kid); ok {
+		return key, nil
+	}
+	if a.refreshErr != nil {
+		return nil, errors.New("unable to fetch signing keys from the OIDC issuer")
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func (a *OIDCAuthenticator) lookupLocked(kid string) (crypto.PublicKey, bool) {
+	if key, ok := a.keys[kid]; ok {
+		return key, true
+	}
+	if kid == "" && len(a.keys) == 1 {
+		for _, key := range a.keys {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// refresh 在后台获取 JWKS，完成后替换密钥并关闭 done；失败时继续使用旧的密钥
+// 不使用触发刷新的请求的 context，该请求被取消不影响其他等待的请求
+func (a *OIDCAuthenticator) refresh(jwksURL string, done chan struct{}) {
+	keys, jwksURL, err := a.fetchKeys(context.Background(), jwksURL)
+	if err != nil {
+		slog.Warn("failed to fetch OIDC signing keys", "issuer", a.cfg.Issuer, "error", err)
+	} else {
+		slog.Info("fetched OIDC signing keys", "issuer", a.cfg.Issuer, "keys", len(keys))
+	}
+
+	a.mu.Lock()
+	if err == nil {
+		a.keys, a.jwksURL = keys, jwksURL
+	}
+	a.refreshErr = err
+	a.refreshing = nil
+	a.mu.Unlock()
+	close(done)
+}
+
+// fetchKeys 获取 JWKS，jwksURL 为空时先通过 discovery 文档找到 jwks_uri，返回密钥和使用的 jwks_uri
+// discovery 文档中的 issuer 必须与 OIDC_ISSUER 一致（OpenID Connect Discovery 4.3）
+func (a *OIDCAuthenticator) fetchKeys(ctx context.Context, jwksURL string) (map[string]crypto.PublicKey, string, error) {
+	if jwksURL == "" {
+		var discovery struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := a.getJSON(ctx, a.cfg.Issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, "", fmt.Errorf("discovery: %w", err)
+		}
+		if strings.TrimRight(discovery.Issuer, "/") != a.cfg.Issuer {
+			return nil, "", fmt.Errorf("discovery document issuer %q does not match %q", discovery.Issuer, a.cfg.Issuer)
+		}
+		if discovery.JWKSURI == "" {
+			return nil, "", errors.New("discovery document has no jwks_uri")
+		}
+		jwksURL = discovery.JWKSURI
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := a.getJSON(ctx, jwksURL, &jwks); err != nil {
+		return nil, "", fmt.Errorf("jwks: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			slog.Warn("skipped OIDC signing key", "kid", jwk.Kid, "error", err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, "", errors.New("no usable signing keys")
+	}
+	return keys, jwksURL, nil
+}
+
+func (a *OIDCAuthenticator) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// jsonWebKey JWKS 中的 RSA / EC 公钥
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, errors.New("invalid key parameter")
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// oidcIssuer 本地的 OIDC 发行方，提供 discovery 文档和 JWKS
+func oidcIssuer(t *testing.T, discoveryIssuer string, keys ...jsonWebKey) *httptest.Server {
+	t.Helper()
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			issuer := discoveryIssuer
+			if issuer == "" {
+				issuer = srv.URL
+			}
+			json.NewEncoder(w).Encode(map[string]string{"issuer": issuer, "jwks_uri": srv.URL + "/jwks"})
+		case "/jwks":
+			json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func b64(data []byte) string { return base64.RawURLEncoding.EncodeToString(data) }
+
+func rsaJWK(kid string, key *rsa.PrivateKey) jsonWebKey {
+	return jsonWebKey{Kty: "RSA", Kid: kid, N: b64(key.N.Bytes()), E: b64(big.NewInt(int64(key.E)).Bytes())}
+}
+
+func ecJWK(kid string, key *ecdsa.PrivateKey) jsonWebKey {
+	return jsonWebKey{Kty: "EC", Kid: kid, Crv: key.Curve.Params().Name, X: b64(key.X.Bytes()), Y: b64(key.Y.Bytes())}
+}
+
+// signJWT 按 alg 用 key 签名，alg 的哈希长度不必与 key 匹配，用于构造错误的令牌；key 为 nil 时签名为空
+func signJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	if key == nil {
+		return signed + "."
+	}
+
+	hash := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}[alg[len(alg)-3:]]
+	digest := jwtDigest(hash, []byte(signed))
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, hash, digest); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+	}
+	return signed + "." + b64(sig)
+}
+
+func TestOIDCAuthenticate(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := oidcIssuer(t, "", rsaJWK("rsa", rsaKey), ecJWK("ec", ecKey))
+	a, err := NewOIDCAuthenticator(OIDCConfig{Issuer: srv.URL, Audiences: []string{"proxy"}, UserClaim: "email"}, "sk-upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := func(change func(map[string]any)) map[string]any {
+		c := map[string]any{
+			"iss":   srv.URL,
+			"aud":   "proxy",
+			"sub":   "user-1",
+			"email": "alice@example.com",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+		}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+	valid := signJWT(t, "RS256", "rsa", rsaKey, claims(nil))
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{"valid RS256", valid, ""},
+		{"valid ES256", signJWT(t, "ES256", "ec", ecKey, claims(nil)), ""},
+		{"RSA key with ES256", signJWT(t, "ES256", "rsa", ecKey, claims(nil)), "key type does not match"},
+		{"P-256 key with ES384", signJWT(t, "ES384", "ec", ecKey, claims(nil)), "key curve P-256 does not match"},
+		{"HS256", signJWT(t, "HS256", "rsa", nil, claims(nil)), "unsupported JWT algorithm"},
+		{"alg none", signJWT(t, "none", "rsa", nil, claims(nil)), "unsupported JWT algorithm"},
+		{"bad signature", valid[:strings.LastIndex(valid, ".")+1] + b64(make([]byte, 256)), "invalid JWT signature"},
+		{"expired", signJWT(t, "RS256", "rsa", rsaKey, claims(func(c map[string]any) { c["exp"] = time.Now().Add(-time.Hour).Unix() })), "expired"},
+		{"wrong audience", signJWT(t, "RS256", "rsa", rsaKey, claims(func(c map[string]any) { c["aud"] = []string{"other"} })), "audience"},
+		{"wrong issuer", signJWT(t, "RS256", "rsa", rsaKey, claims(func(c map[string]any) { c["iss"] = "https://evil.example.com" })), "unexpected issuer"},
+		{"unknown kid", signJWT(t, "RS256", "rotated", rsaKey, claims(nil)), "unknown signing key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := a.Authenticate(context.Background(), tt.token)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("got error %v, want none", err)
+				}
+				if identity.Name != "alice@example.com" || identity.UpstreamKey != "sk-upstream" {
+					t.Errorf("identity = %+v", identity)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// discovery 文档中的 issuer 与配置不一致时不使用其中的 jwks_uri
+func TestOIDCDiscoveryIssuerMismatch(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := oidcIssuer(t, "https://evil.example.com", ecJWK("ec", key))
+	a, err := NewOIDCAuthenticator(OIDCConfig{Issuer: srv.URL, UserClaim: "sub"}, "sk-upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := signJWT(t, "ES256", "ec", key, map[string]any{"iss": srv.URL, "sub": "user-1", "exp": time.Now().Add(time.Hour).Unix()})
+	if _, err := a.Authenticate(context.Background(), token); err == nil || !strings.Contains(err.Error(), "unable to fetch signing keys") {
+		t.Errorf("got error %v, want the signing keys to be rejected", err)
+	}
+}
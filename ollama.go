@@ -0,0 +1,631 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ollamaErrorsKey gin context 中标记 Ollama 接口的请求，错误响应使用 Ollama 的格式
+const ollamaErrorsKey = "ollama_errors"
+
+// OllamaMessage Ollama /api/chat 的消息，图片为不带 data URL 前缀的 base64
+type OllamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	Thinking  string           `json:"thinking,omitempty"`
+	Images    []string         `json:"images,omitempty"`
+	ToolCalls []OllamaToolCall `json:"tool_calls,omitempty"`
+	ToolName  string           `json:"tool_name,omitempty"` // role=tool 时对应的工具名
+}
+
+// OllamaToolCall Ollama 的工具调用没有 ID，参数为 JSON 对象
+type OllamaToolCall struct {
+	Function struct {
+		Name      string                 `json:"name"`
+		Arguments map[string]interface{} `json:"arguments"`
+	} `json:"function"`
+}
+
+// OllamaOptions Ollama 的采样参数，num_ctx 等本地推理参数忽略
+type OllamaOptions struct {
+	Temperature *float64 `json:"temperature"`
+	TopP        float64  `json:"top_p"`
+	TopK        int      `json:"top_k"`
+	NumPredict  int      `json:"num_predict"` // -1 表示不限制，使用默认 max_tokens
+	Stop        []string `json:"stop"`
+}
+
+// OllamaChatRequest POST /api/chat
+type OllamaChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []OllamaMessage `json:"messages"`
+	Tools    []OpenAITool    `json:"tools,omitempty"`
+	Format   json.RawMessage `json:"format,omitempty"` // "json" 或 JSON Schema
+	Options  OllamaOptions   `json:"options"`
+	Stream   *bool           `json:"stream,omitempty"` // 默认为 true
+}
+
+// OllamaGenerateRequest POST /api/generate
+type OllamaGenerateRequest struct {
+	Model   string          `json:"model"`
+	Prompt  string          `json:"prompt"`
+	System  string          `json:"system,omitempty"`
+	Images  []string        `json:"images,omitempty"`
+	Format  json.RawMessage `json:"format,omitempty"`
+	Options OllamaOptions   `json:"options"`
+	Stream  *bool           `json:"stream,omitempty"`
+}
+
+// OllamaResponse /api/chat 与 /api/generate 的响应（流式时为每一行），chat 使用 message，generate 使用 response
+type OllamaResponse struct {
+	Model              string         `json:"model"`
+	CreatedAt          string         `json:"created_at"`
+	Message            *OllamaMessage `json:"message,omitempty"`
+	Response           *string        `json:"response,omitempty"`
+	Done               bool           `json:"done"`
+	DoneReason         string         `json:"done_reason,omitempty"`
+	TotalDuration      int64          `json:"total_duration,omitempty"` // 纳秒
+	PromptEvalCount    int            `json:"prompt_eval_count,omitempty"`
+	PromptEvalDuration int64          `json:"prompt_eval_duration,omitempty"`
+	EvalCount          int            `json:"eval_count,omitempty"`
+	EvalDuration       int64          `json:"eval_duration,omitempty"`
+}
+
+// ollamaTurn 一次 Ollama 请求的输出格式和计时
+type ollamaTurn struct {
+	model      string // 客户端请求的模型名，响应中原样返回
+	chat       bool   // false 表示 /api/generate
+	unwrapJSON bool
+	start      time.Time
+	firstToken time.Time
+}
+
+// chunk 返回一行增量输出
+func (t *ollamaTurn) chunk(text, thinking string, toolCalls []OllamaToolCall) OllamaResponse {
+	if t.firstToken.IsZero() {
+		t.firstToken = time.Now()
+	}
+	resp := OllamaResponse{Model: t.model, CreatedAt: time.Now().UTC().Format(time.RFC3339Nano)}
+	if t.chat {
+		resp.Message = &OllamaMessage{Role: "assistant", Content: text, Thinking: thinking, ToolCalls: toolCalls}
+	} else {
+		resp.Response = &text
+	}
+	return resp
+}
+
+// final 返回带统计信息的最后一行，耗时按首个输出拆分为 prompt 处理和生成两段
+func (t *ollamaTurn) final(resp OllamaResponse, stopReason string, usage *AnthropicUsage) OllamaResponse {
+	now := time.Now()
+	if t.firstToken.IsZero() {
+		t.firstToken = now
+	}
+	resp.Done = true
+	resp.DoneReason = ollamaDoneReason(stopReason)
+	resp.TotalDuration = now.Sub(t.start).Nanoseconds()
+	resp.PromptEvalCount = usage.InputTokens + usage.CacheReadInputTokens + usage.CacheCreationInputTokens
+	resp.PromptEvalDuration = t.firstToken.Sub(t.start).Nanoseconds()
+	resp.EvalCount = usage.OutputTokens
+	resp.EvalDuration = now.Sub(t.firstToken).Nanoseconds()
+	return resp
+}
+
+// ollamaDoneReason Ollama 只区分正常结束（stop）和达到长度上限（length），工具调用也是 stop
+func ollamaDoneReason(stopReason string) string {
+	if stopReason == "max_tokens" {
+		return "length"
+	}
+	return "stop"
+}
+
+// ollamaModel Ollama 客户端会给模型名加上 :latest 标签
+func ollamaModel(model string) string {
+	return strings.TrimSuffix(model, ":latest")
+}
+
+// ollamaStream Ollama 的 stream 默认为 true
+func ollamaStream(stream *bool) bool {
+	return stream == nil || *stream
+}
+
+// ollamaAuth 准备 Ollama 请求：错误使用 Ollama 格式；客户端没有带 key 时使用 OLLAMA_API_KEY（Ollama 客户端通常不发送 key）
+func (h *ProxyHandler) ollamaAuth(c *gin.Context) {
+	c.Set(ollamaErrorsKey, true)
+	if h.ollamaAPIKey == "" {
+		return
+	}
+	if hasCredentials(c) {
+		return
+	}
+	c.Request.Header.Set("Authorization", "Bearer "+h.ollamaAPIKey)
+}
+
+// HandleOllamaChat 将 Ollama /api/chat 请求转换为 Anthropic 请求，流式响应为 NDJSON
+func (h *ProxyHandler) HandleOllamaChat(c *gin.Context) {
+	reqID := requestID(c)
+	logger := reqLog(reqID)
+	h.ollamaAuth(c)
+
+	apiKey, ok := h.extractAPIKey(c, reqID)
+	if !ok {
+		return
+	}
+	rawBody, ok := readRequestBody(c, reqID)
+	if !ok {
+		return
+	}
+	logger.Debug("raw ollama chat request", "body", string(rawBody))
+
+	var chatReq OllamaChatRequest
+	if err := json.Unmarshal(rawBody, &chatReq); err != nil {
+		logger.Error("failed to parse request", "error", err)
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if chatReq.Model == "" {
+		respondError(c, http.StatusBadRequest, "model is required")
+		return
+	}
+
+	openaiReq := OpenAIRequest{
+		Model:    ollamaModel(chatReq.Model),
+		Messages: convertOllamaMessages(chatReq.Messages),
+		Tools:    chatReq.Tools,
+		Stream:   ollamaStream(chatReq.Stream),
+	}
+	applyOllamaOptions(&openaiReq, chatReq.Options, chatReq.Format)
+	if len(openaiReq.Messages) == 0 {
+		respondError(c, http.StatusBadRequest, "messages is required")
+		return
+	}
+
+	turn := &ollamaTurn{model: chatReq.Model, chat: true}
+	h.serveOllama(c, openaiReq, chatReq.Options.TopK, turn, apiKey, reqID)
+}
+
+// HandleOllamaGenerate 将 Ollama /api/generate 请求转换为单条 user 消息的 Anthropic 请求
+func (h *ProxyHandler) HandleOllamaGenerate(c *gin.Context) {
+	reqID := requestID(c)
+	logger := reqLog(reqID)
+	h.ollamaAuth(c)
+
+	apiKey, ok := h.extractAPIKey(c, reqID)
+	if !ok {
+		return
+	}
+	rawBody, ok := readRequestBody(c, reqID)
+	if !ok {
+		return
+	}
+	logger.Debug("raw ollama generate request", "body", string(rawBody))
+
+	var genReq OllamaGenerateRequest
+	if err := json.Unmarshal(rawBody, &genReq); err != nil {
+		logger.Error("failed to parse request", "error", err)
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if genReq.Model == "" {
+		respondError(c, http.StatusBadRequest, "model is required")
+		return
+	}
+
+	// 空 prompt 是 Ollama 客户端预加载模型的请求，直接返回 done_reason=load
+	if genReq.Prompt == "" && len(genReq.Images) == 0 {
+		empty := ""
+		c.JSON(http.StatusOK, OllamaResponse{
+			Model:      genReq.Model,
+			CreatedAt:  time.Now().UTC().Format(time.RFC3339Nano),
+			Response:   &empty,
+			Done:       true,
+			DoneReason: "load",
+		})
+		return
+	}
+
+	var messages []OllamaMessage
+	if genReq.System != "" {
+		messages = append(messages, OllamaMessage{Role: "system", Content: genReq.System})
+	}
+	messages = append(messages, OllamaMessage{Role: "user", Content: genReq.Prompt, Images: genReq.Images})
+
+	openaiReq := OpenAIRequest{
+		Model:    ollamaModel(genReq.Model),
+		Messages: convertOllamaMessages(messages),
+		Stream:   ollamaStream(genReq.Stream),
+	}
+	applyOllamaOptions(&openaiReq, genReq.Options, genReq.Format)
+
+	turn := &ollamaTurn{model: genReq.Model}
+	h.serveOllama(c, openaiReq, genReq.Options.TopK, turn, apiKey, reqID)
+}
+
+// serveOllama 转换并发送请求，按 Ollama 格式返回响应
+func (h *ProxyHandler) serveOllama(c *gin.Context, openaiReq OpenAIRequest, topK int, turn *ollamaTurn, apiKey string, reqID string) {
+	logger := reqLog(reqID)
+	c.Set(streamKey, openaiReq.Stream)
+	logger.Info("ollama request",
+		"path", c.Request.URL.Path,
+		"model", openaiReq.Model,
+		"stream", openaiReq.Stream,
+		"messages", len(openaiReq.Messages),
+		"tools", len(openaiReq.Tools))
+
+	// temperature/top_p 转换到 Anthropic 支持的范围
+	if !applySampling(c, &openaiReq, h.temperatureMode, reqID) {
+		return
+	}
+
+	settings := h.settings()
+	profile := h.modelProfile(openaiReq.Model)
+	openaiReq.Model = h.mapRequestModel(c, settings, openaiReq.Model, reqID)
+
+	if !h.checkRateLimit(c, apiKey, openaiReq.Model, reqID) {
+		return
+	}
+	release, ok := h.acquireConcurrency(c, apiKey, reqID)
+	if !ok {
+		return
+	}
+	defer release()
+
+	_, convertSpan := startSpan(c.Request.Context(), "convert request", spanKindInternal)
+	anthropicReq, err := ConvertOpenAIToAnthropic(openaiReq, settings.MaxTokensMapping, apiKey)
+	if err != nil {
+		convertSpan.SetError(err.Error())
+		convertSpan.End()
+		logger.Error("conversion failed", "error", err)
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if topK > 0 {
+		anthropicReq.TopK = topK
+	}
+	applyThinking(anthropicReq, h.thinkingBudgets, reqID)
+	applyModelProfile(anthropicReq, profile, reqID)
+	h.clampMaxTokens(c, anthropicReq, reqID)
+	h.applyPromptTemplate(anthropicReq, settings.Cache, reqID)
+	applyCacheControl(anthropicReq, settings.Cache)
+	convertSpan.SetAttr("gen_ai.request.model", anthropicReq.Model)
+	convertSpan.End()
+
+	turn.unwrapJSON = usesJSONResponseTool(openaiReq)
+	turn.start = time.Now()
+	httpResp, ok := h.sendAnthropicRequest(c, anthropicReq, apiKey, reqID)
+	if !ok {
+		return
+	}
+	defer httpResp.Body.Close()
+
+	if openaiReq.Stream {
+		h.handleOllamaStream(c, httpResp, turn, reqID)
+	} else {
+		h.handleOllamaResponse(c, httpResp, turn, reqID)
+	}
+}
+
+// convertOllamaMessages 转换为 OpenAI 消息
+// Ollama 的工具调用没有 ID：按顺序生成 ID，role=tool 的消息优先按 tool_name 对应，否则按顺序对应
+func convertOllamaMessages(messages []OllamaMessage) []OpenAIMessage {
+	converted := make([]OpenAIMessage, 0, len(messages))
+	var pending []ToolCall
+	callCount := 0
+
+	for _, msg := range messages {
+		switch msg.Role {
+		case "assistant":
+			out := OpenAIMessage{Role: "assistant", Content: msg.Content}
+			pending = pending[:0]
+			for _, tc := range msg.ToolCalls {
+				callCount++
+				args, _ := json.Marshal(tc.Function.Arguments)
+				call := ToolCall{ID: fmt.Sprintf("call_%d", callCount), Type: "function"}
+				call.Function.Name = tc.Function.Name
+				call.Function.Arguments = string(args)
+				out.ToolCalls = append(out.ToolCalls, call)
+			}
+			pending = append(pending, out.ToolCalls...)
+			converted = append(converted, out)
+
+		case "tool":
+			index := -1
+			for i, call := range pending {
+				if msg.ToolName == "" || call.Function.Name == msg.ToolName {
+					index = i
+					break
+				}
+			}
+			if index < 0 {
+				// 没有对应的工具调用时作为普通 user 消息，避免上游因缺少 tool_use 拒绝请求
+				converted = append(converted, OpenAIMessage{Role: "user", Content: "Tool result: " + msg.Content})
+				continue
+			}
+			converted = append(converted, OpenAIMessage{Role: "tool", ToolCallID: pending[index].ID, Content: msg.Content})
+			pending = append(pending[:index], pending[index+1:]...)
+
+		default:
+			converted = append(converted, OpenAIMessage{Role: msg.Role, Content: ollamaContent(msg)})
+		}
+	}
+	return converted
+}
+
+// ollamaContent 带图片时转换为 OpenAI 的内容数组，图片类型按文件头识别
+func ollamaContent(msg OllamaMessage) interface{} {
+	if len(msg.Images) == 0 {
+		return msg.Content
+	}
+	parts := make([]interface{}, 0, len(msg.Images)+1)
+	for _, image := range msg.Images {
+		head, _ := base64.StdEncoding.DecodeString(image[:min(len(image), 684)])
+		mediaType := http.DetectContentType(head)
+		parts = append(parts, map[string]interface{}{
+			"type":      "image_url",
+			"image_url": map[string]interface{}{"url": "data:" + mediaType + ";base64," + image},
+		})
+	}
+	if msg.Content != "" {
+		parts = append(parts, map[string]interface{}{"type": "text", "text": msg.Content})
+	}
+	return parts
+}
+
+// applyOllamaOptions 转换采样参数和 format（"json" 对应 json_object，对象对应 json_schema）
+func applyOllamaOptions(req *OpenAIRequest, opts OllamaOptions, format json.RawMessage) {
+	req.Temperature = opts.Temperature
+	req.TopP = opts.TopP
+	req.TopK = opts.TopK
+	if opts.NumPredict > 0 {
+		req.MaxTokens = opts.NumPredict
+	}
+	if len(opts.Stop) > 0 {
+		stop := make([]interface{}, len(opts.Stop))
+		for i, s := range opts.Stop {
+			stop[i] = s
+		}
+		req.Stop = stop
+	}
+
+	var schema map[string]interface{}
+	switch {
+	case len(format) == 0 || string(format) == "null" || string(format) == `""`:
+	case string(format) == `"json"`:
+		req.ResponseFormat = &ResponseFormat{Type: "json_object"}
+	case json.Unmarshal(format, &schema) == nil:
+		req.ResponseFormat = &ResponseFormat{Type: "json_schema"}
+		req.ResponseFormat.JSONSchema = &struct {
+			Name        string                 `json:"name"`
+			Description string                 `json:"description,omitempty"`
+			Schema      map[string]interface{} `json:"schema"`
+			Strict      bool                   `json:"strict,omitempty"`
+		}{Name: "response", Schema: schema}
+	}
+}
+
+func (h *ProxyHandler) handleOllamaResponse(c *gin.Context, httpResp *http.Response, turn *ollamaTurn, reqID string) {
+	bodyBytes, err := readResponseBody(httpResp.Body, h.maxResponseBytes)
+	if err != nil {
+		reqLog(reqID).Error("read response body failed", "error", err)
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var anthropicResp AnthropicResponse
+	if err := json.Unmarshal(bodyBytes, &anthropicResp); err != nil {
+		reqLog(reqID).Error("parse anthropic response failed", "error", err)
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	h.recordUsage(c, reqID, anthropicResp.Model, &anthropicResp.Usage)
+	metrics.ObserveToolCalls(anthropicResp.Model, countToolUses(anthropicResp.Content))
+	if !h.transformResponse(c, &anthropicResp, reqID) {
+		return
+	}
+	if turn.unwrapJSON {
+		unwrapJSONResponseTool(&anthropicResp)
+	}
+
+	var text, thinking strings.Builder
+	var toolCalls []OllamaToolCall
+	for _, content := range anthropicResp.Content {
+		switch content.Type {
+		case "text":
+			if content.Text != nil {
+				text.WriteString(*content.Text)
+			}
+		case "thinking":
+			thinking.WriteString(content.Thinking)
+		case "tool_use":
+			var call OllamaToolCall
+			call.Function.Name = content.Name
+			if content.Input != nil {
+				call.Function.Arguments = *content.Input
+			}
+			toolCalls = append(toolCalls, call)
+		}
+	}
+
+	c.JSON(http.StatusOK, turn.final(turn.chunk(text.String(), thinking.String(), toolCalls), anthropicResp.StopReason, &anthropicResp.Usage))
+}
+
+// handleOllamaStream 将 Anthropic SSE 转换为 Ollama 的 NDJSON 流
+// 工具调用在参数接收完整后作为一行输出；NDJSON 不能插入注释，因此不发送心跳
+func (h *ProxyHandler) handleOllamaStream(c *gin.Context, httpResp *http.Response, turn *ollamaTurn, reqID string) {
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Cache-Control", "no-cache")
+
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		reqLog(reqID).Error("streaming not supported by client")
+		respondError(c, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+	writeLine := func(v interface{}) {
+		line, _ := json.Marshal(v)
+		c.Writer.Write(append(line, '\n'))
+		flusher.Flush()
+	}
+
+	_, relaySpan := startSpan(c.Request.Context(), "stream relay", spanKindInternal)
+	defer relaySpan.End()
+
+	type toolBlock struct {
+		name string
+		args strings.Builder
+	}
+	tools := make(map[int]*toolBlock)
+	usage := &AnthropicUsage{}
+	model, stopReason := turn.model, ""
+	doneSent, upstreamFailed := false, false
+
+	tc := h.streamTransformContext(c, reqID)
+	defer closeOnDisconnect(c, httpResp.Body)()
+	scanner := newHeartbeatScanner(httpResp.Body, 0, h.streamIdleTimeout, nil)
+	defer scanner.Stop()
+	for scanner.Scan() {
+		data := scanner.Event().Data
+		if data == "[DONE]" || data == "" {
+			continue
+		}
+
+		var event map[string]interface{}
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			reqLog(reqID).Warn("failed to parse event", "error", err, "data", data)
+			continue
+		}
+		for _, event := range h.transformEvent(tc, event) {
+			index := -1
+			if v, ok := event["index"].(float64); ok {
+				index = int(v)
+			}
+
+			switch event["type"] {
+			case "message_start":
+				if msg, ok := event["message"].(map[string]interface{}); ok {
+					if m, ok := msg["model"].(string); ok {
+						model = m
+					}
+					if u, ok := msg["usage"].(map[string]interface{}); ok {
+						usage = parseUsage(u)
+					}
+				}
+
+			case "content_block_start":
+				if block, ok := event["content_block"].(map[string]interface{}); ok && block["type"] == "tool_use" {
+					name, _ := block["name"].(string)
+					tools[index] = &toolBlock{name: name}
+				}
+
+			case "content_block_delta":
+				delta, _ := event["delta"].(map[string]interface{})
+				switch delta["type"] {
+				case "text_delta":
+					if text, _ := delta["text"].(string); text != "" {
+						writeLine(turn.chunk(text, "", nil))
+					}
+				case "thinking_delta":
+					if thinking, _ := delta["thinking"].(string); thinking != "" && turn.chat {
+						writeLine(turn.chunk("", thinking, nil))
+					}
+				case "input_json_delta":
+					partial, _ := delta["partial_json"].(string)
+					block := tools[index]
+					if block == nil {
+						continue
+					}
+					if turn.unwrapJSON && block.name == jsonResponseToolName {
+						// 合成的 json_schema 工具：参数就是输出的 JSON 文本
+						if partial != "" {
+							writeLine(turn.chunk(partial, "", nil))
+						}
+						continue
+					}
+					block.args.WriteString(partial)
+				}
+
+			case "content_block_stop":
+				block := tools[index]
+				if block == nil || (turn.unwrapJSON && block.name == jsonResponseToolName) {
+					continue
+				}
+				var call OllamaToolCall
+				call.Function.Name = block.name
+				call.Function.Arguments = map[string]interface{}{}
+				if block.args.Len() > 0 {
+					if err := json.Unmarshal([]byte(block.args.String()), &call.Function.Arguments); err != nil {
+						reqLog(reqID).Warn("invalid tool arguments", "tool", block.name, "error", err)
+					}
+				}
+				if turn.chat {
+					writeLine(turn.chunk("", "", []OllamaToolCall{call}))
+				}
+
+			case "message_delta":
+				if u, ok := event["usage"].(map[string]interface{}); ok {
+					mergeDeltaUsage(usage, parseUsage(u))
+				}
+				if delta, ok := event["delta"].(map[string]interface{}); ok {
+					if reason, ok := delta["stop_reason"].(string); ok {
+						stopReason = reason
+					}
+				}
+
+			case "message_stop":
+				writeLine(turn.final(turn.chunk("", "", nil), stopReason, usage))
+				doneSent = true
+
+			case "error":
+				reqLog(reqID).Error("upstream stream error", "body", data)
+				_, e := translateAnthropicError(http.StatusInternalServerError, data)
+				writeLine(gin.H{"error": e.Message})
+				upstreamFailed = true
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil && !doneSent && !upstreamFailed && c.Request.Context().Err() == nil {
+		writeLine(gin.H{"error": "upstream stream interrupted: " + err.Error()})
+	}
+
+	logStreamEnd(c, reqID, scanner.Err())
+	if err := scanner.Err(); err != nil {
+		relaySpan.SetError(err.Error())
+	}
+
+	h.recordUsage(c, reqID, model, usage)
+	metrics.ObserveStream(model, usage.OutputTokens, time.Since(turn.start))
+}
+
+// HandleOllamaTags 以 Ollama 格式返回模型列表（GET /api/tags），内容与 /v1/models 相同
+func (h *ProxyHandler) HandleOllamaTags(c *gin.Context) {
+	models := h.listModels()
+	tags := make([]gin.H, 0, len(models))
+	modifiedAt := time.Now().UTC().Format(time.RFC3339)
+	for _, m := range models {
+		tags = append(tags, gin.H{
+			"name":        m.ID,
+			"model":       m.ID,
+			"modified_at": modifiedAt,
+			"size":        0,
+			"digest":      "",
+			"details": gin.H{
+				"format":             "",
+				"family":             m.OwnedBy,
+				"parameter_size":     "",
+				"quantization_level": "",
+			},
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"models": tags})
+}
+
+// HandleOllamaVersion Ollama 客户端用 /api/version 检查连接
+func (h *ProxyHandler) HandleOllamaVersion(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"version": version})
+}
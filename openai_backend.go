@@ -0,0 +1,516 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// openaiBackend OpenAI 兼容的 Chat Completions 上游（OpenAI、vLLM、llama.cpp 等）
+// 与其他后端一样把 Anthropic 请求转换为上游协议，响应再转换回 Anthropic 格式；thinking 配置和 cache_control 被忽略
+type openaiBackend struct{}
+
+func (openaiBackend) Name() string { return "openai" }
+
+func (openaiBackend) DefaultBaseURL() string { return "https://api.openai.com" }
+
+func (openaiBackend) NewRequest(ctx context.Context, baseURL string, req *BackendRequest) (*http.Request, error) {
+	body, err := json.Marshal(convertAnthropicRequestToOpenAI(req.Anthropic, req.Model))
+	if err != nil {
+		return nil, err
+	}
+	slog.Debug("openai request body", "body", string(body))
+
+	// 兼容写成 http://host:8000/v1 的地址（vLLM 等的习惯写法）
+	endpoint := strings.TrimSuffix(baseURL, "/v1") + "/v1/chat/completions"
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+req.APIKey)
+	if req.RequestID != "" {
+		httpReq.Header.Set(upstreamRequestIDHeader, req.RequestID)
+	}
+	return httpReq, nil
+}
+
+// convertAnthropicRequestToOpenAI 将 Anthropic 请求转换为 Chat Completions 请求
+func convertAnthropicRequestToOpenAI(req *AnthropicRequest, model string) map[string]interface{} {
+	messages := make([]interface{}, 0, len(req.Messages)+1)
+	if len(req.System) > 0 {
+		texts := make([]string, 0, len(req.System))
+		for _, block := range req.System {
+			texts = append(texts, block.Text)
+		}
+		messages = append(messages, map[string]interface{}{"role": "system", "content": strings.Join(texts, "\n\n")})
+	}
+	for _, msg := range req.Messages {
+		messages = append(messages, openaiMessages(msg)...)
+	}
+
+	body := map[string]interface{}{
+		"model":      model,
+		"messages":   messages,
+		"max_tokens": req.MaxTokens,
+	}
+	if req.Temperature != nil {
+		body["temperature"] = *req.Temperature
+	}
+	if req.TopP != 0 {
+		body["top_p"] = req.TopP
+	}
+	if req.TopK != 0 {
+		// OpenAI 不支持，vLLM 等兼容实现支持
+		body["top_k"] = req.TopK
+	}
+	if len(req.StopSequences) > 0 {
+		body["stop"] = req.StopSequences
+	}
+	if req.Metadata != nil && req.Metadata.UserID != "" {
+		body["user"] = req.Metadata.UserID
+	}
+	if tools := openaiTools(req.Tools); len(tools) > 0 {
+		body["tools"] = tools
+		if choice, parallel := openaiToolChoice(req.ToolChoice); choice != nil {
+			body["tool_choice"] = choice
+			if !parallel {
+				body["parallel_tool_calls"] = false
+			}
+		}
+	}
+	if req.Stream {
+		body["stream"] = true
+		body["stream_options"] = map[string]interface{}{"include_usage": true}
+	}
+	return body
+}
+
+// openaiMessages 转换一条 Anthropic 消息
+// user 消息中的 tool_result 拆分为独立的 tool 消息（放在其余内容之前），assistant 的 tool_use 转为 tool_calls，thinking 块被丢弃
+func openaiMessages(msg AnthropicMessage) []interface{} {
+	if text, ok := msg.Content.(string); ok {
+		return []interface{}{map[string]interface{}{"role": msg.Role, "content": text}}
+	}
+
+	var out []interface{}
+	var parts []map[string]interface{}
+	var toolCalls []map[string]interface{}
+	for _, block := range anthropicBlocks(msg.Content) {
+		switch block.Type {
+		case "text":
+			if block.Text != nil && *block.Text != "" {
+				parts = append(parts, map[string]interface{}{"type": "text", "text": *block.Text})
+			}
+		case "image", "document":
+			if part := openaiMediaPart(block); part != nil {
+				parts = append(parts, part)
+			}
+		case "tool_use":
+			args := []byte("{}")
+			if block.Input != nil {
+				args, _ = json.Marshal(*block.Input)
+			}
+			toolCalls = append(toolCalls, map[string]interface{}{
+				"id":       block.ID,
+				"type":     "function",
+				"function": map[string]interface{}{"name": block.Name, "arguments": string(args)},
+			})
+		case "tool_result":
+			content := toolResultText(block.Content)
+			if block.IsError {
+				content = "Error: " + content
+			}
+			out = append(out, map[string]interface{}{"role": "tool", "tool_call_id": block.ToolUseID, "content": content})
+		}
+	}
+
+	if msg.Role == "assistant" {
+		assistant := map[string]interface{}{"role": "assistant", "content": nil}
+		if len(parts) > 0 {
+			texts := make([]string, 0, len(parts))
+			for _, part := range parts {
+				if text, ok := part["text"].(string); ok {
+					texts = append(texts, text)
+				}
+			}
+			assistant["content"] = strings.Join(texts, "")
+		}
+		if len(toolCalls) > 0 {
+			assistant["tool_calls"] = toolCalls
+		}
+		return append(out, assistant)
+	}
+
+	if len(parts) > 0 {
+		out = append(out, map[string]interface{}{"role": msg.Role, "content": openaiContent(parts)})
+	}
+	return out
+}
+
+// openaiContent 只有文本时使用字符串内容，兼容不支持内容数组的实现
+func openaiContent(parts []map[string]interface{}) interface{} {
+	texts := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if part["type"] != "text" {
+			return parts
+		}
+		texts = append(texts, part["text"].(string))
+	}
+	return strings.Join(texts, "\n")
+}
+
+// openaiMediaPart 图片转为 image_url，PDF 转为 file，文本文档转为文本
+func openaiMediaPart(block AnthropicContent) map[string]interface{} {
+	if block.Source == nil {
+		return nil
+	}
+	switch block.Source.Type {
+	case "base64":
+		dataURL := "data:" + block.Source.MediaType + ";base64," + block.Source.Data
+		if block.Type == "document" {
+			filename := block.Title
+			if filename == "" {
+				filename = "document.pdf"
+			}
+			return map[string]interface{}{"type": "file", "file": map[string]interface{}{"filename": filename, "file_data": dataURL}}
+		}
+		return map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": dataURL}}
+	case "url":
+		if block.Type == "image" {
+			return map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": block.Source.URL}}
+		}
+	case "text":
+		return map[string]interface{}{"type": "text", "text": block.Source.Data}
+	}
+	slog.Warn("unsupported content block for openai backend", "type", block.Type, "source", block.Source.Type)
+	return nil
+}
+
+// openaiTools 转换工具定义，服务端工具（web_search 等带 type 的工具）被丢弃
+func openaiTools(tools []interface{}) []interface{} {
+	out := make([]interface{}, 0, len(tools))
+	for _, tool := range tools {
+		data, err := json.Marshal(tool)
+		if err != nil {
+			continue
+		}
+		var def struct {
+			Type        string                 `json:"type"`
+			Name        string                 `json:"name"`
+			Description string                 `json:"description"`
+			InputSchema map[string]interface{} `json:"input_schema"`
+		}
+		if json.Unmarshal(data, &def) != nil || (def.Type != "" && def.Type != "custom") {
+			slog.Warn("dropping server tool for openai backend", "type", def.Type, "name", def.Name)
+			continue
+		}
+		function := map[string]interface{}{"name": def.Name, "parameters": def.InputSchema}
+		if def.Description != "" {
+			function["description"] = def.Description
+		}
+		out = append(out, map[string]interface{}{"type": "function", "function": function})
+	}
+	return out
+}
+
+// openaiToolChoice 转换 tool_choice：auto -> auto，any -> required，tool -> 指定函数，none -> none
+// 第二个返回值为 false 表示 disable_parallel_tool_use
+func openaiToolChoice(toolChoice interface{}) (interface{}, bool) {
+	data, err := json.Marshal(toolChoice)
+	if err != nil || toolChoice == nil {
+		return nil, true
+	}
+	var choice struct {
+		Type                   string `json:"type"`
+		Name                   string `json:"name"`
+		DisableParallelToolUse bool   `json:"disable_parallel_tool_use"`
+	}
+	if json.Unmarshal(data, &choice) != nil {
+		return nil, true
+	}
+	parallel := !choice.DisableParallelToolUse
+	switch choice.Type {
+	case "any":
+		return "required", parallel
+	case "tool":
+		return map[string]interface{}{"type": "function", "function": map[string]interface{}{"name": choice.Name}}, parallel
+	case "none":
+		return "none", parallel
+	default:
+		return "auto", parallel
+	}
+}
+
+// openaiStopReason finish_reason -> Anthropic stop_reason
+func openaiStopReason(finishReason string, toolUse bool) string {
+	switch finishReason {
+	case "length":
+		return "max_tokens"
+	case "tool_calls", "function_call":
+		return "tool_use"
+	case "content_filter":
+		return "refusal"
+	}
+	if toolUse {
+		return "tool_use"
+	}
+	return "end_turn"
+}
+
+// openaiUsage 转换 usage：Anthropic 的 input_tokens 不含缓存命中的部分
+func openaiUsage(prompt, completion, cached int) AnthropicUsage {
+	return AnthropicUsage{
+		InputTokens:          prompt - cached,
+		CacheReadInputTokens: cached,
+		OutputTokens:         completion,
+	}
+}
+
+// openaiToolInput 解析工具参数，非法 JSON 时返回空对象
+func openaiToolInput(arguments string) map[string]interface{} {
+	input := map[string]interface{}{}
+	if arguments != "" {
+		if err := json.Unmarshal([]byte(arguments), &input); err != nil {
+			slog.Warn("failed to parse openai tool call arguments", "error", err)
+		}
+	}
+	return input
+}
+
+func (openaiBackend) ConvertResponse(body io.ReadCloser, req *BackendRequest) io.ReadCloser {
+	if req.Anthropic.Stream {
+		return convertStream(body, func(w io.Writer) error {
+			return convertOpenAIStream(body, w, req.Model)
+		})
+	}
+
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return io.NopCloser(&errReader{err: err})
+	}
+	var resp OpenAIResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return io.NopCloser(&errReader{err: fmt.Errorf("parse openai response: %w", err)})
+	}
+	converted, _ := json.Marshal(convertOpenAIResponse(&resp, req.Model))
+	return io.NopCloser(bytes.NewReader(converted))
+}
+
+// convertOpenAIResponse 非流式响应转换为 Anthropic 响应，reasoning_content 转为 thinking 块
+func convertOpenAIResponse(resp *OpenAIResponse, model string) AnthropicResponse {
+	out := AnthropicResponse{
+		ID:      "msg_" + resp.ID,
+		Type:    "message",
+		Role:    "assistant",
+		Model:   model,
+		Content: []AnthropicContent{},
+		Usage:   openaiUsage(resp.Usage.PromptTokens, resp.Usage.CompletionTokens, resp.Usage.PromptTokensDetails.CachedTokens),
+	}
+	if len(resp.Choices) == 0 {
+		out.StopReason = "end_turn"
+		return out
+	}
+
+	choice := resp.Choices[0]
+	if choice.Message.ReasoningContent != "" {
+		out.Content = append(out.Content, AnthropicContent{Type: "thinking", Thinking: choice.Message.ReasoningContent})
+	}
+	if choice.Message.Content != "" {
+		out.Content = append(out.Content, AnthropicContent{Type: "text", Text: stringPtr(choice.Message.Content)})
+	}
+	for _, call := range choice.Message.ToolCalls {
+		input := openaiToolInput(call.Function.Arguments)
+		out.Content = append(out.Content, AnthropicContent{Type: "tool_use", ID: call.ID, Name: call.Function.Name, Input: &input})
+	}
+	out.StopReason = openaiStopReason(choice.FinishReason, len(choice.Message.ToolCalls) > 0)
+	return out
+}
+
+// openaiChunk Chat Completions 流式 chunk 中用到的字段
+type openaiChunk struct {
+	ID      string `json:"id"`
+	Choices []struct {
+		Delta struct {
+			Content          string `json:"content"`
+			ReasoningContent string `json:"reasoning_content"`
+			ToolCalls        []struct {
+				Index    int    `json:"index"`
+				ID       string `json:"id"`
+				Function struct {
+					Name      string `json:"name"`
+					Arguments string `json:"arguments"`
+				} `json:"function"`
+			} `json:"tool_calls"`
+		} `json:"delta"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *struct {
+		PromptTokens        int `json:"prompt_tokens"`
+		CompletionTokens    int `json:"completion_tokens"`
+		PromptTokensDetails struct {
+			CachedTokens int `json:"cached_tokens"`
+		} `json:"prompt_tokens_details"`
+	} `json:"usage"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// convertOpenAIStream 将 Chat Completions 的 SSE chunk 转换为 Anthropic 的 SSE 事件
+// Anthropic 的内容块必须依次开始和结束，同一时刻只有一个打开的块；工具调用按 index 依次转换，回到已结束的调用的参数片段会被丢弃
+func convertOpenAIStream(body io.Reader, w io.Writer, model string) error {
+	var (
+		started    bool
+		index      int
+		openBlock  string // 当前未结束的 text / thinking / tool_use 块
+		toolIndex  = -1   // 当前打开的 tool_use 块对应的 OpenAI tool_calls index
+		toolUse    bool
+		stopReason string
+		usage      AnthropicUsage
+		writeErr   error
+	)
+	emit := func(event map[string]interface{}) {
+		if writeErr != nil {
+			return
+		}
+		data, _ := json.Marshal(event)
+		_, writeErr = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event["type"], data)
+	}
+	closeBlock := func() {
+		if openBlock != "" {
+			emit(map[string]interface{}{"type": "content_block_stop", "index": index})
+			index++
+			openBlock = ""
+		}
+	}
+	openText := func(blockType string) {
+		if openBlock == blockType {
+			return
+		}
+		closeBlock()
+		block := map[string]interface{}{"type": blockType, "text": ""}
+		if blockType == "thinking" {
+			block = map[string]interface{}{"type": "thinking", "thinking": ""}
+		}
+		emit(map[string]interface{}{"type": "content_block_start", "index": index, "content_block": block})
+		openBlock = blockType
+	}
+
+	reader := newSSEReader(body)
+	for writeErr == nil {
+		ev, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if ev.Data == "" {
+			continue
+		}
+		if ev.Data == "[DONE]" {
+			break
+		}
+
+		var chunk openaiChunk
+		if err := json.Unmarshal([]byte(ev.Data), &chunk); err != nil {
+			slog.Warn("failed to parse openai chunk", "error", err, "data", ev.Data)
+			continue
+		}
+		if chunk.Error != nil {
+			emit(map[string]interface{}{"type": "error", "error": map[string]interface{}{"type": "api_error", "message": chunk.Error.Message}})
+			return writeErr
+		}
+		if chunk.Usage != nil {
+			usage = openaiUsage(chunk.Usage.PromptTokens, chunk.Usage.CompletionTokens, chunk.Usage.PromptTokensDetails.CachedTokens)
+		}
+		if !started {
+			emit(map[string]interface{}{
+				"type": "message_start",
+				"message": map[string]interface{}{
+					"id": "msg_" + chunk.ID, "type": "message", "role": "assistant", "model": model,
+					"content": []interface{}{}, "stop_reason": nil, "stop_sequence": nil, "usage": usage,
+				},
+			})
+			started = true
+		}
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+
+		choice := chunk.Choices[0]
+		if choice.Delta.ReasoningContent != "" {
+			openText("thinking")
+			emit(map[string]interface{}{"type": "content_block_delta", "index": index, "delta": map[string]interface{}{"type": "thinking_delta", "thinking": choice.Delta.ReasoningContent}})
+		}
+		if choice.Delta.Content != "" {
+			openText("text")
+			emit(map[string]interface{}{"type": "content_block_delta", "index": index, "delta": map[string]interface{}{"type": "text_delta", "text": choice.Delta.Content}})
+		}
+		for _, call := range choice.Delta.ToolCalls {
+			if openBlock != "tool_use" || call.Index != toolIndex {
+				if call.Index < toolIndex {
+					slog.Warn("dropping out-of-order openai tool call delta", "index", call.Index)
+					continue
+				}
+				closeBlock()
+				emit(map[string]interface{}{"type": "content_block_start", "index": index, "content_block": map[string]interface{}{
+					"type": "tool_use", "id": call.ID, "name": call.Function.Name, "input": map[string]interface{}{},
+				}})
+				openBlock = "tool_use"
+				toolIndex = call.Index
+				toolUse = true
+			}
+			if call.Function.Arguments != "" {
+				emit(map[string]interface{}{"type": "content_block_delta", "index": index, "delta": map[string]interface{}{"type": "input_json_delta", "partial_json": call.Function.Arguments}})
+			}
+		}
+		if choice.FinishReason != "" {
+			stopReason = openaiStopReason(choice.FinishReason, toolUse)
+		}
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	if !started {
+		return errors.New("openai stream ended without any chunk")
+	}
+
+	closeBlock()
+	if stopReason == "" {
+		stopReason = openaiStopReason("", toolUse)
+	}
+	emit(map[string]interface{}{
+		"type":  "message_delta",
+		"delta": map[string]interface{}{"stop_reason": stopReason, "stop_sequence": nil},
+		"usage": usage,
+	})
+	emit(map[string]interface{}{"type": "message_stop"})
+	return writeErr
+}
+
+// ConvertError 按状态码映射错误类型（与 Bedrock 相同），消息取自 OpenAI 的 error.message
+func (openaiBackend) ConvertError(status int, body []byte) []byte {
+	var resp struct {
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &resp) != nil || resp.Error == nil || resp.Error.Message == "" {
+		return body
+	}
+	errorType, ok := bedrockErrorTypes[status]
+	if !ok {
+		errorType = "api_error"
+	}
+	converted, _ := json.Marshal(map[string]interface{}{"type": "error", "error": map[string]interface{}{"type": errorType, "message": resp.Error.Message}})
+	return converted
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OverflowConfig 提示超出模型上下文窗口时的处理方式
+type OverflowConfig struct {
+	Mode        string // off / truncate（丢弃最早的对话轮次）/ summarize（把较早的轮次压缩为摘要）
+	CountTokens bool   // 估算接近上限时用上游 count_tokens 接口校准（仅 Anthropic 上游）
+	Windows     []ContextWindow
+
+	CompactionModel     string // 生成摘要的模型
+	CompactionThreshold int    // 提示超过该值时压缩，0 表示上下文窗口减去 max_tokens
+}
+
+// ContextWindow 模型的上下文窗口（输入 + max_tokens）
+type ContextWindow struct {
+	Pattern string // glob 模式，如 claude-sonnet-4*
+	Tokens  int
+}
+
+// defaultContextWindows 内置的上下文窗口，未匹配的模型不处理
+var defaultContextWindows = []ContextWindow{
+	{"claude-*", 200000},
+}
+
+// loadOverflowConfig 读取 CONTEXT_OVERFLOW（off / truncate / summarize）、CONTEXT_TOKEN_COUNT（heuristic / api）、
+// MODEL_CONTEXT_WINDOW 和 COMPACTION_*
+func loadOverflowConfig() OverflowConfig {
+	mode := strings.ToLower(os.Getenv("CONTEXT_OVERFLOW"))
+	switch mode {
+	case "":
+		mode = "off"
+	case "off", "truncate", "summarize":
+	default:
+		slog.Warn("unknown CONTEXT_OVERFLOW, overflow handling disabled", "value", mode)
+		mode = "off"
+	}
+	compactionModel := os.Getenv("COMPACTION_MODEL")
+	if compactionModel == "" {
+		compactionModel = defaultCompactionModel
+	}
+	return OverflowConfig{
+		Mode:                mode,
+		CountTokens:         strings.ToLower(os.Getenv("CONTEXT_TOKEN_COUNT")) == "api",
+		Windows:             parseContextWindows(os.Getenv("MODEL_CONTEXT_WINDOW")),
+		CompactionModel:     compactionModel,
+		CompactionThreshold: getEnvInt("COMPACTION_THRESHOLD", 0),
+	}
+}
+
+// parseContextWindows 解析 MODEL_CONTEXT_WINDOW，配置项优先于内置窗口
+// 格式: "pattern=tokens"，示例: "claude-sonnet-4*=1000000,my-proxy-model=32000"
+func parseContextWindows(windowsStr string) []ContextWindow {
+	windows := make([]ContextWindow, 0, len(defaultContextWindows))
+
+	for _, item := range strings.Split(windowsStr, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		pattern := strings.TrimSpace(parts[0])
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			slog.Warn("invalid context window pattern", "pattern", pattern, "error", err)
+			continue
+		}
+		tokens, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || tokens <= 0 {
+			slog.Warn("invalid context window", "pattern", pattern, "value", parts[1])
+			continue
+		}
+		windows = append(windows, ContextWindow{Pattern: pattern, Tokens: tokens})
+	}
+
+	return append(windows, defaultContextWindows...)
+}
+
+// contextWindow 返回模型的上下文窗口，未配置时返回 false
+func (h *ProxyHandler) contextWindow(model string) (int, bool) {
+	for _, w := range h.overflow.Windows {
+		if ok, _ := path.Match(w.Pattern, model); ok {
+			return w.Tokens, true
+		}
+	}
+	return 0, false
+}
+
+// 估算 token 数时图片和 PDF 的近似值
+const (
+	imageTokenEstimate   = 1600 // 约 1.15 百万像素的图片
+	pdfBytesPerToken     = 40   // PDF 每页同时按文本和图片计费，按 base64 长度粗略估算
+	messageTokenOverhead = 4    // 每条消息 / 内容块的格式开销
+)
+
+// estimateTextTokens 粗略估算文本的 token 数：ASCII 约 4 个字符一个 token，其他字符（中文等）约一个字符一个 token
+func estimateTextTokens(s string) int {
+	ascii, other := 0, 0
+	for _, r := range s {
+		if r < utf8.RuneSelf {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	return (ascii+3)/4 + other
+}
+
+// estimateJSONTokens 按 JSON 序列化后的文本估算
+func estimateJSONTokens(v interface{}) int {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return 0
+	}
+	return estimateTextTokens(string(data))
+}
+
+// estimateBlockTokens 估算单个内容块，图片和文档不按 base64 长度计算
+func estimateBlockTokens(block AnthropicContent) int {
+	switch block.Type {
+	case "text":
+		if block.Text != nil {
+			return estimateTextTokens(*block.Text) + messageTokenOverhead
+		}
+	case "image":
+		return imageTokenEstimate
+	case "document":
+		if block.Source != nil && block.Source.Type == "base64" {
+			if strings.HasPrefix(block.Source.MediaType, "text/") {
+				return estimateTextTokens(block.Source.Data)*3/4 + messageTokenOverhead
+			}
+			return len(block.Source.Data)/pdfBytesPerToken + messageTokenOverhead
+		}
+		return imageTokenEstimate
+	case "tool_result":
+		if blocks, ok := block.Content.([]AnthropicContent); ok {
+			n := messageTokenOverhead
+			for _, b := range blocks {
+				n += estimateBlockTokens(b)
+			}
+			return n
+		}
+	}
+	return estimateJSONTokens(block)
+}
+
+// estimateMessageTokens 估算一条消息
+func estimateMessageTokens(msg AnthropicMessage) int {
+	switch content := msg.Content.(type) {
+	case string:
+		return estimateTextTokens(content) + messageTokenOverhead
+	case []AnthropicContent:
+		n := messageTokenOverhead
+		for _, block := range content {
+			n += estimateBlockTokens(block)
+		}
+		return n
+	}
+	return estimateJSONTokens(msg.Content) + messageTokenOverhead
+}
+
+// estimateFixedTokens 估算不会被截断的部分（system 和工具定义）
+func estimateFixedTokens(req *AnthropicRequest) int {
+	n := 0
+	for _, block := range req.System {
+		n += estimateTextTokens(block.Text) + messageTokenOverhead
+	}
+	if len(req.Tools) > 0 {
+		n += estimateJSONTokens(req.Tools)
+	}
+	return n
+}
+
+// isTurnStart 可以作为截断后第一条消息的位置：不含 tool_result 的 user 消息
+// 从这里截断不会留下没有 tool_use 的 tool_result
+func isTurnStart(msg AnthropicMessage) bool {
+	if msg.Role != "user" {
+		return false
+	}
+	if contents, ok := msg.Content.([]AnthropicContent); ok {
+		for _, block := range contents {
+			if block.Type == "tool_result" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// truncateHistory 丢弃最早的对话轮次，直到估算的提示不超过预算
+// costs 为每条消息的估算值，fixed 为 system 和工具定义的估算值；总是保留最后一个轮次，仍然超出时返回 false
+func truncateHistory(messages []AnthropicMessage, costs []int, fixed int, budget int) ([]AnthropicMessage, bool) {
+	total := fixed
+	for _, cost := range costs {
+		total += cost
+	}
+	cut, remaining := 0, total
+	for i := 1; i < len(messages) && remaining > budget; i++ {
+		total -= costs[i-1]
+		if isTurnStart(messages[i]) {
+			cut, remaining = i, total
+		}
+	}
+	return messages[cut:], remaining <= budget
+}
+
+// countTokensRequest count_tokens 接口的请求体，只包含影响输入 token 数的字段
+type countTokensRequest struct {
+	Model      string                 `json:"model"`
+	Messages   []AnthropicMessage     `json:"messages"`
+	System     []AnthropicSystemBlock `json:"system,omitempty"`
+	Tools      []interface{}          `json:"tools,omitempty"`
+	ToolChoice interface{}            `json:"tool_choice,omitempty"`
+	Thinking   *ThinkingConfig        `json:"thinking,omitempty"`
+}
+
+// countTokens 调用上游 /v1/messages/count_tokens 计算输入 token 数，只支持 Anthropic 上游
+// 计数请求是原请求的副本，同样经过 guardrails 和转换插件（如 pii 脱敏）
+func (h *ProxyHandler) countTokens(c *gin.Context, req *AnthropicRequest, apiKey string, reqID string) (int, error) {
+	target := h.resolveUpstream(req.Model)
+	if target.Backend != nil {
+		return 0, errors.New("count_tokens requires an Anthropic upstream")
+	}
+	if target.APIKey != "" {
+		apiKey = target.APIKey
+	}
+	orig := req
+	req, err := cloneAnthropicRequest(req)
+	if err != nil {
+		return 0, err
+	}
+	if err := h.transformHelperRequest(c, orig, req, reqID); err != nil {
+		return 0, err
+	}
+
+	body, err := json.Marshal(countTokensRequest{
+		Model:      req.Model,
+		Messages:   req.Messages,
+		System:     req.System,
+		Tools:      req.Tools,
+		ToolChoice: req.ToolChoice,
+		Thinking:   req.Thinking,
+	})
+	if err != nil {
+		return 0, err
+	}
+	httpReq, err := http.NewRequestWithContext(c.Request.Context(), "POST", target.BaseURL+"/v1/messages/count_tokens", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("x-api-key", apiKey)
+	httpReq.Header.Set("anthropic-version", "2023-06-01")
+	if betas := anthropicBetas(req, h.settings().Cache.Enabled, h.betas.forModel(req.Model)); betas != "" {
+		httpReq.Header.Set("anthropic-beta", betas)
+	}
+	httpReq.Header.Set(upstreamRequestIDHeader, reqID)
+
+	httpResp, err := h.client.Do(httpReq)
+	if err != nil {
+		return 0, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(io.LimitReader(httpResp.Body, 1024))
+		return 0, fmt.Errorf("count_tokens status %d: %s", httpResp.StatusCode, respBody)
+	}
+	var result struct {
+		InputTokens int `json:"input_tokens"`
+	}
+	if err := json.NewDecoder(httpResp.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+	return result.InputTokens, nil
+}
+
+// fitContext 提示超出模型上下文窗口（减去 max_tokens）时丢弃最早的对话轮次，
+// 并通过 x-proxy-context-truncated 告知客户端丢弃的消息数；summarize 模式下超过压缩阈值时改为压缩为摘要，失败时退回截断
+// 启用 count_tokens 时，估算超过预算一半才调用上游计数，并按实际值等比校准每条消息的估算
+func (h *ProxyHandler) fitContext(c *gin.Context, req *AnthropicRequest, apiKey, user string, reqID string) {
+	if h.overflow.Mode == "off" || len(req.Messages) < 2 {
+		return
+	}
+	window, ok := h.contextWindow(req.Model)
+	if !ok {
+		return
+	}
+	logger := reqLog(reqID)
+	budget := window - req.MaxTokens
+	if budget <= 0 {
+		logger.Warn("max_tokens exceeds context window, skip truncation", "model", req.Model, "max_tokens", req.MaxTokens, "context_window", window)
+		return
+	}
+
+	fixed := estimateFixedTokens(req)
+	costs := make([]int, len(req.Messages))
+	estimate := fixed
+	for i, msg := range req.Messages {
+		costs[i] = estimateMessageTokens(msg)
+		estimate += costs[i]
+	}
+
+	limit := budget
+	if h.overflow.Mode == "summarize" && h.overflow.CompactionThreshold > 0 {
+		limit = min(budget, h.overflow.CompactionThreshold)
+	}
+
+	if h.overflow.CountTokens && estimate > limit/2 {
+		counted, err := h.countTokens(c, req, apiKey, reqID)
+		if err != nil {
+			logger.Warn("count_tokens failed, using estimate", "error", err)
+		} else {
+			logger.Debug("count_tokens", "estimate", estimate, "input_tokens", counted)
+			if counted <= limit {
+				return
+			}
+			// 按实际值校准估算
+			scale := float64(counted) / float64(max(estimate, 1))
+			fixed = int(float64(fixed) * scale)
+			for i := range costs {
+				costs[i] = int(float64(costs[i]) * scale)
+			}
+			estimate = counted
+		}
+	}
+	if estimate <= limit {
+		return
+	}
+	if h.overflow.Mode == "summarize" {
+		if h.compactHistory(c, req, costs, fixed, limit, apiKey, user, reqID) {
+			return
+		}
+		if estimate <= budget {
+			return
+		}
+	}
+
+	messages, fits := truncateHistory(req.Messages, costs, fixed, budget)
+	dropped := len(req.Messages) - len(messages)
+	if dropped == 0 {
+		logger.Warn("prompt exceeds context window but cannot be truncated", "model", req.Model, "estimate", estimate, "budget", budget)
+		return
+	}
+	req.Messages = messages
+	logger.Info("context truncated", "model", req.Model, "estimate", estimate, "budget", budget,
+		"dropped_messages", dropped, "messages", len(messages), "fits", fits)
+	c.Header("x-proxy-context-truncated", strconv.Itoa(dropped))
+}
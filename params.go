@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// unsupportedParams Anthropic 没有对应参数的 OpenAI 请求字段，默认丢弃
+// 后半部分是 vLLM / llama.cpp / TGI 等本地推理服务的扩展参数，为这些服务编写的工具常常会带上
+var unsupportedParams = []string{
+	"frequency_penalty",
+	"presence_penalty",
+	"logit_bias",
+	"logprobs",
+	"top_logprobs",
+	"best_of",
+	"suffix",
+	"min_p",
+	"typical_p",
+	"top_a",
+	"tfs_z",
+	"repetition_penalty",
+	"repeat_penalty",
+	"repeat_last_n",
+	"length_penalty",
+	"use_beam_search",
+	"min_tokens",
+	"ignore_eos",
+	"stop_token_ids",
+	"mirostat",
+	"mirostat_tau",
+	"mirostat_eta",
+	"guided_regex",
+	"guided_choice",
+	"guided_grammar",
+	"grammar",
+}
+
+// paramDefaults 默认值不为 0 的字段，等于默认值时不影响结果
+var paramDefaults = map[string]float64{
+	"best_of":            1,
+	"typical_p":          1,
+	"tfs_z":              1,
+	"repetition_penalty": 1,
+	"repeat_penalty":     1,
+	"length_penalty":     1,
+}
+
+// findUnsupportedParams 返回请求体中设置了非默认值的不支持字段
+// SDK 常常带上 0、null 或空对象等默认值，这些不影响结果，不算在内
+func findUnsupportedParams(rawBody []byte) []string {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(rawBody, &fields); err != nil {
+		return nil
+	}
+
+	var found []string
+	for _, name := range unsupportedParams {
+		if value, ok := fields[name]; ok && !isDefaultParam(name, value) {
+			found = append(found, name)
+		}
+	}
+	return found
+}
+
+func isDefaultParam(name string, value json.RawMessage) bool {
+	switch string(bytes.TrimSpace(value)) {
+	case "null", "false", "{}", "[]", `""`:
+		return true
+	}
+	var n float64
+	if err := json.Unmarshal(value, &n); err != nil {
+		return false
+	}
+	if d, ok := paramDefaults[name]; ok {
+		return n == d
+	}
+	return n == 0
+}
+
+// localInferenceParams 本地推理服务中有对应含义的扩展字段
+type localInferenceParams struct {
+	NPredict     int             `json:"n_predict"`      // llama.cpp，-1 表示不限制
+	MaxNewTokens int             `json:"max_new_tokens"` // TGI
+	GuidedJSON   json.RawMessage `json:"guided_json"`    // vLLM，JSON Schema 对象或其 JSON 字符串
+}
+
+// mapLocalInferenceParams 把 n_predict / max_new_tokens 转换为 max_tokens，guided_json 转换为 json_schema 的 response_format
+// 只在请求没有设置对应的标准字段时生效，返回转换了的字段
+func mapLocalInferenceParams(rawBody []byte, req *OpenAIRequest) []string {
+	var p localInferenceParams
+	if err := json.Unmarshal(rawBody, &p); err != nil {
+		return nil
+	}
+
+	var mapped []string
+	if req.MaxTokens == 0 {
+		if p.MaxNewTokens > 0 {
+			req.MaxTokens = p.MaxNewTokens
+			mapped = append(mapped, "max_new_tokens")
+		} else if p.NPredict > 0 {
+			req.MaxTokens = p.NPredict
+			mapped = append(mapped, "n_predict")
+		}
+	}
+	if req.ResponseFormat == nil && len(p.GuidedJSON) > 0 && string(p.GuidedJSON) != "null" {
+		schema := p.GuidedJSON
+		var text string
+		if json.Unmarshal(schema, &text) == nil {
+			schema = json.RawMessage(text)
+		}
+		var format ResponseFormat
+		raw := fmt.Sprintf(`{"type":"json_schema","json_schema":{"name":"guided_json","schema":%s}}`, schema)
+		if json.Unmarshal([]byte(raw), &format) == nil && format.JSONSchema.Schema != nil {
+			req.ResponseFormat = &format
+			mapped = append(mapped, "guided_json")
+		}
+	}
+	return mapped
+}
+
+// jsonFieldNames 返回结构体各字段的 JSON 名称
+func jsonFieldNames(v interface{}) []string {
+	t := reflect.TypeOf(v)
+	names := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// findUnknownFields 返回请求体顶层中 v 的字段、unsupportedParams 和本地推理扩展字段以外的字段，按名称排序
+// 相当于对顶层字段使用 DisallowUnknownFields，但会列出全部未识别的字段；嵌套对象（messages、tools 等）不检查
+func findUnknownFields(rawBody []byte, v interface{}) []string {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(rawBody, &fields); err != nil {
+		return nil
+	}
+	known := make(map[string]bool)
+	for _, name := range jsonFieldNames(v) {
+		known[name] = true
+	}
+	for _, name := range jsonFieldNames(localInferenceParams{}) {
+		known[name] = true
+	}
+	for _, name := range unsupportedParams {
+		known[name] = true
+	}
+
+	var unknown []string
+	for name := range fields {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// checkUnknownFields STRICT_JSON 时请求体带有未识别的字段返回 400 并列出这些字段；
+// 不支持但已知的字段（penalty 等）仍按 checkUnsupportedParams 处理
+func (h *ProxyHandler) checkUnknownFields(c *gin.Context, rawBody []byte, v interface{}, reqID string) bool {
+	if !h.strictJSON {
+		return true
+	}
+	unknown := findUnknownFields(rawBody, v)
+	if len(unknown) == 0 {
+		return true
+	}
+	reqLog(reqID).Warn("unknown request fields rejected", "fields", unknown)
+	respondParamError(c, unknown[0], fmt.Sprintf("unrecognized request fields: %s", strings.Join(unknown, ", ")))
+	return false
+}
+
+// checkUnsupportedParams 处理不支持的请求字段：STRICT_PARAMS 时返回 400 并列出字段，否则丢弃并在 X-Proxy-Warning 中说明
+// REJECT_LOGPROBS 时只对 logprobs / top_logprobs 返回 400，其他字段仍按 STRICT_PARAMS 处理
+func (h *ProxyHandler) checkUnsupportedParams(c *gin.Context, rawBody []byte, reqID string) bool {
+	params := findUnsupportedParams(rawBody)
+	if len(params) == 0 {
+		return true
+	}
+	if h.rejectLogprobs {
+		for _, param := range params {
+			if param == "logprobs" || param == "top_logprobs" {
+				reqLog(reqID).Warn("logprobs request rejected", "param", param)
+				respondParamError(c, param, "logprobs are not supported: Claude models do not return token log probabilities")
+				return false
+			}
+		}
+	}
+	if h.strictParams {
+		reqLog(reqID).Warn("unsupported parameters rejected", "params", params)
+		respondParamError(c, params[0], fmt.Sprintf("unsupported parameters: %s", strings.Join(params, ", ")))
+		return false
+	}
+	reqLog(reqID).Info("unsupported parameters ignored", "params", params)
+	addProxyWarning(c, "ignored unsupported parameters: "+strings.Join(params, ", "))
+	return true
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// hopByHopHeaders 逐跳头，不应在代理两端之间转发
+var hopByHopHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+}
+
+// HandleMessages Anthropic 原生 /v1/messages 透传，不做格式转换，也不执行转换插件（请求体和响应原样转发）
+func (h *ProxyHandler) HandleMessages(c *gin.Context) {
+	reqID := requestID(c)
+	logger := reqLog(reqID)
+
+	apiKey, ok := h.trustedNetworkAPIKey(c, reqID)
+	clientKey := apiKey
+	if !ok {
+		apiKey = anthropicAPIKey(c)
+		if apiKey == "" {
+			logger.Warn("missing x-api-key or Authorization header")
+			respondAnthropicError(c, http.StatusUnauthorized, "Missing x-api-key or Authorization header")
+			return
+		}
+		clientKey = apiKey
+		if apiKey, ok = h.resolveAPIKey(c, apiKey, reqID); !ok {
+			return
+		}
+	}
+
+	rawBody, ok := readRequestBody(c, reqID)
+	if !ok {
+		return
+	}
+
+	logger.Debug("raw anthropic request", "body", string(rawBody))
+
+	// 只解析 stream 字段用于决定响应处理方式，请求体原样转发
+	var probe struct {
+		Model  string `json:"model"`
+		Stream bool   `json:"stream"`
+	}
+	_ = json.Unmarshal(rawBody, &probe)
+	logger.Info("messages request (passthrough)", "model", probe.Model, "stream", probe.Stream)
+	c.Set(metricsModelKey, probe.Model)
+	c.Set(streamKey, probe.Stream)
+
+	if !h.checkRateLimit(c, clientKey, probe.Model, reqID) {
+		return
+	}
+	if h.guardrails != nil {
+		// 请求体原样转发，只为检查策略解析
+		req, err := parseAnthropicRequest(rawBody)
+		if err != nil {
+			logger.Warn("invalid anthropic request", "error", err)
+			respondAnthropicError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		if !h.checkAnthropicGuardrails(c, req, reqID) {
+			return
+		}
+	}
+	release, ok := h.acquireConcurrency(c, clientKey, reqID)
+	if !ok {
+		return
+	}
+	defer release()
+
+	primary := h.resolveUpstream(probe.Model)
+	if primary.Backend != nil && primary.Backend.Name() != "anthropic" {
+		logger.Warn("passthrough to non-anthropic backend", "model", probe.Model, "backend", primary.Backend.Name())
+		respondAnthropicError(c, http.StatusBadRequest, "model "+probe.Model+" is routed to the "+primary.Backend.Name()+" backend, /v1/messages only supports Anthropic upstreams")
+		return
+	}
+	path := "/v1/messages"
+	if c.Request.URL.RawQuery != "" {
+		path += "?" + c.Request.URL.RawQuery
+	}
+
+	newRequest := func(ctx context.Context, target upstreamTarget) (*http.Request, error) {
+		body := rawBody
+		if target.Model != "" {
+			body = withModel(rawBody, target.Model)
+		}
+		httpReq, err := http.NewRequestWithContext(ctx, "POST", target.BaseURL+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+
+		// 原样转发请求头（逐跳头除外）
+		copyHeaders(httpReq.Header, c.Request.Header)
+		// 交给 http.Client 处理压缩，避免把压缩后的 SSE 直接透传
+		httpReq.Header.Del("Accept-Encoding")
+		httpReq.Header.Del("Content-Length")
+		if httpReq.Header.Get("x-api-key") == "" || apiKey != clientKey {
+			// Bearer 形式的 key 转为 x-api-key，避免上游按 OAuth token 处理；虚拟 key 替换为上游 key
+			httpReq.Header.Del("Authorization")
+			httpReq.Header.Set("x-api-key", apiKey)
+		}
+		if target.APIKey != "" {
+			httpReq.Header.Del("Authorization")
+			httpReq.Header.Set("x-api-key", target.APIKey)
+		}
+		if httpReq.Header.Get("anthropic-version") == "" {
+			httpReq.Header.Set("anthropic-version", "2023-06-01")
+		}
+		httpReq.Header.Del(requestIDHeader)
+		httpReq.Header.Set(upstreamRequestIDHeader, reqID)
+		return httpReq, nil
+	}
+
+	logger.Debug("forwarding request", "url", primary.BaseURL+path)
+
+	httpResp, call, err := h.doUpstream(c.Request.Context(), primary, newRequest, probe.Model, reqID)
+	if err != nil {
+		upErr := call.upstreamError(err)
+		call.release()
+		logger.Error("upstream request failed", "status", upErr.StatusCode, "error", err)
+		respondAnthropicError(c, upErr.StatusCode, upErr.Message)
+		return
+	}
+	call.bind(httpResp)
+	defer httpResp.Body.Close()
+
+	copyHeaders(c.Writer.Header(), httpResp.Header)
+	c.Writer.Header().Del("Content-Length")
+	c.Writer.Header().Del("Content-Encoding")
+
+	if probe.Stream && httpResp.StatusCode == http.StatusOK {
+		call.streaming()
+		h.passthroughStream(c, httpResp, probe.Model, reqID)
+	} else {
+		h.passthroughBody(c, httpResp, reqID)
+	}
+}
+
+// passthroughBody 原样返回非流式响应，并记录 usage
+func (h *ProxyHandler) passthroughBody(c *gin.Context, httpResp *http.Response, reqID string) {
+	bodyBytes, err := readResponseBody(httpResp.Body, h.maxResponseBytes)
+	if err != nil {
+		reqLog(reqID).Error("read response body failed", "error", err)
+		respondAnthropicError(c, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	if httpResp.StatusCode != http.StatusOK {
+		reqLog(reqID).Error("anthropic error response", "status", httpResp.StatusCode, "body", string(bodyBytes))
+	} else {
+		var anthropicResp AnthropicResponse
+		if err := json.Unmarshal(bodyBytes, &anthropicResp); err == nil {
+			h.recordUsage(c, reqID, anthropicResp.Model, &anthropicResp.Usage)
+			metrics.ObserveToolCalls(anthropicResp.Model, countToolUses(anthropicResp.Content))
+		}
+	}
+
+	c.Status(httpResp.StatusCode)
+	c.Writer.Write(bodyBytes)
+}
+
+// passthroughStream 逐行透传 SSE，同时从 message_start/message_delta 中收集 usage
+func (h *ProxyHandler) passthroughStream(c *gin.Context, httpResp *http.Response, model string, reqID string) {
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		reqLog(reqID).Error("streaming not supported by client")
+		respondAnthropicError(c, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	c.Status(httpResp.StatusCode)
+
+	usage := &AnthropicUsage{}
+	eventCount := 0
+	toolCalls := 0
+	start := time.Now()
+	_, relaySpan := startSpan(c.Request.Context(), "stream relay", spanKindInternal)
+	defer relaySpan.End()
+
+	// 按完整事件转发，心跳只会出现在两个事件之间
+	defer closeOnDisconnect(c, httpResp.Body)()
+	scanner := newHeartbeatScanner(httpResp.Body, h.heartbeatInterval, h.streamIdleTimeout, ssePing(c, flusher))
+	defer scanner.Stop()
+	for scanner.Scan() {
+		ev := scanner.Event()
+		fmt.Fprintf(c.Writer, "%s\n", ev.Raw)
+		flusher.Flush()
+
+		if ev.Data == "" {
+			continue
+		}
+		eventCount++
+
+		var event map[string]interface{}
+		if err := json.Unmarshal([]byte(ev.Data), &event); err != nil {
+			continue
+		}
+
+		switch event["type"] {
+		case "message_start":
+			if msg, ok := event["message"].(map[string]interface{}); ok {
+				if u, ok := msg["usage"].(map[string]interface{}); ok {
+					usage = parseUsage(u)
+				}
+			}
+		case "content_block_start":
+			if block, ok := event["content_block"].(map[string]interface{}); ok && block["type"] == "tool_use" {
+				toolCalls++
+			}
+		case "message_delta":
+			if u, ok := event["usage"].(map[string]interface{}); ok {
+				mergeDeltaUsage(usage, parseUsage(u))
+			}
+		}
+	}
+	flusher.Flush()
+
+	logStreamEnd(c, reqID, scanner.Err())
+	if err := scanner.Err(); err != nil {
+		relaySpan.SetError(err.Error())
+	}
+
+	reqLog(reqID).Info("passthrough stream completed", "events", eventCount, "duration", time.Since(start))
+	h.recordUsage(c, reqID, model, usage)
+	metrics.ObserveStream(model, usage.OutputTokens, time.Since(start))
+	metrics.ObserveToolCalls(model, toolCalls)
+}
+
+// recordUsage 记录 usage 日志并更新 token 指标
+func (h *ProxyHandler) recordUsage(c *gin.Context, reqID string, model string, usage *AnthropicUsage) {
+	args := []any{
+		"model", model,
+		"input_tokens", usage.InputTokens,
+		"output_tokens", usage.OutputTokens,
+		"cache_read", usage.CacheReadInputTokens,
+		"cache_creation", usage.CacheCreationInputTokens,
+	}
+	if cost, priced := h.observeUsage(c, model, usage); priced {
+		args = append(args, "cost_usd", cost)
+	}
+	reqLog(reqID).Info("usage", args...)
+	h.observeSessionCache(c, usage, reqID)
+}
+
+func countToolUses(contents []AnthropicContent) int {
+	n := 0
+	for _, content := range contents {
+		if content.Type == "tool_use" {
+			n++
+		}
+	}
+	return n
+}
+
+func copyHeaders(dst, src http.Header) {
+	for key, values := range src {
+		if hopByHopHeaders[http.CanonicalHeaderKey(key)] {
+			continue
+		}
+		for _, v := range values {
+			dst.Add(key, v)
+		}
+	}
+}
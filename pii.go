@@ -0,0 +1,426 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+func init() {
+	RegisterTransformer("pii", newPIITransformer)
+}
+
+// piiDetector 一类敏感信息的识别规则
+type piiDetector struct {
+	label   string // 占位符前缀，如 EMAIL → [EMAIL_1]
+	pattern *regexp.Regexp
+	valid   func(string) bool // 可选的二次校验，如信用卡号的 Luhn 校验
+}
+
+// piiDetectors 按 PII_TYPES 中的名称索引
+var piiDetectors = map[string]piiDetector{
+	"secret": {label: "SECRET", pattern: regexp.MustCompile(
+		`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----` +
+			`|\bsk-(?:ant-)?[A-Za-z0-9_-]{20,}` +
+			`|\b(?:AKIA|ASIA)[0-9A-Z]{16}\b` +
+			`|\bgh[pousr]_[A-Za-z0-9]{36,}\b|\bgithub_pat_[A-Za-z0-9_]{22,}` +
+			`|\bxox[abprs]-[A-Za-z0-9-]{10,}` +
+			`|\bAIza[0-9A-Za-z_-]{35}` +
+			`|\beyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}`)},
+	"email":       {label: "EMAIL", pattern: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`)},
+	"credit_card": {label: "CARD", pattern: regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`), valid: luhnValid},
+	// 国际格式（+ 开头）、中国大陆手机号、以空格或 - 分隔的号码；不匹配 . 分隔，避免误伤版本号和 IP
+	"phone": {label: "PHONE", pattern: regexp.MustCompile(
+		`\+\d{1,3}[ -]?(?:\(\d{1,4}\)[ -]?)?\d{2,4}(?:[ -]?\d{2,4}){1,3}\b` +
+			`|\b1[3-9]\d{9}\b` +
+			`|(?:\(\d{2,4}\)[ -]?|\b\d{3,4}[ -])\d{3,4}[ -]\d{4}\b`)},
+}
+
+// piiDetectorOrder 识别顺序：secret 在最前面，避免 key 中的片段先被识别为电话或卡号
+var piiDetectorOrder = []string{"secret", "email", "credit_card", "phone"}
+
+// piiPlaceholder 占位符，响应中出现时还原为原文
+var piiPlaceholder = regexp.MustCompile(`\[(?:SECRET|EMAIL|CARD|PHONE)_\d+\]`)
+
+// piiNotice 有内容被替换时追加到 system，要求模型原样使用占位符，否则响应中的占位符无法还原
+const piiNotice = "Some personal or secret values in this conversation have been replaced with placeholders such as [EMAIL_1] or [PHONE_2]. " +
+	"Use the placeholders verbatim (including the brackets) wherever you need to refer to these values; they are restored before your response reaches the user."
+
+// piiRule 匹配模型时使用的识别类型，types 为空表示不过滤
+type piiRule struct {
+	pattern string
+	types   []string
+}
+
+// piiTransformer 内置插件：把发送给上游的消息中的邮箱、电话、信用卡号和密钥替换为占位符，响应中的占位符再还原为原文
+// 同一个值在一个请求中使用同一个占位符，编号按首次出现的顺序分配，历史不变时编号不变，不影响 prompt cache
+type piiTransformer struct {
+	defaults []string
+	rules    []piiRule
+	paths    []string // 只处理这些客户端请求路径（支持 * 通配），为空表示全部
+}
+
+func newPIITransformer() (Transformer, error) {
+	defaults, err := parsePIITypes(os.Getenv("PII_TYPES"), piiDetectorOrder)
+	if err != nil {
+		return nil, fmt.Errorf("PII_TYPES: %w", err)
+	}
+	t := &piiTransformer{defaults: defaults}
+	for _, item := range parseModelList(os.Getenv("PII_MODELS")) {
+		pattern, types, ok := strings.Cut(item, "=")
+		pattern = strings.TrimSpace(pattern)
+		if _, err := path.Match(pattern, ""); !ok || err != nil || pattern == "" {
+			return nil, fmt.Errorf("PII_MODELS: invalid rule %q, expected pattern=type|type", item)
+		}
+		parsed, err := parsePIITypes(strings.ReplaceAll(types, "|", ","), nil)
+		if err != nil {
+			return nil, fmt.Errorf("PII_MODELS: %w", err)
+		}
+		t.rules = append(t.rules, piiRule{pattern: pattern, types: parsed})
+	}
+	for _, p := range parseModelList(os.Getenv("PII_PATHS")) {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("PII_PATHS: invalid pattern %q", p)
+		}
+		t.paths = append(t.paths, p)
+	}
+	slog.Info("pii filter enabled", "types", defaults, "model_rules", len(t.rules), "paths", t.paths)
+	return t, nil
+}
+
+// parsePIITypes 解析逗号分隔的类型，all 表示全部，none 表示不过滤；为空时返回 fallback
+func parsePIITypes(s string, fallback []string) ([]string, error) {
+	names := parseModelList(s)
+	if len(names) == 0 {
+		return fallback, nil
+	}
+	enabled := make(map[string]bool)
+	for _, name := range names {
+		switch name {
+		case "all":
+			for _, n := range piiDetectorOrder {
+				enabled[n] = true
+			}
+		case "none":
+		default:
+			if _, ok := piiDetectors[name]; !ok {
+				return nil, fmt.Errorf("unknown type %q (supported: %s)", name, strings.Join(piiDetectorOrder, ", "))
+			}
+			enabled[name] = true
+		}
+	}
+	var types []string
+	for _, name := range piiDetectorOrder {
+		if enabled[name] {
+			types = append(types, name)
+		}
+	}
+	return types, nil
+}
+
+func (t *piiTransformer) Name() string { return "pii" }
+
+// typesFor 请求路径不在 PII_PATHS 中时不过滤；否则按 PII_MODELS 的顺序匹配模型，都不匹配时使用 PII_TYPES
+func (t *piiTransformer) typesFor(reqPath, model string) []string {
+	if len(t.paths) > 0 && !slices.ContainsFunc(t.paths, func(p string) bool {
+		ok, _ := path.Match(p, reqPath)
+		return ok
+	}) {
+		return nil
+	}
+	for _, rule := range t.rules {
+		if ok, _ := path.Match(rule.pattern, model); ok {
+			return rule.types
+		}
+	}
+	return t.defaults
+}
+
+// piiVault 一个请求中原文与占位符的对应关系，以及流式响应中暂存的未完整的占位符
+type piiVault struct {
+	detectors []piiDetector
+	byValue   map[string]string // 原文 → 占位符
+	byToken   map[string]string // 占位符 → 原文
+	counts    map[string]int
+	pendingMu sync.Mutex
+	pending   map[piiBlock]piiPending // 按 choice 和内容块序号暂存的未完整的占位符
+}
+
+// piiPending 暂存的片段，jsonEscape 表示来自工具参数的 partial_json
+type piiPending struct {
+	text       string
+	jsonEscape bool
+}
+
+// piiBlock 流式响应中的一个内容块，n > 1 时多个流的内容块序号重复
+type piiBlock struct {
+	choice, index int
+}
+
+func (v *piiVault) mask(text string) string {
+	for _, d := range v.detectors {
+		text = d.pattern.ReplaceAllStringFunc(text, func(match string) string {
+			if d.valid != nil && !d.valid(match) {
+				return match
+			}
+			if token, ok := v.byValue[match]; ok {
+				return token
+			}
+			v.counts[d.label]++
+			token := fmt.Sprintf("[%s_%d]", d.label, v.counts[d.label])
+			v.byValue[match], v.byToken[token] = token, match
+			return token
+		})
+	}
+	return text
+}
+
+// restore 把文本中的占位符还原为原文，jsonEscape 为 true 时原文按 JSON 字符串转义（用于工具参数的 partial_json）
+func (v *piiVault) restore(text string, jsonEscape bool) string {
+	return piiPlaceholder.ReplaceAllStringFunc(text, func(token string) string {
+		original, ok := v.byToken[token]
+		if !ok {
+			return token
+		}
+		if jsonEscape {
+			quoted, _ := json.Marshal(original)
+			return string(quoted[1 : len(quoted)-1])
+		}
+		return original
+	})
+}
+
+// restoreDelta 还原流式片段；片段末尾可能是被拆开的占位符（如 "[EMA"），暂存到同一内容块的下一个片段再处理
+func (v *piiVault) restoreDelta(block piiBlock, text string, jsonEscape bool) string {
+	v.pendingMu.Lock()
+	text = v.pending[block].text + text
+	delete(v.pending, block)
+	if i := strings.LastIndexByte(text, '['); i >= 0 && !strings.Contains(text[i:], "]") && v.isTokenPrefix(text[i:]) {
+		v.pending[block] = piiPending{text: text[i:], jsonEscape: jsonEscape}
+		text = text[:i]
+	}
+	v.pendingMu.Unlock()
+	return v.restore(text, jsonEscape)
+}
+
+// flushBlock 内容块结束时取出暂存的片段：流已结束，不完整的占位符按原样输出
+func (v *piiVault) flushBlock(block piiBlock) (piiPending, bool) {
+	v.pendingMu.Lock()
+	defer v.pendingMu.Unlock()
+	p, ok := v.pending[block]
+	delete(v.pending, block)
+	if ok {
+		p.text = v.restore(p.text, p.jsonEscape)
+	}
+	return p, ok && p.text != ""
+}
+
+func (v *piiVault) isTokenPrefix(s string) bool {
+	for token := range v.byToken {
+		if strings.HasPrefix(token, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// maskValue 递归替换工具参数中的字符串
+func (v *piiVault) maskValue(value interface{}) interface{} {
+	switch val := value.(type) {
+	case string:
+		return v.mask(val)
+	case map[string]interface{}:
+		for k, item := range val {
+			val[k] = v.maskValue(item)
+		}
+	case []interface{}:
+		for i, item := range val {
+			val[i] = v.maskValue(item)
+		}
+	}
+	return value
+}
+
+func (v *piiVault) restoreValue(value interface{}) interface{} {
+	switch val := value.(type) {
+	case string:
+		return v.restore(val, false)
+	case map[string]interface{}:
+		for k, item := range val {
+			val[k] = v.restoreValue(item)
+		}
+	case []interface{}:
+		for i, item := range val {
+			val[i] = v.restoreValue(item)
+		}
+	}
+	return value
+}
+
+// maskBlocks 替换文本、工具调用参数和工具结果；thinking 块带有签名，不能修改
+func (v *piiVault) maskBlocks(blocks []AnthropicContent) {
+	for i := range blocks {
+		block := &blocks[i]
+		switch block.Type {
+		case "text":
+			if block.Text != nil {
+				block.Text = stringPtr(v.mask(*block.Text))
+			}
+		case "tool_use":
+			if block.Input != nil {
+				v.maskValue(*block.Input)
+			}
+		case "tool_result":
+			switch content := block.Content.(type) {
+			case string:
+				block.Content = v.mask(content)
+			case []AnthropicContent:
+				v.maskBlocks(content)
+			}
+		}
+	}
+}
+
+func vaultFrom(tc *TransformContext) *piiVault {
+	v, _ := tc.State["pii"].(*piiVault)
+	return v
+}
+
+func (t *piiTransformer) TransformRequest(tc *TransformContext, req *AnthropicRequest) error {
+	types := t.typesFor(tc.Path, req.Model)
+	if len(types) == 0 {
+		return nil
+	}
+	v := &piiVault{
+		byValue: make(map[string]string),
+		byToken: make(map[string]string),
+		counts:  make(map[string]int),
+		pending: make(map[piiBlock]piiPending),
+	}
+	for _, name := range types {
+		v.detectors = append(v.detectors, piiDetectors[name])
+	}
+
+	for i := range req.System {
+		req.System[i].Text = v.mask(req.System[i].Text)
+	}
+	for i := range req.Messages {
+		switch content := req.Messages[i].Content.(type) {
+		case string:
+			req.Messages[i].Content = v.mask(content)
+		case []AnthropicContent:
+			v.maskBlocks(content)
+		}
+	}
+	if len(v.byToken) == 0 {
+		// 辅助请求（摘要、count_tokens）可能已经保存了映射表，主请求没有需要脱敏的内容时不再使用它
+		delete(tc.State, "pii")
+		return nil
+	}
+	req.System = append(req.System, AnthropicSystemBlock{Type: "text", Text: piiNotice})
+	tc.State["pii"] = v
+
+	masked := make(map[string]int)
+	for _, d := range v.detectors {
+		if n := v.counts[d.label]; n > 0 {
+			masked[strings.ToLower(d.label)] = n
+		}
+	}
+	reqLog(tc.RequestID).Info("pii masked", "model", req.Model, "values", masked)
+	return nil
+}
+
+func (t *piiTransformer) TransformResponse(tc *TransformContext, resp *AnthropicResponse) error {
+	v := vaultFrom(tc)
+	if v == nil {
+		return nil
+	}
+	for i, block := range resp.Content {
+		switch block.Type {
+		case "text":
+			if block.Text != nil {
+				resp.Content[i].Text = stringPtr(v.restore(*block.Text, false))
+			}
+		case "tool_use":
+			if block.Input != nil {
+				v.restoreValue(*block.Input)
+			}
+		}
+	}
+	return nil
+}
+
+// piiEventBlock 事件所属的内容块
+func piiEventBlock(tc *TransformContext, event map[string]interface{}) piiBlock {
+	block := piiBlock{choice: tc.Choice, index: -1}
+	if i, ok := event["index"].(float64); ok {
+		block.index = int(i)
+	}
+	return block
+}
+
+func (t *piiTransformer) TransformEvent(tc *TransformContext, event map[string]interface{}) {
+	v := vaultFrom(tc)
+	if v == nil || event["type"] != "content_block_delta" {
+		return
+	}
+	block := piiEventBlock(tc, event)
+	delta, ok := event["delta"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	switch delta["type"] {
+	case "text_delta":
+		if text, ok := delta["text"].(string); ok {
+			delta["text"] = v.restoreDelta(block, text, false)
+		}
+	case "input_json_delta":
+		if partial, ok := delta["partial_json"].(string); ok {
+			delta["partial_json"] = v.restoreDelta(block, partial, true)
+		}
+	}
+}
+
+// FlushBlock 内容块以 "[" 或不完整的占位符结尾时，在 content_block_stop 之前补发暂存的片段
+func (t *piiTransformer) FlushBlock(tc *TransformContext, stop map[string]interface{}) []map[string]interface{} {
+	v := vaultFrom(tc)
+	if v == nil {
+		return nil
+	}
+	p, ok := v.flushBlock(piiEventBlock(tc, stop))
+	if !ok {
+		return nil
+	}
+	delta := map[string]interface{}{"type": "text_delta", "text": p.text}
+	if p.jsonEscape {
+		delta = map[string]interface{}{"type": "input_json_delta", "partial_json": p.text}
+	}
+	return []map[string]interface{}{{"type": "content_block_delta", "index": stop["index"], "delta": delta}}
+}
+
+// luhnValid 信用卡号的 Luhn 校验，排除普通的长数字
+func luhnValid(s string) bool {
+	sum, n := 0, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 13 && sum%10 == 0
+}
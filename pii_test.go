@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 最后一个 delta 以 "[" 或不完整的占位符结尾时，暂存的片段要在 content_block_stop 之前补发
+func TestPIIFlushesPendingTextAtBlockStop(t *testing.T) {
+	pii := &piiTransformer{defaults: []string{"email"}}
+	h := &ProxyHandler{}
+	h.Use(pii)
+
+	tc := &TransformContext{RequestID: "test", State: make(map[string]interface{})}
+	req := &AnthropicRequest{Model: "claude-test", Messages: []AnthropicMessage{{Role: "user", Content: "mail alice@example.com"}}}
+	if err := pii.TransformRequest(tc, req); err != nil {
+		t.Fatal(err)
+	}
+	if got := req.Messages[0].Content.(string); got != "mail [EMAIL_1]" {
+		t.Fatalf("masked content = %q", got)
+	}
+
+	tests := []struct {
+		name   string
+		deltas []string
+		want   string
+	}{
+		{"trailing bracket", []string{"Sent to [EMA", "IL_1]. See note ["}, "Sent to alice@example.com. See note ["},
+		{"partial placeholder", []string{"Reply to [EM"}, "Reply to [EM"},
+	}
+	for i, tt := range tests {
+		index := float64(i)
+		var events []map[string]interface{}
+		for _, text := range tt.deltas {
+			delta := map[string]interface{}{"type": "content_block_delta", "index": index,
+				"delta": map[string]interface{}{"type": "text_delta", "text": text}}
+			events = append(events, h.transformEvent(tc, delta)...)
+		}
+		events = append(events, h.transformEvent(tc, map[string]interface{}{"type": "content_block_stop", "index": index})...)
+
+		var text strings.Builder
+		for _, event := range events {
+			if event["type"] == "content_block_delta" {
+				text.WriteString(event["delta"].(map[string]interface{})["text"].(string))
+			}
+		}
+		if text.String() != tt.want {
+			t.Errorf("%s: streamed text = %q, want %q", tt.name, text.String(), tt.want)
+		}
+		if last := events[len(events)-1]; last["type"] != "content_block_stop" {
+			t.Errorf("%s: last event = %v, want content_block_stop", tt.name, last["type"])
+		}
+	}
+}
+
+// 上下文压缩的摘要请求同样经过 pii 脱敏：摘要模型只看到占位符，返回的摘要还原为原文
+func TestPIIMasksCompactionSummaryRequest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var sent []byte
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent, _ = io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-summary",`+
+			`"content":[{"type":"text","text":"The user shared [EMAIL_1] and card [CARD_1]."}],`+
+			`"stop_reason":"end_turn","usage":{"input_tokens":10,"output_tokens":5}}`)
+	}))
+	defer upstream.Close()
+
+	h, err := NewProxyHandler(ProxyConfig{
+		AnthropicURL: upstream.URL,
+		Overflow:     OverflowConfig{Mode: "summarize", CompactionModel: "claude-summary"},
+		Transformers: []Transformer{&piiTransformer{defaults: []string{"email", "credit_card"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+
+	messages := []AnthropicMessage{
+		{Role: "user", Content: "my email is alice@example.com and my card is 4111 1111 1111 1111"},
+		{Role: "assistant", Content: "Noted."},
+	}
+	summary, err := h.summarizeHistory(c, messages, "", "sk-test", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, secret := range []string{"alice@example.com", "4111 1111 1111 1111"} {
+		if strings.Contains(string(sent), secret) {
+			t.Errorf("summary request contains %q: %s", secret, sent)
+		}
+	}
+	for _, token := range []string{"[EMAIL_1]", "[CARD_1]"} {
+		if !strings.Contains(string(sent), token) {
+			t.Errorf("summary request lacks placeholder %s: %s", token, sent)
+		}
+	}
+	if want := "The user shared alice@example.com and card 4111 1111 1111 1111."; summary != want {
+		t.Errorf("summary = %q, want %q", summary, want)
+	}
+}
+
+// PII_PATHS 只对列出的客户端请求路径脱敏
+func TestPIIPaths(t *testing.T) {
+	pii := &piiTransformer{defaults: []string{"email"}, paths: []string{"/v1/chat/completions"}}
+	for _, tt := range []struct {
+		path string
+		want string
+	}{
+		{"/v1/chat/completions", "mail [EMAIL_1]"},
+		{"/v1/responses", "mail alice@example.com"},
+	} {
+		tc := &TransformContext{RequestID: "test", Path: tt.path, State: make(map[string]interface{})}
+		req := &AnthropicRequest{Model: "claude-test", Messages: []AnthropicMessage{{Role: "user", Content: "mail alice@example.com"}}}
+		if err := pii.TransformRequest(tc, req); err != nil {
+			t.Fatal(err)
+		}
+		if got := req.Messages[0].Content.(string); got != tt.want {
+			t.Errorf("%s: content = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// predictionPrefillKey gin context 中作为 assistant prefill 发送的预测文本，响应开头需要补上这段文本
+const predictionPrefillKey = "prediction_prefill"
+
+// OpenAIPrediction predicted outputs 的 prediction 参数，Anthropic 没有对应功能
+type OpenAIPrediction struct {
+	Type    string      `json:"type"`
+	Content interface{} `json:"content"` // string or []OpenAIContent
+}
+
+// applyPrediction 处理 prediction 参数：默认丢弃；PREDICTION_MODE=prefill 时作为 assistant prefill 发送，
+// 模型从预测内容之后继续生成，响应中再补上预测内容，客户端收到的仍是完整输出
+// 启用 thinking、最后一条消息不是 user 或预测内容为空时不能 prefill，同样丢弃
+// 两种方式下响应中的 accepted_prediction_tokens / rejected_prediction_tokens 都为 0
+func (h *ProxyHandler) applyPrediction(c *gin.Context, req *AnthropicRequest, prediction *OpenAIPrediction, reqID string) {
+	if prediction == nil {
+		return
+	}
+	logger := reqLog(reqID)
+	if h.predictionMode != "prefill" {
+		logger.Debug("prediction ignored")
+		return
+	}
+	// Anthropic 不接受以空白结尾的 prefill
+	text := strings.TrimRight(strings.Join(systemTexts(prediction.Content), ""), " \t\r\n")
+	switch {
+	case text == "":
+		return
+	case req.Thinking != nil && req.Thinking.Type == "enabled":
+		logger.Debug("prediction ignored: prefill is not supported with extended thinking")
+		return
+	case len(req.Messages) == 0 || req.Messages[len(req.Messages)-1].Role != "user":
+		logger.Debug("prediction ignored: last message is not a user message")
+		return
+	}
+	req.Messages = append(req.Messages, AnthropicMessage{Role: "assistant", Content: text})
+	c.Set(predictionPrefillKey, text)
+	logger.Info("prediction sent as assistant prefill", "chars", runeLen(text))
+}
+
+// prependPrefill 把 prefill 的文本补到响应的第一个文本块之前
+func prependPrefill(c *gin.Context, resp *AnthropicResponse) {
+	prefill := c.GetString(predictionPrefillKey)
+	if prefill == "" {
+		return
+	}
+	if len(resp.Content) > 0 && resp.Content[0].Type == "text" && resp.Content[0].Text != nil {
+		resp.Content[0].Text = stringPtr(prefill + *resp.Content[0].Text)
+		return
+	}
+	resp.Content = append([]AnthropicContent{{Type: "text", Text: stringPtr(prefill)}}, resp.Content...)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log/slog"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// costKey gin context 中当前请求累计的费用（美元），n > 1 时为各子请求之和
+const costKey = "cost_usd"
+
+// ModelPrice 模型单价，单位为美元 / 百万 token
+type ModelPrice struct {
+	Pattern    string // glob 模式，如 claude-sonnet*
+	Input      float64
+	Output     float64
+	CacheRead  float64
+	CacheWrite float64
+}
+
+// parseModelPricing 解析价格表，按书写顺序匹配，先匹配先生效
+// 格式: "pattern=input/output[/cache_read/cache_write]"，省略缓存价格时按 input 的 0.1 倍和 1.25 倍计算
+// 示例: "claude-opus*=15/75/1.5/18.75,claude-sonnet*=3/15"
+func parseModelPricing(pricingStr string) []ModelPrice {
+	prices := make([]ModelPrice, 0)
+
+	if pricingStr == "" {
+		return prices
+	}
+
+	for _, item := range strings.Split(pricingStr, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		pattern := strings.TrimSpace(parts[0])
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			slog.Warn("invalid pricing pattern", "pattern", pattern, "error", err)
+			continue
+		}
+
+		fields := strings.Split(parts[1], "/")
+		if len(fields) != 2 && len(fields) != 4 {
+			slog.Warn("invalid pricing", "pattern", pattern, "value", parts[1])
+			continue
+		}
+		values := make([]float64, len(fields))
+		valid := true
+		for i, f := range fields {
+			v, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+			if err != nil || v < 0 {
+				valid = false
+				break
+			}
+			values[i] = v
+		}
+		if !valid {
+			slog.Warn("invalid pricing", "pattern", pattern, "value", parts[1])
+			continue
+		}
+
+		price := ModelPrice{Pattern: pattern, Input: values[0], Output: values[1]}
+		if len(values) == 4 {
+			price.CacheRead, price.CacheWrite = values[2], values[3]
+		} else {
+			price.CacheRead, price.CacheWrite = price.Input*0.1, price.Input*1.25
+		}
+		prices = append(prices, price)
+	}
+
+	return prices
+}
+
+// estimateCost 按价格表计算一次请求的费用（美元），模型未配置价格时返回 false
+func (h *ProxyHandler) estimateCost(model string, usage *AnthropicUsage) (float64, bool) {
+	for _, p := range h.pricing {
+		if ok, _ := path.Match(p.Pattern, model); ok {
+			cost := float64(usage.InputTokens)*p.Input +
+				float64(usage.OutputTokens)*p.Output +
+				float64(usage.CacheReadInputTokens)*p.CacheRead +
+				float64(usage.CacheCreationInputTokens)*p.CacheWrite
+			return cost / 1e6, true
+		}
+	}
+	return 0, false
+}
+
+// addRequestCost 累加当前请求的费用，响应头尚未写出时更新 x-proxy-cost-usd（流式响应只记录在日志中）
+func addRequestCost(c *gin.Context, cost float64) {
+	total := c.GetFloat64(costKey) + cost
+	c.Set(costKey, total)
+	if !c.Writer.Written() {
+		c.Header("x-proxy-cost-usd", strconv.FormatFloat(total, 'f', 6, 64))
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+)
+
+// PromptTemplate 按模型在 system 前后注入的固定内容（如公司政策），按书写顺序匹配，先匹配先生效
+type PromptTemplate struct {
+	Model  string `json:"model"`            // 模型 glob（映射后的名称）
+	Prefix string `json:"prefix,omitempty"` // 插入在客户端 system 之前
+	Suffix string `json:"suffix,omitempty"` // 追加在客户端 system 之后
+}
+
+// loadPromptTemplates 从 PROMPT_TEMPLATES_FILE（JSON 数组）读取模板，未配置时返回 nil
+func loadPromptTemplates() ([]PromptTemplate, error) {
+	name := os.Getenv("PROMPT_TEMPLATES_FILE")
+	if name == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var templates []PromptTemplate
+	if err := json.Unmarshal(data, &templates); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", name, err)
+	}
+	for i, t := range templates {
+		if _, err := path.Match(t.Model, ""); err != nil || t.Model == "" {
+			return nil, fmt.Errorf("%s: template %d has invalid model pattern %q", name, i, t.Model)
+		}
+		if t.Prefix == "" && t.Suffix == "" {
+			return nil, fmt.Errorf("%s: template %d (%s) has neither prefix nor suffix", name, i, t.Model)
+		}
+	}
+	return templates, nil
+}
+
+// applyPromptTemplate 为匹配的模型注入 system 前缀和后缀
+// 前缀单独作为第一个 system 块并带 cache_control：内容固定，即使客户端的 system 每次不同也能命中缓存
+func (h *ProxyHandler) applyPromptTemplate(req *AnthropicRequest, cfg CacheConfig, reqID string) {
+	for _, t := range h.promptTemplates {
+		if ok, _ := path.Match(t.Model, req.Model); !ok {
+			continue
+		}
+
+		if t.Prefix != "" {
+			prefix := AnthropicSystemBlock{Type: "text", Text: t.Prefix}
+			if cfg.Enabled {
+				prefix.CacheControl = cfg.cacheControl()
+			}
+			req.System = append([]AnthropicSystemBlock{prefix}, req.System...)
+		}
+		if t.Suffix != "" {
+			req.System = append(req.System, AnthropicSystemBlock{Type: "text", Text: t.Suffix})
+		}
+		reqLog(reqID).Debug("applied prompt template", "pattern", t.Model, "model", req.Model)
+		return
+	}
+}
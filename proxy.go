@@ -1,425 +1,965 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-// 请求计数器，用于追踪请求
-var requestCounter uint64
-
 type ProxyHandler struct {
 	anthropicURL      string
-	modelMapping      map[string]string
-	maxTokensMapping  map[string]int
+	defaultModel      string         // 未映射的未知模型改用的目标模型
+	echoRequestModel  bool           // 响应的 model 字段回显客户端请求的模型名
+	thinkingBudgets   map[string]int // 模型 -> extended thinking budget_tokens
+	temperatureMode   string         // temperature > 1 的处理方式：clamp 或 scale
+	predictionMode    string         // prediction 参数的处理方式：ignore 或 prefill
+	strictParams      bool           // 请求带有不支持的参数时返回 400，而不是丢弃
+	strictJSON        bool           // 请求带有未识别的字段时返回 400
+	rejectLogprobs    bool           // 请求 logprobs 时返回 400
+	staticModels      []string
+	routes            []Route
+	maxN              int // n 参数上限
+	fanoutConcurrency int // n > 1 时的并发上限
+	retry             RetryConfig
+	maxResponseBytes  int64           // 上游非流式响应体上限
+	heartbeatInterval time.Duration   // 流式响应上游静默时的心跳间隔，0 表示关闭
+	upstreamTimeout   time.Duration   // 非流式请求的整体超时（流式请求为等待响应头的超时），0 表示不限制
+	streamIdleTimeout time.Duration   // 流式响应上游无数据的超时，0 表示不限制
+	keyStore          *KeyStore       // 虚拟 key，nil 表示未启用
+	authenticators    []Authenticator // 在虚拟 key 之前尝试的认证方式（OIDC 等）
+	trustedKey        string          // TRUSTED_NETWORKS 中没有带 key 的请求使用的上游 key
+	audit             *AuditLog       // nil 表示未启用审计日志
+	runtime           atomic.Pointer[RuntimeSettings]
+	runtimeMu         sync.Mutex   // 串行化 /admin/config 的修改
+	rateLimiter       *RateLimiter // nil 表示未启用限流
+	concurrency       *ConcurrencyLimiter
+	usageStore        *UsageStore  // nil 表示未启用用量统计
+	pricing           []ModelPrice // 费用估算的价格表
+	streamUpgrade     bool         // 非流式请求改为流式发送给上游
+	upgradeMinTokens  int          // max_tokens 不小于该值时才改为流式
+	embeddings        EmbeddingsConfig
+	moderation        ModerationConfig
+	guardrails        *Guardrails
+	serverTools       []ServerTool
+	betas             BetaConfig
+	promptTemplates   []PromptTemplate
+	modelProfiles     []ModelProfile
+	ollamaAPIKey      string // Ollama 请求未带 key 时使用
+	outputLimits      []OutputLimit
+	overflow          OverflowConfig
+	reverse           ReverseConfig
+	failover          FailoverConfig
+	breakers          *CircuitBreakers
+	responseCache     ResponseCache
+	responseCacheMax  int
+	cacheSessions     *CacheSessions
+	compactions       *Compactions
+	batches           *BatchStore
+	keyPool           *KeyPool
+	tape              *Tape
+	shadow            *Shadow
+	readiness         ReadinessConfig
+	probe             upstreamProbe
+	adminToken        string
+	client            *http.Client // 共享客户端，复用上游连接
+
+	// 转换插件，由 Use 注册
+	requestTransformers  []RequestTransformer
+	responseTransformers []ResponseTransformer
+	streamTransformers   []StreamTransformer
 }
 
-func NewProxyHandler(baseURL string, modelMapping map[string]string, maxTokensMapping map[string]int) *ProxyHandler {
+func NewProxyHandler(cfg ProxyConfig) (*ProxyHandler, error) {
+	baseURL := cfg.AnthropicURL
 	if baseURL == "" {
 		baseURL = "https://api.anthropic.com"
 	}
-	return &ProxyHandler{
-		anthropicURL:     baseURL,
-		modelMapping:     modelMapping,
-		maxTokensMapping: maxTokensMapping,
+
+	client, err := newHTTPClient(cfg.HTTPClient)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.KeyPool != nil {
+		client.Transport = &keyPoolTransport{pool: cfg.KeyPool, base: client.Transport}
 	}
+
+	var rateLimiter *RateLimiter
+	if cfg.RateLimit.enabled() {
+		rateLimiter = NewRateLimiter(cfg.RateLimit)
+	}
+
+	var concurrency *ConcurrencyLimiter
+	if cfg.Concurrency.MaxConcurrent > 0 {
+		concurrency = NewConcurrencyLimiter(cfg.Concurrency)
+	}
+
+	responseCache, err := NewResponseCache(cfg.ResponseCache)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &ProxyHandler{
+		anthropicURL:      baseURL,
+		defaultModel:      cfg.DefaultModel,
+		echoRequestModel:  cfg.EchoRequestModel,
+		thinkingBudgets:   cfg.ThinkingBudgets,
+		temperatureMode:   cfg.TemperatureMode,
+		predictionMode:    cfg.PredictionMode,
+		strictParams:      cfg.StrictParams,
+		strictJSON:        cfg.StrictJSON,
+		rejectLogprobs:    cfg.RejectLogprobs,
+		staticModels:      cfg.StaticModels,
+		routes:            cfg.Routes,
+		maxN:              cfg.MaxN,
+		fanoutConcurrency: cfg.FanoutConcurrency,
+		retry:             cfg.Retry,
+		maxResponseBytes:  cfg.MaxResponseBytes,
+		heartbeatInterval: cfg.HeartbeatInterval,
+		upstreamTimeout:   cfg.UpstreamTimeout,
+		streamIdleTimeout: cfg.StreamIdleTimeout,
+		keyStore:          cfg.KeyStore,
+		authenticators:    cfg.Authenticators,
+		trustedKey:        cfg.TrustedKey,
+		audit:             cfg.Audit,
+		rateLimiter:       rateLimiter,
+		concurrency:       concurrency,
+		usageStore:        cfg.UsageStore,
+		pricing:           cfg.Pricing,
+		outputLimits:      cfg.OutputLimits,
+		overflow:          cfg.Overflow,
+		reverse:           cfg.Reverse,
+		streamUpgrade:     cfg.StreamUpgrade,
+		upgradeMinTokens:  cfg.UpgradeMinTokens,
+		embeddings:        cfg.Embeddings,
+		moderation:        cfg.Moderation,
+		guardrails:        cfg.Guardrails,
+		serverTools:       cfg.ServerTools,
+		betas:             cfg.Betas,
+		promptTemplates:   cfg.PromptTemplates,
+		modelProfiles:     cfg.ModelProfiles,
+		ollamaAPIKey:      cfg.OllamaAPIKey,
+		failover:          cfg.Failover,
+		breakers:          NewCircuitBreakers(cfg.Failover.FailureThreshold, cfg.Failover.OpenDuration),
+		keyPool:           cfg.KeyPool,
+		tape:              cfg.Tape,
+		shadow:            cfg.Shadow,
+		responseCache:     responseCache,
+		responseCacheMax:  cfg.ResponseCache.MaxBytes,
+		cacheSessions:     NewCacheSessions(),
+		compactions:       NewCompactions(),
+		batches:           NewBatchStore(),
+		readiness:         cfg.Readiness,
+		adminToken:        cfg.AdminToken,
+		client:            client,
+	}
+	h.runtime.Store(&RuntimeSettings{
+		ModelMapping:     cfg.ModelMapping,
+		ModelGroups:      cfg.ModelGroups,
+		MaxTokensMapping: cfg.MaxTokensMapping,
+		Cache:            cfg.Cache,
+	})
+	for _, t := range cfg.Transformers {
+		h.Use(t)
+	}
+	return h, nil
 }
 
 func (h *ProxyHandler) HandleChatCompletions(c *gin.Context) {
 	// 生成请求 ID
-	reqID := atomic.AddUint64(&requestCounter, 1)
-	log.Printf("\n========== [REQ#%d] NEW REQUEST ==========", reqID)
-	
-	// 从请求头提取 API Key
-	authHeader := c.GetHeader("Authorization")
-	if authHeader == "" {
-		log.Printf("[REQ#%d][ERROR] Missing Authorization header", reqID)
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing Authorization header"})
-		return
-	}
+	reqID := requestID(c)
+	logger := reqLog(reqID)
 
-	// 提取 Bearer token
-	apiKey := strings.TrimPrefix(authHeader, "Bearer ")
-	if apiKey == authHeader {
-		log.Printf("[REQ#%d][ERROR] Invalid Authorization header format", reqID)
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid Authorization header format, expected: Bearer <token>"})
+	// 从请求头提取 API Key
+	apiKey, ok := h.extractAPIKey(c, reqID)
+	if !ok {
 		return
 	}
 
-	log.Printf("[REQ#%d] API Key: %s...%s", reqID, apiKey[:min(10, len(apiKey))], apiKey[max(0, len(apiKey)-10):])
-
 	// 读取原始请求体以便记录
-	rawBody, err := io.ReadAll(c.Request.Body)
-	if err != nil {
-		log.Printf("[REQ#%d][ERROR] Failed to read request body: %v", reqID, err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	_, parseSpan := startSpan(c.Request.Context(), "parse request", spanKindInternal)
+	rawBody, ok := readRequestBody(c, reqID)
+	if !ok {
+		parseSpan.SetError("invalid request body")
+		parseSpan.End()
 		return
 	}
-	c.Request.Body = io.NopCloser(bytes.NewReader(rawBody))
-	
-	log.Printf("[REQ#%d] ========== RAW OpenAI REQUEST ==========", reqID)
-	log.Printf("%s", string(rawBody))
-	log.Printf("[REQ#%d] ========== END RAW REQUEST ==========", reqID)
+	parseSpan.SetAttr("body_bytes", len(rawBody))
+	logger.Debug("raw openai request", "body", string(rawBody))
 
 	// 解析 OpenAI 请求
 	var openaiReq OpenAIRequest
 	if err := json.Unmarshal(rawBody, &openaiReq); err != nil {
-		log.Printf("[REQ#%d][ERROR] Failed to parse request: %v", reqID, err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		parseSpan.SetError(err.Error())
+		parseSpan.End()
+		logger.Error("failed to parse request", "error", err)
+		respondError(c, http.StatusBadRequest, err.Error())
 		return
 	}
+	parseSpan.End()
 
-	log.Printf("[REQ#%d] OpenAI Request Summary:", reqID)
-	log.Printf("[REQ#%d]   Model: %s", reqID, openaiReq.Model)
-	log.Printf("[REQ#%d]   Stream: %v", reqID, openaiReq.Stream)
-	log.Printf("[REQ#%d]   MaxTokens: %d", reqID, openaiReq.MaxTokens)
-	log.Printf("[REQ#%d]   Tools: %d", reqID, len(openaiReq.Tools))
-	log.Printf("[REQ#%d]   Messages: %d", reqID, len(openaiReq.Messages))
-	log.Printf("[REQ#%d]   User (session hint): '%s'", reqID, openaiReq.User) // 关键：Cursor 传的用户/会话标识
-	
-	// 详细记录每条消息
-	for i, msg := range openaiReq.Messages {
-		contentStr := ""
-		if str, ok := msg.Content.(string); ok {
-			if len(str) > 500 {
-				contentStr = str[:500] + "..."
-			} else {
-				contentStr = str
-			}
-		} else {
-			contentBytes, _ := json.Marshal(msg.Content)
-			if len(contentBytes) > 500 {
-				contentStr = string(contentBytes[:500]) + "..."
-			} else {
-				contentStr = string(contentBytes)
+	if !h.checkUnknownFields(c, rawBody, openaiReq, reqID) {
+		return
+	}
+	if !h.checkUnsupportedParams(c, rawBody, reqID) {
+		return
+	}
+	if mapped := mapLocalInferenceParams(rawBody, &openaiReq); len(mapped) > 0 {
+		logger.Info("local inference parameters mapped", "params", mapped)
+	}
+
+	// 旧版 functions/function_call 转换为 tools/tool_choice
+	if convertLegacyFunctions(&openaiReq) {
+		c.Set(legacyFunctionsKey, true)
+		logger.Debug("legacy functions request", "functions", len(openaiReq.Tools))
+	}
+
+	c.Set(streamKey, openaiReq.Stream)
+	logger.Info("openai request",
+		"model", openaiReq.Model,
+		"stream", openaiReq.Stream,
+		"n", openaiReq.N,
+		"max_tokens", openaiReq.MaxTokens,
+		"tools", len(openaiReq.Tools),
+		"messages", len(openaiReq.Messages),
+		"user", openaiReq.User) // 关键：Cursor 传的用户/会话标识
+
+	// 详细记录每条消息（仅 DEBUG）
+	if logger.Enabled(c, slog.LevelDebug) {
+		for i, msg := range openaiReq.Messages {
+			logger.Debug("openai message",
+				"index", i,
+				"role", msg.Role,
+				"tool_calls", len(msg.ToolCalls),
+				"tool_call_id", msg.ToolCallID,
+				"content", truncate(contentString(msg.Content), 500))
+			for j, tc := range msg.ToolCalls {
+				logger.Debug("openai tool call",
+					"index", i, "tool_index", j, "id", tc.ID, "name", tc.Function.Name, "args", tc.Function.Arguments)
 			}
 		}
-		log.Printf("[REQ#%d]   Message[%d]: role=%s, tool_calls=%d, tool_call_id=%s", 
-			reqID, i, msg.Role, len(msg.ToolCalls), msg.ToolCallID)
-		log.Printf("[REQ#%d]     Content: %s", reqID, contentStr)
-		
-		// 详细记录 tool_calls
-		for j, tc := range msg.ToolCalls {
-			log.Printf("[REQ#%d]     ToolCall[%d]: id=%s, name=%s, args=%s", 
-				reqID, j, tc.ID, tc.Function.Name, tc.Function.Arguments)
-		}
+	}
+
+	// temperature/top_p 转换到 Anthropic 支持的范围
+	if !applySampling(c, &openaiReq, h.temperatureMode, reqID) {
+		return
 	}
 
 	// 应用模型映射
-	originalModel := openaiReq.Model
-	if mappedModel, ok := h.modelMapping[openaiReq.Model]; ok {
-		openaiReq.Model = mappedModel
-		log.Printf("[REQ#%d] Model mapped: %s -> %s", reqID, originalModel, mappedModel)
+	settings := h.settings()
+	profile := h.modelProfile(openaiReq.Model)
+	openaiReq.Model = h.mapRequestModel(c, settings, openaiReq.Model, reqID)
+
+	if !h.checkRateLimit(c, apiKey, openaiReq.Model, reqID) {
+		return
+	}
+	release, ok := h.acquireConcurrency(c, apiKey, reqID)
+	if !ok {
+		return
 	}
+	defer release()
 
 	// 转换为 Anthropic 格式
-	anthropicReq, err := ConvertOpenAIToAnthropic(openaiReq, h.maxTokensMapping, apiKey)
+	_, convertSpan := startSpan(c.Request.Context(), "convert request", spanKindInternal)
+	anthropicReq, err := ConvertOpenAIToAnthropic(openaiReq, settings.MaxTokensMapping, apiKey)
 	if err != nil {
-		log.Printf("[REQ#%d][ERROR] Conversion failed: %v", reqID, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		convertSpan.SetError(err.Error())
+		convertSpan.End()
+		logger.Error("conversion failed", "error", err)
+		respondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
+	applyThinking(anthropicReq, h.thinkingBudgets, reqID)
+	applyModelProfile(anthropicReq, profile, reqID)
+	h.clampMaxTokens(c, anthropicReq, reqID)
+	h.fitContext(c, anthropicReq, apiKey, openaiReq.User, reqID)
+	acceptSeed(c, openaiReq.Seed, anthropicReq.Model, reqID)
+	h.applyPromptTemplate(anthropicReq, settings.Cache, reqID)
+	h.applySessionCache(c, anthropicReq, settings.Cache, apiKey, openaiReq.User, reqID)
+	h.applyServerTools(anthropicReq, reqID)
+	h.applyPrediction(c, anthropicReq, openaiReq.Prediction, reqID)
+	convertSpan.SetAttr("gen_ai.request.model", anthropicReq.Model)
+	convertSpan.End()
 
-	log.Printf("[REQ#%d] Anthropic Request Summary:", reqID)
-	log.Printf("[REQ#%d]   Model: %s", reqID, anthropicReq.Model)
-	log.Printf("[REQ#%d]   MaxTokens: %d", reqID, anthropicReq.MaxTokens)
-	log.Printf("[REQ#%d]   System blocks: %d", reqID, len(anthropicReq.System))
-	log.Printf("[REQ#%d]   Tools: %d", reqID, len(anthropicReq.Tools))
-	log.Printf("[REQ#%d]   Messages: %d", reqID, len(anthropicReq.Messages))
+	userID := ""
 	if anthropicReq.Metadata != nil {
-		log.Printf("[REQ#%d]   Metadata.user_id: %s", reqID, anthropicReq.Metadata.UserID)
-	}
-	
-	// 详细记录转换后的每条消息
-	for i, msg := range anthropicReq.Messages {
-		contentStr := ""
-		if str, ok := msg.Content.(string); ok {
-			if len(str) > 500 {
-				contentStr = str[:500] + "..."
-			} else {
-				contentStr = str
+		userID = anthropicReq.Metadata.UserID
+	}
+	logger.Info("anthropic request",
+		"model", anthropicReq.Model,
+		"max_tokens", anthropicReq.MaxTokens,
+		"system_blocks", len(anthropicReq.System),
+		"tools", len(anthropicReq.Tools),
+		"messages", len(anthropicReq.Messages),
+		"user_id", userID)
+
+	// 详细记录转换后的每条消息（仅 DEBUG）
+	if logger.Enabled(c, slog.LevelDebug) {
+		for i, msg := range anthropicReq.Messages {
+			logger.Debug("anthropic message", "index", i, "role", msg.Role, "content", truncate(contentString(msg.Content), 500))
+		}
+	}
+
+	// json_schema 通过合成工具实现时，需要把工具调用还原为文本
+	unwrapJSON := usesJSONResponseTool(openaiReq)
+
+	// n > 1：并发多个请求合并为多个 choice
+	if openaiReq.N > 1 {
+		h.handleFanout(c, anthropicReq, openaiReq, apiKey, unwrapJSON, reqID)
+		return
+	}
+
+	httpResp, ok := h.sendAnthropicRequest(c, anthropicReq, apiKey, reqID)
+	if !ok {
+		return
+	}
+	defer httpResp.Body.Close()
+
+	// 流式响应
+	if openaiReq.Stream {
+		h.handleStreamResponse(c, httpResp, openaiReq.Model, unwrapJSON, openaiReq.includeUsage(), reqID)
+	} else {
+		h.handleNonStreamResponse(c, httpResp, unwrapJSON, reqID)
+	}
+}
+
+// extractAPIKey 提取 API Key，失败时直接写入错误响应
+// 优先使用 Authorization: Bearer，其次是 x-api-key（Anthropic 风格）和 api-key（Azure 风格）
+// 启用虚拟 key 时返回的是对应的上游 key
+func (h *ProxyHandler) extractAPIKey(c *gin.Context, reqID string) (string, bool) {
+	authHeader := c.GetHeader("Authorization")
+	if authHeader == "" {
+		for _, header := range []string{"x-api-key", "api-key"} {
+			if apiKey := c.GetHeader(header); apiKey != "" {
+				reqLog(reqID).Debug("api key", "header", header, "key", maskKey(apiKey))
+				return h.resolveAPIKey(c, apiKey, reqID)
 			}
+		}
+		if apiKey, ok := h.trustedNetworkAPIKey(c, reqID); ok {
+			return apiKey, true
+		}
+		reqLog(reqID).Warn("missing Authorization header")
+		respondError(c, http.StatusUnauthorized, "Missing Authorization, x-api-key or api-key header")
+		return "", false
+	}
+
+	// 提取 Bearer token
+	apiKey := strings.TrimPrefix(authHeader, "Bearer ")
+	if apiKey == authHeader {
+		reqLog(reqID).Warn("invalid Authorization header format")
+		respondError(c, http.StatusUnauthorized, "Invalid Authorization header format, expected: Bearer <token>")
+		return "", false
+	}
+
+	reqLog(reqID).Debug("api key", "key", maskKey(apiKey))
+	return h.resolveAPIKey(c, apiKey, reqID)
+}
+
+// maskKey 日志和管理接口中只保留 API Key 的首尾部分，仅用于展示，不能作为身份标识（见 apiKeyID）
+func maskKey(key string) string {
+	return key[:min(10, len(key))] + "..." + key[max(0, len(key)-10):]
+}
+
+// upstreamError 上游请求失败的信息，StatusCode 为返回给客户端的状态码
+type upstreamError struct {
+	StatusCode int
+	Message    string
+	Header     http.Header // 上游的响应头，请求未得到上游响应时为 nil
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("upstream error %d: %s", e.StatusCode, e.Message)
+}
+
+// sendAnthropicRequest 序列化并发送 Anthropic 请求
+// 返回状态码为 200 的响应；出错时已写入错误响应并返回 false
+// 启用响应缓存时，可缓存的请求优先从缓存返回；上游过载时可降级到其他模型，降级的响应不缓存
+func (h *ProxyHandler) sendAnthropicRequest(c *gin.Context, anthropicReq *AnthropicRequest, apiKey string, reqID string) (*http.Response, bool) {
+	if !h.checkGuardrails(c, anthropicReq, reqID) {
+		return nil, false
+	}
+	if !h.transformRequest(c, anthropicReq, reqID) {
+		return nil, false
+	}
+	c.Set(metricsModelKey, anthropicReq.Model)
+
+	call := h.callUpstream(c, anthropicReq, apiKey, 0, reqID)
+	applyUpstreamResult(c, call)
+	if call.err != nil {
+		respondUpstreamError(c, call.err)
+		return nil, false
+	}
+	return call.resp, true
+}
+
+// upstreamResult 一次上游调用的结果，由调用方写入客户端响应
+type upstreamResult struct {
+	resp          *http.Response
+	err           *upstreamError
+	header        http.Header // 上游响应头（失败时为错误响应头），用于限流头
+	cached        bool        // 是否查询了响应缓存
+	cacheHit      bool
+	fallbackModel string // 过载降级后实际使用的模型
+}
+
+// callUpstream 发送一次上游请求：查询和写入响应缓存、录制 tape、过载时降级重试、发送影子请求
+// 不修改 gin context，n > 1 时在多个 goroutine 中并发调用，结果由 applyUpstreamResult 写入响应；
+// choice 为子请求的序号，只有第 0 个子请求录制 tape 和发送影子请求，每个客户端请求最多录制一条、抽样一次
+func (h *ProxyHandler) callUpstream(c *gin.Context, anthropicReq *AnthropicRequest, apiKey string, choice int, reqID string) upstreamResult {
+	var call upstreamResult
+	var cacheKey string
+	if h.responseCache != nil {
+		cacheKey, call.cached = responseCacheKey(anthropicReq, apiKey)
+	}
+	if call.cached {
+		if httpResp, hit := h.lookupResponseCache(cacheKey, anthropicReq.Model, reqID); hit {
+			call.resp, call.cacheHit = httpResp, true
+			return call
+		}
+	}
+
+	record := h.tape != nil && choice == 0
+	var tapeEntry TapeEntry
+	if record {
+		tapeEntry = h.tape.newEntry(c, anthropicReq, reqID)
+	}
+
+	start := time.Now()
+	httpResp, upErr := h.doAnthropicRequest(c.Request.Context(), anthropicReq, apiKey, reqID)
+	if upErr != nil && len(h.failover.OverloadModels) > 0 {
+		httpResp, call.fallbackModel, upErr = h.retryOnOverload(c.Request.Context(), anthropicReq, apiKey, upErr, reqID)
+	}
+	if upErr != nil {
+		if record {
+			h.tape.recordError(tapeEntry, upErr)
+		}
+		call.err, call.header = upErr, upErr.Header
+		return call
+	}
+	call.header = httpResp.Header
+	if record {
+		h.tape.recordResponse(tapeEntry, httpResp)
+	}
+	if choice == 0 {
+		h.startShadow(c, anthropicReq, httpResp, apiKey, start, reqID)
+	}
+
+	// 降级后的响应不是请求的模型生成的，不写入缓存
+	if call.cached && call.fallbackModel == "" {
+		var err error
+		if httpResp, err = h.storeResponseCache(httpResp, cacheKey, reqID); err != nil {
+			reqLog(reqID).Error("read response body failed", "error", err)
+			call.err = &upstreamError{StatusCode: http.StatusBadGateway, Message: err.Error()}
+			return call
+		}
+	}
+	call.resp = httpResp
+	return call
+}
+
+// applyUpstreamResult 把上游调用的缓存状态、降级模型和限流头写入客户端响应
+func applyUpstreamResult(c *gin.Context, call upstreamResult) {
+	if call.cached {
+		if call.cacheHit {
+			c.Header("x-proxy-cache", "hit")
+			c.Set(responseCacheHitKey, true)
 		} else {
-			contentBytes, _ := json.Marshal(msg.Content)
-			if len(contentBytes) > 500 {
-				contentStr = string(contentBytes[:500]) + "..."
-			} else {
-				contentStr = string(contentBytes)
-			}
+			c.Header("x-proxy-cache", "miss")
 		}
-		log.Printf("[REQ#%d]   AnthropicMsg[%d]: role=%s, content=%s", reqID, i, msg.Role, contentStr)
+	}
+	if call.fallbackModel != "" {
+		c.Header("x-proxy-fallback-model", call.fallbackModel)
+		c.Set(metricsModelKey, call.fallbackModel)
+	}
+	if !call.cacheHit {
+		setRateLimitHeaders(c, call.header)
+	}
+}
+
+// modelOverrideHeader 按请求覆盖目标模型，便于在不修改客户端配置的情况下对比不同模型
+const modelOverrideHeader = "x-proxy-model"
+
+// requestedModelKey gin context 中客户端请求的原始模型名，改用 DEFAULT_TARGET_MODEL 或开启 ECHO_REQUEST_MODEL 时设置，响应中回显该名称
+const requestedModelKey = "requested_model"
+
+// mapModel 应用 MODEL_MAPPING 和 MODEL_GROUPS（同名时 MODEL_MAPPING 优先），请求带 x-proxy-model 头时以其为准（在映射之后生效）
+func (h *ProxyHandler) mapModel(c *gin.Context, settings *RuntimeSettings, model string, reqID string) string {
+	logger := reqLog(reqID)
+	mapped := model
+	if target, ok := settings.ModelMapping[model]; ok {
+		mapped = target
+		logger.Info("model mapped", "from", model, "to", mapped)
+	} else if targets, ok := settings.ModelGroups[model]; ok {
+		mapped = h.pickGroupTarget(model, targets, reqID)
+	}
+	if override := strings.TrimSpace(c.GetHeader(modelOverrideHeader)); override != "" {
+		logger.Info("model overridden by header", "from", mapped, "to", override)
+		mapped = override
+	}
+	return mapped
+}
+
+// mapRequestModel OpenAI 兼容接口的模型映射：在 mapModel 之后，未映射的未知模型（不是 claude-* 也没有匹配的路由）
+// 改用 DEFAULT_TARGET_MODEL，原始模型名记录在 context 中用于响应
+func (h *ProxyHandler) mapRequestModel(c *gin.Context, settings *RuntimeSettings, model string, reqID string) string {
+	if h.echoRequestModel {
+		c.Set(requestedModelKey, model)
+	}
+	mapped := h.mapModel(c, settings, model, reqID)
+	if mapped != model || h.defaultModel == "" || h.knownModel(model) {
+		return mapped
+	}
+	reqLog(reqID).Info("unknown model routed to default", "from", model, "to", h.defaultModel)
+	c.Set(requestedModelKey, model)
+	return h.defaultModel
+}
+
+// knownModel 模型名以 claude 开头或匹配 ROUTES 中的路由时视为已知
+func (h *ProxyHandler) knownModel(model string) bool {
+	if strings.HasPrefix(model, "claude") {
+		return true
+	}
+	_, ok := h.matchRoute(model)
+	return ok
+}
+
+// responseModel 返回响应中使用的模型名：开启 ECHO_REQUEST_MODEL 或改用默认模型时为客户端请求的模型名，
+// 否则非流式响应为 Anthropic 返回的模型名，流式响应为映射后的模型名
+func responseModel(c *gin.Context, model string) string {
+	if requested := c.GetString(requestedModelKey); requested != "" {
+		return requested
+	}
+	return model
+}
+
+// doAnthropicRequest 发送 Anthropic 请求，不写入客户端响应，上游按模型路由选择
+// 非 200 响应会读取并关闭 body，以 upstreamError 返回
+// ctx 取消（客户端断开）时上游请求随之取消
+func (h *ProxyHandler) doAnthropicRequest(ctx context.Context, anthropicReq *AnthropicRequest, apiKey string, reqID string) (*http.Response, *upstreamError) {
+	return h.doBackendRequest(ctx, anthropicReq, h.resolveUpstream(anthropicReq.Model), apiKey, reqID)
+}
+
+// doBackendRequest 与 doAnthropicRequest 相同，但由调用方指定主上游
+func (h *ProxyHandler) doBackendRequest(ctx context.Context, anthropicReq *AnthropicRequest, primary upstreamTarget, apiKey string, reqID string) (*http.Response, *upstreamError) {
+	logger := reqLog(reqID)
+
+	// 非流式请求改为流式发送，收到后再拼装为完整响应
+	upgrade := h.shouldUpgradeStream(anthropicReq)
+	if upgrade {
+		upgraded := *anthropicReq
+		upgraded.Stream = true
+		anthropicReq = &upgraded
+		logger.Debug("stream upgrade", "max_tokens", anthropicReq.MaxTokens)
 	}
 
 	// 序列化请求
 	reqBody, err := json.Marshal(anthropicReq)
 	if err != nil {
-		log.Printf("[REQ#%d][ERROR] Marshal failed: %v", reqID, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		logger.Error("marshal failed", "error", err)
+		return nil, &upstreamError{StatusCode: http.StatusInternalServerError, Message: err.Error()}
 	}
 
-	log.Printf("[REQ#%d] ========== ANTHROPIC REQUEST BODY ==========", reqID)
-	log.Printf("%s", string(reqBody))
-	log.Printf("[REQ#%d] ========== END ANTHROPIC REQUEST ==========", reqID)
+	logger.Debug("anthropic request body", "body", string(reqBody))
 
-	// 创建 HTTP 请求
-	httpReq, err := http.NewRequest("POST", h.anthropicURL+"/v1/messages", bytes.NewReader(reqBody))
-	if err != nil {
-		log.Printf("[REQ#%d][ERROR] Create request failed: %v", reqID, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
+	betas := anthropicBetas(anthropicReq, h.settings().Cache.Enabled, h.betas.forModel(anthropicReq.Model))
 
-	// 设置请求头 - 使用调用者提供的 API Key
-	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("x-api-key", apiKey)
-	httpReq.Header.Set("anthropic-version", "2023-06-01")
-	httpReq.Header.Set("anthropic-beta", "prompt-caching-2024-07-31")
+	// 实际发送的目标（主上游或备用上游），响应按其后端转换
+	var sent upstreamTarget
+	var backendReq *BackendRequest
+	newRequest := func(ctx context.Context, target upstreamTarget) (*http.Request, error) {
+		sent = target
+		backendReq = &BackendRequest{Anthropic: anthropicReq, Body: reqBody, Model: anthropicReq.Model, APIKey: apiKey, Betas: betas, RequestID: reqID}
+		if target.Model != "" {
+			backendReq.Body = withModel(reqBody, target.Model)
+			backendReq.Model = target.Model
+		}
+		// 路由指定的 key 优先于调用者提供的 API Key
+		if target.APIKey != "" {
+			backendReq.APIKey = target.APIKey
+		}
+		return target.backend().NewRequest(ctx, target.BaseURL, backendReq)
+	}
 
-	log.Printf("[REQ#%d] Sending request to: %s/v1/messages", reqID, h.anthropicURL)
+	logger.Debug("sending request", "url", primary.BaseURL, "backend", primary.backend().Name())
 
-	// 发送请求
-	client := &http.Client{}
-	httpResp, err := client.Do(httpReq)
+	// 发送请求（可重试的失败会按策略重试，主上游故障时切换到备用上游）
+	httpResp, call, err := h.doUpstream(ctx, primary, newRequest, anthropicReq.Model, reqID)
 	if err != nil {
-		log.Printf("[REQ#%d][ERROR] Request failed: %v", reqID, err)
-		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
-		return
+		upErr := call.upstreamError(err)
+		call.release()
+		logger.Error("upstream request failed", "status", upErr.StatusCode, "error", err)
+		return nil, upErr
 	}
-	defer httpResp.Body.Close()
-
-	log.Printf("[REQ#%d] Anthropic response status: %d", reqID, httpResp.StatusCode)
+	call.bind(httpResp)
+	logger.Debug("upstream response", "status", httpResp.StatusCode, "upstream_request_id", httpResp.Header.Get("request-id"))
 
 	// 处理错误响应
+	backend := sent.backend()
 	if httpResp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(httpResp.Body)
-		log.Printf("[REQ#%d][ERROR] Anthropic error response: %s", reqID, string(body))
-		c.JSON(httpResp.StatusCode, gin.H{
-			"error": string(body),
-		})
-		return
+		httpResp.Body.Close()
+		body = backend.ConvertError(httpResp.StatusCode, body)
+		logger.Error("anthropic error response", "status", httpResp.StatusCode, "upstream_request_id", httpResp.Header.Get("request-id"), "body", string(body))
+		return nil, &upstreamError{StatusCode: httpResp.StatusCode, Message: string(body), Header: httpResp.Header}
 	}
+	httpResp.Body = backend.ConvertResponse(httpResp.Body, backendReq)
 
-	// 流式响应
-	if openaiReq.Stream {
-		log.Printf("[REQ#%d] Handling streaming response", reqID)
-		h.handleStreamResponse(c, httpResp, openaiReq.Model, reqID)
-	} else {
-		log.Printf("[REQ#%d] Handling non-streaming response", reqID)
-		h.handleNonStreamResponse(c, httpResp, reqID)
+	if upgrade {
+		resp, upErr := assembleStreamResponse(httpResp.Body)
+		if upErr != nil && call.ctx.Err() != nil {
+			upErr = call.upstreamError(call.ctx.Err())
+		}
+		httpResp.Body.Close()
+		if upErr != nil {
+			logger.Error("assemble upgraded stream failed", "status", upErr.StatusCode, "error", upErr.Message)
+			return nil, upErr
+		}
+		return upgradedResponse(httpResp, resp)
+	}
+
+	if anthropicReq.Stream {
+		call.streaming()
 	}
-	
-	log.Printf("[REQ#%d] ========== REQUEST COMPLETED ==========\n", reqID)
+	return httpResp, nil
 }
 
-func (h *ProxyHandler) handleNonStreamResponse(c *gin.Context, httpResp *http.Response, reqID uint64) {
+func (h *ProxyHandler) handleNonStreamResponse(c *gin.Context, httpResp *http.Response, unwrapJSON bool, reqID string) {
+	logger := reqLog(reqID)
+
 	// 读取完整响应以便记录
-	bodyBytes, err := io.ReadAll(httpResp.Body)
+	bodyBytes, err := readResponseBody(httpResp.Body, h.maxResponseBytes)
 	if err != nil {
-		log.Printf("[REQ#%d][ERROR] Read response body failed: %v", reqID, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		logger.Error("read response body failed", "error", err)
+		respondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	log.Printf("[REQ#%d] ========== ANTHROPIC RESPONSE BODY ==========", reqID)
-	log.Printf("%s", string(bodyBytes))
-	log.Printf("[REQ#%d] ========== END ANTHROPIC RESPONSE ==========", reqID)
+	logger.Debug("anthropic response body", "body", string(bodyBytes))
 
 	var anthropicResp AnthropicResponse
 	if err := json.Unmarshal(bodyBytes, &anthropicResp); err != nil {
-		log.Printf("[REQ#%d][ERROR] Parse Anthropic response failed: %v", reqID, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		logger.Error("parse anthropic response failed", "error", err)
+		respondError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	log.Printf("[REQ#%d] Anthropic Response Summary:", reqID)
-	log.Printf("[REQ#%d]   ID: %s", reqID, anthropicResp.ID)
-	log.Printf("[REQ#%d]   Role: %s", reqID, anthropicResp.Role)
-	log.Printf("[REQ#%d]   StopReason: %s", reqID, anthropicResp.StopReason)
-	log.Printf("[REQ#%d]   Content blocks: %d", reqID, len(anthropicResp.Content))
-	log.Printf("[REQ#%d]   Usage: input=%d, output=%d, cache_read=%d, cache_creation=%d", reqID,
-		anthropicResp.Usage.InputTokens, anthropicResp.Usage.OutputTokens,
-		anthropicResp.Usage.CacheReadInputTokens, anthropicResp.Usage.CacheCreationInputTokens)
+	args := []any{
+		"id", anthropicResp.ID,
+		"stop_reason", anthropicResp.StopReason,
+		"content_blocks", len(anthropicResp.Content),
+		"input_tokens", anthropicResp.Usage.InputTokens,
+		"output_tokens", anthropicResp.Usage.OutputTokens,
+		"cache_read", anthropicResp.Usage.CacheReadInputTokens,
+		"cache_creation", anthropicResp.Usage.CacheCreationInputTokens,
+	}
+	if cost, priced := h.observeUsage(c, anthropicResp.Model, &anthropicResp.Usage); priced {
+		args = append(args, "cost_usd", cost)
+	}
+	logger.Info("anthropic response", args...)
+	h.observeSessionCache(c, &anthropicResp.Usage, reqID)
+
+	if !h.transformResponse(c, &anthropicResp, reqID) {
+		return
+	}
+	prependPrefill(c, &anthropicResp)
+	if unwrapJSON {
+		unwrapJSONResponseTool(&anthropicResp)
+	}
+	metrics.ObserveToolCalls(anthropicResp.Model, countToolUses(anthropicResp.Content))
 
 	// 转换为 OpenAI 格式
 	openaiResp := ConvertAnthropicToOpenAI(anthropicResp)
+	openaiResp.Model = responseModel(c, openaiResp.Model)
+	openaiResp.SystemFingerprint = c.GetString(systemFingerprintKey)
+	if c.GetBool(legacyFunctionsKey) {
+		legacyFunctionResponse(&openaiResp)
+	}
 
-	respJSON, _ := json.Marshal(openaiResp)
-	log.Printf("[REQ#%d] ========== OPENAI RESPONSE BODY ==========", reqID)
-	log.Printf("%s", string(respJSON))
-	log.Printf("[REQ#%d] ========== END OPENAI RESPONSE ==========", reqID)
+	if logger.Enabled(c, slog.LevelDebug) {
+		respJSON, _ := json.Marshal(openaiResp)
+		logger.Debug("openai response body", "body", string(respJSON))
+	}
 
 	c.JSON(http.StatusOK, openaiResp)
 }
 
-func (h *ProxyHandler) handleStreamResponse(c *gin.Context, httpResp *http.Response, model string, reqID uint64) {
+// includeUsage 为 true 时 usage 单独在最后一个 chunk 中返回，否则附带在 finish_reason 所在的 chunk 中
+func (h *ProxyHandler) handleStreamResponse(c *gin.Context, httpResp *http.Response, model string, unwrapJSON bool, includeUsage bool, reqID string) {
 	c.Header("Content-Type", "text/event-stream")
 	c.Header("Cache-Control", "no-cache")
 	c.Header("Connection", "keep-alive")
 
 	flusher, ok := c.Writer.(http.Flusher)
 	if !ok {
-		log.Printf("[REQ#%d][ERROR] Streaming not supported by client", reqID)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "streaming not supported"})
+		reqLog(reqID).Error("streaming not supported by client")
+		respondError(c, http.StatusInternalServerError, "streaming not supported")
 		return
 	}
 
-	scanner := bufio.NewScanner(httpResp.Body)
+	out := streamOutput{
+		send: func(chunk map[string]interface{}) { sendSSE(c, chunk, flusher) },
+		ping: ssePing(c, flusher),
+	}
+	res := h.relayStream(c, httpResp.Body, model, unwrapJSON, !includeUsage, out, reqID)
+	h.observeStream(c, model, res, reqID)
+
+	// stream_options.include_usage：choices 为空、只带 usage 的最后一个 chunk
+	if includeUsage && res.usage != nil {
+		sendSSE(c, map[string]interface{}{
+			"id":      res.id,
+			"object":  "chat.completion.chunk",
+			"created": res.created,
+			"model":   responseModel(c, model),
+			"choices": []map[string]interface{}{},
+			"usage":   streamUsage(res.usage, res.reasoning),
+		}, flusher)
+	}
+
+	// 发送 [DONE]
+	fmt.Fprintf(c.Writer, "data: [DONE]\n\n")
+	flusher.Flush()
+}
+
+// streamOutput 转换后的 chunk 的去向：单个流直接写给客户端，n > 1 时由 fan-out 合并多个流后输出
+type streamOutput struct {
+	send   func(chunk map[string]interface{})
+	ping   func() // 上游空闲时发送心跳
+	choice int    // chunk 中 choices[].index
+}
+
+// streamResult 一个上游流转换结束后的统计信息
+type streamResult struct {
+	id         string
+	created    int64
+	stopReason string
+	usage      *AnthropicUsage
+	reasoning  string // thinking 文本，用于估算 reasoning_tokens
+	events     int
+	toolCalls  int
+	elapsed    time.Duration
+}
+
+// relayStream 读取一个上游 Anthropic 流，逐个事件转换为 OpenAI chunk 交给 out.send
+// usageInFinish 为 true 时结束块带上 usage（客户端没有设置 stream_options.include_usage）
+func (h *ProxyHandler) relayStream(c *gin.Context, body io.ReadCloser, model string, unwrapJSON bool, usageInFinish bool, out streamOutput, reqID string) streamResult {
+	logger := reqLog(reqID)
+	model = responseModel(c, model)
+
+	// 同一个流的所有 chunk 使用相同的 created
+	created := getCurrentTimestamp()
+	start := time.Now()
+
+	_, relaySpan := startSpan(c.Request.Context(), "stream relay", spanKindInternal)
+	defer relaySpan.End()
+
+	tc := h.streamTransformContext(c, reqID)
+	if tc != nil {
+		tc.Choice = out.choice
+	}
+	defer closeOnDisconnect(c, body)()
+	scanner := newHeartbeatScanner(body, h.heartbeatInterval, h.streamIdleTimeout, out.ping)
+	defer scanner.Stop()
 	var (
-		messageID   string
-		usage       *AnthropicUsage
-		eventCount  int
-		toolIndex   int
+		messageID       string
+		usage           *AnthropicUsage
+		eventCount      int
+		finalStopReason string
+		// thinking 文本，用于估算 reasoning_tokens
+		reasoning strings.Builder
+		// Anthropic content block index -> OpenAI tool_calls[].index
+		// 只有 tool_use 块分配工具序号，文本块不占用
+		toolIndexByBlock = make(map[int]int)
+		nextToolIndex    int
+		// json_schema 合成工具所在的 content block，-1 表示没有
+		jsonBlockIndex = -1
+		// 服务端工具调用所在的 content block，参数累积完整后以文本输出
+		serverToolBlocks = make(map[int]*serverToolCall)
+		// 已输出内容的字符数，文本块的起始位置和引用，用于计算 annotations 的位置
+		contentLen     int
+		textBlockStart = make(map[int]int)
+		blockCitations = make(map[int][]map[string]interface{})
+		footnotes      citationFootnotes
 	)
 
-	log.Printf("[REQ#%d] ========== STREAMING EVENTS ==========", reqID)
+	sendContent := func(text string) {
+		contentLen += runeLen(text)
+		chunk := map[string]interface{}{
+			"id":      messageID,
+			"object":  "chat.completion.chunk",
+			"created": created,
+			"model":   model,
+			"choices": []map[string]interface{}{
+				{
+					"index": out.choice,
+					"delta": map[string]interface{}{
+						"content": text,
+					},
+					"finish_reason": nil,
+				},
+			},
+		}
+		out.send(chunk)
+	}
+
+	// 结束块只发送一次：通常由 message_delta 的 stop_reason 触发，
+	// 缺失时在 message_stop 或流结束时补发，保证客户端总能收到 finish_reason
+	finishSent := false
+	upstreamFailed := false
+	sendFinish := func(stopReason, stopSequence string) {
+		if finishSent {
+			return
+		}
+		finishSent = true
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		eventCount++
+		// 有引用时在结束前输出来源列表
+		if refs := footnotes.references(); refs != "" {
+			sendContent(refs)
+		}
 
-		// 记录所有事件（流式日志）
-		log.Printf("[REQ#%d] Stream[%d]: %s", reqID, eventCount, line)
+		finishReason := convertStopReason(stopReason)
+		switch {
+		case nextToolIndex > 0:
+			// 与非流式一致：有工具调用时总是 tool_calls
+			finishReason = "tool_calls"
+		case stopReason == "tool_use" && jsonBlockIndex >= 0:
+			finishReason = "stop"
+		case stopReason == "":
+			// 上游在给出 stop_reason 之前中断，输出不完整
+			finishReason = "length"
+		}
 
-		if !strings.HasPrefix(line, "data:") {
-			continue
+		chunk := map[string]interface{}{
+			"id":      messageID,
+			"object":  "chat.completion.chunk",
+			"created": created,
+			"model":   model,
+			"choices": []map[string]interface{}{
+				{
+					"index":         out.choice,
+					"delta":         map[string]interface{}{},
+					"finish_reason": finishReason,
+				},
+			},
 		}
 
-		data := strings.TrimPrefix(line, "data:")
-		data = strings.TrimSpace(data) // 去除可能的前后空格
+		// 命中 stop 参数时带回匹配的 stop 字符串
+		if stopSequence != "" && stopReason == "stop_sequence" {
+			chunk["choices"].([]map[string]interface{})[0]["stop_reason"] = stopSequence
+		}
+
+		if usage != nil && usageInFinish {
+			chunk["usage"] = streamUsage(usage, reasoning.String())
+		}
+
+		out.send(chunk)
+	}
+
+	for scanner.Scan() {
+		ev := scanner.Event()
+		eventCount++
+
+		// 记录所有事件（仅 DEBUG）
+		logger.Debug("stream event", "seq", eventCount, "event", ev.Event, "data", ev.Data)
+
+		data := ev.Data
 		if data == "[DONE]" || data == "" {
 			continue
 		}
 
 		var event map[string]interface{}
 		if err := json.Unmarshal([]byte(data), &event); err != nil {
-			log.Printf("[REQ#%d][WARN] Failed to parse event: %v, data: %s", reqID, err, data)
+			logger.Warn("failed to parse event", "error", err, "data", data)
 			continue
 		}
+		for _, event := range h.transformEvent(tc, event) {
+			eventType, _ := event["type"].(string)
 
-		eventType, _ := event["type"].(string)
-		log.Printf("[REQ#%d] EventType: %s", reqID, eventType)
-
-		switch eventType {
-		case "message_start":
-			if msg, ok := event["message"].(map[string]interface{}); ok {
-				messageID, _ = msg["id"].(string)
-				log.Printf("[REQ#%d] Stream started - Message ID: %s", reqID, messageID)
-				if u, ok := msg["usage"].(map[string]interface{}); ok {
-					usage = parseUsage(u)
-					log.Printf("[REQ#%d] Initial usage: input=%d, cache_creation=%d, cache_read=%d", reqID,
-						usage.InputTokens, usage.CacheCreationInputTokens, usage.CacheReadInputTokens)
-				}
-
-				// 发送初始块（带 role）
-				chunk := map[string]interface{}{
-					"id":      messageID,
-					"object":  "chat.completion.chunk",
-					"created": getCurrentTimestamp(),
-					"model":   model,
-					"choices": []map[string]interface{}{
-						{
-							"index": 0,
-							"delta": map[string]interface{}{
-								"role":    "assistant",
-								"content": "",
-							},
-							"finish_reason": nil,
-						},
-					},
-				}
-				sendSSE(c, chunk, flusher)
+			blockIndex := -1
+			if v, ok := event["index"].(float64); ok {
+				blockIndex = int(v)
 			}
 
-		case "content_block_start":
-			// 处理工具调用开始
-			if block, ok := event["content_block"].(map[string]interface{}); ok {
-				blockType, _ := block["type"].(string)
-				if blockType == "tool_use" {
-					toolID, _ := block["id"].(string)
-					toolName, _ := block["name"].(string)
-					log.Printf("[REQ#%d] Tool use started - ID: %s, Name: %s, Index: %d", reqID, toolID, toolName, toolIndex)
+			switch eventType {
+			case "message_start":
+				if msg, ok := event["message"].(map[string]interface{}); ok {
+					messageID, _ = msg["id"].(string)
+					if u, ok := msg["usage"].(map[string]interface{}); ok {
+						usage = parseUsage(u)
+					}
 
-					// 发送工具调用开始事件
+					// 发送初始块（带 role），prediction 作为 prefill 发送时在这里补上
+					prefill := c.GetString(predictionPrefillKey)
+					contentLen += runeLen(prefill)
 					chunk := map[string]interface{}{
 						"id":      messageID,
 						"object":  "chat.completion.chunk",
-						"created": getCurrentTimestamp(),
+						"created": created,
 						"model":   model,
 						"choices": []map[string]interface{}{
 							{
-								"index": 0,
+								"index": out.choice,
 								"delta": map[string]interface{}{
-									"tool_calls": []map[string]interface{}{
-										{
-											"index": toolIndex,
-											"id":    toolID,
-											"type":  "function",
-											"function": map[string]string{
-												"name":      toolName,
-												"arguments": "",
-											},
-										},
-									},
+									"role":    "assistant",
+									"content": prefill,
 								},
 								"finish_reason": nil,
 							},
 						},
 					}
-					sendSSE(c, chunk, flusher)
+					out.send(chunk)
 				}
-			}
-
-		case "content_block_delta":
-			if delta, ok := event["delta"].(map[string]interface{}); ok {
-				deltaType, _ := delta["type"].(string)
 
-				if deltaType == "text_delta" {
-					// 处理文本内容
-					if text, ok := delta["text"].(string); ok {
-						chunk := map[string]interface{}{
-							"id":      messageID,
-							"object":  "chat.completion.chunk",
-							"created": getCurrentTimestamp(),
-							"model":   model,
-							"choices": []map[string]interface{}{
-								{
-									"index": 0,
-									"delta": map[string]interface{}{
-										"content": text,
-									},
-									"finish_reason": nil,
-								},
-							},
+			case "content_block_start":
+				// 处理工具调用开始
+				if block, ok := event["content_block"].(map[string]interface{}); ok {
+					blockType, _ := block["type"].(string)
+					toolName, _ := block["name"].(string)
+					if blockType == "server_tool_use" {
+						serverToolBlocks[blockIndex] = &serverToolCall{name: toolName}
+						logger.Debug("server tool use started", "name", toolName, "block", blockIndex)
+					} else if isServerToolResult(blockType) {
+						if text := renderServerToolResult(decodeContentBlock(block)); text != "" {
+							sendContent(text)
 						}
-						sendSSE(c, chunk, flusher)
-					}
-				} else if deltaType == "input_json_delta" {
-					// 处理工具参数增量
-					if partialJSON, ok := delta["partial_json"].(string); ok {
+					} else if blockType == "text" {
+						textBlockStart[blockIndex] = contentLen
+					} else if blockType == "tool_use" && unwrapJSON && toolName == jsonResponseToolName {
+						// json_schema 合成工具：参数作为文本输出
+						jsonBlockIndex = blockIndex
+						logger.Debug("json response tool started", "block", blockIndex)
+					} else if blockType == "tool_use" {
+						toolID, _ := block["id"].(string)
+						toolIndex := nextToolIndex
+						toolIndexByBlock[blockIndex] = toolIndex
+						nextToolIndex++
+						logger.Debug("tool use started", "id", toolID, "name", toolName, "block", blockIndex, "tool_index", toolIndex)
+
+						// 发送工具调用开始事件
 						chunk := map[string]interface{}{
 							"id":      messageID,
 							"object":  "chat.completion.chunk",
-							"created": getCurrentTimestamp(),
+							"created": created,
 							"model":   model,
 							"choices": []map[string]interface{}{
 								{
-									"index": 0,
+									"index": out.choice,
 									"delta": map[string]interface{}{
 										"tool_calls": []map[string]interface{}{
 											{
 												"index": toolIndex,
+												"id":    toolID,
+												"type":  "function",
 												"function": map[string]string{
-													"arguments": partialJSON,
+													"name":      toolName,
+													"arguments": "",
 												},
 											},
 										},
@@ -428,68 +968,205 @@ func (h *ProxyHandler) handleStreamResponse(c *gin.Context, httpResp *http.Respo
 								},
 							},
 						}
-						sendSSE(c, chunk, flusher)
+						out.send(chunk)
 					}
 				}
-			}
 
-		case "content_block_stop":
-			// 工具块结束
-			log.Printf("[REQ#%d] Content block %d stopped", reqID, toolIndex)
-			toolIndex++
+			case "content_block_delta":
+				if delta, ok := event["delta"].(map[string]interface{}); ok {
+					deltaType, _ := delta["type"].(string)
 
-		case "message_delta":
-			if delta, ok := event["delta"].(map[string]interface{}); ok {
-				if stopReason, ok := delta["stop_reason"].(string); ok {
-					log.Printf("[REQ#%d] Stream ended - Stop reason: %s", reqID, stopReason)
+					if deltaType == "text_delta" {
+						// 处理文本内容
+						if text, ok := delta["text"].(string); ok {
+							sendContent(text)
+						}
+					} else if deltaType == "citations_delta" {
+						// 引用在文本块结束时以脚注标记输出
+						if citation, ok := delta["citation"].(map[string]interface{}); ok {
+							blockCitations[blockIndex] = append(blockCitations[blockIndex], citation)
+						}
+					} else if deltaType == "thinking_delta" {
+						// extended thinking 以 reasoning_content 输出
+						if thinking, ok := delta["thinking"].(string); ok && thinking != "" {
+							reasoning.WriteString(thinking)
+							chunk := map[string]interface{}{
+								"id":      messageID,
+								"object":  "chat.completion.chunk",
+								"created": created,
+								"model":   model,
+								"choices": []map[string]interface{}{
+									{
+										"index": out.choice,
+										"delta": map[string]interface{}{
+											"reasoning_content": thinking,
+										},
+										"finish_reason": nil,
+									},
+								},
+							}
+							out.send(chunk)
+						}
+					} else if st, ok := serverToolBlocks[blockIndex]; ok && deltaType == "input_json_delta" {
+						partialJSON, _ := delta["partial_json"].(string)
+						st.input.WriteString(partialJSON)
+					} else if deltaType == "input_json_delta" && blockIndex == jsonBlockIndex {
+						// 合成工具的参数增量即 JSON 文本
+						if partialJSON, ok := delta["partial_json"].(string); ok && partialJSON != "" {
+							sendContent(partialJSON)
+						}
+					} else if deltaType == "input_json_delta" {
+						// 处理工具参数增量
+						toolIndex, isTool := toolIndexByBlock[blockIndex]
+						if !isTool {
+							logger.Warn("input_json_delta for unknown block", "block", blockIndex)
+							continue
+						}
+						if partialJSON, ok := delta["partial_json"].(string); ok {
+							chunk := map[string]interface{}{
+								"id":      messageID,
+								"object":  "chat.completion.chunk",
+								"created": created,
+								"model":   model,
+								"choices": []map[string]interface{}{
+									{
+										"index": out.choice,
+										"delta": map[string]interface{}{
+											"tool_calls": []map[string]interface{}{
+												{
+													"index": toolIndex,
+													"function": map[string]string{
+														"arguments": partialJSON,
+													},
+												},
+											},
+										},
+										"finish_reason": nil,
+									},
+								},
+							}
+							out.send(chunk)
+						}
+					}
+				}
 
-					// 发送最终块
-					chunk := map[string]interface{}{
+			case "content_block_stop":
+				if st, ok := serverToolBlocks[blockIndex]; ok {
+					delete(serverToolBlocks, blockIndex)
+					sendContent(renderServerToolUse(st.name, serverToolInput(st.input.String())))
+				}
+				if citations, ok := blockCitations[blockIndex]; ok {
+					delete(blockCitations, blockIndex)
+					marker, annotations := footnotes.cite(citations, textBlockStart[blockIndex], contentLen)
+					contentLen += runeLen(marker)
+					out.send(map[string]interface{}{
 						"id":      messageID,
 						"object":  "chat.completion.chunk",
-						"created": getCurrentTimestamp(),
+						"created": created,
 						"model":   model,
 						"choices": []map[string]interface{}{
 							{
-								"index":         0,
-								"delta":         map[string]interface{}{},
-								"finish_reason": convertStopReason(stopReason),
+								"index": out.choice,
+								"delta": map[string]interface{}{
+									"content":     marker,
+									"annotations": annotations,
+								},
+								"finish_reason": nil,
 							},
 						},
-					}
+					})
+				}
 
-					if usage != nil {
-						chunk["usage"] = map[string]interface{}{
-							"prompt_tokens":     usage.InputTokens,
-							"completion_tokens": usage.OutputTokens,
-							"total_tokens":      usage.InputTokens + usage.OutputTokens,
-							"prompt_tokens_details": map[string]interface{}{
-								"cached_tokens": usage.CacheReadInputTokens,
-								"audio_tokens":  0,
-							},
-							"completion_tokens_details": map[string]interface{}{
-								"reasoning_tokens":            0,
-								"audio_tokens":                0,
-								"accepted_prediction_tokens":  0,
-								"rejected_prediction_tokens":  0,
-							},
-						}
+			case "error":
+				// 流中途的上游错误（如 overloaded_error），以 OpenAI 错误格式转发
+				logger.Error("upstream stream error", "body", data)
+				out.send(streamEventError(data, reqID))
+				upstreamFailed = true
+
+			case "message_delta":
+				// message_delta 携带最终的 output_tokens（message_start 中只有初始值）
+				if u, ok := event["usage"].(map[string]interface{}); ok {
+					if usage == nil {
+						usage = &AnthropicUsage{}
 					}
+					mergeDeltaUsage(usage, parseUsage(u))
+				}
+				if stopReason, stopSequence := eventStopReason(event); stopReason != "" {
+					finalStopReason = stopReason
+					sendFinish(stopReason, stopSequence)
+				}
 
-					sendSSE(c, chunk, flusher)
+			case "message_stop":
+				// 部分网关把 stop_reason 放在 message_stop 中，或者省略了 message_delta
+				stopReason, stopSequence := eventStopReason(event)
+				if stopReason != "" {
+					finalStopReason = stopReason
+				} else if !finishSent {
+					logger.Warn("message_stop without stop_reason")
+					stopReason = "end_turn"
 				}
+				sendFinish(stopReason, stopSequence)
 			}
 		}
 	}
 
+	// 读取上游失败（连接断开、空闲超时）时发送错误 chunk，客户端不必等到超时
+	if err := scanner.Err(); err != nil && !finishSent && !upstreamFailed && c.Request.Context().Err() == nil {
+		out.send(streamReadError(err, reqID))
+		upstreamFailed = true
+	}
+
+	// 上游流正常结束但缺少 stop_reason 时补发结束块；客户端已断开或已转发上游错误时不再发送
+	if !finishSent && !upstreamFailed && c.Request.Context().Err() == nil {
+		logger.Warn("stream ended without stop_reason", "tool_calls", nextToolIndex)
+		sendFinish("", "")
+	}
+
+	logStreamEnd(c, reqID, scanner.Err())
 	if err := scanner.Err(); err != nil {
-		log.Printf("[REQ#%d][ERROR] Scanner error: %v", reqID, err)
+		relaySpan.SetError(err.Error())
 	}
 
-	// 发送 [DONE]
-	log.Printf("[REQ#%d] ========== END STREAMING (total events: %d) ==========", reqID, eventCount)
-	fmt.Fprintf(c.Writer, "data: [DONE]\n\n")
-	flusher.Flush()
+	return streamResult{
+		id:         messageID,
+		created:    created,
+		stopReason: finalStopReason,
+		usage:      usage,
+		reasoning:  reasoning.String(),
+		events:     eventCount,
+		toolCalls:  nextToolIndex,
+		elapsed:    time.Since(start),
+	}
+}
+
+// observeStream 记录一个流的用量、费用和指标
+func (h *ProxyHandler) observeStream(c *gin.Context, model string, res streamResult, reqID string) {
+	args := []any{
+		"id", res.id,
+		"events", res.events,
+		"stop_reason", res.stopReason,
+		"tool_calls", res.toolCalls,
+		"duration", res.elapsed,
+	}
+	if res.usage != nil {
+		if cost, priced := h.observeUsage(c, model, res.usage); priced {
+			args = append(args, "cost_usd", cost)
+		}
+		metrics.ObserveStream(model, res.usage.OutputTokens, res.elapsed)
+		h.observeSessionCache(c, res.usage, reqID)
+	}
+	metrics.ObserveToolCalls(model, res.toolCalls)
+
+	reqLog(reqID).Info("stream completed", args...)
+}
+
+// contentString 将消息内容转为字符串以便记录
+func contentString(content interface{}) string {
+	if str, ok := content.(string); ok {
+		return str
+	}
+	contentBytes, _ := json.Marshal(content)
+	return string(contentBytes)
 }
 
 func parseUsage(u map[string]interface{}) *AnthropicUsage {
@@ -511,7 +1188,59 @@ func parseUsage(u map[string]interface{}) *AnthropicUsage {
 	return usage
 }
 
+// streamUsage 流式响应中 OpenAI 格式的 usage
+func streamUsage(usage *AnthropicUsage, reasoning string) map[string]interface{} {
+	return map[string]interface{}{
+		"prompt_tokens":     usage.InputTokens,
+		"completion_tokens": usage.OutputTokens,
+		"total_tokens":      usage.InputTokens + usage.OutputTokens,
+		"prompt_tokens_details": map[string]interface{}{
+			"cached_tokens": usage.CacheReadInputTokens,
+			"audio_tokens":  0,
+		},
+		"completion_tokens_details": map[string]interface{}{
+			"reasoning_tokens":           estimateReasoningTokens(reasoning, usage.OutputTokens),
+			"audio_tokens":               0,
+			"accepted_prediction_tokens": 0,
+			"rejected_prediction_tokens": 0,
+		},
+	}
+}
+
+// mergeDeltaUsage 合并 message_delta 中的 usage
+// 其中的计数是累计值而不是增量：output_tokens 直接覆盖，input/cache 计数只在非 0 时覆盖 message_start 的值
+func mergeDeltaUsage(usage *AnthropicUsage, delta *AnthropicUsage) {
+	usage.OutputTokens = delta.OutputTokens
+	if delta.InputTokens > 0 {
+		usage.InputTokens = delta.InputTokens
+	}
+	if delta.CacheCreationInputTokens > 0 {
+		usage.CacheCreationInputTokens = delta.CacheCreationInputTokens
+	}
+	if delta.CacheReadInputTokens > 0 {
+		usage.CacheReadInputTokens = delta.CacheReadInputTokens
+	}
+}
+
+// sendSSE 写入一个 SSE data 事件，旧版 functions 请求的 chunk 先转换为 function_call 格式
 func sendSSE(c *gin.Context, data interface{}, flusher http.Flusher) {
+	if c.GetBool(legacyFunctionsKey) && !legacyFunctionChunk(data) {
+		return
+	}
+	if chunk, ok := data.(map[string]interface{}); ok {
+		// 流式 chunk 与非流式响应一样带上 system_fingerprint
+		if fingerprint := c.GetString(systemFingerprintKey); fingerprint != "" {
+			chunk["system_fingerprint"] = fingerprint
+		}
+		// 每个 choice 都带上 logprobs: null
+		if choices, ok := chunk["choices"].([]map[string]interface{}); ok {
+			for _, choice := range choices {
+				if _, ok := choice["logprobs"]; !ok {
+					choice["logprobs"] = nil
+				}
+			}
+		}
+	}
 	jsonData, _ := json.Marshal(data)
 	fmt.Fprintf(c.Writer, "data: %s\n\n", jsonData)
 	flusher.Flush()
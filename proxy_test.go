@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 流式转换的每个 chunk 都带有真实且相同的 created
+func TestRelayStreamCreatedTimestamp(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	events := []string{
+		`{"type":"message_start","message":{"id":"msg_1","model":"claude-test","usage":{"input_tokens":5,"output_tokens":0}}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hel"}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"lo"}}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":2}}`,
+		`{"type":"message_stop"}`,
+	}
+	var sse strings.Builder
+	for _, e := range events {
+		sse.WriteString("data: " + e + "\n\n")
+	}
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+
+	var chunks []map[string]interface{}
+	out := streamOutput{send: func(chunk map[string]interface{}) { chunks = append(chunks, chunk) }}
+	before := time.Now().Unix()
+	h := &ProxyHandler{}
+	res := h.relayStream(c, io.NopCloser(strings.NewReader(sse.String())), "claude-test", false, true, out, "test")
+	after := time.Now().Unix()
+
+	if len(chunks) < 3 {
+		t.Fatalf("got %d chunks, want at least 3", len(chunks))
+	}
+	first, ok := chunks[0]["created"].(int64)
+	if !ok || first < before || first > after {
+		t.Fatalf("created = %v, want a Unix timestamp between %d and %d", chunks[0]["created"], before, after)
+	}
+	for i, chunk := range chunks {
+		if chunk["created"] != first {
+			t.Errorf("chunk %d: created = %v, want %d", i, chunk["created"], first)
+		}
+	}
+	if res.created != first {
+		t.Errorf("stream result created = %d, want %d", res.created, first)
+	}
+}
+
+// stateWriter 在每个流式事件中写入 State，用于检查 n > 1 时各个流是否共享 State
+type stateWriter struct{}
+
+func (stateWriter) Name() string { return "state_writer" }
+
+func (stateWriter) TransformEvent(tc *TransformContext, event map[string]interface{}) {
+	n, _ := tc.State["events"].(int)
+	tc.State["events"] = n + 1
+}
+
+// n > 1 的流式请求在同一个 gin context 上并发转发多个流，每个流的插件使用各自的 State（配合 -race 运行）
+func TestRelayStreamConcurrentTransformState(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	sse := "data: " + `{"type":"message_start","message":{"id":"msg_1","model":"claude-test","usage":{"input_tokens":5,"output_tokens":0}}}` + "\n\n" +
+		"data: " + `{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}` + "\n\n" +
+		"data: " + `{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hi"}}` + "\n\n" +
+		"data: " + `{"type":"content_block_stop","index":0}` + "\n\n" +
+		"data: " + `{"type":"message_stop"}` + "\n\n"
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	h := &ProxyHandler{}
+	h.Use(stateWriter{})
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		out := streamOutput{
+			send: func(map[string]interface{}) {
+				mu.Lock()
+				defer mu.Unlock()
+			},
+			choice: i,
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.relayStream(c, io.NopCloser(strings.NewReader(sse)), "claude-test", false, true, out, "test")
+		}()
+	}
+	wg.Wait()
+
+	if v, ok := c.Get(transformStateKey); ok && len(v.(map[string]interface{})) != 0 {
+		t.Errorf("shared State = %v, want stream writes kept out of it", v)
+	}
+}
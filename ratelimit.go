@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// rateLimitIDKey gin context 中限流使用的身份标识，请求结束后按实际 token 用量扣减 TPM
+const rateLimitIDKey = "rate_limit_id"
+
+// 空闲超过 bucketIdleTTL 的桶会被清理
+const bucketIdleTTL = 10 * time.Minute
+
+// RateLimitConfig 限流配置，0 表示不限制
+type RateLimitConfig struct {
+	RPM      int            // 每个身份每分钟请求数
+	TPM      int            // 每个身份每分钟 token 数（input + output）
+	ModelRPM map[string]int // 每个身份对指定模型每分钟请求数
+	ByIP     bool           // true 时按客户端 IP 限流，否则按 API Key
+}
+
+func (cfg RateLimitConfig) enabled() bool {
+	return cfg.RPM > 0 || cfg.TPM > 0 || len(cfg.ModelRPM) > 0
+}
+
+// loadRateLimitConfig 从环境变量读取限流配置
+func loadRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		RPM:      getEnvInt("RATE_LIMIT_RPM", 0),
+		TPM:      getEnvInt("RATE_LIMIT_TPM", 0),
+		ModelRPM: parseMaxTokensMapping(os.Getenv("RATE_LIMIT_MODEL_RPM")),
+		ByIP:     strings.ToLower(os.Getenv("RATE_LIMIT_BY")) == "ip",
+	}
+}
+
+// tokenBucket 令牌桶，容量为每分钟限额，按秒匀速补充
+// TPM 桶允许扣成负数：请求前只要求余额为正，响应后按实际用量扣减
+type tokenBucket struct {
+	tokens   float64
+	capacity float64
+	last     time.Time
+}
+
+func newTokenBucket(perMinute int, now time.Time) *tokenBucket {
+	return &tokenBucket{tokens: float64(perMinute), capacity: float64(perMinute), last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.capacity/60)
+	b.last = now
+}
+
+// waitFor 余额达到 need 需要等待的时间
+func (b *tokenBucket) waitFor(need float64) time.Duration {
+	if b.tokens >= need {
+		return 0
+	}
+	return time.Duration((need - b.tokens) / (b.capacity / 60) * float64(time.Second))
+}
+
+// RateLimiter 按身份（API Key 或 IP）的 RPM/TPM 限流
+type RateLimiter struct {
+	cfg       RateLimitConfig
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+func NewRateLimiter(cfg RateLimitConfig) *RateLimiter {
+	return &RateLimiter{cfg: cfg, buckets: make(map[string]*tokenBucket), lastPrune: time.Now()}
+}
+
+func (l *RateLimiter) bucket(key string, perMinute int, now time.Time) *tokenBucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = newTokenBucket(perMinute, now)
+		l.buckets[key] = b
+	}
+	b.refill(now)
+	return b
+}
+
+// Allow 检查并占用一次请求额度，超限时返回需要等待的时间
+func (l *RateLimiter) Allow(id, model string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.pruneLocked(now)
+
+	var requestBuckets []*tokenBucket
+	if l.cfg.RPM > 0 {
+		requestBuckets = append(requestBuckets, l.bucket("rpm|"+id, l.cfg.RPM, now))
+	}
+	if rpm, ok := l.cfg.ModelRPM[model]; ok {
+		requestBuckets = append(requestBuckets, l.bucket("model_rpm|"+id+"|"+model, rpm, now))
+	}
+
+	var wait time.Duration
+	for _, b := range requestBuckets {
+		if d := b.waitFor(1); d > wait {
+			wait = d
+		}
+	}
+	if l.cfg.TPM > 0 {
+		// 余额为正即可放行，实际用量在响应后扣减
+		if d := l.bucket("tpm|"+id, l.cfg.TPM, now).waitFor(math.SmallestNonzeroFloat64); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		return false, wait
+	}
+
+	for _, b := range requestBuckets {
+		b.tokens--
+	}
+	return true, 0
+}
+
+// Consume 按实际 token 用量扣减 TPM 额度
+func (l *RateLimiter) Consume(id string, tokens int) {
+	if l.cfg.TPM <= 0 || tokens <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.bucket("tpm|"+id, l.cfg.TPM, time.Now()).tokens -= float64(tokens)
+}
+
+// pruneLocked 清理长时间未使用的桶，避免身份过多时内存增长
+func (l *RateLimiter) pruneLocked(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > bucketIdleTTL {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimitID 限流身份
+func (h *ProxyHandler) rateLimitID(c *gin.Context, apiKey string) string {
+	return clientID(c, apiKey, h.rateLimiter.cfg.ByIP)
+}
+
+// clientID 限流和并发限制的身份：按 IP 或虚拟 key 名称，否则使用 API Key 的哈希（不在内存中保存原始 key）
+func clientID(c *gin.Context, apiKey string, byIP bool) string {
+	if byIP {
+		return "ip:" + c.ClientIP()
+	}
+	if name := c.GetString(keyNameKey); name != "" {
+		return "name:" + name
+	}
+	return fmt.Sprintf("key:%x", sha256.Sum256([]byte(apiKey)))[:20]
+}
+
+// checkRateLimit 超限时写入 429（带 retry-after）并返回 false
+func (h *ProxyHandler) checkRateLimit(c *gin.Context, apiKey, model string, reqID string) bool {
+	if h.rateLimiter == nil {
+		return true
+	}
+	id := h.rateLimitID(c, apiKey)
+	c.Set(rateLimitIDKey, id)
+
+	ok, wait := h.rateLimiter.Allow(id, model)
+	if ok {
+		return true
+	}
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	reqLog(reqID).Warn("rate limited", "id", id, "model", model, "retry_after", retryAfter)
+	c.Header("retry-after", fmt.Sprint(retryAfter))
+	c.Set(auditDecisionKey, auditRateLimited)
+	respondError(c, http.StatusTooManyRequests, fmt.Sprintf("Rate limit exceeded, retry after %d seconds", retryAfter))
+	return false
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 上游 Anthropic 的限流响应头转换为 OpenAI 的写法，便于客户端自带的退避逻辑根据剩余额度调整请求速度
+// 原始的 anthropic-ratelimit-* 头同时透传
+
+// rateLimitHeaderMapping anthropic-ratelimit-* -> x-ratelimit-*
+var rateLimitHeaderMapping = []struct {
+	anthropic, openai string
+	reset             bool // Anthropic 为 RFC 3339 时间，OpenAI 为距离重置的时长（如 "6m0s"）
+}{
+	{"anthropic-ratelimit-requests-limit", "x-ratelimit-limit-requests", false},
+	{"anthropic-ratelimit-requests-remaining", "x-ratelimit-remaining-requests", false},
+	{"anthropic-ratelimit-requests-reset", "x-ratelimit-reset-requests", true},
+	{"anthropic-ratelimit-tokens-limit", "x-ratelimit-limit-tokens", false},
+	{"anthropic-ratelimit-tokens-remaining", "x-ratelimit-remaining-tokens", false},
+	{"anthropic-ratelimit-tokens-reset", "x-ratelimit-reset-tokens", true},
+}
+
+// rateLimitExposedHeaders 跨域时需要暴露给浏览器的限流头
+const rateLimitExposedHeaders = "x-ratelimit-limit-requests, x-ratelimit-remaining-requests, x-ratelimit-reset-requests, " +
+	"x-ratelimit-limit-tokens, x-ratelimit-remaining-tokens, x-ratelimit-reset-tokens"
+
+// setRateLimitHeaders 把上游响应的限流头写入客户端响应（响应头尚未写出时），上游没有返回时不做任何事
+// 429 响应同时透传 retry-after
+func setRateLimitHeaders(c *gin.Context, header http.Header) {
+	if header == nil || c.Writer.Written() {
+		return
+	}
+	for name, values := range header {
+		if strings.HasPrefix(strings.ToLower(name), "anthropic-ratelimit-") && len(values) > 0 {
+			c.Header(name, values[0])
+		}
+	}
+	for _, m := range rateLimitHeaderMapping {
+		v := header.Get(m.anthropic)
+		if v == "" {
+			continue
+		}
+		if m.reset {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				continue
+			}
+			wait := time.Until(t)
+			if wait < 0 {
+				wait = 0
+			}
+			v = wait.Round(time.Millisecond).String()
+		}
+		c.Header(m.openai, v)
+	}
+	if v := header.Get("retry-after"); v != "" {
+		c.Header("retry-after", v)
+	}
+}
+
+// remainingRequests 上游返回的剩余请求数，没有返回时视为不限
+func remainingRequests(header http.Header) int {
+	n, err := strconv.Atoi(header.Get("anthropic-ratelimit-requests-remaining"))
+	if err != nil {
+		return math.MaxInt
+	}
+	return n
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RPM 用完后拒绝并返回等待时间，额度按时间匀速恢复，不同身份互不影响
+func TestRateLimiterRPM(t *testing.T) {
+	l := NewRateLimiter(RateLimitConfig{RPM: 2, ModelRPM: map[string]int{"claude-opus": 1}})
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("alice", "claude-sonnet"); !ok {
+			t.Fatalf("request %d rejected within the RPM", i)
+		}
+	}
+	ok, wait := l.Allow("alice", "claude-sonnet")
+	if ok || wait <= 0 || wait > 30*time.Second {
+		t.Fatalf("over RPM: allow = %v, wait = %v; want rejected with a wait of at most 30s", ok, wait)
+	}
+	if ok, _ := l.Allow("bob", "claude-sonnet"); !ok {
+		t.Error("another identity was limited")
+	}
+
+	// 半分钟恢复一次请求的额度
+	l.buckets["rpm|alice"].last = time.Now().Add(-30 * time.Second)
+	if ok, _ := l.Allow("alice", "claude-sonnet"); !ok {
+		t.Error("request rejected after the bucket refilled")
+	}
+
+	// 模型限额与总限额同时生效
+	if ok, _ := l.Allow("bob", "claude-opus"); !ok {
+		t.Fatal("first claude-opus request rejected")
+	}
+	if ok, _ := l.Allow("bob", "claude-opus"); ok {
+		t.Error("second claude-opus request allowed over the model RPM")
+	}
+	if ok, _ := l.Allow("carol", "claude-opus"); !ok {
+		t.Error("model RPM shared between identities")
+	}
+}
+
+// TPM 在请求前只要求余额为正，响应后按实际用量扣减，超出的部分需要等待恢复
+func TestRateLimiterTPM(t *testing.T) {
+	l := NewRateLimiter(RateLimitConfig{TPM: 600})
+	if ok, _ := l.Allow("alice", "claude-test"); !ok {
+		t.Fatal("first request rejected")
+	}
+	l.Consume("alice", 900)
+	ok, wait := l.Allow("alice", "claude-test")
+	if ok {
+		t.Fatal("request allowed with a negative TPM balance")
+	}
+	if wait < 29*time.Second || wait > 31*time.Second {
+		t.Errorf("wait = %v, want about 30s to pay back 300 tokens", wait)
+	}
+	if ok, _ := l.Allow("bob", "claude-test"); !ok {
+		t.Error("another identity was limited")
+	}
+}
+
+// 超限的请求返回 429 和 retry-after，并记录审计决定；同一虚拟 key 名称的不同 key 共享额度
+func TestCheckRateLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h := &ProxyHandler{rateLimiter: NewRateLimiter(RateLimitConfig{RPM: 1})}
+	check := func(apiKey, keyName string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		if keyName != "" {
+			c.Set(keyNameKey, keyName)
+		}
+		if !h.checkRateLimit(c, apiKey, "claude-test", "test") && c.GetString(auditDecisionKey) != auditRateLimited {
+			t.Errorf("audit decision = %q, want %q", c.GetString(auditDecisionKey), auditRateLimited)
+		}
+		return w
+	}
+
+	if w := check("sk-a", ""); w.Code != http.StatusOK {
+		t.Fatalf("first request: status = %d", w.Code)
+	}
+	w := check("sk-a", "")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("retry-after") == "" {
+		t.Errorf("second request: status = %d, retry-after = %q; want 429 with retry-after", w.Code, w.Header().Get("retry-after"))
+	}
+	if w := check("sk-b", ""); w.Code != http.StatusOK {
+		t.Errorf("other key: status = %d, want 200", w.Code)
+	}
+
+	if w := check("sk-team-1", "team"); w.Code != http.StatusOK {
+		t.Fatalf("virtual key: status = %d", w.Code)
+	}
+	if w := check("sk-team-2", "team"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("second key of the same virtual key name: status = %d, want 429", w.Code)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// runReplay 实现 replay 子命令：重新发送 tape 中录制的请求
+// 默认把客户端原始请求发给代理（重新走一遍格式转换），-upstream 时把转换后的请求直接发给 Anthropic
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: openai-anthropic-proxy replay [flags] <tape.jsonl>")
+		fs.PrintDefaults()
+	}
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	baseURL := os.Getenv("ANTHROPIC_BASE_URL")
+	if baseURL == "" {
+		baseURL = "https://api.anthropic.com"
+	}
+	proxyURL := fs.String("url", "http://localhost:"+port, "proxy base URL")
+	apiKey := fs.String("key", os.Getenv("ANTHROPIC_API_KEY"), "API key (defaults to ANTHROPIC_API_KEY)")
+	requestID := fs.String("id", "", "request_id to replay (defaults to the last entry; the last match wins when IDs repeat)")
+	upstream := fs.Bool("upstream", false, "send the converted anthropic_request to ANTHROPIC_BASE_URL instead of the proxy")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	entry, err := findTapeEntry(fs.Arg(0), *requestID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "replay:", err)
+		return 1
+	}
+
+	var req *http.Request
+	if *upstream {
+		req, err = http.NewRequest(http.MethodPost, strings.TrimSuffix(baseURL, "/")+"/v1/messages", bytes.NewReader(entry.Anthropic))
+		if err == nil {
+			req.Header.Set("x-api-key", *apiKey)
+			req.Header.Set("anthropic-version", "2023-06-01")
+		}
+	} else {
+		if len(entry.Request) == 0 {
+			fmt.Fprintln(os.Stderr, "replay: entry has no client request, use -upstream")
+			return 1
+		}
+		req, err = http.NewRequest(entry.Method, strings.TrimSuffix(*proxyURL, "/")+entry.Path, bytes.NewReader(entry.Request))
+		if err == nil {
+			req.Header.Set("Authorization", "Bearer "+*apiKey)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "replay:", err)
+		return 1
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	fmt.Fprintf(os.Stderr, "replaying request %s (%s %s, recorded %s, status %d) to %s\n",
+		entry.RequestID, entry.Method, entry.Path, entry.Time.Format("2006-01-02 15:04:05"), entry.Status, req.URL)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "replay:", err)
+		return 1
+	}
+	defer resp.Body.Close()
+
+	fmt.Fprintln(os.Stderr, "status:", resp.Status)
+	if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+		fmt.Fprintln(os.Stderr, "replay:", err)
+		return 1
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 1
+	}
+	return 0
+}
+
+// findTapeEntry 读取 tape 文件，返回指定 request_id 的最后一条记录，id 为空时返回最后一条
+func findTapeEntry(name string, requestID string) (*TapeEntry, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var found *TapeEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		// 旧版本录制的 request_id 是数字，类型不匹配时其余字段仍然可用
+		var entry TapeEntry
+		var typeErr *json.UnmarshalTypeError
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil && !errors.As(err, &typeErr) {
+			continue
+		}
+		if requestID == "" || entry.RequestID == requestID {
+			found = &entry
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if found == nil {
+		if requestID != "" {
+			return nil, fmt.Errorf("request_id %s not found in %s", requestID, name)
+		}
+		return nil, errors.New("no entries in " + name)
+	}
+	return found, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestIDHeader 客户端可以通过该请求头指定请求 ID，响应总是带上本次请求使用的 ID
+const requestIDHeader = "x-request-id"
+
+// upstreamRequestIDHeader 转发给上游的请求 ID，便于与 Anthropic 返回的 request-id 对应
+const upstreamRequestIDHeader = "x-client-request-id"
+
+// maxRequestIDLength 客户端提供的请求 ID 的最大长度
+const maxRequestIDLength = 128
+
+// RequestID 为每个请求分配 ID：客户端提供了合法的 x-request-id 时沿用，否则生成 UUID
+// ID 写入响应头、日志、错误响应和上游请求，用于跨系统关联
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		c.Set(reqIDKey, id)
+		c.Header(requestIDHeader, id)
+		c.Next()
+	}
+}
+
+// requestID 返回当前请求的 ID，未经过 RequestID 中间件时生成一个新的
+func requestID(c *gin.Context) string {
+	if id := c.GetString(reqIDKey); id != "" {
+		return id
+	}
+	id := newRequestID()
+	c.Set(reqIDKey, id)
+	return id
+}
+
+// validRequestID 只接受字母、数字和 "-_.:"，避免日志注入
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, ch := range id {
+		switch {
+		case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch >= '0' && ch <= '9':
+		case ch == '-', ch == '_', ch == '.', ch == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID 生成 UUID v4
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
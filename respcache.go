@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// responseCacheHitKey 响应来自缓存，不计入用量、费用和限流
+const responseCacheHitKey = "response_cache_hit"
+
+// ResponseCacheConfig 非流式响应缓存配置
+type ResponseCacheConfig struct {
+	Backend    string        // memory / redis，为空表示不启用
+	TTL        time.Duration // 缓存有效期
+	MaxEntries int           // memory 后端的最大条目数，超出时淘汰最久未使用的
+	MaxBytes   int           // 单个响应体上限，超出不缓存
+	RedisURL   string        // redis://[:password@]host:port[/db]
+}
+
+// loadResponseCacheConfig 从环境变量读取响应缓存配置
+func loadResponseCacheConfig() ResponseCacheConfig {
+	return ResponseCacheConfig{
+		Backend:    strings.ToLower(os.Getenv("RESPONSE_CACHE")),
+		TTL:        getEnvSeconds("RESPONSE_CACHE_TTL_SECONDS", 300*time.Second),
+		MaxEntries: getEnvInt("RESPONSE_CACHE_MAX_ENTRIES", 1000),
+		MaxBytes:   getEnvInt("RESPONSE_CACHE_MAX_ENTRY_KB", 256) << 10,
+		RedisURL:   os.Getenv("REDIS_URL"),
+	}
+}
+
+// ResponseCache 缓存上游返回的 Anthropic 响应体，键为转换后请求的哈希
+type ResponseCache interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, body []byte)
+}
+
+// NewResponseCache 按配置创建响应缓存，未启用时返回 nil
+func NewResponseCache(cfg ResponseCacheConfig) (ResponseCache, error) {
+	switch cfg.Backend {
+	case "":
+		return nil, nil
+	case "memory":
+		return newMemoryResponseCache(cfg.MaxEntries, cfg.TTL), nil
+	case "redis":
+		return newRedisResponseCache(cfg.RedisURL, cfg.TTL)
+	}
+	return nil, fmt.Errorf("unknown RESPONSE_CACHE backend %q, expected memory or redis", cfg.Backend)
+}
+
+// responseCacheKey 可缓存时返回缓存键：只缓存客户端显式设置 temperature 为 0 的非流式请求
+// 未设置 temperature 时上游使用默认值 1，结果不确定，不缓存
+// 键包含 API Key，不同 key 之间不共享缓存
+func responseCacheKey(req *AnthropicRequest, apiKey string) (string, bool) {
+	if req.Stream || req.Temperature == nil || *req.Temperature != 0 {
+		return "", false
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return "", false
+	}
+	sum := sha256.New()
+	sum.Write([]byte(apiKey))
+	sum.Write([]byte{0})
+	sum.Write(body)
+	return hex.EncodeToString(sum.Sum(nil)), true
+}
+
+// cachedResponse 将缓存的响应体包装为上游响应
+func cachedResponse(body []byte) *http.Response {
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+	}
+}
+
+// lookupResponseCache 命中时返回缓存的响应，调用方负责标记请求不计入用量
+func (h *ProxyHandler) lookupResponseCache(key string, model string, reqID string) (*http.Response, bool) {
+	body, ok := h.responseCache.Get(key)
+	metrics.ObserveResponseCache(model, ok)
+	if !ok {
+		return nil, false
+	}
+	reqLog(reqID).Info("response cache hit", "model", model, "bytes", len(body))
+	return cachedResponse(body), true
+}
+
+// storeResponseCache 读取上游响应体并写入缓存，返回可以继续读取的响应
+func (h *ProxyHandler) storeResponseCache(httpResp *http.Response, key string, reqID string) (*http.Response, error) {
+	body, err := readResponseBody(httpResp.Body, h.maxResponseBytes)
+	httpResp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(body) <= h.responseCacheMax {
+		h.responseCache.Set(key, body)
+	} else {
+		reqLog(reqID).Debug("response too large to cache", "bytes", len(body))
+	}
+	httpResp.Body = io.NopCloser(bytes.NewReader(body))
+	return httpResp, nil
+}
+
+// memoryResponseCache 进程内 LRU 缓存
+type memoryResponseCache struct {
+	maxEntries int
+	ttl        time.Duration
+
+	mu      sync.Mutex
+	order   *list.List // 队首为最近使用
+	entries map[string]*list.Element
+}
+
+type memoryCacheEntry struct {
+	key       string
+	body      []byte
+	expiresAt time.Time
+}
+
+func newMemoryResponseCache(maxEntries int, ttl time.Duration) *memoryResponseCache {
+	return &memoryResponseCache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+func (m *memoryResponseCache) Get(key string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*memoryCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		m.order.Remove(el)
+		delete(m.entries, key)
+		return nil, false
+	}
+	m.order.MoveToFront(el)
+	return entry.body, true
+}
+
+func (m *memoryResponseCache) Set(key string, body []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := &memoryCacheEntry{key: key, body: body, expiresAt: time.Now().Add(m.ttl)}
+	if el, ok := m.entries[key]; ok {
+		el.Value = entry
+		m.order.MoveToFront(el)
+		return
+	}
+	m.entries[key] = m.order.PushFront(entry)
+	for m.order.Len() > m.maxEntries {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.entries, oldest.Value.(*memoryCacheEntry).key)
+	}
+}
+
+// redisResponseCache 基于 Redis 的缓存，多实例部署时共享
+// 只用到 GET/SET，直接实现 RESP 协议，避免引入客户端依赖
+// Redis 不可用时按未命中处理，不影响请求
+type redisResponseCache struct {
+	addr     string
+	password string
+	db       int
+	ttl      time.Duration
+
+	slots chan struct{}   // 限制同时打开的连接数，容量为 redisPoolSize
+	idle  chan *redisConn // 空闲连接
+
+	mu        sync.Mutex
+	downUntil time.Time // 连接失败后暂停重连，避免每个请求都等待连接超时
+}
+
+// redisConn 连接池中的一个连接，同一时间只被一个命令使用
+type redisConn struct {
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// redisKeyPrefix 缓存键前缀，与同一 Redis 中的其他数据区分
+const redisKeyPrefix = "openai-claude-proxy:response:"
+
+// redisTimeout 单次 Redis 操作的超时，缓存不能拖慢请求
+const redisTimeout = time.Second
+
+// redisReconnectDelay 连接失败后多久再尝试重连
+const redisReconnectDelay = 10 * time.Second
+
+// redisPoolSize 最多同时打开的连接数，一个连接上的慢命令或重连不会阻塞其他缓存操作
+const redisPoolSize = 8
+
+var (
+	errRedisDown = errors.New("redis: unavailable, waiting to reconnect")
+	errRedisBusy = errors.New("redis: all connections busy")
+)
+
+func newRedisResponseCache(rawURL string, ttl time.Duration) (*redisResponseCache, error) {
+	if rawURL == "" {
+		return nil, errors.New("RESPONSE_CACHE=redis requires REDIS_URL")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("invalid REDIS_URL %q, expected redis://[:password@]host:port[/db]", rawURL)
+	}
+	r := &redisResponseCache{
+		addr:  u.Host,
+		ttl:   ttl,
+		slots: make(chan struct{}, redisPoolSize),
+		idle:  make(chan *redisConn, redisPoolSize),
+	}
+	if !strings.Contains(u.Host, ":") {
+		r.addr = u.Host + ":6379"
+	}
+	if u.User != nil {
+		r.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if r.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid REDIS_URL database %q", db)
+		}
+	}
+	return r, nil
+}
+
+func (r *redisResponseCache) Get(key string) ([]byte, bool) {
+	reply, err := r.do("GET", redisKeyPrefix+key)
+	if errors.Is(err, errRedisDown) || errors.Is(err, errRedisBusy) {
+		return nil, false
+	}
+	if err != nil {
+		slog.Warn("redis GET failed", "error", err)
+		return nil, false
+	}
+	body, ok := reply.([]byte)
+	return body, ok
+}
+
+func (r *redisResponseCache) Set(key string, body []byte) {
+	ttl := strconv.FormatInt(r.ttl.Milliseconds(), 10)
+	if _, err := r.do("SET", redisKeyPrefix+key, string(body), "PX", ttl); err != nil && !errors.Is(err, errRedisDown) && !errors.Is(err, errRedisBusy) {
+		slog.Warn("redis SET failed", "error", err)
+	}
+}
+
+// do 从连接池取一个连接发送命令并读取回复，每个命令都有 redisTimeout 的期限
+// 所有连接都在使用时最多等待 redisTimeout，出错时关闭该连接，下次调用重新连接
+func (r *redisResponseCache) do(args ...string) (interface{}, error) {
+	select {
+	case r.slots <- struct{}{}:
+	default:
+		timer := time.NewTimer(redisTimeout)
+		defer timer.Stop()
+		select {
+		case r.slots <- struct{}{}:
+		case <-timer.C:
+			return nil, errRedisBusy
+		}
+	}
+	defer func() { <-r.slots }()
+
+	var rc *redisConn
+	select {
+	case rc = <-r.idle:
+	default:
+		r.mu.Lock()
+		down := time.Now().Before(r.downUntil)
+		r.mu.Unlock()
+		if down {
+			return nil, errRedisDown
+		}
+		var err error
+		if rc, err = r.connect(); err != nil {
+			r.mu.Lock()
+			r.downUntil = time.Now().Add(redisReconnectDelay)
+			r.mu.Unlock()
+			return nil, err
+		}
+	}
+	rc.conn.SetDeadline(time.Now().Add(redisTimeout))
+	reply, err := rc.command(args...)
+	if err != nil {
+		var redisErr redisError
+		if !errors.As(err, &redisErr) {
+			rc.conn.Close()
+			return nil, err
+		}
+	}
+	// 打开的连接数不超过 slots 的容量，放回时不会阻塞
+	r.idle <- rc
+	return reply, err
+}
+
+func (r *redisResponseCache) connect() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", r.addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{conn: conn, rd: bufio.NewReader(conn)}
+	conn.SetDeadline(time.Now().Add(redisTimeout))
+
+	if r.password != "" {
+		if _, err := rc.command("AUTH", r.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if r.db != 0 {
+		if _, err := rc.command("SELECT", strconv.Itoa(r.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// command 以 RESP 数组发送命令，返回 string（简单字符串）、int64、[]byte（bulk string，nil 表示不存在）
+func (rc *redisConn) command(args ...string) (interface{}, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := rc.conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	line, err := rc.rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.rd, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// redisError Redis 返回的错误回复，连接本身仍然可用
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+)
+
+// jsonResponseToolName json_schema 模式下用于强制结构化输出的合成工具名
+const jsonResponseToolName = "json_response"
+
+// ResponseFormat OpenAI response_format 参数
+type ResponseFormat struct {
+	Type       string `json:"type"` // text / json_object / json_schema
+	JSONSchema *struct {
+		Name        string                 `json:"name"`
+		Description string                 `json:"description,omitempty"`
+		Schema      map[string]interface{} `json:"schema"`
+		Strict      bool                   `json:"strict,omitempty"`
+	} `json:"json_schema,omitempty"`
+}
+
+const jsonObjectDirective = "Respond only with a single valid JSON object. Do not wrap it in markdown code fences and do not add any text before or after the JSON."
+
+// usesJSONResponseTool 判断请求是否通过合成工具实现 json_schema
+// 客户端自带 tools 时不能强制工具调用，退化为 system 指令
+func usesJSONResponseTool(req OpenAIRequest) bool {
+	return req.ResponseFormat != nil &&
+		req.ResponseFormat.Type == "json_schema" &&
+		req.ResponseFormat.JSONSchema != nil &&
+		req.ResponseFormat.JSONSchema.Schema != nil &&
+		len(req.Tools) == 0
+}
+
+// applyResponseFormat 根据 response_format 修改 Anthropic 请求
+// json_object：追加 system 指令；json_schema：强制调用合成工具，schema 作为 input_schema
+func applyResponseFormat(req OpenAIRequest, anthReq *AnthropicRequest, systemMessages []AnthropicSystemBlock) []AnthropicSystemBlock {
+	format := req.ResponseFormat
+	if format == nil || format.Type == "" || format.Type == "text" {
+		return systemMessages
+	}
+
+	if usesJSONResponseTool(req) {
+		description := format.JSONSchema.Description
+		if description == "" {
+			description = "Return the final answer as structured JSON matching the schema."
+		}
+		anthReq.Tools = append(anthReq.Tools, AnthropicTool{
+			Name:        jsonResponseToolName,
+			Description: description,
+			InputSchema: format.JSONSchema.Schema,
+		})
+		anthReq.ToolChoice = map[string]string{"type": "tool", "name": jsonResponseToolName}
+		slog.Debug("response_format json_schema: forcing tool", "tool", jsonResponseToolName)
+		return systemMessages
+	}
+
+	directive := jsonObjectDirective
+	if format.Type == "json_schema" && format.JSONSchema != nil && format.JSONSchema.Schema != nil {
+		schemaBytes, _ := json.Marshal(format.JSONSchema.Schema)
+		directive = fmt.Sprintf("%s The JSON must conform to this JSON Schema: %s", jsonObjectDirective, schemaBytes)
+	} else if format.Type != "json_object" {
+		slog.Warn("unsupported response_format type ignored", "type", format.Type)
+		return systemMessages
+	}
+
+	slog.Debug("response_format: added JSON system directive", "type", format.Type)
+	return append(systemMessages, AnthropicSystemBlock{
+		Type: "text",
+		Text: directive,
+	})
+}
+
+// unwrapJSONResponseTool 将合成工具的调用结果还原为纯文本 JSON
+func unwrapJSONResponseTool(anthResp *AnthropicResponse) {
+	for i, content := range anthResp.Content {
+		if content.Type != "tool_use" || content.Name != jsonResponseToolName {
+			continue
+		}
+		inputBytes, _ := json.Marshal(content.Input)
+		anthResp.Content[i] = AnthropicContent{
+			Type: "text",
+			Text: stringPtr(string(inputBytes)),
+		}
+		if anthResp.StopReason == "tool_use" {
+			anthResp.StopReason = "end_turn"
+		}
+	}
+}
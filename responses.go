@@ -0,0 +1,738 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ResponsesRequest OpenAI Responses API 请求（/v1/responses）
+type ResponsesRequest struct {
+	Model              string          `json:"model"`
+	Input              interface{}     `json:"input"` // string or []item
+	Instructions       string          `json:"instructions,omitempty"`
+	MaxOutputTokens    int             `json:"max_output_tokens,omitempty"`
+	Temperature        *float64        `json:"temperature,omitempty"`
+	TopP               float64         `json:"top_p,omitempty"`
+	Stream             bool            `json:"stream,omitempty"`
+	Tools              []ResponsesTool `json:"tools,omitempty"`
+	ToolChoice         interface{}     `json:"tool_choice,omitempty"`
+	ParallelToolCalls  *bool           `json:"parallel_tool_calls,omitempty"`
+	User               string          `json:"user,omitempty"`
+	PreviousResponseID string          `json:"previous_response_id,omitempty"`
+}
+
+// ResponsesTool Responses API 的工具定义（function 字段是扁平的）
+type ResponsesTool struct {
+	Type        string      `json:"type"`
+	Name        string      `json:"name,omitempty"`
+	Description string      `json:"description,omitempty"`
+	Parameters  interface{} `json:"parameters,omitempty"`
+}
+
+// HandleResponses 将 Responses API 请求转换为 Anthropic 请求
+func (h *ProxyHandler) HandleResponses(c *gin.Context) {
+	reqID := requestID(c)
+	logger := reqLog(reqID)
+
+	apiKey, ok := h.extractAPIKey(c, reqID)
+	if !ok {
+		return
+	}
+
+	_, parseSpan := startSpan(c.Request.Context(), "parse request", spanKindInternal)
+	rawBody, ok := readRequestBody(c, reqID)
+	if !ok {
+		parseSpan.SetError("invalid request body")
+		parseSpan.End()
+		return
+	}
+	parseSpan.SetAttr("body_bytes", len(rawBody))
+
+	logger.Debug("raw responses request", "body", string(rawBody))
+
+	var respReq ResponsesRequest
+	if err := json.Unmarshal(rawBody, &respReq); err != nil {
+		parseSpan.SetError(err.Error())
+		parseSpan.End()
+		logger.Error("failed to parse request", "error", err)
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	parseSpan.End()
+
+	// 代理不保存会话状态，无法根据 previous_response_id 还原历史
+	if respReq.PreviousResponseID != "" {
+		logger.Warn("previous_response_id is not supported")
+		respondError(c, http.StatusBadRequest, "previous_response_id is not supported, send the full input instead")
+		return
+	}
+
+	openaiReq, err := ConvertResponsesToOpenAI(respReq)
+	if err != nil {
+		logger.Warn("invalid input", "error", err)
+		respondError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.Set(streamKey, openaiReq.Stream)
+	logger.Info("responses request",
+		"model", openaiReq.Model,
+		"stream", openaiReq.Stream,
+		"messages", len(openaiReq.Messages),
+		"tools", len(openaiReq.Tools))
+
+	// temperature/top_p 转换到 Anthropic 支持的范围
+	if !applySampling(c, &openaiReq, h.temperatureMode, reqID) {
+		return
+	}
+
+	settings := h.settings()
+	profile := h.modelProfile(openaiReq.Model)
+	openaiReq.Model = h.mapRequestModel(c, settings, openaiReq.Model, reqID)
+
+	if !h.checkRateLimit(c, apiKey, openaiReq.Model, reqID) {
+		return
+	}
+	release, ok := h.acquireConcurrency(c, apiKey, reqID)
+	if !ok {
+		return
+	}
+	defer release()
+
+	_, convertSpan := startSpan(c.Request.Context(), "convert request", spanKindInternal)
+	anthropicReq, err := ConvertOpenAIToAnthropic(openaiReq, settings.MaxTokensMapping, apiKey)
+	if err != nil {
+		convertSpan.SetError(err.Error())
+		convertSpan.End()
+		logger.Error("conversion failed", "error", err)
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	applyThinking(anthropicReq, h.thinkingBudgets, reqID)
+	applyModelProfile(anthropicReq, profile, reqID)
+	h.clampMaxTokens(c, anthropicReq, reqID)
+	h.fitContext(c, anthropicReq, apiKey, openaiReq.User, reqID)
+	h.applyPromptTemplate(anthropicReq, settings.Cache, reqID)
+	h.applySessionCache(c, anthropicReq, settings.Cache, apiKey, openaiReq.User, reqID)
+	h.applyServerTools(anthropicReq, reqID)
+	convertSpan.SetAttr("gen_ai.request.model", anthropicReq.Model)
+	convertSpan.End()
+
+	httpResp, ok := h.sendAnthropicRequest(c, anthropicReq, apiKey, reqID)
+	if !ok {
+		return
+	}
+	defer httpResp.Body.Close()
+
+	if openaiReq.Stream {
+		h.handleResponsesStream(c, httpResp, openaiReq.Model, reqID)
+	} else {
+		h.handleResponsesResponse(c, httpResp, reqID)
+	}
+}
+
+// ConvertResponsesToOpenAI 将 Responses API 的 input/instructions/tools 转换为 Chat Completions 请求
+func ConvertResponsesToOpenAI(req ResponsesRequest) (OpenAIRequest, error) {
+	openaiReq := OpenAIRequest{
+		Model:             req.Model,
+		MaxTokens:         req.MaxOutputTokens,
+		Temperature:       req.Temperature,
+		TopP:              req.TopP,
+		Stream:            req.Stream,
+		ToolChoice:        convertResponsesToolChoice(req.ToolChoice),
+		ParallelToolCalls: req.ParallelToolCalls,
+		User:              req.User,
+	}
+
+	if req.Instructions != "" {
+		openaiReq.Messages = append(openaiReq.Messages, OpenAIMessage{
+			Role:    "system",
+			Content: req.Instructions,
+		})
+	}
+
+	switch input := req.Input.(type) {
+	case string:
+		openaiReq.Messages = append(openaiReq.Messages, OpenAIMessage{Role: "user", Content: input})
+	case []interface{}:
+		for _, raw := range input {
+			item, ok := raw.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			openaiReq.Messages = appendResponsesInputItem(openaiReq.Messages, item)
+		}
+	default:
+		return openaiReq, fmt.Errorf("input must be a string or an array of input items")
+	}
+
+	for _, tool := range req.Tools {
+		if tool.Type != "function" {
+			slog.Warn("skipping unsupported Responses tool type", "type", tool.Type)
+			continue
+		}
+		var openaiTool OpenAITool
+		openaiTool.Type = "function"
+		openaiTool.Function.Name = tool.Name
+		openaiTool.Function.Description = tool.Description
+		openaiTool.Function.Parameters = tool.Parameters
+		openaiReq.Tools = append(openaiReq.Tools, openaiTool)
+	}
+
+	return openaiReq, nil
+}
+
+// appendResponsesInputItem 将单个 input item 转换为 Chat 消息
+func appendResponsesInputItem(messages []OpenAIMessage, item map[string]interface{}) []OpenAIMessage {
+	itemType, _ := item["type"].(string)
+
+	switch itemType {
+	case "", "message":
+		role, _ := item["role"].(string)
+		return append(messages, OpenAIMessage{
+			Role:    role,
+			Content: convertResponsesContent(item["content"]),
+		})
+
+	case "function_call":
+		callID, _ := item["call_id"].(string)
+		name, _ := item["name"].(string)
+		arguments, _ := item["arguments"].(string)
+
+		var toolCall ToolCall
+		toolCall.ID = callID
+		toolCall.Type = "function"
+		toolCall.Function.Name = name
+		toolCall.Function.Arguments = arguments
+
+		// 连续的 function_call 合并到同一条 assistant 消息
+		if len(messages) > 0 && messages[len(messages)-1].Role == "assistant" {
+			last := &messages[len(messages)-1]
+			last.ToolCalls = append(last.ToolCalls, toolCall)
+			return messages
+		}
+		return append(messages, OpenAIMessage{
+			Role:      "assistant",
+			ToolCalls: []ToolCall{toolCall},
+		})
+
+	case "function_call_output":
+		callID, _ := item["call_id"].(string)
+		return append(messages, OpenAIMessage{
+			Role:       "tool",
+			ToolCallID: callID,
+			Content:    convertResponsesContent(item["output"]),
+		})
+
+	default:
+		slog.Warn("skipping unsupported Responses input item type", "type", itemType)
+		return messages
+	}
+}
+
+// convertResponsesContent 将 input_text/output_text/input_image 转换为 Chat 的 content 数组
+func convertResponsesContent(content interface{}) interface{} {
+	parts, ok := content.([]interface{})
+	if !ok {
+		return content
+	}
+
+	converted := make([]interface{}, 0, len(parts))
+	for _, raw := range parts {
+		part, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		switch part["type"] {
+		case "input_text", "output_text", "text":
+			converted = append(converted, map[string]interface{}{
+				"type": "text",
+				"text": part["text"],
+			})
+		case "input_image":
+			if url, ok := part["image_url"].(string); ok {
+				converted = append(converted, map[string]interface{}{
+					"type":      "image_url",
+					"image_url": map[string]interface{}{"url": url},
+				})
+			}
+		case "input_file":
+			// Responses 的文件字段直接放在 part 上，Chat 格式放在 file 对象中
+			file := map[string]interface{}{}
+			for _, key := range []string{"file_data", "file_url", "file_id", "filename"} {
+				if v, ok := part[key]; ok {
+					file[key] = v
+				}
+			}
+			converted = append(converted, map[string]interface{}{
+				"type": "file",
+				"file": file,
+			})
+		default:
+			slog.Warn("skipping unsupported Responses content type", "type", part["type"])
+		}
+	}
+	return converted
+}
+
+// convertResponsesToolChoice Responses 的 {"type":"function","name":...} 转为 Chat 格式
+func convertResponsesToolChoice(choice interface{}) interface{} {
+	if v, ok := choice.(map[string]interface{}); ok && v["type"] == "function" {
+		if name, ok := v["name"].(string); ok {
+			return map[string]interface{}{
+				"type":     "function",
+				"function": map[string]interface{}{"name": name},
+			}
+		}
+	}
+	return choice
+}
+
+func (h *ProxyHandler) handleResponsesResponse(c *gin.Context, httpResp *http.Response, reqID string) {
+	bodyBytes, err := readResponseBody(httpResp.Body, h.maxResponseBytes)
+	if err != nil {
+		reqLog(reqID).Error("read response body failed", "error", err)
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	var anthropicResp AnthropicResponse
+	if err := json.Unmarshal(bodyBytes, &anthropicResp); err != nil {
+		reqLog(reqID).Error("parse anthropic response failed", "error", err)
+		respondError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	h.recordUsage(c, reqID, anthropicResp.Model, &anthropicResp.Usage)
+	metrics.ObserveToolCalls(anthropicResp.Model, countToolUses(anthropicResp.Content))
+	if !h.transformResponse(c, &anthropicResp, reqID) {
+		return
+	}
+	anthropicResp.Model = responseModel(c, anthropicResp.Model)
+
+	c.JSON(http.StatusOK, ConvertAnthropicToResponses(anthropicResp))
+}
+
+// ConvertAnthropicToResponses 将 Anthropic 响应转换为 Responses API 的 response 对象
+func ConvertAnthropicToResponses(anthResp AnthropicResponse) map[string]interface{} {
+	output := make([]interface{}, 0, len(anthResp.Content))
+	var footnotes citationFootnotes
+	for i, content := range anthResp.Content {
+		switch content.Type {
+		case "text":
+			if content.Text == nil {
+				continue
+			}
+			text := *content.Text
+			var annotations []map[string]interface{}
+			if len(content.Citations) > 0 {
+				// 引用以脚注标记附在文本后，位置相对于该 item 的文本
+				var marker string
+				marker, annotations = footnotes.cite(content.Citations, 0, runeLen(text))
+				text += marker
+			}
+			output = append(output, responsesAnnotatedMessageItem(fmt.Sprintf("%s_%d", anthResp.ID, i), text, "completed", annotations))
+		case "tool_use":
+			argsBytes, _ := json.Marshal(content.Input)
+			output = append(output, responsesFunctionCallItem(content.ID, content.Name, string(argsBytes), "completed"))
+		case "server_tool_use":
+			// 服务端工具由 Anthropic 执行，调用和结果以文本形式展示
+			var input map[string]interface{}
+			if content.Input != nil {
+				input = *content.Input
+			}
+			output = append(output, responsesMessageItem(fmt.Sprintf("%s_%d", anthResp.ID, i), renderServerToolUse(content.Name, input), "completed"))
+		default:
+			if text := renderServerToolResult(content); isServerToolResult(content.Type) && text != "" {
+				output = append(output, responsesMessageItem(fmt.Sprintf("%s_%d", anthResp.ID, i), text, "completed"))
+			}
+		}
+	}
+
+	return responsesObject(anthResp.ID, anthResp.Model, anthResp.StopReason, getCurrentTimestamp(), output, &anthResp.Usage)
+}
+
+func responsesMessageItem(id, text, status string) map[string]interface{} {
+	return responsesAnnotatedMessageItem(id, text, status, nil)
+}
+
+// responsesAnnotatedMessageItem 带引用来源的文本 message item
+func responsesAnnotatedMessageItem(id, text, status string, annotations []map[string]interface{}) map[string]interface{} {
+	content := []interface{}{}
+	if status == "completed" {
+		content = append(content, responsesTextPart(text, annotations))
+	}
+	return map[string]interface{}{
+		"type":    "message",
+		"id":      id,
+		"status":  status,
+		"role":    "assistant",
+		"content": content,
+	}
+}
+
+func responsesTextPart(text string, annotations []map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"type":        "output_text",
+		"text":        text,
+		"annotations": responsesAnnotations(annotations),
+		"logprobs":    []interface{}{},
+	}
+}
+
+func responsesFunctionCallItem(callID, name, arguments, status string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":      "function_call",
+		"id":        "fc_" + callID,
+		"call_id":   callID,
+		"name":      name,
+		"arguments": arguments,
+		"status":    status,
+	}
+}
+
+// responsesObject 构造 response 对象；stopReason 为空表示仍在生成中
+func responsesObject(messageID, model, stopReason string, createdAt int64, output []interface{}, usage *AnthropicUsage) map[string]interface{} {
+	resp := map[string]interface{}{
+		"id":                 "resp_" + strings.TrimPrefix(messageID, "msg_"),
+		"object":             "response",
+		"created_at":         createdAt,
+		"model":              model,
+		"output":             output,
+		"status":             "completed",
+		"incomplete_details": nil,
+		"error":              nil,
+	}
+
+	switch stopReason {
+	case "":
+		resp["status"] = "in_progress"
+	case "max_tokens":
+		resp["status"] = "incomplete"
+		resp["incomplete_details"] = map[string]interface{}{"reason": "max_output_tokens"}
+	}
+
+	if usage != nil {
+		resp["usage"] = map[string]interface{}{
+			"input_tokens":  usage.InputTokens,
+			"output_tokens": usage.OutputTokens,
+			"total_tokens":  usage.InputTokens + usage.OutputTokens,
+			"input_tokens_details": map[string]interface{}{
+				"cached_tokens": usage.CacheReadInputTokens,
+			},
+			"output_tokens_details": map[string]interface{}{
+				"reasoning_tokens": 0,
+			},
+		}
+	}
+
+	return resp
+}
+
+// responsesStreamBlock 记录流式输出中一个 Anthropic content block 对应的 output item
+type responsesStreamBlock struct {
+	blockType   string
+	outputIndex int
+	itemID      string
+	callID      string
+	name        string
+	buf         strings.Builder
+	citations   []map[string]interface{}
+}
+
+func (h *ProxyHandler) handleResponsesStream(c *gin.Context, httpResp *http.Response, model string, reqID string) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		reqLog(reqID).Error("streaming not supported by client")
+		respondError(c, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	var (
+		messageID  string
+		stopReason string
+		usage      = &AnthropicUsage{}
+		output     []interface{}
+		blocks     = make(map[int]*responsesStreamBlock)
+		sequence   int
+		createdAt  = getCurrentTimestamp()
+		start      = time.Now()
+		toolCalls  int
+		footnotes  citationFootnotes
+	)
+
+	emit := func(eventType string, payload map[string]interface{}) {
+		payload["type"] = eventType
+		payload["sequence_number"] = sequence
+		sequence++
+		jsonData, _ := json.Marshal(payload)
+		fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", eventType, jsonData)
+		flusher.Flush()
+	}
+
+	// emitTextItem 一次性输出一个完整的文本 message item（服务端工具的调用和结果）
+	emitTextItem := func(itemID, text string) {
+		outputIndex := len(output)
+		item := responsesMessageItem(itemID, text, "completed")
+		output = append(output, item)
+		emit("response.output_item.added", map[string]interface{}{
+			"output_index": outputIndex,
+			"item":         responsesMessageItem(itemID, "", "in_progress"),
+		})
+		emit("response.content_part.added", map[string]interface{}{
+			"item_id":       itemID,
+			"output_index":  outputIndex,
+			"content_index": 0,
+			"part":          responsesTextPart("", nil),
+		})
+		emit("response.output_text.delta", map[string]interface{}{
+			"item_id":       itemID,
+			"output_index":  outputIndex,
+			"content_index": 0,
+			"delta":         text,
+		})
+		emit("response.output_text.done", map[string]interface{}{
+			"item_id":       itemID,
+			"output_index":  outputIndex,
+			"content_index": 0,
+			"text":          text,
+		})
+		emit("response.content_part.done", map[string]interface{}{
+			"item_id":       itemID,
+			"output_index":  outputIndex,
+			"content_index": 0,
+			"part":          responsesTextPart(text, nil),
+		})
+		emit("response.output_item.done", map[string]interface{}{
+			"output_index": outputIndex,
+			"item":         item,
+		})
+	}
+
+	_, relaySpan := startSpan(c.Request.Context(), "stream relay", spanKindInternal)
+	defer relaySpan.End()
+
+	tc := h.streamTransformContext(c, reqID)
+	defer closeOnDisconnect(c, httpResp.Body)()
+	scanner := newHeartbeatScanner(httpResp.Body, h.heartbeatInterval, h.streamIdleTimeout, ssePing(c, flusher))
+	defer scanner.Stop()
+	for scanner.Scan() {
+		data := scanner.Event().Data
+		if data == "[DONE]" || data == "" {
+			continue
+		}
+
+		var event map[string]interface{}
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			reqLog(reqID).Warn("failed to parse event", "error", err, "data", data)
+			continue
+		}
+		for _, event := range h.transformEvent(tc, event) {
+			index := 0
+			if v, ok := event["index"].(float64); ok {
+				index = int(v)
+			}
+
+			switch event["type"] {
+			case "message_start":
+				if msg, ok := event["message"].(map[string]interface{}); ok {
+					messageID, _ = msg["id"].(string)
+					if u, ok := msg["usage"].(map[string]interface{}); ok {
+						usage = parseUsage(u)
+					}
+				}
+				emit("response.created", map[string]interface{}{
+					"response": responsesObject(messageID, responseModel(c, model), "", createdAt, []interface{}{}, nil),
+				})
+
+			case "content_block_start":
+				block, ok := event["content_block"].(map[string]interface{})
+				if !ok {
+					continue
+				}
+				sb := &responsesStreamBlock{outputIndex: len(output)}
+				sb.blockType, _ = block["type"].(string)
+
+				if sb.blockType == "server_tool_use" {
+					// 参数累积完整后在 content_block_stop 时输出
+					sb.name, _ = block["name"].(string)
+					sb.itemID = fmt.Sprintf("%s_%d", messageID, index)
+					blocks[index] = sb
+					continue
+				}
+				if isServerToolResult(sb.blockType) {
+					if text := renderServerToolResult(decodeContentBlock(block)); text != "" {
+						emitTextItem(fmt.Sprintf("%s_%d", messageID, index), text)
+					}
+					continue
+				}
+
+				switch sb.blockType {
+				case "text":
+					sb.itemID = fmt.Sprintf("%s_%d", messageID, index)
+					emit("response.output_item.added", map[string]interface{}{
+						"output_index": sb.outputIndex,
+						"item":         responsesMessageItem(sb.itemID, "", "in_progress"),
+					})
+					emit("response.content_part.added", map[string]interface{}{
+						"item_id":       sb.itemID,
+						"output_index":  sb.outputIndex,
+						"content_index": 0,
+						"part":          responsesTextPart("", nil),
+					})
+				case "tool_use":
+					toolCalls++
+					sb.callID, _ = block["id"].(string)
+					sb.name, _ = block["name"].(string)
+					sb.itemID = "fc_" + sb.callID
+					emit("response.output_item.added", map[string]interface{}{
+						"output_index": sb.outputIndex,
+						"item":         responsesFunctionCallItem(sb.callID, sb.name, "", "in_progress"),
+					})
+				default:
+					continue
+				}
+				blocks[index] = sb
+				// 占位，content_block_stop 时替换为完整 item
+				output = append(output, nil)
+
+			case "content_block_delta":
+				sb, ok := blocks[index]
+				if !ok {
+					continue
+				}
+				delta, ok := event["delta"].(map[string]interface{})
+				if !ok {
+					continue
+				}
+				if partialJSON, ok := delta["partial_json"].(string); ok && sb.blockType == "server_tool_use" {
+					sb.buf.WriteString(partialJSON)
+				} else if citation, ok := delta["citation"].(map[string]interface{}); ok && delta["type"] == "citations_delta" {
+					sb.citations = append(sb.citations, citation)
+				} else if text, ok := delta["text"].(string); ok && delta["type"] == "text_delta" {
+					sb.buf.WriteString(text)
+					emit("response.output_text.delta", map[string]interface{}{
+						"item_id":       sb.itemID,
+						"output_index":  sb.outputIndex,
+						"content_index": 0,
+						"delta":         text,
+					})
+				} else if partialJSON, ok := delta["partial_json"].(string); ok && delta["type"] == "input_json_delta" {
+					sb.buf.WriteString(partialJSON)
+					emit("response.function_call_arguments.delta", map[string]interface{}{
+						"item_id":      sb.itemID,
+						"output_index": sb.outputIndex,
+						"delta":        partialJSON,
+					})
+				}
+
+			case "content_block_stop":
+				sb, ok := blocks[index]
+				if !ok {
+					continue
+				}
+				delete(blocks, index)
+
+				if sb.blockType == "server_tool_use" {
+					emitTextItem(sb.itemID, renderServerToolUse(sb.name, serverToolInput(sb.buf.String())))
+					continue
+				}
+
+				var item map[string]interface{}
+				if sb.blockType == "text" {
+					text := sb.buf.String()
+					var annotations []map[string]interface{}
+					if len(sb.citations) > 0 {
+						// 引用以脚注标记附在文本后
+						var marker string
+						marker, annotations = footnotes.cite(sb.citations, 0, runeLen(text))
+						text += marker
+						emit("response.output_text.delta", map[string]interface{}{
+							"item_id":       sb.itemID,
+							"output_index":  sb.outputIndex,
+							"content_index": 0,
+							"delta":         marker,
+						})
+						for i, annotation := range responsesAnnotations(annotations) {
+							emit("response.output_text.annotation.added", map[string]interface{}{
+								"item_id":          sb.itemID,
+								"output_index":     sb.outputIndex,
+								"content_index":    0,
+								"annotation_index": i,
+								"annotation":       annotation,
+							})
+						}
+					}
+					emit("response.output_text.done", map[string]interface{}{
+						"item_id":       sb.itemID,
+						"output_index":  sb.outputIndex,
+						"content_index": 0,
+						"text":          text,
+					})
+					emit("response.content_part.done", map[string]interface{}{
+						"item_id":       sb.itemID,
+						"output_index":  sb.outputIndex,
+						"content_index": 0,
+						"part":          responsesTextPart(text, annotations),
+					})
+					item = responsesAnnotatedMessageItem(sb.itemID, text, "completed", annotations)
+				} else {
+					arguments := sb.buf.String()
+					if arguments == "" {
+						arguments = "{}"
+					}
+					emit("response.function_call_arguments.done", map[string]interface{}{
+						"item_id":      sb.itemID,
+						"output_index": sb.outputIndex,
+						"arguments":    arguments,
+					})
+					item = responsesFunctionCallItem(sb.callID, sb.name, arguments, "completed")
+				}
+				output[sb.outputIndex] = item
+				emit("response.output_item.done", map[string]interface{}{
+					"output_index": sb.outputIndex,
+					"item":         item,
+				})
+
+			case "message_delta":
+				if delta, ok := event["delta"].(map[string]interface{}); ok {
+					if reason, ok := delta["stop_reason"].(string); ok {
+						stopReason = reason
+					}
+				}
+				if u, ok := event["usage"].(map[string]interface{}); ok {
+					mergeDeltaUsage(usage, parseUsage(u))
+				}
+			}
+		}
+	}
+
+	logStreamEnd(c, reqID, scanner.Err())
+	if err := scanner.Err(); err != nil {
+		relaySpan.SetError(err.Error())
+	}
+
+	if stopReason == "" {
+		stopReason = "end_turn"
+	}
+	h.recordUsage(c, reqID, model, usage)
+	metrics.ObserveStream(model, usage.OutputTokens, time.Since(start))
+	metrics.ObserveToolCalls(model, toolCalls)
+
+	eventType := "response.completed"
+	if stopReason == "max_tokens" {
+		eventType = "response.incomplete"
+	}
+	emit(eventType, map[string]interface{}{
+		"response": responsesObject(messageID, responseModel(c, model), stopReason, createdAt, output, usage),
+	})
+}
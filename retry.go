@@ -0,0 +1,137 @@
+package main
+
+import (
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryConfig 上游请求重试策略
+// 只在拿到响应体之前重试（连接失败或 429/529/5xx 状态码），流开始后不会重试
+type RetryConfig struct {
+	MaxAttempts int // 总尝试次数，1 表示不重试
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// loadRetryConfig 从环境变量读取重试配置
+func loadRetryConfig() RetryConfig {
+	return RetryConfig{
+		MaxAttempts: getEnvInt("RETRY_MAX_ATTEMPTS", 3),
+		BaseDelay:   getEnvMillis("RETRY_BASE_DELAY_MS", 500*time.Millisecond),
+		MaxDelay:    getEnvMillis("RETRY_MAX_DELAY_MS", 10*time.Second),
+	}
+}
+
+func isRetryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code == 529 || code >= 500
+}
+
+// backoff 计算第 attempt 次重试前的等待时间（指数退避 + 抖动）
+// 上游返回 retry-after 时优先使用，但不超过 MaxDelay
+func (r RetryConfig) backoff(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if d, ok := parseRetryAfter(resp.Header.Get("retry-after")); ok {
+			if d > r.MaxDelay {
+				d = r.MaxDelay
+			}
+			return d
+		}
+	}
+
+	delay := r.BaseDelay << uint(attempt-1)
+	if delay <= 0 || delay > r.MaxDelay {
+		delay = r.MaxDelay
+	}
+	// 在 [delay/2, delay] 之间随机，避免多个请求同时重试
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// parseRetryAfter 解析 retry-after（秒数或 HTTP 日期）
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// doWithRetry 发送上游请求，按重试策略处理可重试的失败
+// newRequest 每次调用都需要返回新的请求（请求体不可复用）
+// 重试耗尽后返回最后一次的响应或错误，由调用方处理
+func (h *ProxyHandler) doWithRetry(newRequest func() (*http.Request, error), model string, reqID string) (*http.Response, error) {
+	attempts := h.retry.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	for attempt := 1; ; attempt++ {
+		httpReq, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+
+		// 每次尝试一个 client span，traceparent 传播给上游
+		_, span := startSpan(httpReq.Context(), httpReq.Method+" "+httpReq.URL.Path, spanKindClient)
+		span.inject(httpReq.Header)
+
+		start := time.Now()
+		httpResp, err := h.client.Do(httpReq)
+		status := http.StatusBadGateway
+		if err == nil {
+			status = httpResp.StatusCode
+		}
+		metrics.ObserveUpstream(model, status, time.Since(start))
+
+		span.SetAttr("server.address", httpReq.URL.Host)
+		span.SetAttr("gen_ai.request.model", model)
+		span.SetAttr("http.request.resend_count", attempt-1)
+		if err != nil {
+			span.SetError(err.Error())
+		} else {
+			span.SetAttr("http.response.status_code", status)
+			if status >= 400 {
+				span.SetError(http.StatusText(status))
+			}
+		}
+		span.End()
+
+		retryable := err != nil || isRetryableStatus(status)
+		if !retryable || attempt >= attempts {
+			if attempt > 1 {
+				reqLog(reqID).Info("upstream finished after retries", "attempts", attempt, "status", status)
+			}
+			return httpResp, err
+		}
+
+		delay := h.retry.backoff(attempt, httpResp)
+		if err != nil {
+			reqLog(reqID).Warn("upstream attempt failed, retrying",
+				"attempt", attempt, "max_attempts", attempts, "error", err, "delay", delay)
+		} else {
+			body, _ := io.ReadAll(httpResp.Body)
+			httpResp.Body.Close()
+			reqLog(reqID).Warn("upstream attempt failed, retrying",
+				"attempt", attempt, "max_attempts", attempts, "status", status, "body", string(body), "delay", delay)
+		}
+		metrics.ObserveRetry(model, status)
+
+		// 客户端已断开则不再重试
+		select {
+		case <-time.After(delay):
+		case <-httpReq.Context().Done():
+			return nil, httpReq.Context().Err()
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ReverseConfig /anthropic/v1/messages 默认使用的 OpenAI 兼容上游
+type ReverseConfig struct {
+	BaseURL string
+	APIKey  string // 非空时替换请求中的 API Key
+}
+
+func loadReverseConfig() ReverseConfig {
+	baseURL := strings.TrimRight(os.Getenv("OPENAI_BASE_URL"), "/")
+	if baseURL == "" {
+		baseURL = openaiBackend{}.DefaultBaseURL()
+	}
+	return ReverseConfig{BaseURL: baseURL, APIKey: os.Getenv("OPENAI_API_KEY")}
+}
+
+// parseAnthropicRequest 解析 Anthropic 格式的请求体，system 可以是字符串或文本块数组
+func parseAnthropicRequest(body []byte) (*AnthropicRequest, error) {
+	var raw struct {
+		AnthropicRequest
+		System json.RawMessage `json:"system"`
+	}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, err
+	}
+	req := raw.AnthropicRequest
+	if len(raw.System) > 0 && string(raw.System) != "null" {
+		var text string
+		if json.Unmarshal(raw.System, &text) == nil {
+			if text != "" {
+				req.System = []AnthropicSystemBlock{{Type: "text", Text: text}}
+			}
+		} else if err := json.Unmarshal(raw.System, &req.System); err != nil {
+			return nil, fmt.Errorf("invalid system: %w", err)
+		}
+	}
+	if req.Model == "" {
+		return nil, errors.New("model is required")
+	}
+	if len(req.Messages) == 0 {
+		return nil, errors.New("messages is required")
+	}
+	return &req, nil
+}
+
+// respondAnthropicError 以 Anthropic 格式返回错误，Anthropic 客户端按 error.type 决定是否重试
+func respondAnthropicError(c *gin.Context, status int, message string) {
+	errorType, ok := bedrockErrorTypes[status]
+	if !ok {
+		errorType = "api_error"
+	}
+	c.JSON(status, gin.H{"type": "error", "error": gin.H{"type": errorType, "message": message}})
+}
+
+// anthropicAPIKey Anthropic 客户端使用 x-api-key，兼容 Authorization: Bearer
+func anthropicAPIKey(c *gin.Context) string {
+	if apiKey := c.GetHeader("x-api-key"); apiKey != "" {
+		return apiKey
+	}
+	return strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+}
+
+// HandleAnthropicMessages Anthropic 格式的 /anthropic/v1/messages，转换为 Chat Completions 发送给 OpenAI 兼容上游，
+// 便于 Claude Code 等 Anthropic 客户端使用 OpenAI / vLLM 等后端
+// 模型经过 MODEL_MAPPING；匹配 ROUTES 时使用路由的上游和后端，否则发送到 OPENAI_BASE_URL
+// 响应原样转发，不执行转换插件
+func (h *ProxyHandler) HandleAnthropicMessages(c *gin.Context) {
+	reqID := requestID(c)
+	logger := reqLog(reqID)
+
+	apiKey, ok := h.trustedNetworkAPIKey(c, reqID)
+	clientKey := apiKey
+	if !ok {
+		clientKey = anthropicAPIKey(c)
+		if clientKey == "" {
+			logger.Warn("missing x-api-key or Authorization header")
+			respondAnthropicError(c, http.StatusUnauthorized, "Missing x-api-key or Authorization header")
+			return
+		}
+		if apiKey, ok = h.resolveAPIKey(c, clientKey, reqID); !ok {
+			return
+		}
+	}
+
+	rawBody, ok := readRequestBody(c, reqID)
+	if !ok {
+		return
+	}
+	logger.Debug("raw anthropic request", "body", string(rawBody))
+
+	req, err := parseAnthropicRequest(rawBody)
+	if err != nil {
+		logger.Warn("invalid anthropic request", "error", err)
+		respondAnthropicError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	req.Model = h.mapModel(c, h.settings(), req.Model, reqID)
+	c.Set(metricsModelKey, req.Model)
+	c.Set(streamKey, req.Stream)
+
+	primary, routed := h.matchRoute(req.Model)
+	if !routed {
+		primary = upstreamTarget{BaseURL: h.reverse.BaseURL, APIKey: h.reverse.APIKey, Backend: openaiBackend{}}
+	}
+	logger.Info("anthropic messages request",
+		"model", req.Model,
+		"stream", req.Stream,
+		"max_tokens", req.MaxTokens,
+		"tools", len(req.Tools),
+		"messages", len(req.Messages),
+		"backend", primary.backend().Name())
+
+	if !h.checkRateLimit(c, clientKey, req.Model, reqID) {
+		return
+	}
+	if !h.checkAnthropicGuardrails(c, req, reqID) {
+		return
+	}
+	release, ok := h.acquireConcurrency(c, clientKey, reqID)
+	if !ok {
+		return
+	}
+	defer release()
+
+	httpResp, upErr := h.doBackendRequest(c.Request.Context(), req, primary, apiKey, reqID)
+	if upErr != nil {
+		// 上游的错误响应已由后端转换为 Anthropic 错误 JSON
+		if json.Valid([]byte(upErr.Message)) {
+			c.Data(upErr.StatusCode, "application/json", []byte(upErr.Message))
+		} else {
+			respondAnthropicError(c, upErr.StatusCode, upErr.Message)
+		}
+		return
+	}
+	defer httpResp.Body.Close()
+
+	if req.Stream {
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		h.passthroughStream(c, httpResp, req.Model, reqID)
+	} else {
+		c.Header("Content-Type", "application/json")
+		h.passthroughBody(c, httpResp, reqID)
+	}
+}
+
+// HandleAnthropicCountTokens /anthropic/v1/messages/count_tokens，OpenAI 兼容上游没有对应接口，返回估算值
+func (h *ProxyHandler) HandleAnthropicCountTokens(c *gin.Context) {
+	reqID := requestID(c)
+	rawBody, ok := readRequestBody(c, reqID)
+	if !ok {
+		return
+	}
+	req, err := parseAnthropicRequest(rawBody)
+	if err != nil {
+		respondAnthropicError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	tokens := estimateFixedTokens(req)
+	for _, msg := range req.Messages {
+		tokens += estimateMessageTokens(msg)
+	}
+	c.JSON(http.StatusOK, gin.H{"input_tokens": tokens})
+}
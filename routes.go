@@ -0,0 +1,116 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+)
+
+// Route 按模型名匹配的上游路由
+type Route struct {
+	Pattern string // glob 模式，如 claude-opus*
+	BaseURL string
+	APIKey  string  // 可选，覆盖请求中的 API Key
+	Backend Backend // 为 nil 表示 Anthropic
+}
+
+// parseRoutes 解析多上游路由配置，按书写顺序匹配，先匹配先生效
+// 格式: "pattern1=url1,pattern2=url2|apikey"，地址前可以加后端名称（如 gemini:https://...），只写后端名称时使用其默认地址
+// 示例: "claude-opus*=https://a.example.com,claude-haiku*=https://b.example.com|sk-ant-xxx,gemini-*=gemini|AIza..."
+func parseRoutes(routesStr string) []Route {
+	routes := make([]Route, 0)
+
+	if routesStr == "" {
+		return routes
+	}
+
+	for _, item := range strings.Split(routesStr, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		pattern := strings.TrimSpace(parts[0])
+		target := strings.TrimSpace(parts[1])
+
+		apiKey := ""
+		if idx := strings.LastIndex(target, "|"); idx >= 0 {
+			apiKey = strings.TrimSpace(target[idx+1:])
+			target = strings.TrimSpace(target[:idx])
+		}
+
+		var backend Backend
+		name, rest, _ := strings.Cut(target, ":")
+		if b, ok := backends[name]; ok {
+			backend, target = b, strings.TrimSpace(rest)
+			if target == "" {
+				target = b.DefaultBaseURL()
+			}
+		} else if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+			slog.Warn("invalid route target, expected a URL or backend name", "pattern", pattern, "target", target, "backends", backendNames())
+			continue
+		}
+
+		if pattern == "" || target == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			slog.Warn("invalid route pattern", "pattern", pattern, "error", err)
+			continue
+		}
+
+		switch {
+		case backend == nil || backend.Name() == "anthropic":
+		case backend.Name() == "bedrock":
+			// Bedrock 使用 AWS 凭证，不发送任何 API Key
+			if apiKey != "" {
+				slog.Warn("bedrock routes authenticate with AWS credentials, route key ignored", "pattern", pattern)
+			}
+			if os.Getenv("AWS_BEARER_TOKEN_BEDROCK") == "" && (os.Getenv("AWS_ACCESS_KEY_ID") == "" || os.Getenv("AWS_SECRET_ACCESS_KEY") == "") {
+				slog.Warn("bedrock route has no AWS credentials, set AWS_ACCESS_KEY_ID / AWS_SECRET_ACCESS_KEY or AWS_BEARER_TOKEN_BEDROCK", "pattern", pattern)
+			}
+		case apiKey == "":
+			slog.Warn("route to non-anthropic backend has no key, the client API key will be sent upstream", "pattern", pattern, "backend", backend.Name())
+		}
+
+		routes = append(routes, Route{
+			Pattern: pattern,
+			BaseURL: strings.TrimRight(target, "/"),
+			APIKey:  apiKey,
+			Backend: backend,
+		})
+	}
+
+	return routes
+}
+
+// resolveUpstream 根据模型名选择上游，未命中任何路由时使用 ANTHROPIC_BASE_URL
+// 返回的 APIKey 非空时应替换请求中的 API Key
+func (h *ProxyHandler) resolveUpstream(model string) upstreamTarget {
+	if target, ok := h.matchRoute(model); ok {
+		return target
+	}
+	return upstreamTarget{BaseURL: h.anthropicURL}
+}
+
+// matchRoute 返回模型匹配的第一条路由，未命中时返回 false
+func (h *ProxyHandler) matchRoute(model string) (upstreamTarget, bool) {
+	for _, route := range h.routes {
+		if ok, _ := path.Match(route.Pattern, model); ok {
+			return upstreamTarget{BaseURL: route.BaseURL, APIKey: route.APIKey, Backend: route.Backend}, true
+		}
+	}
+	return upstreamTarget{}, false
+}
+
+// String 日志输出时隐藏 API Key
+func (r Route) String() string {
+	s := r.Pattern + "=" + r.BaseURL
+	if r.Backend != nil {
+		s = r.Pattern + "=" + r.Backend.Name() + ":" + r.BaseURL
+	}
+	if r.APIKey != "" {
+		s += " (key override)"
+	}
+	return s
+}
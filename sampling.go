@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// samplingWarningHeader 采样参数被调整或请求参数被忽略时返回给客户端的提示头
+const samplingWarningHeader = "X-Proxy-Warning"
+
+// Anthropic temperature 上限为 1，OpenAI 为 2
+const (
+	openAIMaxTemperature    = 2.0
+	anthropicMaxTemperature = 1.0
+)
+
+// paramError 请求参数非法，以 OpenAI 的 invalid_request_error 格式返回
+type paramError struct {
+	Param   string
+	Message string
+}
+
+func (e *paramError) Error() string {
+	return e.Message
+}
+
+// normalizeSampling 校验 temperature/top_p/top_k 和 extra_body，并把 temperature 转换到 Anthropic 支持的范围
+// mode 为 scale 时 temperature 按比例缩放（0–2 → 0–1），否则超过 1 的值截断为 1
+// 返回对参数所做调整的说明；超出 OpenAI 允许范围时返回错误
+func normalizeSampling(req *OpenAIRequest, mode string) ([]string, *paramError) {
+	if t := req.Temperature; t != nil && (*t < 0 || *t > openAIMaxTemperature) {
+		return nil, &paramError{
+			Param:   "temperature",
+			Message: fmt.Sprintf("%g is not a valid temperature, expected a value between 0 and 2", *t),
+		}
+	}
+	if req.TopP < 0 || req.TopP > 1 {
+		return nil, &paramError{
+			Param:   "top_p",
+			Message: fmt.Sprintf("%g is not a valid top_p, expected a value between 0 and 1", req.TopP),
+		}
+	}
+	if req.TopK < 0 {
+		return nil, &paramError{
+			Param:   "top_k",
+			Message: fmt.Sprintf("%d is not a valid top_k, expected a non-negative integer", req.TopK),
+		}
+	}
+	if perr := checkExtraBody(req.ExtraBody); perr != nil {
+		return nil, perr
+	}
+
+	// 未设置 temperature 时保持 nil，由上游使用默认值
+	t := req.Temperature
+	if t == nil {
+		return nil, nil
+	}
+	var warnings []string
+	if mode == "scale" {
+		if *t != 0 {
+			scaled := *t * anthropicMaxTemperature / openAIMaxTemperature
+			warnings = append(warnings, fmt.Sprintf("temperature %g scaled to %g", *t, scaled))
+			req.Temperature = &scaled
+		}
+	} else if *t > anthropicMaxTemperature {
+		warnings = append(warnings, fmt.Sprintf("temperature %g clamped to %g", *t, anthropicMaxTemperature))
+		clamped := anthropicMaxTemperature
+		req.Temperature = &clamped
+	}
+	return warnings, nil
+}
+
+// applySampling 调整采样参数，出错时写入 400 响应并返回 false
+func applySampling(c *gin.Context, req *OpenAIRequest, mode string, reqID string) bool {
+	warnings, perr := normalizeSampling(req, mode)
+	if perr != nil {
+		reqLog(reqID).Warn("invalid sampling parameter", "param", perr.Param, "error", perr.Message)
+		respondParamError(c, perr.Param, perr.Message)
+		return false
+	}
+	if len(warnings) > 0 {
+		reqLog(reqID).Info("sampling parameters adjusted", "warnings", warnings)
+		addProxyWarning(c, strings.Join(warnings, "; "))
+	}
+	return true
+}
+
+// addProxyWarning 追加一条 X-Proxy-Warning 说明，多条以 "; " 分隔
+func addProxyWarning(c *gin.Context, warning string) {
+	if prev := c.Writer.Header().Get(samplingWarningHeader); prev != "" {
+		warning = prev + "; " + warning
+	}
+	c.Header(samplingWarningHeader, warning)
+}
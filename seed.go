@@ -0,0 +1,32 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/gin-gonic/gin"
+)
+
+// version 代理版本，构建时通过 -ldflags "-X main.version=v1.2.3" 设置
+var version = "dev"
+
+// systemFingerprintKey 请求带 seed 时返回给客户端的 system_fingerprint
+const systemFingerprintKey = "system_fingerprint"
+
+// systemFingerprint 由目标模型和代理版本生成，两者不变时指纹不变
+func systemFingerprint(model string) string {
+	sum := sha256.Sum256([]byte(model + "|" + version))
+	return "fp_" + hex.EncodeToString(sum[:5])
+}
+
+// acceptSeed Anthropic 不支持 seed：请求带 seed 时返回 system_fingerprint，便于客户端按指纹检测后端变化，
+// 并在 X-Proxy-Warning 中说明相同 seed 不保证相同输出
+func acceptSeed(c *gin.Context, seed *int64, model string, reqID string) {
+	if seed == nil {
+		return
+	}
+	fingerprint := systemFingerprint(model)
+	c.Set(systemFingerprintKey, fingerprint)
+	addProxyWarning(c, "seed accepted but sampling is not deterministic")
+	reqLog(reqID).Debug("seed accepted", "seed", *seed, "system_fingerprint", fingerprint)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// ServerTool 为匹配的模型追加的 Anthropic 服务端工具（如 web_search），由 Anthropic 执行，客户端只看到结果
+type ServerTool struct {
+	Pattern string   // 模型 glob（映射后的名称）
+	Types   []string // 工具类型，如 web_search_20250305
+	MaxUses int      // 单个请求内最多调用次数，0 表示不限制
+}
+
+// serverToolVersion 工具类型末尾的版本日期，去掉后即为工具名（web_search_20250305 -> web_search）
+var serverToolVersion = regexp.MustCompile(`_\d{8}$`)
+
+// serverToolBetas 需要 anthropic-beta 头才能使用的服务端工具
+var serverToolBetas = map[string]string{
+	"web_fetch":      "web-fetch-2025-09-10",
+	"code_execution": "code-execution-2025-05-22",
+}
+
+// parseServerTools 解析服务端工具配置，按书写顺序匹配，先匹配先生效
+// 格式: "pattern=type1|type2,..."
+// 示例: "claude-sonnet*=web_search_20250305,claude-opus*=web_search_20250305|web_fetch_20250910"
+func parseServerTools(toolsStr string, maxUses int) []ServerTool {
+	tools := make([]ServerTool, 0)
+
+	if toolsStr == "" {
+		return tools
+	}
+
+	for _, item := range strings.Split(toolsStr, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		pattern := strings.TrimSpace(parts[0])
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			slog.Warn("invalid server tool pattern", "pattern", pattern, "error", err)
+			continue
+		}
+
+		tool := ServerTool{Pattern: pattern, MaxUses: maxUses}
+		for _, t := range strings.Split(parts[1], "|") {
+			if t = strings.TrimSpace(t); t != "" {
+				tool.Types = append(tool.Types, t)
+			}
+		}
+		if len(tool.Types) > 0 {
+			tools = append(tools, tool)
+		}
+	}
+
+	return tools
+}
+
+// applyServerTools 为匹配的模型追加服务端工具，客户端已定义同名工具时跳过
+func (h *ProxyHandler) applyServerTools(req *AnthropicRequest, reqID string) {
+	for _, st := range h.serverTools {
+		if ok, _ := path.Match(st.Pattern, req.Model); !ok {
+			continue
+		}
+
+		defined := make(map[string]bool)
+		for _, tool := range req.Tools {
+			switch t := tool.(type) {
+			case AnthropicTool:
+				defined[t.Name] = true
+			case map[string]interface{}:
+				name, _ := t["name"].(string)
+				defined[name] = true
+			}
+		}
+
+		for _, toolType := range st.Types {
+			name := serverToolVersion.ReplaceAllString(toolType, "")
+			if defined[name] {
+				reqLog(reqID).Warn("server tool skipped: client defines a tool with the same name", "tool", name)
+				continue
+			}
+			tool := map[string]interface{}{"type": toolType, "name": name}
+			if st.MaxUses > 0 {
+				tool["max_uses"] = st.MaxUses
+			}
+			req.Tools = append(req.Tools, tool)
+		}
+		reqLog(reqID).Debug("server tools added", "model", req.Model, "tools", st.Types)
+		return
+	}
+}
+
+// anthropicBetas 返回请求需要的 anthropic-beta 头，多个值以逗号分隔，重复的值只保留一个
+// configured 为 ANTHROPIC_BETAS / MODEL_BETAS 中配置的值
+func anthropicBetas(req *AnthropicRequest, cacheEnabled bool, configured []string) string {
+	var betas []string
+	if cacheEnabled {
+		betas = append(betas, "prompt-caching-2024-07-31")
+	}
+	for _, tool := range req.Tools {
+		t, ok := tool.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _ := t["name"].(string)
+		if beta, ok := serverToolBetas[name]; ok {
+			betas = append(betas, beta)
+		}
+	}
+	betas = append(betas, configured...)
+
+	seen := make(map[string]bool, len(betas))
+	unique := betas[:0]
+	for _, beta := range betas {
+		if !seen[beta] {
+			seen[beta] = true
+			unique = append(unique, beta)
+		}
+	}
+	return strings.Join(unique, ",")
+}
+
+// isServerToolResult 服务端工具的结果块（web_search_tool_result、web_fetch_tool_result 等）
+func isServerToolResult(blockType string) bool {
+	return strings.HasSuffix(blockType, "_tool_result") && blockType != "tool_result"
+}
+
+// renderServerToolUse 将服务端工具调用渲染为 Markdown 引用，作为 assistant 文本输出给 OpenAI 客户端
+func renderServerToolUse(name string, input map[string]interface{}) string {
+	var arg string
+	for _, key := range []string{"query", "url"} {
+		if v, ok := input[key].(string); ok {
+			arg = v
+			break
+		}
+	}
+	if arg == "" && len(input) > 0 {
+		b, _ := json.Marshal(input)
+		arg = string(b)
+	}
+	return fmt.Sprintf("\n\n> %s: %s\n\n", name, arg)
+}
+
+// renderServerToolResult 将服务端工具结果渲染为 Markdown 引用（搜索结果为链接列表）
+func renderServerToolResult(block AnthropicContent) string {
+	var sb strings.Builder
+	switch content := block.Content.(type) {
+	case []interface{}:
+		for i, item := range content {
+			result, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			url, _ := result["url"].(string)
+			title, _ := result["title"].(string)
+			if title == "" {
+				title = url
+			}
+			if url != "" {
+				fmt.Fprintf(&sb, "> %d. [%s](%s)\n", i+1, title, url)
+			}
+		}
+	case map[string]interface{}:
+		if code, ok := content["error_code"].(string); ok {
+			fmt.Fprintf(&sb, "> %s error: %s\n", strings.TrimSuffix(block.Type, "_tool_result"), code)
+		} else if url, ok := content["url"].(string); ok {
+			fmt.Fprintf(&sb, "> fetched: %s\n", url)
+		}
+	}
+	if sb.Len() == 0 {
+		return ""
+	}
+	return sb.String() + "\n"
+}
+
+// decodeContentBlock 将流式事件中的 content_block 解码为 AnthropicContent
+func decodeContentBlock(block map[string]interface{}) AnthropicContent {
+	var content AnthropicContent
+	b, _ := json.Marshal(block)
+	_ = json.Unmarshal(b, &content)
+	return content
+}
+
+// serverToolCall 流式响应中正在接收参数的服务端工具调用
+type serverToolCall struct {
+	name  string
+	input strings.Builder
+}
+
+// serverToolInput 解析流式累积的服务端工具参数
+func serverToolInput(partialJSON string) map[string]interface{} {
+	input := map[string]interface{}{}
+	if partialJSON != "" {
+		_ = json.Unmarshal([]byte(partialJSON), &input)
+	}
+	return input
+}
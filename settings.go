@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+)
+
+// RuntimeSettings 可以通过 /admin/config 在运行时修改的配置
+// 每次修改都替换为新的快照，请求处理过程中读取到的快照不会被改动
+type RuntimeSettings struct {
+	ModelMapping     map[string]string             `json:"model_mapping"`
+	ModelGroups      map[string][]ModelGroupTarget `json:"model_groups"`
+	MaxTokensMapping map[string]int                `json:"max_tokens_mapping"`
+	Cache            CacheConfig                   `json:"cache"`
+}
+
+// settings 返回当前配置快照，同一请求内应只读取一次，保证前后使用的配置一致
+func (h *ProxyHandler) settings() *RuntimeSettings {
+	return h.runtime.Load()
+}
+
+// RuntimeSettingsUpdate PUT /admin/config 的请求体，未出现的字段保持不变
+// 映射表整体替换；cache 解码前预先填入当前值，因此只覆盖出现的字段
+type RuntimeSettingsUpdate struct {
+	ModelMapping     map[string]string             `json:"model_mapping"`
+	ModelGroups      map[string][]ModelGroupTarget `json:"model_groups"`
+	MaxTokensMapping map[string]int                `json:"max_tokens_mapping"`
+	Cache            *CacheConfig                  `json:"cache"`
+}
+
+// apply 基于当前配置生成新的快照，校验失败时返回出错的参数名
+func (u RuntimeSettingsUpdate) apply(cur *RuntimeSettings) (*RuntimeSettings, string, error) {
+	next := &RuntimeSettings{
+		ModelMapping:     maps.Clone(cur.ModelMapping),
+		ModelGroups:      maps.Clone(cur.ModelGroups),
+		MaxTokensMapping: maps.Clone(cur.MaxTokensMapping),
+		Cache:            cur.Cache,
+	}
+
+	if u.ModelMapping != nil {
+		for source, target := range u.ModelMapping {
+			if source == "" || target == "" {
+				return nil, "model_mapping", fmt.Errorf("model_mapping entries must not be empty")
+			}
+		}
+		next.ModelMapping = u.ModelMapping
+	}
+
+	if u.ModelGroups != nil {
+		if err := validateModelGroups(u.ModelGroups); err != nil {
+			return nil, "model_groups", err
+		}
+		next.ModelGroups = u.ModelGroups
+	}
+
+	if u.MaxTokensMapping != nil {
+		for model, tokens := range u.MaxTokensMapping {
+			if model == "" || tokens <= 0 {
+				return nil, "max_tokens_mapping", fmt.Errorf("max_tokens_mapping values must be positive, got %s=%d", model, tokens)
+			}
+		}
+		next.MaxTokensMapping = u.MaxTokensMapping
+	}
+
+	if u.Cache != nil {
+		if u.Cache.TTL != "5m" && u.Cache.TTL != "1h" {
+			return nil, "cache.ttl", fmt.Errorf("cache.ttl must be 5m or 1h")
+		}
+		if u.Cache.UserTurns < 0 {
+			return nil, "cache.user_turns", fmt.Errorf("cache.user_turns must not be negative")
+		}
+		next.Cache = *u.Cache
+	}
+
+	return next, "", nil
+}
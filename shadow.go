@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ShadowConfig 影子流量：按比例把请求复制一份发给另一个模型，影子响应不返回给客户端，
+// 用于切换映射之前评估新模型
+type ShadowConfig struct {
+	Model          string        // 影子请求使用的模型，为空表示不启用；上游按 ROUTES 选择
+	Percent        int           // 复制的请求比例，0–100
+	SourceModels   []string      // 只复制这些模型（映射后的模型名，支持 * 通配）的请求，为空表示全部
+	Dir            string        // 主请求与影子请求的响应按 JSON lines 写入该目录，为空表示不保存
+	MaxConcurrency int           // 同时进行的影子请求上限，超过时跳过
+	MaxBodyBytes   int64         // 主响应最多缓存的字节数，超过时不记录主响应内容
+	Timeout        time.Duration // 影子请求的超时
+}
+
+// loadShadowConfig 从环境变量读取影子流量配置
+func loadShadowConfig() (ShadowConfig, error) {
+	cfg := ShadowConfig{
+		Model:          strings.TrimSpace(os.Getenv("SHADOW_MODEL")),
+		Percent:        getEnvInt("SHADOW_PERCENT", 100),
+		SourceModels:   parseModelList(os.Getenv("SHADOW_SOURCE_MODELS")),
+		Dir:            os.Getenv("SHADOW_DIR"),
+		MaxConcurrency: getEnvInt("SHADOW_MAX_CONCURRENCY", 8),
+		MaxBodyBytes:   int64(getEnvInt("SHADOW_MAX_BODY_KB", 4096)) * 1024,
+		Timeout:        getEnvSeconds("SHADOW_TIMEOUT_SECONDS", 5*time.Minute),
+	}
+	if cfg.Percent < 0 || cfg.Percent > 100 {
+		return cfg, fmt.Errorf("SHADOW_PERCENT must be between 0 and 100, got %d", cfg.Percent)
+	}
+	for _, pattern := range cfg.SourceModels {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return cfg, fmt.Errorf("SHADOW_SOURCE_MODELS: invalid pattern %q", pattern)
+		}
+	}
+	if cfg.MaxConcurrency <= 0 {
+		cfg.MaxConcurrency = 1
+	}
+	return cfg, nil
+}
+
+// ShadowResult 一侧请求的结果，Message 为完整的响应消息（流式响应拼装后的结果）
+type ShadowResult struct {
+	Model    string             `json:"model"`
+	Status   int                `json:"status"`
+	Error    string             `json:"error,omitempty"`
+	Duration float64            `json:"duration_seconds"`
+	Message  *AnthropicResponse `json:"message,omitempty"`
+}
+
+// ShadowRecord SHADOW_DIR 中的一行，request_id 可与 tape 中的请求对应
+type ShadowRecord struct {
+	Time      time.Time    `json:"time"`
+	RequestID string       `json:"request_id"`
+	Path      string       `json:"path"`
+	Primary   ShadowResult `json:"primary"`
+	Shadow    ShadowResult `json:"shadow"`
+	Diff      *ShadowDiff  `json:"diff,omitempty"` // 两侧都成功时的对比
+}
+
+// Shadow 发送影子请求并保存结果
+type Shadow struct {
+	cfg   ShadowConfig
+	sem   chan struct{}
+	stats *shadowStats
+
+	mu   sync.Mutex
+	day  string
+	file *os.File
+}
+
+// NewShadow 未配置 SHADOW_MODEL 或比例为 0 时返回 nil
+func NewShadow(cfg ShadowConfig) (*Shadow, error) {
+	if cfg.Model == "" || cfg.Percent == 0 {
+		return nil, nil
+	}
+	if cfg.Dir != "" {
+		if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+			return nil, fmt.Errorf("create shadow dir: %w", err)
+		}
+	}
+	return &Shadow{cfg: cfg, sem: make(chan struct{}, cfg.MaxConcurrency), stats: newShadowStats()}, nil
+}
+
+// sampled 按来源模型和比例决定是否复制该请求
+func (s *Shadow) sampled(model string) bool {
+	if model == s.cfg.Model {
+		return false
+	}
+	if len(s.cfg.SourceModels) > 0 {
+		matched := false
+		for _, pattern := range s.cfg.SourceModels {
+			if ok, _ := path.Match(pattern, model); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return s.cfg.Percent >= 100 || rand.Intn(100) < s.cfg.Percent
+}
+
+// startShadow 抽中时发送影子请求：包装主响应体以便在读完后得到完整的主响应，影子请求不随客户端断开而取消
+// start 为主请求开始发送的时间
+func (h *ProxyHandler) startShadow(c *gin.Context, anthropicReq *AnthropicRequest, httpResp *http.Response, apiKey string, start time.Time, reqID string) {
+	s := h.shadow
+	if s == nil || !s.sampled(anthropicReq.Model) {
+		return
+	}
+	select {
+	case s.sem <- struct{}{}:
+	default:
+		reqLog(reqID).Debug("shadow request skipped: too many in flight")
+		metrics.ObserveShadow(s.cfg.Model, "skipped")
+		return
+	}
+
+	record := ShadowRecord{Time: start, RequestID: reqID, Path: c.Request.URL.Path}
+	primary := make(chan ShadowResult, 1)
+	body := &tapeBody{ReadCloser: httpResp.Body, limit: s.cfg.MaxBodyBytes}
+	var once sync.Once
+	body.done = func() {
+		once.Do(func() {
+			primary <- primaryShadowResult(anthropicReq.Model, httpResp, body, start)
+		})
+	}
+	httpResp.Body = body
+
+	shadowReq := *anthropicReq
+	shadowReq.Model = s.cfg.Model
+	shadowReq.Stream = false
+	if requested, clamped := h.fitMaxTokens(&shadowReq); clamped {
+		reqLog(reqID).Debug("shadow max_tokens clamped", "model", s.cfg.Model, "requested", requested, "max_tokens", shadowReq.MaxTokens)
+	}
+	reqLog(reqID).Info("shadow request", "from", anthropicReq.Model, "to", s.cfg.Model)
+
+	go func() {
+		defer func() { <-s.sem }()
+		record.Shadow = h.doShadowRequest(&shadowReq, apiKey, reqID)
+		record.Primary = <-primary
+		h.finishShadow(record, reqID)
+	}()
+}
+
+// primaryShadowResult 从缓存的主响应体解析出完整的消息，流式响应按 SSE 拼装
+func primaryShadowResult(model string, resp *http.Response, body *tapeBody, start time.Time) ShadowResult {
+	res := ShadowResult{Model: model, Status: resp.StatusCode, Duration: time.Since(start).Seconds()}
+	switch {
+	case body.truncated:
+		res.Error = "response exceeds SHADOW_MAX_BODY_KB"
+	case !body.eof:
+		res.Error = "response closed before it was fully read"
+	case strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream"):
+		msg, upErr := assembleStreamResponse(bytes.NewReader(body.buf.Bytes()))
+		if upErr != nil {
+			res.Error = upErr.Message
+		}
+		res.Message = msg
+	default:
+		var msg AnthropicResponse
+		if err := json.Unmarshal(body.buf.Bytes(), &msg); err != nil {
+			res.Error = err.Error()
+		} else {
+			res.Message = &msg
+		}
+	}
+	return res
+}
+
+// doShadowRequest 发送影子请求并读取完整响应，不写入客户端响应，也不计入用量
+func (h *ProxyHandler) doShadowRequest(req *AnthropicRequest, apiKey string, reqID string) ShadowResult {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), h.shadow.cfg.Timeout)
+	defer cancel()
+
+	res := ShadowResult{Model: req.Model}
+	httpResp, upErr := h.doAnthropicRequest(ctx, req, apiKey, reqID)
+	if upErr != nil {
+		res.Status, res.Error = upErr.StatusCode, upErr.Message
+		res.Duration = time.Since(start).Seconds()
+		return res
+	}
+	defer httpResp.Body.Close()
+	res.Status = httpResp.StatusCode
+
+	bodyBytes, err := readResponseBody(httpResp.Body, h.maxResponseBytes)
+	res.Duration = time.Since(start).Seconds()
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	var msg AnthropicResponse
+	if err := json.Unmarshal(bodyBytes, &msg); err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.Message = &msg
+	return res
+}
+
+// finishShadow 对比两侧响应并计入汇总，记录日志和指标，配置了 SHADOW_DIR 时写入文件
+func (h *ProxyHandler) finishShadow(record ShadowRecord, reqID string) {
+	result := "ok"
+	if record.Shadow.Error != "" {
+		result = "error"
+	}
+	metrics.ObserveShadow(record.Shadow.Model, result)
+	record.Diff = h.diffShadow(&record)
+	h.shadow.stats.record(&record)
+
+	args := []any{
+		"model", record.Shadow.Model,
+		"status", record.Shadow.Status,
+		"duration", record.Shadow.Duration,
+		"primary_duration", record.Primary.Duration,
+	}
+	if record.Shadow.Error != "" {
+		args = append(args, "error", record.Shadow.Error)
+	}
+	if d := record.Diff; d != nil {
+		args = append(args,
+			"primary_chars", d.PrimaryChars,
+			"shadow_chars", d.ShadowChars,
+			"tool_calls_match", d.ToolCallsMatch,
+			"stop_reason_match", d.StopReasonMatch)
+	}
+	reqLog(reqID).Info("shadow response", args...)
+
+	if h.shadow.cfg.Dir != "" {
+		h.shadow.write(record)
+	}
+}
+
+// write 追加一条记录，写入失败只记录日志
+func (s *Shadow) write(record ShadowRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		slog.Error("marshal shadow record failed", "error", err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	day := record.Time.Format("2006-01-02")
+	if s.file == nil || s.day != day {
+		if s.file != nil {
+			s.file.Close()
+		}
+		name := filepath.Join(s.cfg.Dir, "shadow-"+day+".jsonl")
+		file, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			slog.Error("open shadow file failed", "file", name, "error", err)
+			s.file = nil
+			return
+		}
+		s.file, s.day = file, day
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		slog.Error("write shadow record failed", "error", err)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ShadowDiff 主响应与影子响应的对比，两侧都成功返回完整消息时才计算
+type ShadowDiff struct {
+	PrimaryChars        int      `json:"primary_chars"`
+	ShadowChars         int      `json:"shadow_chars"`
+	PrimaryToolCalls    []string `json:"primary_tool_calls,omitempty"`
+	ShadowToolCalls     []string `json:"shadow_tool_calls,omitempty"`
+	ToolCallsMatch      bool     `json:"tool_calls_match"` // 调用的工具名称（不计顺序）相同
+	StopReasonMatch     bool     `json:"stop_reason_match"`
+	LatencyDelta        float64  `json:"latency_delta_seconds"` // 影子耗时减去主请求耗时
+	PrimaryOutputTokens int      `json:"primary_output_tokens"`
+	ShadowOutputTokens  int      `json:"shadow_output_tokens"`
+	PrimaryCostUSD      *float64 `json:"primary_cost_usd,omitempty"` // 模型未配置价格时为空
+	ShadowCostUSD       *float64 `json:"shadow_cost_usd,omitempty"`
+}
+
+// diffShadow 计算一对响应的差异，任一侧出错时返回 nil
+func (h *ProxyHandler) diffShadow(record *ShadowRecord) *ShadowDiff {
+	p, s := record.Primary.Message, record.Shadow.Message
+	if record.Primary.Error != "" || record.Shadow.Error != "" || p == nil || s == nil {
+		return nil
+	}
+	d := &ShadowDiff{
+		PrimaryChars:        responseChars(p),
+		ShadowChars:         responseChars(s),
+		PrimaryToolCalls:    responseToolNames(p),
+		ShadowToolCalls:     responseToolNames(s),
+		StopReasonMatch:     p.StopReason == s.StopReason,
+		LatencyDelta:        record.Shadow.Duration - record.Primary.Duration,
+		PrimaryOutputTokens: p.Usage.OutputTokens,
+		ShadowOutputTokens:  s.Usage.OutputTokens,
+	}
+	d.ToolCallsMatch = slices.Equal(sortedCopy(d.PrimaryToolCalls), sortedCopy(d.ShadowToolCalls))
+	if cost, ok := h.estimateCost(record.Primary.Model, &p.Usage); ok {
+		d.PrimaryCostUSD = &cost
+	}
+	if cost, ok := h.estimateCost(record.Shadow.Model, &s.Usage); ok {
+		d.ShadowCostUSD = &cost
+	}
+	return d
+}
+
+// responseChars 响应中文本块的字符数
+func responseChars(resp *AnthropicResponse) int {
+	n := 0
+	for _, block := range resp.Content {
+		if block.Type == "text" && block.Text != nil {
+			n += runeLen(*block.Text)
+		}
+	}
+	return n
+}
+
+// responseToolNames 按出现顺序返回调用的工具名称
+func responseToolNames(resp *AnthropicResponse) []string {
+	var names []string
+	for _, block := range resp.Content {
+		if block.Type == "tool_use" {
+			names = append(names, block.Name)
+		}
+	}
+	return names
+}
+
+func sortedCopy(s []string) []string {
+	c := slices.Clone(s)
+	sort.Strings(c)
+	return c
+}
+
+// shadowPairStats 一对主模型 → 影子模型的累计结果
+type shadowPairStats struct {
+	primaryModel, shadowModel string
+
+	requests, primaryErrors, shadowErrors, compared int
+	toolCallMatches, stopReasonMatches              int
+	primaryChars, shadowChars                       int
+	primaryOutputTokens, shadowOutputTokens         int
+	primaryLatency, shadowLatency                   float64
+	priced                                          int
+	primaryCost, shadowCost                         float64
+}
+
+// shadowStats 影子流量的内存统计，重启后清空
+type shadowStats struct {
+	mu    sync.Mutex
+	since time.Time
+	pairs map[[2]string]*shadowPairStats
+}
+
+func newShadowStats() *shadowStats {
+	return &shadowStats{since: time.Now(), pairs: make(map[[2]string]*shadowPairStats)}
+}
+
+func (s *shadowStats) record(record *ShadowRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := [2]string{record.Primary.Model, record.Shadow.Model}
+	p, ok := s.pairs[key]
+	if !ok {
+		p = &shadowPairStats{primaryModel: key[0], shadowModel: key[1]}
+		s.pairs[key] = p
+	}
+	p.requests++
+	if record.Primary.Error != "" {
+		p.primaryErrors++
+	}
+	if record.Shadow.Error != "" {
+		p.shadowErrors++
+	}
+	d := record.Diff
+	if d == nil {
+		return
+	}
+	p.compared++
+	if d.ToolCallsMatch {
+		p.toolCallMatches++
+	}
+	if d.StopReasonMatch {
+		p.stopReasonMatches++
+	}
+	p.primaryChars += d.PrimaryChars
+	p.shadowChars += d.ShadowChars
+	p.primaryOutputTokens += d.PrimaryOutputTokens
+	p.shadowOutputTokens += d.ShadowOutputTokens
+	p.primaryLatency += record.Primary.Duration
+	p.shadowLatency += record.Shadow.Duration
+	// 两侧都有价格时才计入费用对比
+	if d.PrimaryCostUSD != nil && d.ShadowCostUSD != nil {
+		p.priced++
+		p.primaryCost += *d.PrimaryCostUSD
+		p.shadowCost += *d.ShadowCostUSD
+	}
+}
+
+// ShadowPairReport GET /admin/shadow 中一对模型的汇总，平均值和比例只统计两侧都成功的请求
+type ShadowPairReport struct {
+	PrimaryModel        string  `json:"primary_model"`
+	ShadowModel         string  `json:"shadow_model"`
+	Requests            int     `json:"requests"`
+	PrimaryErrors       int     `json:"primary_errors"`
+	ShadowErrors        int     `json:"shadow_errors"`
+	Compared            int     `json:"compared"`
+	AvgPrimaryChars     float64 `json:"avg_primary_chars"`
+	AvgShadowChars      float64 `json:"avg_shadow_chars"`
+	LengthRatio         float64 `json:"length_ratio"` // 影子总字符数 / 主请求总字符数
+	ToolCallMatchRate   float64 `json:"tool_call_match_rate"`
+	StopReasonMatchRate float64 `json:"stop_reason_match_rate"`
+	AvgPrimaryLatency   float64 `json:"avg_primary_latency_seconds"`
+	AvgShadowLatency    float64 `json:"avg_shadow_latency_seconds"`
+	AvgPrimaryOutput    float64 `json:"avg_primary_output_tokens"`
+	AvgShadowOutput     float64 `json:"avg_shadow_output_tokens"`
+	Priced              int     `json:"priced"` // 两侧都配置了价格的请求数
+	PrimaryCostUSD      float64 `json:"primary_cost_usd"`
+	ShadowCostUSD       float64 `json:"shadow_cost_usd"`
+	CostRatio           float64 `json:"cost_ratio"` // 影子费用 / 主请求费用
+}
+
+func ratio(a, b float64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return a / b
+}
+
+// snapshot 按主模型、影子模型排序返回各对模型的汇总
+func (s *shadowStats) snapshot() (time.Time, []ShadowPairReport) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reports := make([]ShadowPairReport, 0, len(s.pairs))
+	for _, p := range s.pairs {
+		n := float64(p.compared)
+		reports = append(reports, ShadowPairReport{
+			PrimaryModel:        p.primaryModel,
+			ShadowModel:         p.shadowModel,
+			Requests:            p.requests,
+			PrimaryErrors:       p.primaryErrors,
+			ShadowErrors:        p.shadowErrors,
+			Compared:            p.compared,
+			AvgPrimaryChars:     ratio(float64(p.primaryChars), n),
+			AvgShadowChars:      ratio(float64(p.shadowChars), n),
+			LengthRatio:         ratio(float64(p.shadowChars), float64(p.primaryChars)),
+			ToolCallMatchRate:   ratio(float64(p.toolCallMatches), n),
+			StopReasonMatchRate: ratio(float64(p.stopReasonMatches), n),
+			AvgPrimaryLatency:   ratio(p.primaryLatency, n),
+			AvgShadowLatency:    ratio(p.shadowLatency, n),
+			AvgPrimaryOutput:    ratio(float64(p.primaryOutputTokens), n),
+			AvgShadowOutput:     ratio(float64(p.shadowOutputTokens), n),
+			Priced:              p.priced,
+			PrimaryCostUSD:      p.primaryCost,
+			ShadowCostUSD:       p.shadowCost,
+			CostRatio:           ratio(p.shadowCost, p.primaryCost),
+		})
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		if reports[i].PrimaryModel != reports[j].PrimaryModel {
+			return reports[i].PrimaryModel < reports[j].PrimaryModel
+		}
+		return reports[i].ShadowModel < reports[j].ShadowModel
+	})
+	return s.since, reports
+}
+
+// reset 清空统计，重新开始计算
+func (s *shadowStats) reset() {
+	s.mu.Lock()
+	s.since = time.Now()
+	s.pairs = make(map[[2]string]*shadowPairStats)
+	s.mu.Unlock()
+}
+
+// HandleShadowReport 影子流量对比汇总（GET /admin/shadow）
+func (h *ProxyHandler) HandleShadowReport(c *gin.Context) {
+	since, pairs := h.shadow.stats.snapshot()
+	c.JSON(http.StatusOK, gin.H{
+		"shadow_model": h.shadow.cfg.Model,
+		"percent":      h.shadow.cfg.Percent,
+		"since":        since,
+		"pairs":        pairs,
+	})
+}
+
+// HandleResetShadowReport 清空对比汇总（DELETE /admin/shadow），例如修改提示词之后重新评估
+func (h *ProxyHandler) HandleResetShadowReport(c *gin.Context) {
+	h.shadow.stats.reset()
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// modelCounter 按模型统计收到的请求，返回固定的非流式响应
+type modelCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (m *modelCounter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Model string `json:"model"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	m.mu.Lock()
+	m.counts[req.Model]++
+	m.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, `{"id":"msg_1","type":"message","role":"assistant","model":"`+req.Model+`",`+
+		`"content":[{"type":"text","text":"hi"}],"stop_reason":"end_turn","usage":{"input_tokens":1,"output_tokens":1}}`)
+}
+
+func (m *modelCounter) count(model string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counts[model]
+}
+
+// waitShadowIdle 等待所有影子请求结束
+func waitShadowIdle(t *testing.T, s *Shadow) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.sem) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("shadow requests did not finish")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func newShadowTestHandler(t *testing.T, upstream *httptest.Server, cfg ShadowConfig) *ProxyHandler {
+	t.Helper()
+	shadow, err := NewShadow(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewProxyHandler(ProxyConfig{AnthropicURL: upstream.URL, MaxN: 4, FanoutConcurrency: 4, Shadow: shadow})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func shadowTestRequest(model string) *AnthropicRequest {
+	return &AnthropicRequest{Model: model, MaxTokens: 16, Messages: []AnthropicMessage{{Role: "user", Content: "hello"}}}
+}
+
+// 抽中的请求复制一份发给影子模型，并对比两侧的响应；SOURCE_MODELS 之外的模型不复制
+func TestShadowCopiesSampledRequests(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	counter := &modelCounter{counts: make(map[string]int)}
+	upstream := httptest.NewServer(counter)
+	defer upstream.Close()
+	h := newShadowTestHandler(t, upstream, ShadowConfig{
+		Model: "claude-shadow", Percent: 100, SourceModels: []string{"claude-primary*"},
+		MaxConcurrency: 4, MaxBodyBytes: 1 << 20, Timeout: time.Minute,
+	})
+
+	for _, model := range []string{"claude-primary-1", "claude-other"} {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		httpResp, ok := h.sendAnthropicRequest(c, shadowTestRequest(model), "sk-test", "test")
+		if !ok {
+			t.Fatalf("%s: status = %d: %s", model, w.Code, w.Body)
+		}
+		io.ReadAll(httpResp.Body)
+		httpResp.Body.Close()
+	}
+	waitShadowIdle(t, h.shadow)
+
+	if got := counter.count("claude-shadow"); got != 1 {
+		t.Errorf("shadow model received %d requests, want 1", got)
+	}
+	_, pairs := h.shadow.stats.snapshot()
+	if len(pairs) != 1 || pairs[0].PrimaryModel != "claude-primary-1" || pairs[0].Compared != 1 || pairs[0].StopReasonMatchRate != 1 {
+		t.Errorf("shadow stats = %+v, want one compared claude-primary-1 pair with matching stop reasons", pairs)
+	}
+}
+
+// n > 1 的请求按客户端请求抽样一次，只复制一个子请求
+func TestShadowSamplesFanoutOnce(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	counter := &modelCounter{counts: make(map[string]int)}
+	upstream := httptest.NewServer(counter)
+	defer upstream.Close()
+	h := newShadowTestHandler(t, upstream, ShadowConfig{
+		Model: "claude-shadow", Percent: 100, MaxConcurrency: 4, MaxBodyBytes: 1 << 20, Timeout: time.Minute,
+	})
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	h.handleFanout(c, shadowTestRequest("claude-primary"), OpenAIRequest{Model: "claude-primary", N: 3}, "sk-test", false, "test")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	waitShadowIdle(t, h.shadow)
+
+	if got := counter.count("claude-primary"); got != 3 {
+		t.Errorf("primary model received %d requests, want 3", got)
+	}
+	if got := counter.count("claude-shadow"); got != 1 {
+		t.Errorf("shadow model received %d requests, want 1", got)
+	}
+}
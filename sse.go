@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+)
+
+// maxSSEEventBytes 单个 SSE 事件的大小上限，防止异常上游耗尽内存
+// 大段 input_json_delta 或文本可能远超 bufio.Scanner 默认的 64KB 行长度
+const maxSSEEventBytes = 64 << 20
+
+var errSSEEventTooLarge = errors.New("sse event too large")
+
+// sseEvent 一个完整的 SSE 事件（以空行结束）
+type sseEvent struct {
+	Event string
+	Data  string // 多行 data 以 \n 连接
+	Raw   string // 事件的原始文本（每行以 \n 结尾，不含结束空行），透传时原样写出
+}
+
+// sseReader 按 SSE 规范逐个读取事件：累积 event/data 字段，忽略注释行，单行长度不受限制
+type sseReader struct {
+	r *bufio.Reader
+}
+
+func newSSEReader(r io.Reader) *sseReader {
+	return &sseReader{r: bufio.NewReaderSize(r, 64*1024)}
+}
+
+// Next 返回下一个事件，流正常结束时返回 io.EOF
+// 只包含注释的事件（如上游的 ": ping"）也会返回，Data 为空
+func (s *sseReader) Next() (sseEvent, error) {
+	var (
+		ev      sseEvent
+		raw     strings.Builder
+		data    strings.Builder
+		hasData bool
+	)
+	finish := func() sseEvent {
+		ev.Data = data.String()
+		ev.Raw = raw.String()
+		return ev
+	}
+
+	for {
+		line, err := s.readLine()
+		if err != nil {
+			// 最后一个事件缺少结束空行时仍然返回
+			if errors.Is(err, io.EOF) && raw.Len() > 0 {
+				return finish(), nil
+			}
+			return sseEvent{}, err
+		}
+
+		if line == "" {
+			if raw.Len() == 0 {
+				continue
+			}
+			return finish(), nil
+		}
+
+		raw.WriteString(line)
+		raw.WriteByte('\n')
+		if raw.Len() > maxSSEEventBytes {
+			return sseEvent{}, errSSEEventTooLarge
+		}
+
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			ev.Event = value
+		case "data":
+			if hasData {
+				data.WriteByte('\n')
+			}
+			data.WriteString(value)
+			hasData = true
+		}
+	}
+}
+
+// readLine 读取一行（去掉 \n 或 \r\n），超过 maxSSEEventBytes 时返回错误
+func (s *sseReader) readLine() (string, error) {
+	var buf []byte
+	for {
+		chunk, err := s.r.ReadSlice('\n')
+		buf = append(buf, chunk...)
+		if len(buf) > maxSSEEventBytes {
+			return "", errSSEEventTooLarge
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if err != nil && (!errors.Is(err, io.EOF) || len(buf) == 0) {
+			return "", err
+		}
+		return strings.TrimSuffix(strings.TrimSuffix(string(buf), "\n"), "\r"), nil
+	}
+}
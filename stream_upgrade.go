@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// shouldUpgradeStream 非流式请求是否改为流式发送给上游（STREAM_UPGRADE）
+// max_tokens 较大的非流式请求容易触发上游的长请求超时，流式请求则不受影响
+func (h *ProxyHandler) shouldUpgradeStream(anthropicReq *AnthropicRequest) bool {
+	return h.streamUpgrade && !anthropicReq.Stream && anthropicReq.MaxTokens >= h.upgradeMinTokens
+}
+
+// assembleStreamResponse 读取上游 SSE 并拼装为与非流式响应相同的 AnthropicResponse
+// 流中途的 error 事件以 upstreamError 返回
+func assembleStreamResponse(r io.Reader) (*AnthropicResponse, *upstreamError) {
+	var resp AnthropicResponse
+	partialJSON := make(map[int]*strings.Builder)
+	started := false
+
+	reader := newSSEReader(r)
+	for {
+		ev, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, &upstreamError{StatusCode: http.StatusBadGateway, Message: err.Error()}
+		}
+		data := ev.Data
+		if data == "" {
+			continue
+		}
+
+		var event struct {
+			Type         string            `json:"type"`
+			Index        int               `json:"index"`
+			Message      AnthropicResponse `json:"message"`
+			ContentBlock AnthropicContent  `json:"content_block"`
+			Delta        struct {
+				Type         string  `json:"type"`
+				Text         string  `json:"text"`
+				PartialJSON  string  `json:"partial_json"`
+				Thinking     string  `json:"thinking"`
+				Signature    string  `json:"signature"`
+				StopReason   string  `json:"stop_reason"`
+				StopSequence *string `json:"stop_sequence"`
+			} `json:"delta"`
+			Usage *AnthropicUsage `json:"usage"`
+		}
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return nil, &upstreamError{StatusCode: http.StatusBadGateway, Message: "invalid stream event: " + err.Error()}
+		}
+
+		switch event.Type {
+		case "message_start":
+			resp = event.Message
+			resp.Content = resp.Content[:0]
+			started = true
+
+		case "content_block_start":
+			if event.Index != len(resp.Content) {
+				return nil, &upstreamError{StatusCode: http.StatusBadGateway, Message: fmt.Sprintf("unexpected content block index %d", event.Index)}
+			}
+			resp.Content = append(resp.Content, event.ContentBlock)
+
+		case "content_block_delta":
+			if event.Index < 0 || event.Index >= len(resp.Content) {
+				continue
+			}
+			block := &resp.Content[event.Index]
+			switch event.Delta.Type {
+			case "text_delta":
+				text := event.Delta.Text
+				if block.Text != nil {
+					text = *block.Text + text
+				}
+				block.Text = &text
+			case "input_json_delta":
+				if partialJSON[event.Index] == nil {
+					partialJSON[event.Index] = &strings.Builder{}
+				}
+				partialJSON[event.Index].WriteString(event.Delta.PartialJSON)
+			case "thinking_delta":
+				block.Thinking += event.Delta.Thinking
+			case "signature_delta":
+				block.Signature += event.Delta.Signature
+			}
+
+		case "content_block_stop":
+			// tool_use 的参数以 JSON 片段流式返回，块结束时再解析
+			if b, ok := partialJSON[event.Index]; ok && event.Index < len(resp.Content) {
+				input := map[string]interface{}{}
+				if b.Len() > 0 {
+					if err := json.Unmarshal([]byte(b.String()), &input); err != nil {
+						return nil, &upstreamError{StatusCode: http.StatusBadGateway, Message: "invalid tool input: " + err.Error()}
+					}
+				}
+				resp.Content[event.Index].Input = &input
+			}
+
+		case "message_delta":
+			if event.Delta.StopReason != "" {
+				resp.StopReason = event.Delta.StopReason
+			}
+			if event.Delta.StopSequence != nil {
+				resp.StopSequence = event.Delta.StopSequence
+			}
+			if event.Usage != nil {
+				mergeDeltaUsage(&resp.Usage, event.Usage)
+			}
+
+		case "error":
+			return nil, &upstreamError{StatusCode: http.StatusInternalServerError, Message: data}
+		}
+	}
+	if !started {
+		return nil, &upstreamError{StatusCode: http.StatusBadGateway, Message: "upstream stream ended without message_start"}
+	}
+	return &resp, nil
+}
+
+// upgradedResponse 将拼装好的响应包装为普通的非流式 http.Response，后续处理与非流式请求相同
+func upgradedResponse(httpResp *http.Response, resp *AnthropicResponse) (*http.Response, *upstreamError) {
+	body, err := json.Marshal(resp)
+	if err != nil {
+		return nil, &upstreamError{StatusCode: http.StatusInternalServerError, Message: err.Error()}
+	}
+	httpResp.Header.Set("Content-Type", "application/json")
+	httpResp.Header.Del("Content-Length")
+	httpResp.ContentLength = int64(len(body))
+	httpResp.Body = io.NopCloser(bytes.NewReader(body))
+	return httpResp, nil
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// rawRequestBodyKey 客户端原始请求体，录制时写入 tape
+const rawRequestBodyKey = "raw_request_body"
+
+// TapeConfig 请求/响应录制配置：转换后的请求和上游响应按 JSON lines 写入目录，用于复现转换问题
+type TapeConfig struct {
+	Dir           string // 为空表示不录制
+	MaxBodyBytes  int64  // 单个响应最多录制的字节数，超过时截断
+	RedactContent bool   // 消息文本、工具参数等内容替换为长度占位，只保留请求结构
+	StreamMessage bool   // 流式响应边转发边拼装完整的 assistant 消息（文本和工具调用），写入 message 字段
+}
+
+// loadTapeConfig 从环境变量读取录制配置
+func loadTapeConfig() TapeConfig {
+	return TapeConfig{
+		Dir:           os.Getenv("TAPE_DIR"),
+		MaxBodyBytes:  int64(getEnvInt("TAPE_MAX_BODY_KB", 1024)) * 1024,
+		RedactContent: getEnvBool("TAPE_REDACT_CONTENT", false),
+		StreamMessage: getEnvBool("TAPE_STREAM_MESSAGE", false),
+	}
+}
+
+// TapeEntry tape 文件中的一行
+type TapeEntry struct {
+	Time      time.Time       `json:"time"`
+	RequestID string          `json:"request_id"`
+	Method    string          `json:"method"`
+	Path      string          `json:"path"`
+	Request   json.RawMessage `json:"request,omitempty"` // 客户端原始请求（OpenAI 格式）
+	Anthropic json.RawMessage `json:"anthropic_request"` // 转换后发送给上游的请求
+	Status    int             `json:"status"`
+	Response  string          `json:"response,omitempty"` // 上游响应体，流式响应为 SSE 原文
+	Message   json.RawMessage `json:"message,omitempty"`  // TAPE_STREAM_MESSAGE：流式响应拼装后的完整消息，格式与非流式响应相同
+	Truncated bool            `json:"truncated,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	Duration  float64         `json:"duration_seconds"`
+}
+
+// Tape 按天写入 tape-YYYY-MM-DD.jsonl
+type Tape struct {
+	cfg TapeConfig
+
+	mu   sync.Mutex
+	day  string
+	file *os.File
+}
+
+// NewTape 创建录制目录，未配置 TAPE_DIR 时返回 nil
+func NewTape(cfg TapeConfig) (*Tape, error) {
+	if cfg.Dir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create tape dir: %w", err)
+	}
+	return &Tape{cfg: cfg}, nil
+}
+
+// write 追加一条记录，写入失败只记录日志，不影响请求
+func (t *Tape) write(entry TapeEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		slog.Error("marshal tape entry failed", "error", err)
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	day := entry.Time.Format("2006-01-02")
+	if t.file == nil || t.day != day {
+		if t.file != nil {
+			t.file.Close()
+		}
+		name := filepath.Join(t.cfg.Dir, "tape-"+day+".jsonl")
+		file, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			slog.Error("open tape file failed", "file", name, "error", err)
+			t.file = nil
+			return
+		}
+		t.file, t.day = file, day
+	}
+	if _, err := t.file.Write(append(line, '\n')); err != nil {
+		slog.Error("write tape entry failed", "error", err)
+	}
+}
+
+// newEntry 记录请求部分，响应在上游返回后补全
+func (t *Tape) newEntry(c *gin.Context, anthropicReq *AnthropicRequest, reqID string) TapeEntry {
+	entry := TapeEntry{
+		Time:      time.Now(),
+		RequestID: reqID,
+		Method:    c.Request.Method,
+		Path:      c.Request.URL.Path,
+	}
+	if raw, ok := c.Get(rawRequestBodyKey); ok {
+		entry.Request = t.redactJSON(raw.([]byte))
+	}
+	if body, err := json.Marshal(anthropicReq); err == nil {
+		entry.Anthropic = t.redactJSON(body)
+	}
+	return entry
+}
+
+// recordError 上游请求失败时直接写入记录
+func (t *Tape) recordError(entry TapeEntry, upErr *upstreamError) {
+	entry.Status = upErr.StatusCode
+	entry.Error = upErr.Message
+	entry.Duration = time.Since(entry.Time).Seconds()
+	t.write(entry)
+}
+
+// recordResponse 包装上游响应体：边转发边录制，响应体关闭时写入记录
+// 开启 TAPE_STREAM_MESSAGE 时，流式响应同时交给 assembleStreamResponse 拼装，不受 TAPE_MAX_BODY_KB 限制
+func (t *Tape) recordResponse(entry TapeEntry, resp *http.Response) {
+	body := &tapeBody{ReadCloser: resp.Body, limit: t.cfg.MaxBodyBytes}
+	var assembled chan streamAssembly
+	if t.cfg.StreamMessage && resp.StatusCode == http.StatusOK && strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		pr, pw := io.Pipe()
+		body.tee = pw
+		assembled = make(chan streamAssembly, 1)
+		go func() {
+			msg, upErr := assembleStreamResponse(pr)
+			// 拼装提前结束（流中途出错）时继续读完，避免阻塞转发
+			io.Copy(io.Discard, pr)
+			assembled <- streamAssembly{msg, upErr}
+		}()
+	}
+	var once sync.Once
+	body.done = func() {
+		once.Do(func() {
+			entry.Status = resp.StatusCode
+			entry.Response = t.redactResponse(body.buf.Bytes())
+			entry.Truncated = body.truncated
+			if assembled != nil {
+				if body.eof {
+					body.tee.Close()
+				} else {
+					body.tee.CloseWithError(errors.New("response closed before the stream ended"))
+				}
+				t.recordMessage(&entry, <-assembled)
+			}
+			entry.Duration = time.Since(entry.Time).Seconds()
+			t.write(entry)
+		})
+	}
+	resp.Body = body
+}
+
+// streamAssembly 流式响应的拼装结果
+type streamAssembly struct {
+	msg   *AnthropicResponse
+	upErr *upstreamError
+}
+
+// recordMessage 写入拼装好的消息；流中途出错或客户端提前断开时记录错误，不写 message
+func (t *Tape) recordMessage(entry *TapeEntry, a streamAssembly) {
+	if a.upErr != nil {
+		if entry.Error == "" {
+			entry.Error = a.upErr.Message
+		}
+		return
+	}
+	if body, err := json.Marshal(a.msg); err == nil {
+		entry.Message = t.redactJSON(body)
+	}
+}
+
+// tapeBody 转发读取的数据并保留前 limit 字节，tee 不为 nil 时同时写入完整的数据
+// 客户端断开时 Close 在另一个 goroutine 中调用（closeOnDisconnect），可能与 Read 并发，
+// 因此 Read 更新状态和 Close 调用 done 都持有 mu，done 中可以直接读取 buf、eof 和 truncated
+type tapeBody struct {
+	io.ReadCloser
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	limit     int64
+	truncated bool
+	tee       *io.PipeWriter
+	eof       bool
+	done      func()
+}
+
+func (b *tapeBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n > 0 && b.tee != nil {
+		b.tee.Write(p[:n])
+	}
+	if err == io.EOF {
+		b.eof = true
+	}
+	if n > 0 {
+		if room := b.limit - int64(b.buf.Len()); room >= int64(n) {
+			b.buf.Write(p[:n])
+		} else {
+			if room > 0 {
+				b.buf.Write(p[:room])
+			}
+			b.truncated = true
+		}
+	}
+	return n, err
+}
+
+func (b *tapeBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.done()
+	return err
+}
+
+// redactJSON 去掉 base64 数据（图片、文档），TAPE_REDACT_CONTENT 时同时替换文本内容
+func (t *Tape) redactJSON(body []byte) json.RawMessage {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil
+	}
+	redacted, _ := json.Marshal(t.redactValue("", v, false))
+	return redacted
+}
+
+// redactResponse 非流式响应按 JSON 处理，流式响应逐行处理 SSE 的 data
+func (t *Tape) redactResponse(body []byte) string {
+	if !t.cfg.RedactContent {
+		return string(body)
+	}
+	if json.Valid(body) {
+		return string(t.redactJSON(body))
+	}
+	lines := strings.Split(string(body), "\n")
+	for i, line := range lines {
+		if data, ok := strings.CutPrefix(line, "data: "); ok && json.Valid([]byte(data)) {
+			lines[i] = "data: " + string(t.redactJSON([]byte(data)))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// redactedKeys TAPE_REDACT_CONTENT 时替换的字段：消息文本、thinking、工具参数和结果
+var redactedKeys = map[string]bool{
+	"text":         true,
+	"content":      true,
+	"thinking":     true,
+	"partial_json": true,
+	"arguments":    true,
+	"input":        true,
+	"prompt":       true,
+	"instructions": true,
+	"output":       true,
+	"cited_text":   true,
+}
+
+// redactValue all 为 true 时替换子树中的所有字符串（工具调用的参数对象）
+func (t *Tape) redactValue(key string, v interface{}, all bool) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		if val["type"] == "base64" {
+			if data, ok := val["data"].(string); ok {
+				val["data"] = fmt.Sprintf("[base64 %d bytes]", len(data))
+			}
+		}
+		all = all || (t.cfg.RedactContent && key == "input")
+		for k, child := range val {
+			val[k] = t.redactValue(k, child, all)
+		}
+		return val
+	case []interface{}:
+		for i, child := range val {
+			elemKey := key
+			if _, isMap := child.(map[string]interface{}); isMap && key == "input" {
+				// Responses API 的 input 是消息数组，不是工具参数
+				elemKey = ""
+			}
+			val[i] = t.redactValue(elemKey, child, all)
+		}
+		return val
+	case string:
+		if strings.HasPrefix(val, "data:") && strings.Contains(val, ";base64,") {
+			meta, _, _ := strings.Cut(val, ",")
+			return fmt.Sprintf("%s,[base64 %d bytes]", meta, len(val)-len(meta)-1)
+		}
+		if all || (t.cfg.RedactContent && redactedKeys[key]) {
+			return fmt.Sprintf("[redacted %d chars]", runeLen(val))
+		}
+		return val
+	default:
+		return val
+	}
+}
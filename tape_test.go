@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// endlessBody 一直返回数据直到被关闭，与 http 响应体一样，关闭不会与正在进行的 Read 同步
+type endlessBody struct {
+	closed atomic.Bool
+}
+
+func (b *endlessBody) Read(p []byte) (int, error) {
+	if b.closed.Load() {
+		return 0, errors.New("read on closed body")
+	}
+	return len(p), nil
+}
+
+func (b *endlessBody) Close() error {
+	b.closed.Store(true)
+	return nil
+}
+
+// 客户端断开时 Close 在另一个 goroutine 中调用，与仍在进行的 Read 并发；用 go test -race 运行
+func TestTapeBodyConcurrentClose(t *testing.T) {
+	var size int
+	var eof bool
+	body := &tapeBody{ReadCloser: &endlessBody{}, limit: 1 << 20}
+	body.done = func() { size, eof = body.buf.Len(), body.eof }
+
+	reading := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		p := make([]byte, 256)
+		for i := 0; ; i++ {
+			if i == 10 {
+				close(reading)
+			}
+			if _, err := body.Read(p); err != nil {
+				return
+			}
+		}
+	}()
+
+	<-reading
+	body.Close()
+	<-finished
+	if size == 0 || eof {
+		t.Errorf("done saw %d bytes, eof=%v; want the data read so far without eof", size, eof)
+	}
+}
+
+// n > 1 的请求只录制一条，上游仍然收到 n 个子请求
+func TestTapeRecordsFanoutOnce(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-test",`+
+			`"content":[{"type":"text","text":"hi"}],"stop_reason":"end_turn","usage":{"input_tokens":1,"output_tokens":1}}`)
+	}))
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	tape, err := NewTape(TapeConfig{Dir: dir, MaxBodyBytes: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewProxyHandler(ProxyConfig{AnthropicURL: upstream.URL, MaxN: 4, FanoutConcurrency: 2, Tape: tape})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	req := &AnthropicRequest{Model: "claude-test", MaxTokens: 16, Messages: []AnthropicMessage{{Role: "user", Content: "hello"}}}
+	h.handleFanout(c, req, OpenAIRequest{Model: "claude-test", N: 3}, "sk-test", false, "test")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	tape.file.Close()
+
+	if got := calls.Load(); got != 3 {
+		t.Errorf("upstream received %d requests, want 3", got)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "tape-*.jsonl"))
+	if len(files) != 1 {
+		t.Fatalf("tape files = %v, want one", files)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 1 {
+		t.Errorf("tape has %d entries, want 1", lines)
+	}
+}
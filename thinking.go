@@ -0,0 +1,94 @@
+package main
+
+import "unicode/utf8"
+
+// ThinkingConfig Anthropic extended thinking 配置
+type ThinkingConfig struct {
+	Type         string `json:"type"`
+	BudgetTokens int    `json:"budget_tokens,omitempty"`
+}
+
+// minThinkingBudget Anthropic 要求 budget_tokens 不小于 1024
+const minThinkingBudget = 1024
+
+// applyThinking 按 THINKING_BUDGET_MAPPING 为模型开启 extended thinking
+// budgets 的 key 为映射后的模型名（与 MAX_TOKENS_MAPPING 一致）
+func applyThinking(req *AnthropicRequest, budgets map[string]int, reqID string) {
+	budget, ok := budgets[req.Model]
+	if !ok {
+		return
+	}
+	enableThinking(req, budget, reqID)
+}
+
+// enableThinking 以 budget 开启 extended thinking，条件不满足时不开启
+func enableThinking(req *AnthropicRequest, budget int, reqID string) {
+	if budget < minThinkingBudget {
+		budget = minThinkingBudget
+	}
+
+	// thinking 只支持 auto/none 的 tool_choice，强制工具调用（含 json_schema 合成工具）时不开启
+	if forcesToolUse(req.ToolChoice) {
+		reqLog(reqID).Debug("thinking skipped: tool_choice forces tool use")
+		return
+	}
+	// 工具调用循环中需要回传上一轮的 thinking 块（含签名），OpenAI 客户端无法提供，此时不开启
+	if endsWithToolResult(req.Messages) {
+		reqLog(reqID).Debug("thinking skipped: continuing a tool use turn")
+		return
+	}
+
+	req.Thinking = &ThinkingConfig{Type: "enabled", BudgetTokens: budget}
+
+	// max_tokens 包含 thinking 的预算，必须大于 budget_tokens
+	if req.MaxTokens <= budget {
+		req.MaxTokens += budget
+	}
+	// thinking 模式不支持自定义 temperature/top_p/top_k
+	req.Temperature = nil
+	req.TopP = 0
+	req.TopK = 0
+
+	reqLog(reqID).Debug("thinking enabled", "budget_tokens", budget, "max_tokens", req.MaxTokens)
+}
+
+func forcesToolUse(choice interface{}) bool {
+	switch v := choice.(type) {
+	case map[string]string:
+		return v["type"] == "any" || v["type"] == "tool"
+	case map[string]interface{}:
+		return v["type"] == "any" || v["type"] == "tool"
+	}
+	return false
+}
+
+// endsWithToolResult 最后一条消息是否为 tool_result（即正处于工具调用循环中）
+func endsWithToolResult(messages []AnthropicMessage) bool {
+	if len(messages) == 0 {
+		return false
+	}
+	last := messages[len(messages)-1]
+	contents, ok := last.Content.([]AnthropicContent)
+	if !ok {
+		return false
+	}
+	for _, content := range contents {
+		if content.Type == "tool_result" {
+			return true
+		}
+	}
+	return false
+}
+
+// estimateReasoningTokens 粗略估算 thinking 文本的 token 数（约 4 字符 / token）
+// Anthropic 的 output_tokens 已包含 thinking，不单独返回，因此结果不超过 outputTokens
+func estimateReasoningTokens(thinking string, outputTokens int) int {
+	if thinking == "" {
+		return 0
+	}
+	tokens := (utf8.RuneCountInString(thinking) + 3) / 4
+	if outputTokens > 0 && tokens > outputTokens {
+		tokens = outputTokens
+	}
+	return tokens
+}
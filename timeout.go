@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// errUpstreamTimeout 超过 UPSTREAM_TIMEOUT 仍未完成（流式请求为未收到响应头）
+	errUpstreamTimeout = errors.New("upstream request timed out")
+	// errStreamIdle 流式响应超过 STREAM_IDLE_TIMEOUT 没有收到任何数据
+	errStreamIdle = errors.New("upstream stream idle timeout")
+)
+
+// upstreamCall 一次上游请求的 context：客户端断开或超时时取消，取消后连接随之关闭，上游停止生成
+type upstreamCall struct {
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	timer  *time.Timer
+}
+
+// newUpstreamCall 基于客户端请求的 context 创建上游请求 context，timeout <= 0 表示不限制
+func newUpstreamCall(parent context.Context, timeout time.Duration) *upstreamCall {
+	ctx, cancel := context.WithCancelCause(parent)
+	u := &upstreamCall{ctx: ctx, cancel: cancel}
+	if timeout > 0 {
+		u.timer = time.AfterFunc(timeout, func() { cancel(errUpstreamTimeout) })
+	}
+	return u
+}
+
+// streaming 流式响应收到响应头后停止整体超时计时，之后由 STREAM_IDLE_TIMEOUT 控制
+func (u *upstreamCall) streaming() {
+	if u.timer != nil {
+		u.timer.Stop()
+	}
+}
+
+// release 释放 context，响应体读取完毕前不能调用
+func (u *upstreamCall) release() {
+	if u.timer != nil {
+		u.timer.Stop()
+	}
+	u.cancel(nil)
+}
+
+// bind 关闭响应体时释放 context
+func (u *upstreamCall) bind(httpResp *http.Response) {
+	httpResp.Body = &releaseOnClose{ReadCloser: httpResp.Body, release: u.release}
+}
+
+// upstreamError 将请求失败转换为返回给客户端的错误：超时返回 504，上游熔断返回 503，其他返回 502
+func (u *upstreamCall) upstreamError(err error) *upstreamError {
+	var openErr *circuitOpenError
+	if errors.As(err, &openErr) {
+		return &upstreamError{StatusCode: http.StatusServiceUnavailable, Message: openErr.Error()}
+	}
+	if errors.Is(context.Cause(u.ctx), errUpstreamTimeout) {
+		return &upstreamError{StatusCode: http.StatusGatewayTimeout, Message: errUpstreamTimeout.Error()}
+	}
+	return &upstreamError{StatusCode: http.StatusBadGateway, Message: err.Error()}
+}
+
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+}
+
+func (r *releaseOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	r.release()
+	return err
+}
+
+// closeOnDisconnect 客户端断开（如 Cursor 取消生成）时立即关闭上游响应体：
+// 正在阻塞的读取随之返回，转发循环结束，上游连接关闭后 Anthropic 停止生成，不再为无人接收的输出计费
+// 返回的函数停止监听，转发结束时调用
+func closeOnDisconnect(c *gin.Context, body io.Closer) func() bool {
+	return context.AfterFunc(c.Request.Context(), func() {
+		body.Close()
+	})
+}
+
+// logStreamEnd 记录流式响应异常结束的原因，客户端主动断开不算错误
+func logStreamEnd(c *gin.Context, reqID string, err error) {
+	switch {
+	case c.Request.Context().Err() != nil:
+		reqLog(reqID).Warn("client disconnected, upstream request cancelled")
+	case err != nil:
+		reqLog(reqID).Error("stream read failed", "error", err)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import "log/slog"
+
+// missingToolResult 为缺少结果的 tool_use 补上的占位内容
+const missingToolResult = "Tool result unavailable: it is missing from the conversation history."
+
+// repairToolPairing 修复 tool_use 与 tool_result 的配对
+// Anthropic 要求每个 tool_result 对应紧邻的上一条 assistant 消息中的 tool_use，且每个 tool_use 都有结果，
+// 否则返回 400；客户端截断历史时经常破坏配对。这里删除孤立的 tool_result，并为缺少结果的 tool_use 补上占位结果
+func repairToolPairing(messages []AnthropicMessage) []AnthropicMessage {
+	repaired := make([]AnthropicMessage, 0, len(messages))
+	for _, msg := range messages {
+		if msg.Role == "user" {
+			var prev *AnthropicMessage
+			if len(repaired) > 0 {
+				prev = &repaired[len(repaired)-1]
+			}
+			if !dropOrphanToolResults(&msg, prev) {
+				continue
+			}
+		}
+		repaired = append(repaired, msg)
+	}
+
+	for i := 0; i < len(repaired); i++ {
+		ids := toolUseIDs(repaired[i])
+		if repaired[i].Role != "assistant" || len(ids) == 0 {
+			continue
+		}
+		// 紧随其后的不是 user 消息时插入一条，用来放占位结果
+		if i+1 == len(repaired) || repaired[i+1].Role != "user" {
+			repaired = append(repaired[:i+1], append([]AnthropicMessage{{Role: "user", Content: []AnthropicContent{}}}, repaired[i+1:]...)...)
+		}
+		answered := make(map[string]bool)
+		if contents, ok := repaired[i+1].Content.([]AnthropicContent); ok {
+			for _, block := range contents {
+				if block.Type == "tool_result" {
+					answered[block.ToolUseID] = true
+				}
+			}
+		}
+		for _, id := range ids {
+			if answered[id] {
+				continue
+			}
+			slog.Warn("added placeholder tool_result for dangling tool_use", "tool_use_id", id)
+			insertToolResult(&repaired[i+1], AnthropicContent{
+				Type:      "tool_result",
+				ToolUseID: id,
+				Content:   missingToolResult,
+				IsError:   true,
+			})
+		}
+	}
+	return repaired
+}
+
+// dropOrphanToolResults 删除 user 消息中没有对应 tool_use（或重复）的 tool_result
+// prev 为修复后的上一条消息；消息删除后为空时返回 false
+func dropOrphanToolResults(msg *AnthropicMessage, prev *AnthropicMessage) bool {
+	contents, ok := msg.Content.([]AnthropicContent)
+	if !ok {
+		return true
+	}
+	valid := make(map[string]bool)
+	if prev != nil && prev.Role == "assistant" {
+		for _, id := range toolUseIDs(*prev) {
+			valid[id] = true
+		}
+	}
+
+	kept := make([]AnthropicContent, 0, len(contents))
+	for _, block := range contents {
+		if block.Type == "tool_result" {
+			if !valid[block.ToolUseID] {
+				slog.Warn("dropped orphaned tool_result", "tool_use_id", block.ToolUseID)
+				continue
+			}
+			// 同一个 tool_use 只保留第一个结果
+			delete(valid, block.ToolUseID)
+		}
+		kept = append(kept, block)
+	}
+	if len(kept) == 0 {
+		return false
+	}
+	msg.Content = kept
+	return true
+}
+
+// toolUseIDs 返回消息中 tool_use 块的 ID
+func toolUseIDs(msg AnthropicMessage) []string {
+	contents, ok := msg.Content.([]AnthropicContent)
+	if !ok {
+		return nil
+	}
+	var ids []string
+	for _, block := range contents {
+		if block.Type == "tool_use" {
+			ids = append(ids, block.ID)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 轻量的 OpenTelemetry 链路追踪实现：W3C traceparent 传播 + OTLP/HTTP（JSON 编码）导出，避免引入 OTel SDK 依赖
+
+// OTLP span kind
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// OTLP status code
+const (
+	spanStatusOK    = 1
+	spanStatusError = 2
+)
+
+// TracingConfig 链路追踪配置，使用 OTel 标准环境变量
+type TracingConfig struct {
+	Endpoint    string            // OTLP/HTTP traces 地址，如 http://otel-collector:4318/v1/traces，为空表示未启用
+	Headers     map[string]string // 导出请求额外的头（如鉴权）
+	ServiceName string
+	SampleRatio float64 // 没有上游 traceparent 时的采样比例
+}
+
+// loadTracingConfig 读取 OTEL_EXPORTER_OTLP_(TRACES_)ENDPOINT、OTEL_EXPORTER_OTLP_HEADERS、OTEL_SERVICE_NAME、OTEL_TRACES_SAMPLER_ARG
+func loadTracingConfig() TracingConfig {
+	cfg := TracingConfig{
+		Endpoint:    os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"),
+		Headers:     make(map[string]string),
+		ServiceName: os.Getenv("OTEL_SERVICE_NAME"),
+		SampleRatio: 1,
+	}
+	if cfg.Endpoint == "" {
+		if base := strings.TrimRight(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "/"); base != "" {
+			cfg.Endpoint = base + "/v1/traces"
+		}
+	}
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = "openai-claude-proxy"
+	}
+	for _, pair := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		if key, value, ok := strings.Cut(strings.TrimSpace(pair), "="); ok && key != "" {
+			cfg.Headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	if v := os.Getenv("OTEL_TRACES_SAMPLER_ARG"); v != "" {
+		if ratio, err := strconv.ParseFloat(v, 64); err == nil && ratio >= 0 && ratio <= 1 {
+			cfg.SampleRatio = ratio
+		} else {
+			slog.Warn("invalid OTEL_TRACES_SAMPLER_ARG, using 1", "value", v)
+		}
+	}
+	return cfg
+}
+
+// tracer 全局 tracer，nil 表示未启用，此时所有 span 操作都是空操作
+var tracer *Tracer
+
+// Tracer 收集结束的 span，按批导出到 OTLP collector
+type Tracer struct {
+	cfg    TracingConfig
+	client *http.Client
+	spans  chan *Span
+}
+
+const (
+	traceQueueSize   = 4096
+	traceBatchSize   = 512
+	traceExportEvery = 5 * time.Second
+)
+
+func NewTracer(cfg TracingConfig) *Tracer {
+	return &Tracer{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+		spans:  make(chan *Span, traceQueueSize),
+	}
+}
+
+// Run 定期批量导出 span，队列满时丢弃新的 span，不阻塞请求
+func (t *Tracer) Run() {
+	ticker := time.NewTicker(traceExportEvery)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, traceBatchSize)
+	for {
+		select {
+		case span := <-t.spans:
+			batch = append(batch, span)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := t.export(batch); err != nil {
+			slog.Warn("failed to export traces", "spans", len(batch), "error", err)
+		}
+		batch = batch[:0]
+	}
+}
+
+func (t *Tracer) enqueue(span *Span) {
+	select {
+	case t.spans <- span:
+	default:
+		slog.Debug("trace queue full, span dropped", "name", span.name)
+	}
+}
+
+// export 以 OTLP/HTTP JSON 格式发送一批 span
+func (t *Tracer) export(batch []*Span) error {
+	spans := make([]map[string]interface{}, 0, len(batch))
+	for _, s := range batch {
+		spans = append(spans, s.otlp())
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]interface{}{"service.name": t.cfg.ServiceName}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "openai-anthropic-proxy"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", t.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range t.cfg.Headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// spanContext 跨进程传播的 trace 标识
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+// traceparent 格式化为 W3C traceparent 头
+func (sc spanContext) traceparent() string {
+	flags := "00"
+	if sc.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.traceID[:]) + "-" + hex.EncodeToString(sc.spanID[:]) + "-" + flags
+}
+
+// parseTraceparent 解析 W3C traceparent 头，格式不合法时返回 false
+func parseTraceparent(header string) (spanContext, bool) {
+	var sc spanContext
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.traceID[:], []byte(parts[1])); err != nil || sc.traceID == [16]byte{} {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.spanID[:], []byte(parts[2])); err != nil || sc.spanID == [8]byte{} {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, false
+	}
+	sc.sampled = flags[0]&1 == 1
+	return sc, true
+}
+
+type spanContextKey struct{}
+
+// Span 一个 OTLP span，方法对 nil 安全（未启用追踪时 startSpan 返回 nil）
+type Span struct {
+	spanContext
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	mu        sync.Mutex
+	attrs     map[string]interface{}
+	status    int
+	statusMsg string
+	end       time.Time
+}
+
+// startSpan 以 ctx 中的 span（或远端 traceparent）为父节点创建 span，返回携带新 span 的 ctx
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+
+	span := &Span{name: name, kind: kind, start: time.Now(), attrs: make(map[string]interface{})}
+	if parent, ok := ctx.Value(spanContextKey{}).(spanContext); ok {
+		span.traceID = parent.traceID
+		span.parentID = parent.spanID
+		span.sampled = parent.sampled
+	} else {
+		rand.Read(span.traceID[:])
+		// trace ID 是随机的，用低 8 字节按比例采样
+		span.sampled = float64(binary.BigEndian.Uint64(span.traceID[8:])) < tracer.cfg.SampleRatio*(1<<64)
+	}
+	rand.Read(span.spanID[:])
+
+	return context.WithValue(ctx, spanContextKey{}, span.spanContext), span
+}
+
+// SetAttr 设置属性，支持 string / bool / 整数 / 浮点数
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs[key] = value
+	s.mu.Unlock()
+}
+
+// SetError 标记 span 失败
+func (s *Span) SetError(msg string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.status = spanStatusError
+	s.statusMsg = msg
+	s.mu.Unlock()
+}
+
+// End 结束 span 并加入导出队列，重复调用只生效一次
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	if s.sampled {
+		tracer.enqueue(s)
+	}
+}
+
+// inject 将 span 写入请求的 traceparent 头，传播给上游
+func (s *Span) inject(header http.Header) {
+	if s == nil {
+		return
+	}
+	header.Set("traceparent", s.traceparent())
+}
+
+func (s *Span) otlp() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	span := map[string]interface{}{
+		"traceId":           hex.EncodeToString(s.traceID[:]),
+		"spanId":            hex.EncodeToString(s.spanID[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        otlpAttributes(s.attrs),
+	}
+	if s.parentID != [8]byte{} {
+		span["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+	}
+	if s.status != 0 {
+		span["status"] = map[string]interface{}{"code": s.status, "message": s.statusMsg}
+	}
+	return span
+}
+
+// otlpAttributes 转换为 OTLP 的 KeyValue 列表（JSON 编码中 int64 以字符串表示）
+func otlpAttributes(attrs map[string]interface{}) []map[string]interface{} {
+	list := make([]map[string]interface{}, 0, len(attrs))
+	for _, key := range sortedKeys(attrs) {
+		var value map[string]interface{}
+		switch v := attrs[key].(type) {
+		case string:
+			value = map[string]interface{}{"stringValue": v}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case uint64:
+			value = map[string]interface{}{"intValue": strconv.FormatUint(v, 10)}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		list = append(list, map[string]interface{}{"key": key, "value": value})
+	}
+	return list
+}
+
+// Tracing 为每个请求创建 server span：继承客户端的 traceparent，并在响应头中返回本次请求的 traceparent
+func Tracing() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// 健康检查和指标抓取不产生 trace
+		if tracer == nil || healthPaths[c.FullPath()] || c.FullPath() == "/metrics" {
+			c.Next()
+			return
+		}
+
+		ctx := c.Request.Context()
+		if parent, ok := parseTraceparent(c.GetHeader("traceparent")); ok {
+			ctx = context.WithValue(ctx, spanContextKey{}, parent)
+		}
+		route := c.FullPath()
+		if route == "" {
+			route = c.Request.URL.Path
+		}
+		ctx, span := startSpan(ctx, c.Request.Method+" "+route, spanKindServer)
+		c.Request = c.Request.WithContext(ctx)
+		c.Header("traceparent", span.traceparent())
+
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttr("http.request.method", c.Request.Method)
+		span.SetAttr("http.route", route)
+		span.SetAttr("http.response.status_code", status)
+		if reqID, ok := c.Get(reqIDKey); ok {
+			span.SetAttr("proxy.request_id", reqID)
+		}
+		if model := c.GetString(metricsModelKey); model != "" {
+			span.SetAttr("gen_ai.request.model", model)
+		}
+		if status >= 500 {
+			span.SetError(http.StatusText(status))
+		}
+		span.End()
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Transformer 请求/响应转换插件，按需实现 RequestTransformer、ResponseTransformer、StreamTransformer 中的一个或多个
+// 插件放在单独的文件中，在 init 中调用 RegisterTransformer 注册，再通过 TRANSFORMERS 启用，不需要修改转换代码
+type Transformer interface {
+	Name() string
+}
+
+// RequestTransformer 在请求发送给上游之前修改转换后的 Anthropic 请求，返回错误时以 400 拒绝请求
+type RequestTransformer interface {
+	Transformer
+	TransformRequest(tc *TransformContext, req *AnthropicRequest) error
+}
+
+// ResponseTransformer 在转换为 OpenAI 格式之前修改非流式的 Anthropic 响应，返回错误时以 502 返回
+type ResponseTransformer interface {
+	Transformer
+	TransformResponse(tc *TransformContext, resp *AnthropicResponse) error
+}
+
+// StreamTransformer 在转换之前修改流式响应的每个 Anthropic 事件（已解析的 JSON）
+type StreamTransformer interface {
+	Transformer
+	TransformEvent(tc *TransformContext, event map[string]interface{})
+}
+
+// StreamFlusher 可选：暂存了部分流式内容的 StreamTransformer 在内容块结束时补发，
+// 返回的事件（已经过该插件处理）插在 content_block_stop 之前，后面的插件同样会处理这些事件
+type StreamFlusher interface {
+	FlushBlock(tc *TransformContext, stop map[string]interface{}) []map[string]interface{}
+}
+
+// TransformContext 转换插件可用的请求信息
+type TransformContext struct {
+	Context   context.Context
+	RequestID string
+	Path      string      // 客户端请求的路径，如 /v1/chat/completions
+	KeyName   string      // 虚拟 key 名称，未启用虚拟 key 时为空
+	Header    http.Header // 客户端请求头
+	// State 同一请求的请求、响应和流式事件共享，插件可以在这里保存需要在响应中使用的数据，键名建议使用插件名称
+	// 流式事件拿到的是请求阶段 State 的副本，每个流各自一份；副本中的指针等值仍然共享，并发访问需要插件自行加锁
+	State map[string]interface{}
+	// Choice 流式事件所属的 choice：n > 1 的流式请求有多个上游流并发调用 TransformEvent，内容块序号在各个流中重复
+	Choice int
+}
+
+// transformStateKey gin context 中保存 TransformContext.State
+const transformStateKey = "transform_state"
+
+func newTransformContext(c *gin.Context, reqID string) *TransformContext {
+	var state map[string]interface{}
+	if v, ok := c.Get(transformStateKey); ok {
+		state = v.(map[string]interface{})
+	} else {
+		state = make(map[string]interface{})
+		c.Set(transformStateKey, state)
+	}
+	return &TransformContext{
+		Context:   c.Request.Context(),
+		RequestID: reqID,
+		Path:      c.Request.URL.Path,
+		KeyName:   c.GetString(keyNameKey),
+		Header:    c.Request.Header,
+		State:     state,
+	}
+}
+
+var (
+	transformersMu       sync.Mutex
+	transformerFactories = make(map[string]func() (Transformer, error))
+)
+
+// RegisterTransformer 注册转换插件，名称重复时 panic（与 database/sql 的驱动注册一致）
+func RegisterTransformer(name string, factory func() (Transformer, error)) {
+	transformersMu.Lock()
+	defer transformersMu.Unlock()
+	if _, dup := transformerFactories[name]; dup {
+		panic("transformer registered twice: " + name)
+	}
+	transformerFactories[name] = factory
+}
+
+// loadTransformers 按 TRANSFORMERS 的顺序创建插件
+func loadTransformers() ([]Transformer, error) {
+	transformersMu.Lock()
+	defer transformersMu.Unlock()
+
+	var transformers []Transformer
+	for _, name := range parseModelList(os.Getenv("TRANSFORMERS")) {
+		factory, ok := transformerFactories[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown transformer %q (registered: %s)", name, strings.Join(registeredTransformers(), ", "))
+		}
+		t, err := factory()
+		if err != nil {
+			return nil, fmt.Errorf("transformer %s: %w", name, err)
+		}
+		transformers = append(transformers, t)
+	}
+	return transformers, nil
+}
+
+func registeredTransformers() []string {
+	names := make([]string, 0, len(transformerFactories))
+	for name := range transformerFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Use 注册转换插件，按调用顺序执行
+func (h *ProxyHandler) Use(t Transformer) {
+	if rt, ok := t.(RequestTransformer); ok {
+		h.requestTransformers = append(h.requestTransformers, rt)
+	}
+	if rt, ok := t.(ResponseTransformer); ok {
+		h.responseTransformers = append(h.responseTransformers, rt)
+	}
+	if st, ok := t.(StreamTransformer); ok {
+		h.streamTransformers = append(h.streamTransformers, st)
+	}
+}
+
+// transformRequest 执行请求插件，失败时写入 400 响应
+func (h *ProxyHandler) transformRequest(c *gin.Context, req *AnthropicRequest, reqID string) bool {
+	if len(h.requestTransformers) == 0 {
+		return true
+	}
+	tc := newTransformContext(c, reqID)
+	for _, t := range h.requestTransformers {
+		if err := t.TransformRequest(tc, req); err != nil {
+			reqLog(reqID).Warn("request rejected by transformer", "transformer", t.Name(), "error", err)
+			respondError(c, http.StatusBadRequest, err.Error())
+			return false
+		}
+	}
+	return true
+}
+
+// transformResponse 执行响应插件，失败时写入 502 响应
+func (h *ProxyHandler) transformResponse(c *gin.Context, resp *AnthropicResponse, reqID string) bool {
+	if len(h.responseTransformers) == 0 {
+		return true
+	}
+	tc := newTransformContext(c, reqID)
+	for _, t := range h.responseTransformers {
+		if err := t.TransformResponse(tc, resp); err != nil {
+			reqLog(reqID).Warn("response rejected by transformer", "transformer", t.Name(), "error", err)
+			respondError(c, http.StatusBadGateway, err.Error())
+			return false
+		}
+	}
+	return true
+}
+
+// transformHelperRequest 对代理自己发给上游的辅助请求（上下文压缩的摘要、count_tokens）先检查 guardrails 再执行请求插件，
+// 与主请求共用 State，例如 pii 插件同样会脱敏；返回错误时不发送辅助请求，主请求随后仍按原流程检查
+func (h *ProxyHandler) transformHelperRequest(c *gin.Context, check, req *AnthropicRequest, reqID string) error {
+	if h.guardrails != nil {
+		if v := h.guardrails.Check(check); v != nil {
+			return fmt.Errorf("blocked by guardrail %s", v.Rule)
+		}
+	}
+	if len(h.requestTransformers) == 0 {
+		return nil
+	}
+	tc := newTransformContext(c, reqID)
+	for _, t := range h.requestTransformers {
+		if err := t.TransformRequest(tc, req); err != nil {
+			return fmt.Errorf("transformer %s: %w", t.Name(), err)
+		}
+	}
+	return nil
+}
+
+// transformHelperResponse 对辅助请求的响应执行响应插件，例如 pii 插件还原摘要中的占位符
+func (h *ProxyHandler) transformHelperResponse(c *gin.Context, resp *AnthropicResponse, reqID string) error {
+	if len(h.responseTransformers) == 0 {
+		return nil
+	}
+	tc := newTransformContext(c, reqID)
+	for _, t := range h.responseTransformers {
+		if err := t.TransformResponse(tc, resp); err != nil {
+			return fmt.Errorf("transformer %s: %w", t.Name(), err)
+		}
+	}
+	return nil
+}
+
+// cloneAnthropicRequest 深拷贝请求的 system、消息和工具，供请求插件修改而不影响原请求
+// 消息内容还原为 string 或 []AnthropicContent（tool_result 的内容同样），与转换结果的类型一致
+func cloneAnthropicRequest(req *AnthropicRequest) (*AnthropicRequest, error) {
+	type plain AnthropicRequest
+	data, err := json.Marshal(plain(*req))
+	if err != nil {
+		return nil, err
+	}
+	var clone AnthropicRequest
+	if err := json.Unmarshal(data, (*plain)(&clone)); err != nil {
+		return nil, err
+	}
+	clone.Extra = req.Extra
+	for i := range clone.Messages {
+		clone.Messages[i].Content = decodeContent(clone.Messages[i].Content)
+	}
+	return &clone, nil
+}
+
+// decodeContent 把 JSON 解码得到的内容块数组还原为 []AnthropicContent
+func decodeContent(content interface{}) interface{} {
+	parts, ok := content.([]interface{})
+	if !ok {
+		return content
+	}
+	blocks := make([]AnthropicContent, 0, len(parts))
+	for _, part := range parts {
+		block, ok := part.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		decoded := decodeContentBlock(block)
+		if decoded.Type == "tool_result" {
+			decoded.Content = decodeContent(decoded.Content)
+		}
+		blocks = append(blocks, decoded)
+	}
+	return blocks
+}
+
+// transformEvent 执行流式事件插件，返回需要依次处理的事件：通常只有 event 本身，
+// 插件在 content_block_stop 之前补发的事件排在它前面；tc 为 nil 表示没有插件
+func (h *ProxyHandler) transformEvent(tc *TransformContext, event map[string]interface{}) []map[string]interface{} {
+	events := []map[string]interface{}{event}
+	if tc == nil {
+		return events
+	}
+	for _, t := range h.streamTransformers {
+		out := events[:0:0]
+		for _, e := range events {
+			if f, ok := t.(StreamFlusher); ok && e["type"] == "content_block_stop" {
+				out = append(out, f.FlushBlock(tc, e)...)
+			}
+			t.TransformEvent(tc, e)
+			out = append(out, e)
+		}
+		events = out
+	}
+	return events
+}
+
+// streamTransformContext 有流式插件时返回 TransformContext，否则返回 nil
+// 每个流使用 State 的副本：n > 1 时多个流并发执行插件，在流式事件中写入 State 不会互相影响
+func (h *ProxyHandler) streamTransformContext(c *gin.Context, reqID string) *TransformContext {
+	if len(h.streamTransformers) == 0 {
+		return nil
+	}
+	tc := newTransformContext(c, reqID)
+	tc.State = maps.Clone(tc.State)
+	return tc
+}
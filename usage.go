@@ -0,0 +1,311 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	_ "modernc.org/sqlite"
+)
+
+// usageKeyKey gin context 中用于用量统计的 key 标识：虚拟 key 名称，否则为 API Key 哈希派生的 key_ 标识（见 apiKeyID）
+const usageKeyKey = "usage_key"
+
+// usageDateLayout 用量按 UTC 日期聚合
+const usageDateLayout = "2006-01-02"
+
+// UsageRecord 某个 key 在某天对某个模型的用量汇总
+type UsageRecord struct {
+	Date                     string  `json:"date,omitempty"`
+	Key                      string  `json:"key,omitempty"`
+	Model                    string  `json:"model,omitempty"`
+	Requests                 int64   `json:"requests"`
+	InputTokens              int64   `json:"input_tokens"`
+	OutputTokens             int64   `json:"output_tokens"`
+	CacheReadInputTokens     int64   `json:"cache_read_input_tokens"`
+	CacheCreationInputTokens int64   `json:"cache_creation_input_tokens"`
+	CostUSD                  float64 `json:"cost_usd"` // 按价格表估算，未配置价格的模型为 0
+}
+
+func (r *UsageRecord) add(o *UsageRecord) {
+	r.Requests += o.Requests
+	r.InputTokens += o.InputTokens
+	r.OutputTokens += o.OutputTokens
+	r.CacheReadInputTokens += o.CacheReadInputTokens
+	r.CacheCreationInputTokens += o.CacheCreationInputTokens
+	r.CostUSD += o.CostUSD
+}
+
+type usageID struct {
+	date, key, model string
+}
+
+// usageSchema 每个 key / 日期 / 模型一行，写入时累加
+const usageSchema = `CREATE TABLE IF NOT EXISTS usage (
+	date                        TEXT    NOT NULL,
+	key                         TEXT    NOT NULL,
+	model                       TEXT    NOT NULL,
+	requests                    INTEGER NOT NULL DEFAULT 0,
+	input_tokens                INTEGER NOT NULL DEFAULT 0,
+	output_tokens               INTEGER NOT NULL DEFAULT 0,
+	cache_read_input_tokens     INTEGER NOT NULL DEFAULT 0,
+	cache_creation_input_tokens INTEGER NOT NULL DEFAULT 0,
+	cost_usd                    REAL    NOT NULL DEFAULT 0,
+	PRIMARY KEY (date, key, model)
+)`
+
+const usageUpsert = `INSERT INTO usage (date, key, model, requests, input_tokens, output_tokens,
+	cache_read_input_tokens, cache_creation_input_tokens, cost_usd)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (date, key, model) DO UPDATE SET
+	requests = requests + excluded.requests,
+	input_tokens = input_tokens + excluded.input_tokens,
+	output_tokens = output_tokens + excluded.output_tokens,
+	cache_read_input_tokens = cache_read_input_tokens + excluded.cache_read_input_tokens,
+	cache_creation_input_tokens = cache_creation_input_tokens + excluded.cache_creation_input_tokens,
+	cost_usd = cost_usd + excluded.cost_usd`
+
+// UsageStore 按 key / 模型 / 日期聚合的用量，保存在 SQLite 中
+// 请求的用量先在内存中累加，定期在一个事务中写入，避免每个请求都写一次数据库
+type UsageStore struct {
+	db      *sql.DB
+	path    string
+	mu      sync.Mutex
+	pending map[usageID]*UsageRecord // 尚未写入数据库的增量
+}
+
+// NewUsageStore 打开（不存在时创建）SQLite 数据库
+func NewUsageStore(path string) (*UsageStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// 只有一个写入者，单连接避免 SQLITE_BUSY；WAL 下查询不阻塞写入
+	db.SetMaxOpenConns(1)
+	for _, stmt := range []string{"PRAGMA journal_mode = WAL", "PRAGMA busy_timeout = 5000", usageSchema} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("open %s: %w", path, err)
+		}
+	}
+	return &UsageStore{db: db, path: path, pending: make(map[usageID]*UsageRecord)}, nil
+}
+
+// Record 累加一次请求的用量和费用
+func (s *UsageStore) Record(key, model string, usage *AnthropicUsage, cost float64) {
+	id := usageID{time.Now().UTC().Format(usageDateLayout), key, model}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.pending[id]
+	if !ok {
+		r = &UsageRecord{Date: id.date, Key: key, Model: model}
+		s.pending[id] = r
+	}
+	r.add(&UsageRecord{
+		Requests:                 1,
+		InputTokens:              int64(usage.InputTokens),
+		OutputTokens:             int64(usage.OutputTokens),
+		CacheReadInputTokens:     int64(usage.CacheReadInputTokens),
+		CacheCreationInputTokens: int64(usage.CacheCreationInputTokens),
+		CostUSD:                  cost,
+	})
+}
+
+// UsageQuery 查询条件，空字段表示不过滤；From/To 为包含边界的日期
+type UsageQuery struct {
+	Key   string
+	Model string
+	From  string
+	To    string
+}
+
+// Query 先写入内存中的增量，再返回满足条件的按日记录（按日期、key、模型排序）及其合计
+func (s *UsageStore) Query(q UsageQuery) ([]UsageRecord, UsageRecord, error) {
+	var total UsageRecord
+	if err := s.Flush(); err != nil {
+		return nil, total, err
+	}
+	// 日期格式固定，可以直接按字符串比较
+	rows, err := s.db.Query(`SELECT date, key, model, requests, input_tokens, output_tokens,
+		cache_read_input_tokens, cache_creation_input_tokens, cost_usd
+	FROM usage
+	WHERE (?1 = '' OR key = ?1) AND (?2 = '' OR model = ?2) AND (?3 = '' OR date >= ?3) AND (?4 = '' OR date <= ?4)
+	ORDER BY date, key, model`, q.Key, q.Model, q.From, q.To)
+	if err != nil {
+		return nil, total, err
+	}
+	defer rows.Close()
+
+	var list []UsageRecord
+	for rows.Next() {
+		var r UsageRecord
+		if err := rows.Scan(&r.Date, &r.Key, &r.Model, &r.Requests, &r.InputTokens, &r.OutputTokens,
+			&r.CacheReadInputTokens, &r.CacheCreationInputTokens, &r.CostUSD); err != nil {
+			return nil, total, err
+		}
+		list = append(list, r)
+		total.add(&r)
+	}
+	return list, total, rows.Err()
+}
+
+// Run 每隔 interval 把内存中的增量写入数据库
+func (s *UsageStore) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := s.Flush(); err != nil {
+			slog.Error("failed to save usage", "path", s.path, "error", err)
+		}
+	}
+}
+
+// Flush 在一个事务中写入内存中的增量，失败时增量保留到下次写入
+func (s *UsageStore) Flush() error {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = make(map[usageID]*UsageRecord)
+	s.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	err := s.write(pending)
+	if err != nil {
+		s.mu.Lock()
+		for id, r := range pending {
+			if cur, ok := s.pending[id]; ok {
+				r.add(cur)
+			}
+			s.pending[id] = r
+		}
+		s.mu.Unlock()
+	}
+	return err
+}
+
+func (s *UsageStore) write(records map[usageID]*UsageRecord) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(usageUpsert)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, r := range records {
+		if _, err := stmt.Exec(r.Date, r.Key, r.Model, r.Requests, r.InputTokens, r.OutputTokens,
+			r.CacheReadInputTokens, r.CacheCreationInputTokens, r.CostUSD); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Close 写入剩余的增量并关闭数据库
+func (s *UsageStore) Close() error {
+	err := s.Flush()
+	if cerr := s.db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// observeUsage 更新 token 指标、费用和用量统计，并按实际用量扣减当前身份的 TPM 额度
+// 返回本次费用（美元），模型未配置价格时 priced 为 false
+func (h *ProxyHandler) observeUsage(c *gin.Context, model string, usage *AnthropicUsage) (cost float64, priced bool) {
+	// 缓存命中的响应没有消耗上游 token
+	if c.GetBool(responseCacheHitKey) {
+		return 0, false
+	}
+	metrics.ObserveUsage(model, usage)
+	addRequestUsage(c, usage)
+	cost, priced = h.estimateCost(model, usage)
+	if priced {
+		addRequestCost(c, cost)
+	}
+	if h.usageStore != nil {
+		h.usageStore.Record(c.GetString(usageKeyKey), model, usage, cost)
+	}
+	if h.rateLimiter != nil {
+		h.rateLimiter.Consume(c.GetString(rateLimitIDKey), usage.InputTokens+usage.OutputTokens+usage.CacheReadInputTokens+usage.CacheCreationInputTokens)
+	}
+	return cost, priced
+}
+
+// HandleUsage 查询用量（GET /v1/usage?key=&model=&from=YYYY-MM-DD&to=YYYY-MM-DD）
+// 使用 ADMIN_TOKEN 时可以查询任意 key，否则只能查询调用者自己的用量
+func (h *ProxyHandler) HandleUsage(c *gin.Context) {
+	reqID := requestID(c)
+
+	if h.usageStore == nil {
+		respondError(c, http.StatusNotFound, "usage accounting is disabled, set USAGE_FILE to enable it")
+		return
+	}
+
+	q := UsageQuery{Key: c.Query("key"), Model: c.Query("model")}
+	if !h.isAdminRequest(c) {
+		if _, ok := h.extractAPIKey(c, reqID); !ok {
+			return
+		}
+		own := c.GetString(usageKeyKey)
+		if q.Key != "" && q.Key != own {
+			respondError(c, http.StatusForbidden, "cannot query usage of other keys")
+			return
+		}
+		q.Key = own
+	}
+
+	// 默认查询最近 30 天
+	to := time.Now().UTC()
+	from := to.AddDate(0, 0, -29)
+	for _, p := range []struct {
+		param string
+		t     *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		if v := c.Query(p.param); v != "" {
+			t, err := time.Parse(usageDateLayout, v)
+			if err != nil {
+				respondParamError(c, p.param, "invalid date, expected YYYY-MM-DD")
+				return
+			}
+			*p.t = t
+		}
+	}
+	q.From, q.To = from.Format(usageDateLayout), to.Format(usageDateLayout)
+
+	data, total, err := h.usageStore.Query(q)
+	if err != nil {
+		reqLog(reqID).Error("usage query failed", "error", err)
+		respondError(c, http.StatusInternalServerError, "usage query failed")
+		return
+	}
+	if data == nil {
+		data = []UsageRecord{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"object": "list",
+		"from":   q.From,
+		"to":     q.To,
+		"data":   data,
+		"total":  total,
+	})
+}
+
+// isAdminRequest 请求是否携带 ADMIN_TOKEN
+func (h *ProxyHandler) isAdminRequest(c *gin.Context) bool {
+	if h.adminToken == "" {
+		return false
+	}
+	got := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(h.adminToken)) == 1
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 用量写入 SQLite 后按条件查询，重新打开数据库后仍然存在
+func TestUsageStorePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.db")
+	s, err := NewUsageStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Record("alice", "claude-a", &AnthropicUsage{InputTokens: 10, OutputTokens: 5, CacheReadInputTokens: 3}, 0.5)
+	s.Record("alice", "claude-a", &AnthropicUsage{InputTokens: 20, OutputTokens: 1}, 0.25)
+	s.Record("bob", "claude-b", &AnthropicUsage{InputTokens: 7}, 0)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = NewUsageStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Record("alice", "claude-a", &AnthropicUsage{OutputTokens: 4}, 0.25)
+
+	today := time.Now().UTC().Format(usageDateLayout)
+	list, total, err := s.Query(UsageQuery{Key: "alice", From: today, To: today})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := UsageRecord{Date: today, Key: "alice", Model: "claude-a", Requests: 3, InputTokens: 30, OutputTokens: 10, CacheReadInputTokens: 3, CostUSD: 1}
+	if len(list) != 1 || list[0] != want {
+		t.Fatalf("alice usage = %+v, want [%+v]", list, want)
+	}
+	if total.Requests != 3 || total.CostUSD != 1 {
+		t.Errorf("total = %+v", total)
+	}
+
+	if list, _, err := s.Query(UsageQuery{To: "2000-01-01"}); err != nil || len(list) != 0 {
+		t.Errorf("query before any usage = %+v, %v; want none", list, err)
+	}
+	if _, total, err := s.Query(UsageQuery{}); err != nil || total.Requests != 4 {
+		t.Errorf("all usage = %+v, %v; want 4 requests", total, err)
+	}
+}
+
+// 普通 API Key 只能查到自己的用量，首尾相同的另一个 key 既不能指定对方的标识，也不会查到对方的用量
+func TestUsageQueryIsolatesRawKeys(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	s, err := NewUsageStore(filepath.Join(t.TempDir(), "usage.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	alice := "sk-ant-REDACTED"
+	mallory := "sk-ant-REDACTED"
+	s.Record(apiKeyID(alice), "claude-a", &AnthropicUsage{InputTokens: 10}, 0)
+	h := &ProxyHandler{usageStore: s}
+
+	query := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, target, nil)
+		c.Request.Header.Set("Authorization", "Bearer "+mallory)
+		h.HandleUsage(c)
+		return w
+	}
+
+	if w := query("/v1/usage?key=" + apiKeyID(alice)); w.Code != http.StatusForbidden {
+		t.Errorf("query other key: status = %d, want 403", w.Code)
+	}
+	w := query("/v1/usage")
+	var body struct {
+		Data []UsageRecord `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || len(body.Data) != 0 {
+		t.Errorf("own usage: status = %d, data = %+v; want 200 with no records", w.Code, body.Data)
+	}
+}